@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Prefixes of the callback data of the buttons the admins get to answer an access
+// request, they are followed by the id of the user.
+const (
+	CallbackApproveAccess = "access:approve:"
+	CallbackDenyAccess    = "access:deny:"
+)
+
+// AccessRequestTTL is how long an access request waits for an admin before it is
+// forgotten.
+const AccessRequestTTL = 24 * time.Hour
+
+// AccessRequest is a user waiting for an admin to let them use the bot.
+type AccessRequest struct {
+	UserName  string
+	CreatedAt time.Time
+}
+
+// AccessList holds the users approved through /request_access (persisted in a JSON
+// file, in order of approval) and the requests waiting for an admin (kept only in
+// memory), it is safe for concurrent use.
+type AccessList struct {
+	mu       sync.Mutex
+	filename string
+	maxUsers int
+	// Approved holds the approved users, the first one is the oldest approval.
+	Approved []int64 `json:"approved"`
+	// pending holds the access requests by user id.
+	pending map[int64]AccessRequest
+}
+
+// LoadAccessList loads the approved users persisted in filename, when filename is empty
+// they are kept only in memory. At most maxUsers users (0 means any number) can be
+// approved.
+func LoadAccessList(filename string, maxUsers int) (*AccessList, error) {
+	access := &AccessList{
+		filename: filename,
+		maxUsers: maxUsers,
+		pending:  map[int64]AccessRequest{},
+	}
+	if err := LoadJSON(filename, access); err != nil {
+		return nil, err
+	}
+	return access, nil
+}
+
+// Contains reports whether the user userId was approved.
+func (a *AccessList) Contains(userId int64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, approvedUserId := range a.Approved {
+		if approvedUserId == userId {
+			return true
+		}
+	}
+	return false
+}
+
+// Users returns the approved users.
+func (a *AccessList) Users() []int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]int64{}, a.Approved...)
+}
+
+// Request records the access request of the user userId and reports whether it is new
+// (users who already asked are not sent to the admins again). Expired requests are
+// forgotten.
+func (a *AccessList) Request(userId int64, userName string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for id, request := range a.pending {
+		if now.Sub(request.CreatedAt) > AccessRequestTTL {
+			delete(a.pending, id)
+		}
+	}
+	if _, ok := a.pending[userId]; ok {
+		return false
+	}
+	a.pending[userId] = AccessRequest{UserName: userName, CreatedAt: now}
+	return true
+}
+
+// Approve removes the access request of the user userId, adds them to the approved
+// users and persists them. When there are already maxUsers users the oldest approval is
+// evicted, its id is returned (0 when nobody was evicted).
+func (a *AccessList) Approve(userId int64) (int64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.pending[userId]; !ok {
+		return 0, fmt.Errorf("user %d has no access request", userId)
+	}
+	delete(a.pending, userId)
+	var evictedUserId int64
+	if a.maxUsers > 0 && len(a.Approved) >= a.maxUsers {
+		evictedUserId = a.Approved[0]
+		a.Approved = a.Approved[1:]
+	}
+	a.Approved = append(a.Approved, userId)
+	return evictedUserId, SaveJSON(a.filename, a)
+}
+
+// Deny removes the access request of the user userId and reports whether there was one.
+func (a *AccessList) Deny(userId int64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.pending[userId]
+	delete(a.pending, userId)
+	return ok
+}
+
+// IsAuthorized reports whether the user userId can use the bot in the chat chatId,
+// either through the allowlists of the environment or because an admin approved them.
+func (app *App) IsAuthorized(userId, chatId int64) bool {
+	return UserIsAuthorized(userId, chatId, app.AuthorizedUserIds, app.AuthorizedChatIds) || app.AccessList.Contains(userId)
+}
+
+// RequestAccess handles the /request_access command msg, sending the request of the
+// user to the admins with buttons to approve or deny it.
+func (app *App) RequestAccess(msg *tgbotapi.Message) {
+	if app.IsAuthorized(msg.From.ID, msg.Chat.ID) {
+		ReplyText(app.Bot, msg, app.Message(msg, EventAlreadyAuthorized, MessageData{}, "You can already use me 😺"))
+		return
+	}
+	if len(app.Config.AdminUserIds) == 0 {
+		ReplyText(app.Bot, msg, app.Message(msg, EventNoApprover, MessageData{}, "I'm sorry there is nobody to approve your request ☹"))
+		return
+	}
+	if !app.AccessList.Request(msg.From.ID, msg.From.UserName) {
+		ReplyText(app.Bot, msg, app.Message(msg, EventAccessPending, MessageData{}, "You already asked, please wait for the admin to answer ⏳"))
+		return
+	}
+	log.Printf("[%s %d] Requested access", msg.From.UserName, msg.From.ID)
+	userId := strconv.FormatInt(msg.From.ID, 10)
+	data := MessageData{User: fmt.Sprintf("%s (@%s, %d)", strings.TrimSpace(msg.From.FirstName+" "+msg.From.LastName), msg.From.UserName, msg.From.ID)}
+	for _, adminUserId := range app.Config.AdminUserIds {
+		text := app.UserMessage(&tgbotapi.User{ID: adminUserId}, EventAccessRequest, data, data.User+" asks to use me")
+		request := tgbotapi.NewMessage(adminUserId, text)
+		request.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData(app.UserMessage(&tgbotapi.User{ID: adminUserId}, EventApproveButton, data, "✅ Approve"), CallbackApproveAccess+userId),
+				tgbotapi.NewInlineKeyboardButtonData(app.UserMessage(&tgbotapi.User{ID: adminUserId}, EventDenyButton, data, "❌ Deny"), CallbackDenyAccess+userId),
+			),
+		)
+		if _, err := SendWithRetry(app.Bot, request); err != nil {
+			log.Printf("[%s %d] Unable to send the access request to admin %d: %s", msg.From.UserName, msg.From.ID, adminUserId, err)
+		}
+	}
+	ReplyText(app.Bot, msg, app.Message(msg, EventAccessAsked, MessageData{}, "Ok, I asked the admin, I will let you know 📨"))
+}
+
+// ReportDenied reports the message msg of an unauthorized user to DENIED_LOG_CHAT, so
+// the operator can decide whether to authorize them.
+func (app *App) ReportDenied(msg *tgbotapi.Message) {
+	chat := "a private chat"
+	if !msg.Chat.IsPrivate() {
+		chat = fmt.Sprintf("the chat %s (%d)", msg.Chat.Title, msg.Chat.ID)
+	}
+	data := MessageData{User: fmt.Sprintf("@%s (%d)", msg.From.UserName, msg.From.ID), Chat: chat, Text: msg.Text}
+	// nobody in particular reads the chat, so the report is in DefaultLanguage
+	text := app.Messages.Render(DefaultLanguage, EventDeniedReport, data, fmt.Sprintf("🚫 Denied %s in %s:\n\n%s", data.User, chat, msg.Text))
+	report := tgbotapi.NewMessage(app.Config.DeniedLogChat, text)
+	report.DisableWebPagePreview = true
+	if _, err := SendWithRetry(app.Bot, report); err != nil {
+		log.Printf("[%s %d] Unable to report the denied attempt to chat %d: %s", msg.From.UserName, msg.From.ID, app.Config.DeniedLogChat, err)
+	}
+}
+
+// HandleAccessAnswer processes the answer of an admin to an access request.
+func (app *App) HandleAccessAnswer(query *tgbotapi.CallbackQuery) {
+	if !app.Config.IsAdmin(query.From.ID) {
+		log.Printf("[%s %d] Non-Admin user tried to answer an access request", query.From.UserName, query.From.ID)
+		return
+	}
+	approved := strings.HasPrefix(query.Data, CallbackApproveAccess)
+	userId, err := strconv.ParseInt(strings.TrimPrefix(strings.TrimPrefix(query.Data, CallbackApproveAccess), CallbackDenyAccess), 10, 64)
+	if err != nil {
+		log.Printf("[%s %d] Invalid access request answer %s", query.From.UserName, query.From.ID, query.Data)
+		return
+	}
+	var text string
+	data := MessageData{User: strconv.FormatInt(userId, 10)}
+	if approved {
+		evictedUserId, err := app.AccessList.Approve(userId)
+		if err != nil {
+			log.Printf("[%s %d] Unable to approve user %d: %s", query.From.UserName, query.From.ID, userId, err)
+			data.Error = err.Error()
+			text = app.UserMessage(query.From, EventApprovalFailed, data, fmt.Sprintf("Unable to approve user %d: %s", userId, err))
+		} else {
+			log.Printf("[%s %d] Approved user %d", query.From.UserName, query.From.ID, userId)
+			text = app.UserMessage(query.From, EventUserApproved, data, fmt.Sprintf("User %d approved ✅", userId))
+			if evictedUserId != 0 {
+				log.Printf("[%s %d] Evicted user %d to make room for user %d", query.From.UserName, query.From.ID, evictedUserId, userId)
+				evictedData := MessageData{User: strconv.FormatInt(evictedUserId, 10), Max: app.Config.MaxUsers}
+				text += " " + app.UserMessage(query.From, EventUserEvicted, evictedData, fmt.Sprintf("(user %d was removed to stay within %d users)", evictedUserId, app.Config.MaxUsers))
+			}
+			// the approved user is told in the language they picked, if any
+			notice := app.UserMessage(&tgbotapi.User{ID: userId}, EventAccessGranted, MessageData{}, "The admin let you use me, send me the URL of a video 🎉")
+			if _, err := SendWithRetry(app.Bot, tgbotapi.NewMessage(userId, notice)); err != nil {
+				log.Printf("[%s %d] Unable to tell user %d they were approved: %s", query.From.UserName, query.From.ID, userId, err)
+			}
+		}
+	} else {
+		if app.AccessList.Deny(userId) {
+			log.Printf("[%s %d] Denied user %d", query.From.UserName, query.From.ID, userId)
+		}
+		text = app.UserMessage(query.From, EventUserDenied, data, fmt.Sprintf("User %d denied ❌", userId))
+	}
+	if query.Message != nil {
+		EditText(app.Bot, *query.Message, text)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// ApiSecretHeader is the header of the requests to the API with the API_SECRET.
+const ApiSecretHeader = "X-Api-Secret"
+
+// ApiUserName is the user name the requests of the API are logged (and counted) as.
+const ApiUserName = "api"
+
+// MaxApiRequestBytes is how big the body of a request to the API can be.
+const MaxApiRequestBytes = 16 * 1024
+
+// ApiDownloadRequest is the JSON body of POST /download.
+type ApiDownloadRequest struct {
+	Url string `json:"url"`
+	// Options are the option words and video spots, like "0:10-0:51 audio".
+	Options string `json:"options"`
+}
+
+// ApiDownloadResponse is the JSON answer of POST /download.
+type ApiDownloadResponse struct {
+	// JobId is the id of the job in the logs and the webhook events, empty on errors.
+	JobId string `json:"job_id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// ServeApi serves the API at API_ADDR until it fails, the downloads it accepts are sent
+// to API_CHAT.
+func (app *App) ServeApi() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/download", app.HandleApiDownload)
+	server := &http.Server{
+		Addr:              app.Config.ApiAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Printf("Serving the API at %s", app.Config.ApiAddr)
+	return server.ListenAndServe()
+}
+
+// HandleApiDownload parses the download of a POST /download and starts it in the
+// background, it answers the id of its job (or what is wrong with the request).
+func (app *App) HandleApiDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeApiResponse(w, http.StatusMethodNotAllowed, ApiDownloadResponse{Error: "use POST"})
+		return
+	}
+	secret := r.Header.Get(ApiSecretHeader)
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(app.Config.ApiSecret)) != 1 {
+		log.Printf("Rejected API request from %s: wrong %s", r.RemoteAddr, ApiSecretHeader)
+		writeApiResponse(w, http.StatusUnauthorized, ApiDownloadResponse{Error: fmt.Sprintf("wrong %s", ApiSecretHeader)})
+		return
+	}
+	var request ApiDownloadRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxApiRequestBytes)).Decode(&request); err != nil {
+		writeApiResponse(w, http.StatusBadRequest, ApiDownloadResponse{Error: fmt.Sprintf("unable to decode the request: %s", err)})
+		return
+	}
+	text := strings.TrimSpace(request.Url + " " + request.Options)
+	downloadConfig, err := LoadDownloadConfigFromMsg(text)
+	if err != nil {
+		writeApiResponse(w, http.StatusBadRequest, ApiDownloadResponse{Error: err.Error()})
+		return
+	}
+	// the files are sent to API_CHAT as if a user named api had asked for them there
+	msg := &tgbotapi.Message{
+		From: &tgbotapi.User{UserName: ApiUserName},
+		Chat: &tgbotapi.Chat{ID: app.Config.ApiChat},
+		Text: text,
+	}
+	log.Printf("[%s %d job=%s] Received API request %s", msg.From.UserName, msg.From.ID, downloadConfig.JobId, text)
+	// there is nobody to confirm the expensive requests, the secret is trust enough
+	go app.ProcessDownload(msg, downloadConfig)
+	writeApiResponse(w, http.StatusAccepted, ApiDownloadResponse{JobId: downloadConfig.JobId})
+}
+
+// IsApiRequest reports whether msg was made through the API, such requests have no
+// message of their own in the chat.
+func IsApiRequest(msg *tgbotapi.Message) bool {
+	return msg.MessageID == 0
+}
+
+// writeApiResponse writes response as JSON with the status code status.
+func writeApiResponse(w http.ResponseWriter, status int, response ApiDownloadResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Unable to write the API response: %s", err)
+	}
+}
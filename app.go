@@ -0,0 +1,1118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// App holds everything the bot needs to process the updates received from Telegram.
+type App struct {
+	Bot               *tgbotapi.BotAPI
+	Config            *Config
+	AuthorizedUserIds []int64
+	AuthorizedChatIds []int64
+	PendingDownloads  *PendingDownloads
+	UserPreferences   *UserPreferences
+	ChatModes         *ChatModes
+	Messages          *Messages
+	AccessList        *AccessList
+	InFlightDownloads *InFlightDownloads
+	Quotas            *Quotas
+	Stats             *Stats
+	Maintenance       *Maintenance
+	UserLimiter       *RateLimiter
+	ChatLimiter       *RateLimiter
+}
+
+// HandleUpdate processes a single update received from Telegram.
+func (app *App) HandleUpdate(update tgbotapi.Update) {
+	if update.MyChatMember != nil {
+		app.HandleMyChatMember(update.MyChatMember)
+		return
+	}
+	if update.CallbackQuery != nil {
+		app.HandleCallbackQuery(update.CallbackQuery)
+		return
+	}
+	if update.Message != nil {
+		app.HandleMessage(update.Message)
+	}
+}
+
+// HandleMessage processes a message sent by a user, it can be a command or a download
+// request.
+func (app *App) HandleMessage(msg *tgbotapi.Message) {
+	// In private chats every message is for the bot, in groups only the ones addressed to it
+	if !msg.Chat.IsPrivate() && !msg.IsCommand() {
+		text, addressed := app.GroupRequest(msg)
+		if !addressed {
+			return
+		}
+		msg.Text = text
+	}
+	// Anyone can ask for access
+	if msg.IsCommand() && msg.Command() == "request_access" {
+		app.RequestAccess(msg)
+		return
+	}
+	// Check if user is authorized
+	if !app.IsAuthorized(msg.From.ID, msg.Chat.ID) {
+		log.Printf("[%s %d] Non-Authorized user sent: %s", msg.From.UserName, msg.From.ID, msg.Text)
+		if app.Config.DeniedLogChat != 0 {
+			// the flood waits of the log chat must not hold the other updates
+			go app.ReportDenied(msg)
+		}
+		ReplyText(app.Bot, msg, app.Message(msg, EventNotAuthorized, MessageData{}, "You are NOT AUTHORIZED to use me! 😠"))
+		return
+	} else {
+		log.Printf("[%s %d] Authorized user sent: %s", msg.From.UserName, msg.From.ID, msg.Text)
+	}
+	// Only the admin commands work under maintenance (to switch it off)
+	if !(msg.IsCommand() && app.Config.IsAdmin(msg.From.ID)) && app.RejectForMaintenance(msg) {
+		return
+	}
+	if msg.IsCommand() {
+		app.HandleCommand(msg)
+		return
+	}
+	if msg.Document != nil {
+		app.ProcessList(msg)
+		return
+	}
+	switch msg.Text {
+	case KeyboardVideo:
+		app.ChatModes.Set(msg.Chat.ID, ModeVideo)
+		ReplyText(app.Bot, msg, app.Message(msg, EventVideoMode, MessageData{}, "Ok, now send me the URL of the video"))
+		return
+	case KeyboardAudio:
+		app.ChatModes.Set(msg.Chat.ID, ModeAudio)
+		ReplyText(app.Bot, msg, app.Message(msg, EventAudioMode, MessageData{}, "Ok, now send me the URL of the video and I will send you its audio"))
+		return
+	}
+	request := msg.Text
+	dubAudioFileId, dubRequest, isDub := DubRequest(msg)
+	if isDub {
+		if dubAudioFileId == "" {
+			app.ReplyUsage(msg, fmt.Sprintf("reply to an audio (or a voice note) with %s <url> [options]", DubWord))
+			return
+		}
+		request = dubRequest
+	} else if urls, args := MessageUrls(msg); len(urls) > 1 {
+		app.AskWhichUrl(msg, urls, args)
+		return
+	}
+	downloadConfig, err := LoadDownloadConfigFromMsg(request)
+	if err == nil && isDub {
+		downloadConfig.DubAudioFileId = dubAudioFileId
+		// the dubbed video is sent even to the users who made audio their default
+		downloadConfig.Video = true
+		err = CheckDub(downloadConfig)
+	}
+	if errors.Is(err, ErrInvalidVideoUrl) {
+		log.Printf("[%s %d] Unable to complete request %s: %s", msg.From.UserName, msg.From.ID, msg.Text, err)
+		ReplyText(app.Bot, msg, app.Message(msg, EventUsage, MessageData{Error: err.Error()}, UsageMessage))
+		return
+	}
+	if err != nil {
+		log.Printf("[%s %d] Unable to complete request %s: %s", msg.From.UserName, msg.From.ID, msg.Text, err)
+		ReplyText(app.Bot, msg, app.Message(msg, EventFailed, MessageData{Error: err.Error()}, "I'm sorry I was not able to download your video ☹"))
+		return
+	}
+	log.Printf("[%s %d job=%s] Received request %s", msg.From.UserName, msg.From.ID, downloadConfig.JobId, msg.Text)
+	switch app.ChatModes.Take(msg.Chat.ID) {
+	case ModeVideo:
+		if !downloadConfig.AudioOnly {
+			downloadConfig.Video = true
+		}
+	case ModeAudio:
+		downloadConfig = AudioByDefault(request, downloadConfig)
+	}
+	if app.UserPreferences.WantsAudio(msg.From.ID) {
+		downloadConfig = AudioByDefault(request, downloadConfig)
+	}
+	if downloadConfig.IsExpensive() {
+		app.AskConfirmation(msg, downloadConfig)
+		return
+	}
+	// the download runs on the workers of the stages, the next messages do not wait
+	go app.ProcessDownload(msg, downloadConfig)
+}
+
+// ProcessDownload downloads the video requested in msg and sends it to the user.
+func (app *App) ProcessDownload(msg *tgbotapi.Message, downloadConfig *DownloadConfig) {
+	// the requests confirmed (or picked) after the maintenance started are rejected too
+	if app.RejectForMaintenance(msg) {
+		return
+	}
+	videoUrl, err := NormalizeUrl(app.Config, downloadConfig.VideoUrl)
+	if err != nil {
+		log.Printf("[%s %d job=%s] Keeping the short URL: %s", msg.From.UserName, msg.From.ID, downloadConfig.JobId, err)
+	}
+	downloadConfig.VideoUrl = videoUrl
+	if app.RejectForRateLimit(msg) {
+		return
+	}
+	// the requests rejected before downloading anything give their quota back
+	refundQuota := false
+	// the admins have no quota
+	if !app.Config.IsAdmin(msg.From.ID) {
+		allowed, err := app.Quotas.Take(msg.From.ID)
+		if err != nil {
+			log.Printf("[%s %d job=%s] Unable to persist the quotas: %s", msg.From.UserName, msg.From.ID, downloadConfig.JobId, err)
+		}
+		if !allowed {
+			log.Printf("[%s %d job=%s] Rejected request %s: the daily quota of %d requests is used", msg.From.UserName, msg.From.ID, downloadConfig.JobId, msg.Text, app.Quotas.Limit())
+			data := MessageData{Url: downloadConfig.VideoUrl.String(), Max: app.Quotas.Limit()}
+			ReplyText(app.Bot, msg, app.Message(msg, EventQuotaExceeded, data, fmt.Sprintf("You already made your %d requests of today, come back tomorrow 😿", app.Quotas.Limit())))
+			return
+		}
+		refundQuota = true
+		defer func() {
+			if !refundQuota {
+				return
+			}
+			if err := app.Quotas.Refund(msg.From.ID); err != nil {
+				log.Printf("[%s %d job=%s] Unable to persist the quotas: %s", msg.From.UserName, msg.From.ID, downloadConfig.JobId, err)
+			}
+		}()
+	}
+	log.Printf("[%s %d job=%s] Downloading %s", msg.From.UserName, msg.From.ID, downloadConfig.JobId, downloadConfig.VideoUrl)
+	// Let the user know you are working on the download
+	ack := ReplyText(app.Bot, msg, app.Message(msg, EventAck, MessageData{Url: downloadConfig.VideoUrl.String()}, "Ok, just wait a second..."))
+	if downloadConfig.RecordDuration > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go app.ReportRecordingProgress(msg, ack, downloadConfig.RecordDuration, done)
+	}
+	// the lookups, the download and every ffmpeg step share the same deadline
+	ctx, cancel := context.WithTimeout(context.Background(), app.Config.RequestTimeout(downloadConfig))
+	defer cancel()
+	if app.Config.FiltersExtractors() {
+		extractor, err := GetExtractor(ctx, app.Config, downloadConfig.VideoUrl.String())
+		if err != nil {
+			log.Printf("[%s %d job=%s] Unable to complete request %s: %s", msg.From.UserName, msg.From.ID, downloadConfig.JobId, msg.Text, err)
+			ReplyText(app.Bot, msg, app.Message(msg, EventFailed, MessageData{Url: downloadConfig.VideoUrl.String(), Error: err.Error()}, "I'm sorry I was not able to download your video ☹"))
+			return
+		}
+		if !ExtractorIsAllowed(extractor, app.Config.AllowedExtractors, app.Config.DeniedExtractors) {
+			log.Printf("[%s %d job=%s] Rejected request %s: extractor %s is not allowed", msg.From.UserName, msg.From.ID, downloadConfig.JobId, msg.Text, extractor)
+			data := MessageData{Url: downloadConfig.VideoUrl.String(), Site: extractor}
+			ReplyText(app.Bot, msg, app.Message(msg, EventBlocked, data, "I'm sorry I'm not allowed to download videos from that site ☹"))
+			return
+		}
+	}
+	if err := ResolveDownloadConfig(ctx, app.Config, downloadConfig); err != nil {
+		log.Printf("[%s %d job=%s] Unable to complete request %s: %s", msg.From.UserName, msg.From.ID, downloadConfig.JobId, msg.Text, err)
+		ReplyText(app.Bot, msg, app.Message(msg, EventFailed, MessageData{Url: downloadConfig.VideoUrl.String(), Error: err.Error()}, "I'm sorry I was not able to download your video ☹"))
+		return
+	}
+	if err := CheckClipDuration(app.Config, downloadConfig); err != nil {
+		log.Printf("[%s %d job=%s] Rejected request %s: %s", msg.From.UserName, msg.From.ID, downloadConfig.JobId, msg.Text, err)
+		data := MessageData{Url: downloadConfig.VideoUrl.String(), Duration: app.Config.MaxClipDuration.String(), Error: err.Error()}
+		ReplyText(app.Bot, msg, app.Message(msg, EventClipTooLong, data, fmt.Sprintf("I'm sorry I can not cut that much ☹ %s", err)))
+		return
+	}
+	if downloadConfig.Bumper && !app.Config.HasBumpers() {
+		log.Printf("[%s %d job=%s] Rejected request %s: there is no intro nor outro", msg.From.UserName, msg.From.ID, downloadConfig.JobId, msg.Text)
+		ReplyText(app.Bot, msg, app.Message(msg, EventNoBumpers, MessageData{Url: downloadConfig.VideoUrl.String()}, "I'm sorry I have no intro nor outro to add ☹"))
+		return
+	}
+	if downloadConfig.Timestamp != "" && app.Config.TimestampFont == "" {
+		log.Printf("[%s %d job=%s] Rejected request %s: there is no font to burn the timestamp", msg.From.UserName, msg.From.ID, downloadConfig.JobId, msg.Text)
+		ReplyText(app.Bot, msg, app.Message(msg, EventNoFont, MessageData{Url: downloadConfig.VideoUrl.String()}, "I'm sorry I have no font to write the timestamp ☹"))
+		return
+	}
+	if downloadConfig.AudioLanguage != "" {
+		info, err := downloadConfig.FetchInfo(ctx, app.Config)
+		if err != nil {
+			log.Printf("[%s %d job=%s] Unable to complete request %s: %s", msg.From.UserName, msg.From.ID, downloadConfig.JobId, msg.Text, err)
+			ReplyText(app.Bot, msg, app.Message(msg, EventFailed, MessageData{Url: downloadConfig.VideoUrl.String(), Error: err.Error()}, "I'm sorry I was not able to download your video ☹"))
+			return
+		}
+		if !info.HasAudioLanguage(downloadConfig.AudioLanguage) {
+			log.Printf("[%s %d job=%s] Rejected request %s: there is no %s audio track", msg.From.UserName, msg.From.ID, downloadConfig.JobId, msg.Text, downloadConfig.AudioLanguage)
+			languages := info.AudioLanguages()
+			text := "I'm sorry that video does not tell the language of its audio ☹"
+			if len(languages) != 0 {
+				text = fmt.Sprintf("I'm sorry that video has no %s audio, its audio languages are: %s", downloadConfig.AudioLanguage, strings.Join(languages, ", "))
+			}
+			data := MessageData{Url: downloadConfig.VideoUrl.String(), Language: downloadConfig.AudioLanguage, Languages: strings.Join(languages, ", ")}
+			ReplyText(app.Bot, msg, app.Message(msg, EventNoAudioLang, data, text))
+			return
+		}
+	}
+	if app.Config.FitByDefault && !downloadConfig.AudioOnly {
+		downloadConfig.Fit = true
+	}
+	// the quality option and the multi option pick their own qualities
+	if downloadConfig.MaxHeight == 0 && len(downloadConfig.Qualities) == 0 && !downloadConfig.AudioOnly {
+		downloadConfig.MaxHeight = app.Config.ChatMaxHeight(msg.Chat.IsPrivate())
+	}
+	if downloadConfig.DubAudioFileId != "" {
+		dubAudioFilename, err := DownloadTelegramFile(app.Bot, downloadConfig.DubAudioFileId)
+		if err != nil {
+			log.Printf("[%s %d job=%s] Unable to complete request %s: %s", msg.From.UserName, msg.From.ID, downloadConfig.JobId, msg.Text, err)
+			ReplyText(app.Bot, msg, app.Message(msg, EventFailed, MessageData{Url: downloadConfig.VideoUrl.String(), Error: err.Error()}, "I'm sorry I was not able to get your audio ☹"))
+			return
+		}
+		defer os.Remove(dubAudioFilename)
+		downloadConfig.DubAudioFilename = dubAudioFilename
+	}
+	// from here the request downloads (or waits for an identical one), it uses the quota
+	refundQuota = false
+	downloadConfig.Priority = RequestPriority(app.Config, msg.From.ID, downloadConfig)
+	// identical requests made while downloading get the same files
+	inFlightKey, started := app.InFlightDownloads.Start(msg, downloadConfig)
+	if !started {
+		log.Printf("[%s %d job=%s] Waiting for the identical request in progress", msg.From.UserName, msg.From.ID, downloadConfig.JobId)
+		// the previews are not part of the shared download, the waiting requests send
+		// their own
+		if downloadConfig.Preview {
+			app.SendPreview(ctx, msg, downloadConfig)
+		}
+		return
+	}
+	var progressBar *ProgressBar
+	if downloadConfig.RecordDuration == 0 && ack.MessageID != 0 {
+		progressBar = NewProgressBar(app.Bot, ack)
+		downloadConfig.OnProgress = progressBar.Update
+	}
+	if ack.MessageID != 0 {
+		downloadConfig.OnQueued = func(position int, eta time.Duration) {
+			// the ack goes back to normal (and gets the progress bar) once downloading
+			if position == 0 {
+				EditText(app.Bot, ack, ack.Text)
+				return
+			}
+			text := fmt.Sprintf("Ok, there are %d requests ahead of yours, just wait ⏳", position-1)
+			if position == 1 {
+				text = "Ok, yours is the next request, just wait ⏳"
+			}
+			data := MessageData{Url: downloadConfig.VideoUrl.String(), Count: position}
+			if eta != 0 {
+				data.Duration = eta.Round(time.Second).String()
+				text += fmt.Sprintf(" (about %s)", data.Duration)
+			}
+			EditText(app.Bot, ack, app.Message(msg, EventQueued, data, text))
+		}
+	}
+	var warnings []string
+	// yt-dlp may run several times (like to fit the upload limit), each warning is told
+	// once
+	seenWarnings := map[string]bool{}
+	addWarning := func(warning string) {
+		if !seenWarnings[warning] {
+			seenWarnings[warning] = true
+			warnings = append(warnings, warning)
+		}
+	}
+	downloadConfig.OnFormatFallback = func() {
+		addWarning(FormatFallbackWarning)
+	}
+	if app.Config.SurfaceWarnings {
+		downloadConfig.OnStderr = func(stderr string) {
+			for _, warning := range ClassifyWarnings(stderr, app.Config.WarningRules) {
+				addWarning(warning)
+			}
+		}
+	}
+	if downloadConfig.Preview {
+		app.SendPreview(ctx, msg, downloadConfig)
+	}
+	downloadStart := time.Now()
+	outputs, omittedOutputs, err := DownloadOutputs(ctx, app.Config, downloadConfig)
+	requests := append([]InFlightRequest{{Msg: msg, DownloadConfig: downloadConfig}}, app.InFlightDownloads.Finish(inFlightKey)...)
+	if err != nil {
+		downloadElapsed := time.Since(downloadStart)
+		for _, request := range requests {
+			app.Stats.Record(request.DownloadConfig, false, 0)
+			app.NotifyWebhook(NewWebhookEvent(request.Msg, request.DownloadConfig, downloadElapsed, 0, err))
+			app.ReplyDownloadError(ctx, request.Msg, request.DownloadConfig, err)
+		}
+		return
+	}
+	defer RemoveOutputs(outputs)
+	if progressBar != nil {
+		progressBar.Finish()
+	}
+	downloadElapsed := time.Since(downloadStart)
+	downloadBytes := OutputsSize(outputs)
+	for _, request := range requests {
+		// the identical requests are about the same video
+		if request.DownloadConfig.Info == nil {
+			request.DownloadConfig.Info = downloadConfig.Info
+		}
+		app.Stats.Record(request.DownloadConfig, true, downloadBytes)
+		app.NotifyWebhook(NewWebhookEvent(request.Msg, request.DownloadConfig, downloadElapsed, downloadBytes, nil))
+		app.DeliverOutputs(ctx, request.Msg, request.DownloadConfig, outputs, omittedOutputs, warnings)
+		if app.Config.LogDownloadStats {
+			log.Printf("[%s %d job=%s] Request %s completed elapsed=%s bytes=%d files=%d", request.Msg.From.UserName, request.Msg.From.ID, request.DownloadConfig.JobId, request.Msg.Text, downloadElapsed.Round(time.Millisecond), downloadBytes, len(outputs))
+		} else {
+			log.Printf("[%s %d job=%s] Request %s completed", request.Msg.From.UserName, request.Msg.From.ID, request.DownloadConfig.JobId, request.Msg.Text)
+		}
+	}
+}
+
+// RejectForRateLimit tells the user of msg to slow down and reports true when they (or
+// their group, all of its users together) made too many requests in the last minute.
+// The admins have no rate limit.
+func (app *App) RejectForRateLimit(msg *tgbotapi.Message) bool {
+	if app.Config.IsAdmin(msg.From.ID) {
+		return false
+	}
+	// in private chats the chat is the user
+	limited := !msg.Chat.IsPrivate()
+	userWait := app.UserLimiter.Allow(msg.From.ID)
+	wait, limit, who := userWait, app.UserLimiter.Limit(), "you"
+	if limited {
+		chatWait := app.ChatLimiter.Allow(msg.Chat.ID)
+		if chatWait > wait {
+			wait, limit, who = chatWait, app.ChatLimiter.Limit(), "this group"
+		}
+		// a request rejected by one limiter is not counted by the other one
+		if wait > 0 && chatWait == 0 {
+			app.ChatLimiter.Forget(msg.Chat.ID)
+		}
+	}
+	if wait <= 0 {
+		return false
+	}
+	if userWait == 0 {
+		app.UserLimiter.Forget(msg.From.ID)
+	}
+	wait = wait.Round(time.Second) + time.Second
+	log.Printf("[%s %d] Rejected request %s: %s made %d requests in the last minute", msg.From.UserName, msg.From.ID, msg.Text, who, limit)
+	data := MessageData{Duration: wait.String(), Max: limit}
+	ReplyText(app.Bot, msg, app.Message(msg, EventRateLimited, data, fmt.Sprintf("Slow down, %s can make %d requests a minute, try again in %s 🐢", who, limit, wait)))
+	return true
+}
+
+// SendPreview sends a short, small and muted clip of the video asked in msg, so the user
+// sees something while the full video downloads. A failed preview is only logged, the
+// full video is downloaded anyway.
+func (app *App) SendPreview(ctx context.Context, msg *tgbotapi.Message, downloadConfig *DownloadConfig) {
+	previewFilename, err := DownloadPreview(ctx, app.Config, downloadConfig)
+	if err != nil {
+		log.Printf("[%s %d job=%s] Skipping the preview: %s", msg.From.UserName, msg.From.ID, downloadConfig.JobId, err)
+		return
+	}
+	defer os.Remove(previewFilename)
+	if app.Config.DryRun {
+		return
+	}
+	caption := app.Message(msg, EventPreviewCaption, MessageData{Url: downloadConfig.VideoUrl.String()}, "Preview, the full video is on its way")
+	app.SendFile(msg, downloadConfig.JobId, Output{Filename: previewFilename, Animation: true, Caption: caption})
+}
+
+// DeliverOutputs sends (on a worker of the upload stage) the files produced for the
+// request msg, tells the user about the files left out (and the warnings of the
+// download) and sends the description of the video when it was asked.
+func (app *App) DeliverOutputs(ctx context.Context, msg *tgbotapi.Message, downloadConfig *DownloadConfig, outputs []Output, omittedOutputs int, warnings []string) {
+	// the upload is never given up, the files are ready (ctx only bounds the lookups,
+	// like the one of the description)
+	UploadStage.Run(context.Background(), downloadConfig.Priority, nil, func() {
+		app.deliverOutputs(ctx, msg, downloadConfig, outputs, omittedOutputs, warnings)
+	})
+}
+
+// deliverOutputs is DeliverOutputs out of the upload stage.
+func (app *App) deliverOutputs(ctx context.Context, msg *tgbotapi.Message, downloadConfig *DownloadConfig, outputs []Output, omittedOutputs int, warnings []string) {
+	// the outputs are shared with the identical requests, each of them captions, names
+	// (and links) its own
+	outputs = NameOutputs(app.CaptionOutputs(msg, outputs), downloadConfig.Name)
+	if downloadConfig.Source || app.Config.SourceByDefault {
+		outputs = SourceOutputs(outputs, downloadConfig.VideoUrl.String())
+	}
+	sent := app.SendOutputs(msg, downloadConfig, outputs)
+	if omittedOutputs > 0 {
+		log.Printf("[%s %d job=%s] Request %s left out %d files, the limit is %d files", msg.From.UserName, msg.From.ID, downloadConfig.JobId, msg.Text, omittedOutputs, app.Config.MaxOutputFiles)
+		data := MessageData{Url: downloadConfig.VideoUrl.String(), Count: omittedOutputs, Max: app.Config.MaxOutputFiles}
+		ReplyText(app.Bot, msg, app.Message(msg, EventTooManyFiles, data, fmt.Sprintf("I can send at most %d files per request, so I left the last %d out ⚠️", app.Config.MaxOutputFiles, omittedOutputs)))
+	}
+	if len(warnings) != 0 && sent != 0 {
+		data := MessageData{Url: downloadConfig.VideoUrl.String(), Warnings: strings.Join(warnings, ", ")}
+		ReplyText(app.Bot, msg, app.Message(msg, EventWarnings, data, fmt.Sprintf("Downloaded, but %s ⚠️", data.Warnings)))
+	}
+	if downloadConfig.WithDescription {
+		info, err := downloadConfig.FetchInfo(ctx, app.Config)
+		if err == nil {
+			err = SendDescription(app.Bot, msg, downloadConfig.VideoUrl.String(), info)
+		}
+		if err != nil {
+			log.Printf("[%s %d job=%s] Unable to send the description of %s: %s", msg.From.UserName, msg.From.ID, downloadConfig.JobId, downloadConfig.VideoUrl, err)
+		}
+	}
+	// the requests of the API have no user to ask nor message to delete
+	if IsApiRequest(msg) {
+		return
+	}
+	if app.UserPreferences.Record(msg.From.ID, downloadConfig.AudioOnly) {
+		app.OfferDefaultAudio(msg)
+	}
+	// the request is kept when something went wrong, the user may want to retry it
+	if app.Config.DeleteRequests && sent != 0 && sent == len(outputs) {
+		app.DeleteRequest(msg, downloadConfig.JobId)
+	}
+}
+
+// DeleteRequest deletes the request msg to keep the chat clean, the bot may lack the
+// rights to delete it (like in groups where it is not an admin), which is just logged.
+func (app *App) DeleteRequest(msg *tgbotapi.Message, jobId string) {
+	if _, err := RequestWithRetry(app.Bot, tgbotapi.NewDeleteMessage(msg.Chat.ID, msg.MessageID)); err != nil {
+		log.Printf("[%s %d job=%s] Unable to delete the request message %d: %s", msg.From.UserName, msg.From.ID, jobId, msg.MessageID, err)
+	}
+}
+
+// ReplyDownloadError logs the error err of the download requested in msg and tells the
+// user, when the request ran out of time they are told so.
+func (app *App) ReplyDownloadError(ctx context.Context, msg *tgbotapi.Message, downloadConfig *DownloadConfig, err error) {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		timeout := app.Config.RequestTimeout(downloadConfig)
+		log.Printf("[%s %d job=%s] Cancelled request %s since it took longer than %s: %s", msg.From.UserName, msg.From.ID, downloadConfig.JobId, msg.Text, timeout, err)
+		data := MessageData{Url: downloadConfig.VideoUrl.String(), Duration: timeout.String(), Error: err.Error()}
+		ReplyText(app.Bot, msg, app.Message(msg, EventTimeout, data, fmt.Sprintf("I'm sorry your request took longer than %s, so I cancelled it ⏱", timeout)))
+		return
+	}
+	if PremierePattern.MatchString(err.Error()) && app.OfferSchedule(ctx, msg, downloadConfig) {
+		return
+	}
+	log.Printf("[%s %d job=%s] Unable to complete request %s: %s", msg.From.UserName, msg.From.ID, downloadConfig.JobId, msg.Text, err)
+	text := app.Message(msg, EventFailed, MessageData{Url: downloadConfig.VideoUrl.String(), Error: err.Error()}, "I'm sorry I was not able to download your video ☹")
+	// failures because of site changes are usually fixed by a newer yt-dlp
+	if age, stale := YtdlpStaleness(ctx, app.Config.YtdlpStaleAfter); stale {
+		days := int(age.Hours() / 24)
+		log.Printf("[%s %d job=%s] yt-dlp is %d days old, updating it may fix the request", msg.From.UserName, msg.From.ID, downloadConfig.JobId, days)
+		text += "\n\n" + app.Message(msg, EventStaleYtdlp, MessageData{Count: days}, fmt.Sprintf("My yt-dlp is %d days old, maybe my admin should update it 🔧", days))
+	}
+	ReplyText(app.Bot, msg, text)
+}
+
+// Output is a file produced by a request, ready to be sent to the user.
+type Output struct {
+	Filename  string
+	Caption   string
+	AudioOnly bool
+	// CaptionEvent is the event the caption is rendered from (in the language of each
+	// request, see CaptionOutputs) with CaptionData, Caption being its built-in text.
+	// Empty means Caption is sent as is.
+	CaptionEvent string
+	CaptionData  MessageData
+	// Photo is set for the images, like contact sheets.
+	Photo bool
+	// Animation is set for the GIFs.
+	Animation bool
+	// Title and Performer are the title and the artist of the audio tracks.
+	Title     string
+	Performer string
+	// Cover is the thumbnail shown by Telegram for the videos (and the album art of the
+	// audio tracks), empty means Telegram picks one.
+	Cover string
+	// SourceUrl is the URL of the original video linked by a button below the file (or
+	// in the caption of an album), empty means it is not linked.
+	SourceUrl string
+	// Name is the name the file is sent with as a document, empty means it is sent as a
+	// video (or an audio, a photo...).
+	Name string
+}
+
+// DownloadOutputs downloads the video of downloadConfig and produces the files to send
+// (at most MaxOutputFiles of them), it also returns how many files were left out.
+func DownloadOutputs(ctx context.Context, config *Config, downloadConfig *DownloadConfig) ([]Output, int, error) {
+	outputs := []Output{}
+	omittedOutputs := 0
+	if downloadConfig.Both {
+		fullVideoFilename, cutVideoFilename, err := DownloadVideoAndCut(ctx, config, downloadConfig)
+		if err != nil {
+			return nil, 0, err
+		}
+		outputs = append(
+			outputs,
+			Output{Filename: fullVideoFilename, AudioOnly: downloadConfig.AudioOnly, Caption: "Full video", CaptionEvent: EventFullCaption, CaptionData: MessageData{Url: downloadConfig.VideoUrl.String()}},
+			Output{Filename: cutVideoFilename, AudioOnly: downloadConfig.AudioOnly, Caption: "Cut", CaptionEvent: EventCutCaption, CaptionData: MessageData{Url: downloadConfig.VideoUrl.String()}},
+		)
+	} else if len(downloadConfig.AudioFormats) != 0 {
+		audioFilenames, err := DownloadAudioFormats(ctx, config, downloadConfig)
+		if err != nil {
+			return nil, 0, err
+		}
+		for i, audioFilename := range audioFilenames {
+			outputs = append(outputs, Output{Filename: audioFilename, AudioOnly: true, Caption: strings.ToUpper(downloadConfig.AudioFormats[i])})
+		}
+	} else if downloadConfig.GifFps != 0 {
+		gifFilename, err := DownloadGif(ctx, config, downloadConfig)
+		if err != nil {
+			return nil, 0, err
+		}
+		outputs = append(outputs, Output{Filename: gifFilename, Animation: true})
+	} else if downloadConfig.Thumbnails != 0 {
+		contactSheetFilename, err := DownloadContactSheet(ctx, config, downloadConfig)
+		if err != nil {
+			return nil, 0, err
+		}
+		outputs = append(outputs, Output{Filename: contactSheetFilename, Photo: true})
+	} else if downloadConfig.Chapters {
+		chapterOutputs, omittedChapters, err := DownloadChapters(ctx, config, downloadConfig)
+		if err != nil {
+			return nil, 0, err
+		}
+		outputs = append(outputs, chapterOutputs...)
+		omittedOutputs += omittedChapters
+	} else if len(downloadConfig.Qualities) != 0 {
+		videoFilenames, omittedQualities, err := DownloadQualities(ctx, config, downloadConfig, config.MaxOutputFiles)
+		if err != nil {
+			return nil, 0, err
+		}
+		for i, videoFilename := range videoFilenames {
+			// the site may not have the video that high, then the next lower one is sent
+			outputs = append(outputs, Output{
+				Filename:     videoFilename,
+				Caption:      fmt.Sprintf("Up to %dp", downloadConfig.Qualities[i]),
+				CaptionEvent: EventQualityCaption,
+				CaptionData:  MessageData{Url: downloadConfig.VideoUrl.String(), Height: downloadConfig.Qualities[i]},
+			})
+		}
+		omittedOutputs += omittedQualities
+	} else if IsMultiVideoUrl(downloadConfig.VideoUrl) && !downloadConfig.Fit {
+		// each video of the post is sent
+		videoFilenames, err := DownloadVideos(ctx, config, downloadConfig)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, videoFilename := range videoFilenames {
+			outputs = append(outputs, Output{Filename: videoFilename, AudioOnly: downloadConfig.AudioOnly})
+		}
+	} else {
+		var (
+			videoFilename string
+			quality       int
+			err           error
+		)
+		if downloadConfig.Fit && !downloadConfig.AudioOnly {
+			videoFilename, quality, err = DownloadVideoToFit(ctx, config, downloadConfig)
+		} else {
+			videoFilename, err = DownloadVideo(ctx, config, downloadConfig)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		output := Output{Filename: videoFilename, AudioOnly: downloadConfig.AudioOnly}
+		if quality != 0 {
+			output.Caption = fmt.Sprintf("Sent at %dp to fit the upload limit", quality)
+			output.CaptionEvent = EventFitCaption
+			output.CaptionData = MessageData{Url: downloadConfig.VideoUrl.String(), Height: quality}
+		}
+		outputs = append(outputs, output)
+	}
+	outputs, omitted := LimitOutputs(outputs, config.MaxOutputFiles)
+	if downloadConfig.AudioOnly {
+		// the audio tracks are sent anyway when the metadata is missing
+		info, err := downloadConfig.FetchInfo(ctx, config)
+		if err != nil {
+			log.Printf("[job=%s] Sending the audio tracks without metadata: %s", downloadConfig.JobId, err)
+		} else {
+			TagAudioOutputs(outputs, info)
+		}
+	}
+	if downloadConfig.Thumbnails == 0 && downloadConfig.GifFps == 0 {
+		// the files are sent anyway when the thumbnail is missing
+		coverFilename, err := DownloadCover(ctx, config, downloadConfig)
+		if err != nil {
+			log.Printf("[job=%s] Sending the files without thumbnail: %s", downloadConfig.JobId, err)
+		} else {
+			for i := range outputs {
+				outputs[i].Cover = coverFilename
+			}
+		}
+	}
+	return outputs, omittedOutputs + omitted, nil
+}
+
+// TagAudioOutputs fills the title, the performer and the caption of the audio tracks
+// of outputs (that still lack them) from info.
+func TagAudioOutputs(outputs []Output, info *VideoInfo) {
+	for i := range outputs {
+		if !outputs[i].AudioOnly {
+			continue
+		}
+		if outputs[i].Title == "" {
+			outputs[i].Title = info.TrackTitle()
+		}
+		outputs[i].Performer = info.Performer()
+		if outputs[i].Caption == "" {
+			outputs[i].Caption = AudioCaption(outputs[i].Performer, outputs[i].Title, info.Album)
+		}
+	}
+}
+
+// DownloadChapters downloads the audio and splits it in one output per chapter, named by
+// the chapter title. Videos without chapters produce a single output. Only the first
+// MaxOutputFiles chapters are split, it also returns how many chapters were left out.
+func DownloadChapters(ctx context.Context, config *Config, downloadConfig *DownloadConfig) ([]Output, int, error) {
+	info, err := downloadConfig.FetchInfo(ctx, config)
+	if err != nil {
+		return nil, 0, err
+	}
+	audioFilename, err := DownloadVideo(ctx, config, downloadConfig)
+	if err != nil {
+		return nil, 0, err
+	}
+	chapters := info.Chapters
+	if len(chapters) == 0 {
+		return []Output{{Filename: audioFilename, AudioOnly: true, Title: info.Title}}, 0, nil
+	}
+	defer os.Remove(audioFilename)
+	omittedChapters := 0
+	if len(chapters) > config.MaxOutputFiles {
+		omittedChapters = len(chapters) - config.MaxOutputFiles
+		chapters = chapters[:config.MaxOutputFiles]
+	}
+	chapterFilenames, err := SplitChapters(ctx, audioFilename, chapters)
+	if err != nil {
+		return nil, 0, err
+	}
+	outputs := []Output{}
+	for i, chapterFilename := range chapterFilenames {
+		outputs = append(outputs, Output{
+			Filename:  chapterFilename,
+			AudioOnly: true,
+			Title:     chapters[i].Title,
+			Caption:   fmt.Sprintf("%d. %s", i+1, chapters[i].Title),
+		})
+	}
+	return outputs, omittedChapters, nil
+}
+
+// LimitOutputs keeps the first maxOutputs outputs, removes the files of the rest and
+// returns the kept outputs and how many were removed.
+func LimitOutputs(outputs []Output, maxOutputs int) ([]Output, int) {
+	if len(outputs) <= maxOutputs {
+		return outputs, 0
+	}
+	for _, output := range outputs[maxOutputs:] {
+		os.Remove(output.Filename)
+	}
+	return outputs[:maxOutputs], len(outputs) - maxOutputs
+}
+
+// NameOutputs returns a copy of outputs to be sent as documents named name (with the
+// extension of each file), an empty name returns outputs as they are. The files after
+// the first one are numbered so their names do not clash.
+func NameOutputs(outputs []Output, name string) []Output {
+	if name == "" {
+		return outputs
+	}
+	named := make([]Output, len(outputs))
+	for i, output := range outputs {
+		output.Name = name + filepath.Ext(output.Filename)
+		if i > 0 {
+			output.Name = fmt.Sprintf("%s-%d%s", name, i+1, filepath.Ext(output.Filename))
+		}
+		named[i] = output
+	}
+	return named
+}
+
+// CaptionOutputs returns a copy of outputs with the captions rendered (from their
+// CaptionEvent) in the language of the user of msg.
+func (app *App) CaptionOutputs(msg *tgbotapi.Message, outputs []Output) []Output {
+	captioned := make([]Output, len(outputs))
+	for i, output := range outputs {
+		if output.CaptionEvent != "" {
+			output.Caption = app.Message(msg, output.CaptionEvent, output.CaptionData, output.Caption)
+		}
+		captioned[i] = output
+	}
+	return captioned
+}
+
+// SourceOutputs returns a copy of outputs linking the original video sourceUrl.
+func SourceOutputs(outputs []Output, sourceUrl string) []Output {
+	sourced := make([]Output, len(outputs))
+	for i, output := range outputs {
+		output.SourceUrl = sourceUrl
+		sourced[i] = output
+	}
+	return sourced
+}
+
+// SourceMarkup returns the button to the original video of output (sent replying to
+// msg), nil when it is not linked.
+func (app *App) SourceMarkup(msg *tgbotapi.Message, output Output) interface{} {
+	if output.SourceUrl == "" {
+		return nil
+	}
+	label := app.Message(msg, EventSourceButton, MessageData{Url: output.SourceUrl}, "Source 🔗")
+	return tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonURL(label, output.SourceUrl)))
+}
+
+// OutputsSize returns the total size in bytes of the outputs, the files that can not be
+// read count as 0.
+func OutputsSize(outputs []Output) int64 {
+	var size int64
+	for _, output := range outputs {
+		if info, err := os.Stat(output.Filename); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// SendOutputs sends the files produced by the request msg (each of them must fit the
+// upload limit on its own) and returns how many of them were sent. With the album option
+// the files are grouped in albums.
+func (app *App) SendOutputs(msg *tgbotapi.Message, downloadConfig *DownloadConfig, outputs []Output) int {
+	jobId := downloadConfig.JobId
+	if downloadConfig.Album && len(outputs) > 1 {
+		return app.SendAlbums(msg, jobId, outputs)
+	}
+	sent := 0
+	for _, output := range outputs {
+		if app.SendOutput(msg, jobId, output) {
+			sent++
+		}
+	}
+	return sent
+}
+
+// RemoveOutputs removes the files produced by a request (and their thumbnails, which
+// they may share) once they were sent.
+func RemoveOutputs(outputs []Output) {
+	filenames := map[string]bool{}
+	for _, output := range outputs {
+		filenames[output.Filename] = true
+		if output.Cover != "" {
+			filenames[output.Cover] = true
+		}
+	}
+	for filename := range filenames {
+		if err := os.Remove(filename); err != nil {
+			log.Printf("Unable to erase file %s", filename)
+		}
+	}
+}
+
+// MaxAlbumItems is how many files Telegram accepts in a single album.
+const MaxAlbumItems = 10
+
+// SendAlbums sends the files produced by the request msg grouped in albums of at most
+// MaxAlbumItems files. Telegram does not mix audios with videos (or photos) in an album,
+// so each kind goes in its own albums. It returns how many files were sent.
+func (app *App) SendAlbums(msg *tgbotapi.Message, jobId string, outputs []Output) int {
+	audios, videos := []Output{}, []Output{}
+	for _, output := range outputs {
+		if !app.CanUpload(msg, jobId, output) {
+			continue
+		}
+		if output.AudioOnly {
+			audios = append(audios, output)
+		} else {
+			videos = append(videos, output)
+		}
+	}
+	sent := 0
+	for _, kind := range [][]Output{videos, audios} {
+		for start := 0; start < len(kind); start += MaxAlbumItems {
+			end := start + MaxAlbumItems
+			if end > len(kind) {
+				end = len(kind)
+			}
+			if app.SendAlbum(msg, jobId, kind[start:end]) {
+				sent += end - start
+			}
+		}
+	}
+	return sent
+}
+
+// SendAlbum sends the files (all of the same kind) as a single album replying to msg,
+// a single file is sent on its own since an album needs at least two. It reports
+// whether the album was sent.
+func (app *App) SendAlbum(msg *tgbotapi.Message, jobId string, outputs []Output) bool {
+	if len(outputs) == 1 {
+		return app.SendFile(msg, jobId, outputs[0])
+	}
+	media := []interface{}{}
+	for i, output := range outputs {
+		// the albums can not have buttons, the first caption links the original video
+		if i == 0 && output.SourceUrl != "" {
+			output.Caption = strings.TrimSpace(output.Caption + "\n\n" + output.SourceUrl)
+		}
+		if output.Photo {
+			photo := tgbotapi.NewInputMediaPhoto(tgbotapi.FilePath(output.Filename))
+			photo.Caption = output.Caption
+			media = append(media, photo)
+		} else if output.AudioOnly {
+			audio := tgbotapi.NewInputMediaAudio(tgbotapi.FilePath(output.Filename))
+			audio.Caption = output.Caption
+			audio.Title = output.Title
+			audio.Performer = output.Performer
+			if output.Cover != "" {
+				audio.Thumb = tgbotapi.FilePath(output.Cover)
+			}
+			media = append(media, audio)
+		} else {
+			video := tgbotapi.NewInputMediaVideo(tgbotapi.FilePath(output.Filename))
+			video.Caption = output.Caption
+			media = append(media, video)
+		}
+	}
+	album := tgbotapi.NewMediaGroup(msg.Chat.ID, media)
+	album.ReplyToMessageID = msg.MessageID
+	if _, err := SendMediaGroupWithRetry(app.Bot, album); err != nil {
+		log.Printf("[%s %d job=%s] Unable to send album of %d files: %s", msg.From.UserName, msg.From.ID, jobId, len(outputs), err)
+		return false
+	}
+	return true
+}
+
+// SendOutput sends a file produced by the request msg, unless it is too large or the bot
+// is in dry run mode, and reports whether it was sent.
+func (app *App) SendOutput(msg *tgbotapi.Message, jobId string, output Output) bool {
+	return app.CanUpload(msg, jobId, output) && app.SendFile(msg, jobId, output)
+}
+
+// CanUpload reports whether a file produced by the request msg can be uploaded, when it
+// can not (because it is too large or the bot is in dry run mode) the user is told why.
+// With PUBLIC_DIR the file may be published and linked instead (or besides).
+func (app *App) CanUpload(msg *tgbotapi.Message, jobId string, output Output) bool {
+	var size int64
+	if info, err := os.Stat(output.Filename); err == nil {
+		size = info.Size()
+	}
+	data := MessageData{Size: FormatBytes(size), Limit: FormatBytes(app.Config.MaxUploadBytes)}
+	tooLarge := size > app.Config.MaxUploadBytes
+	if app.Config.PublicDir != "" && !app.Config.DryRun && (tooLarge || app.Config.PublicLinks != PublicLinksLarge) {
+		// when publishing fails the file goes through the usual checks
+		if app.SendLink(msg, jobId, output, size) && (tooLarge || app.Config.PublicLinks == PublicLinksAlways) {
+			return false
+		}
+	}
+	if tooLarge {
+		log.Printf("[%s %d job=%s] Unable to complete request %s: file %s weighs %d bytes, the upload limit is %d bytes", msg.From.UserName, msg.From.ID, jobId, msg.Text, output.Filename, size, app.Config.MaxUploadBytes)
+		text := fmt.Sprintf("I'm sorry your video (%s) is too large for me to send it (the limit is %s) ☹ try cutting it or using the fit word", data.Size, data.Limit)
+		ReplyText(app.Bot, msg, app.Message(msg, EventTooLarge, data, text))
+		return false
+	}
+	if app.Config.DryRun {
+		log.Printf("[%s %d job=%s] Skipping the upload of file %s (%d bytes) since the bot is in dry run mode", msg.From.UserName, msg.From.ID, jobId, output.Filename, size)
+		text := fmt.Sprintf("I downloaded your video (%s), but I'm in dry run mode so I will not send it 🧪", data.Size)
+		ReplyText(app.Bot, msg, app.Message(msg, EventDryRun, data, text))
+		return false
+	}
+	return true
+}
+
+// SendLink publishes a file (of size bytes) produced by the request msg in PUBLIC_DIR
+// and replies with its link, it reports whether it succeeded.
+func (app *App) SendLink(msg *tgbotapi.Message, jobId string, output Output, size int64) bool {
+	link, err := PublishFile(app.Config, output.Filename)
+	if err != nil {
+		log.Printf("[%s %d job=%s] Unable to publish file %s: %s", msg.From.UserName, msg.From.ID, jobId, output.Filename, err)
+		return false
+	}
+	log.Printf("[%s %d job=%s] Published file %s (%d bytes) at %s", msg.From.UserName, msg.From.ID, jobId, output.Filename, size, link)
+	data := MessageData{Size: FormatBytes(size), Limit: FormatBytes(app.Config.MaxUploadBytes), Link: link, Duration: app.Config.PublicRetention.String()}
+	text := fmt.Sprintf("Download it from %s (%s), the link works for %s 🔗", link, FormatBytes(size), app.Config.PublicRetention)
+	if output.Caption != "" {
+		text = output.Caption + ": " + text
+	}
+	ReplyText(app.Bot, msg, app.Message(msg, EventPublicLink, data, text))
+	return true
+}
+
+// SendFile uploads a file produced by the request msg as a photo, a GIF, an audio or a
+// video and reports whether it was sent.
+func (app *App) SendFile(msg *tgbotapi.Message, jobId string, output Output) bool {
+	var resultMsg tgbotapi.Chattable
+	if output.Name != "" {
+		// only documents show the name they were sent with
+		documentMsg := tgbotapi.NewDocument(msg.Chat.ID, NamedFile{Filename: output.Filename, Name: output.Name})
+		documentMsg.ReplyToMessageID = msg.MessageID
+		documentMsg.Caption = output.Caption
+		documentMsg.ReplyMarkup = app.SourceMarkup(msg, output)
+		if output.Cover != "" {
+			documentMsg.Thumb = tgbotapi.FilePath(output.Cover)
+		}
+		resultMsg = documentMsg
+	} else if output.Photo {
+		photoMsg := tgbotapi.NewPhoto(msg.Chat.ID, tgbotapi.FilePath(output.Filename))
+		photoMsg.ReplyToMessageID = msg.MessageID
+		photoMsg.Caption = output.Caption
+		photoMsg.ReplyMarkup = app.SourceMarkup(msg, output)
+		resultMsg = photoMsg
+	} else if output.Animation {
+		animationMsg := tgbotapi.NewAnimation(msg.Chat.ID, tgbotapi.FilePath(output.Filename))
+		animationMsg.ReplyToMessageID = msg.MessageID
+		animationMsg.Caption = output.Caption
+		animationMsg.ReplyMarkup = app.SourceMarkup(msg, output)
+		resultMsg = animationMsg
+	} else if output.AudioOnly {
+		audioMsg := tgbotapi.NewAudio(msg.Chat.ID, tgbotapi.FilePath(output.Filename))
+		audioMsg.ReplyToMessageID = msg.MessageID
+		audioMsg.Caption = output.Caption
+		audioMsg.ReplyMarkup = app.SourceMarkup(msg, output)
+		audioMsg.Title = output.Title
+		audioMsg.Performer = output.Performer
+		if output.Cover != "" {
+			audioMsg.Thumb = tgbotapi.FilePath(output.Cover)
+		}
+		resultMsg = audioMsg
+	} else {
+		videoMsg := tgbotapi.NewVideo(msg.Chat.ID, tgbotapi.FilePath(output.Filename))
+		videoMsg.ReplyToMessageID = msg.MessageID
+		videoMsg.Caption = output.Caption
+		videoMsg.ReplyMarkup = app.SourceMarkup(msg, output)
+		if output.Cover != "" {
+			videoMsg.Thumb = tgbotapi.FilePath(output.Cover)
+		}
+		resultMsg = videoMsg
+	}
+	if _, err := SendWithRetry(app.Bot, resultMsg); err != nil {
+		log.Printf("[%s %d job=%s] Unable to send file %s: %s", msg.From.UserName, msg.From.ID, jobId, output.Filename, err)
+		return false
+	}
+	return true
+}
+
+// RecordingProgressInterval is how often the progress of a recording is reported.
+const RecordingProgressInterval = 30 * time.Second
+
+// ReportRecordingProgress edits the message ack (the reply to msg) every
+// RecordingProgressInterval with the progress of a recording of duration, until done is
+// closed.
+func (app *App) ReportRecordingProgress(msg *tgbotapi.Message, ack tgbotapi.Message, duration time.Duration, done <-chan struct{}) {
+	start := time.Now()
+	ticker := time.NewTicker(RecordingProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			elapsed := time.Since(start).Round(time.Second)
+			data := MessageData{Elapsed: elapsed.String(), Duration: duration.String()}
+			if elapsed < duration {
+				EditText(app.Bot, ack, app.Message(msg, EventRecording, data, fmt.Sprintf("Recording... %s of %s", elapsed, duration)))
+			} else {
+				EditText(app.Bot, ack, app.Message(msg, EventRecorded, data, "Recording finished, preparing the video..."))
+			}
+		}
+	}
+}
+
+// AskConfirmation keeps the expensive download requested in msg waiting and asks the
+// user (with an inline keyboard) to confirm it before starting.
+func (app *App) AskConfirmation(msg *tgbotapi.Message, downloadConfig *DownloadConfig) {
+	id := app.PendingDownloads.Add(msg, downloadConfig)
+	log.Printf("[%s %d job=%s] Waiting for the confirmation of request %s", msg.From.UserName, msg.From.ID, downloadConfig.JobId, msg.Text)
+	data := MessageData{Url: downloadConfig.VideoUrl.String(), Text: strings.Join(downloadConfig.ExpensiveOperations(), " and ")}
+	text := app.Message(msg, EventConfirm, data, fmt.Sprintf("This will %s, which takes a while. Do you want me to continue?", data.Text))
+	reply := tgbotapi.NewMessage(msg.Chat.ID, text)
+	reply.ReplyToMessageID = msg.MessageID
+	reply.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(app.Message(msg, EventContinueButton, data, "✅ Continue"), CallbackConfirm+id),
+			tgbotapi.NewInlineKeyboardButtonData(app.Message(msg, EventCancelButton, data, "❌ Cancel"), CallbackCancel+id),
+		),
+	)
+	if _, err := SendWithRetry(app.Bot, reply); err != nil {
+		log.Printf("[%s %d job=%s] Unable to send message: %s", msg.From.UserName, msg.From.ID, downloadConfig.JobId, err)
+	}
+}
+
+// HandleCallbackQuery processes the presses on the inline keyboard buttons.
+func (app *App) HandleCallbackQuery(query *tgbotapi.CallbackQuery) {
+	if _, err := RequestWithRetry(app.Bot, tgbotapi.NewCallback(query.ID, "")); err != nil {
+		log.Printf("[%s %d] Unable to answer callback query: %s", query.From.UserName, query.From.ID, err)
+	}
+	switch {
+	case strings.HasPrefix(query.Data, CallbackConfirm), strings.HasPrefix(query.Data, CallbackCancel):
+		app.HandleConfirmation(query)
+	case strings.HasPrefix(query.Data, CallbackSearch):
+		app.HandleSearchPick(query)
+	case strings.HasPrefix(query.Data, CallbackPickAll):
+		app.HandlePickAll(query)
+	case strings.HasPrefix(query.Data, CallbackSchedule):
+		app.HandleSchedule(query)
+	case strings.HasPrefix(query.Data, CallbackApproveAccess), strings.HasPrefix(query.Data, CallbackDenyAccess):
+		app.HandleAccessAnswer(query)
+	case strings.HasPrefix(query.Data, CallbackDefaultAudio):
+		app.HandleDefaultAudio(query)
+	default:
+		log.Printf("[%s %d] Unknown callback data: %s", query.From.UserName, query.From.ID, query.Data)
+	}
+}
+
+// HandleConfirmation starts (or drops) the download the user was asked to confirm.
+func (app *App) HandleConfirmation(query *tgbotapi.CallbackQuery) {
+	confirmed := strings.HasPrefix(query.Data, CallbackConfirm)
+	id := strings.TrimPrefix(strings.TrimPrefix(query.Data, CallbackConfirm), CallbackCancel)
+	pending, ok := app.PendingDownloads.Take(id, query.From.ID)
+	if !ok {
+		log.Printf("[%s %d] Confirmation %s is unknown or expired", query.From.UserName, query.From.ID, id)
+		return
+	}
+	text := app.UserMessage(query.From, EventCancelled, MessageData{}, "Ok, I cancelled it")
+	if confirmed {
+		text = app.UserMessage(query.From, EventConfirmed, MessageData{}, "Ok, here we go")
+	}
+	if query.Message != nil {
+		EditText(app.Bot, *query.Message, text)
+	}
+	if !confirmed {
+		log.Printf("[%s %d job=%s] Cancelled request %s", query.From.UserName, query.From.ID, pending.DownloadConfig.JobId, pending.Msg.Text)
+		return
+	}
+	go app.ProcessDownload(pending.Msg, pending.DownloadConfig)
+}
+
+// OfferDefaultAudio asks the user who sent msg whether they want audio as their
+// default.
+func (app *App) OfferDefaultAudio(msg *tgbotapi.Message) {
+	text := app.Message(msg, EventOfferAudio, MessageData{}, "You always ask me for the audio, do you want me to send you only the audio by default? (you can still use the video word)")
+	reply := tgbotapi.NewMessage(msg.Chat.ID, text)
+	reply.ReplyToMessageID = msg.MessageID
+	reply.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(app.Message(msg, EventYesButton, MessageData{}, "🎵 Yes"), CallbackDefaultAudio+"yes"),
+			tgbotapi.NewInlineKeyboardButtonData(app.Message(msg, EventNoButton, MessageData{}, "No, thanks"), CallbackDefaultAudio+"no"),
+		),
+	)
+	if _, err := SendWithRetry(app.Bot, reply); err != nil {
+		log.Printf("[%s %d] Unable to send message: %s", msg.From.UserName, msg.From.ID, err)
+	}
+}
+
+// HandleDefaultAudio saves the answer of the user to OfferDefaultAudio.
+func (app *App) HandleDefaultAudio(query *tgbotapi.CallbackQuery) {
+	defaultAudio := strings.TrimPrefix(query.Data, CallbackDefaultAudio) == "yes"
+	if err := app.UserPreferences.SetDefaultAudio(query.From.ID, defaultAudio); err != nil {
+		log.Printf("[%s %d] Unable to save preferences: %s", query.From.UserName, query.From.ID, err)
+	}
+	text := app.UserMessage(query.From, EventDefaultVideo, MessageData{}, "Ok, I will keep sending you the video by default")
+	if defaultAudio {
+		text = app.UserMessage(query.From, EventDefaultAudio, MessageData{}, "Ok, from now on I will send you only the audio, use the video word to get the video")
+	}
+	if query.Message != nil {
+		EditText(app.Bot, *query.Message, text)
+	}
+}
+
+// HandleSearchPick downloads the result of /search the user picked.
+func (app *App) HandleSearchPick(query *tgbotapi.CallbackQuery) {
+	id := strings.TrimPrefix(query.Data, CallbackSearch)
+	pending, ok := app.PendingDownloads.Take(id, query.From.ID)
+	if !ok {
+		log.Printf("[%s %d] Search result %s is unknown or expired", query.From.UserName, query.From.ID, id)
+		return
+	}
+	go app.ProcessDownload(pending.Msg, pending.DownloadConfig)
+}
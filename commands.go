@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// HandleCommand processes the messages starting with a slash, like /broadcast.
+func (app *App) HandleCommand(msg *tgbotapi.Message) {
+	switch msg.Command() {
+	case "start":
+		reply := tgbotapi.NewMessage(msg.Chat.ID, app.Config.Greeting)
+		reply.ReplyToMessageID = msg.MessageID
+		reply.ReplyMarkup = tgbotapi.NewReplyKeyboard(
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(KeyboardVideo),
+				tgbotapi.NewKeyboardButton(KeyboardAudio),
+			),
+		)
+		if _, err := SendWithRetry(app.Bot, reply); err != nil {
+			log.Printf("[%s %d] Unable to send message: %s", msg.From.UserName, msg.From.ID, err)
+		}
+	case "search":
+		app.Search(msg)
+	case "chapters":
+		app.ListChapters(msg)
+	case "meta":
+		app.SendMeta(msg)
+	case "quota":
+		app.ReportQuota(msg)
+	case "lang":
+		app.SwitchLanguage(msg)
+	case "broadcast", "test", "stats", "maintenance", "config":
+		if !app.Config.IsAdmin(msg.From.ID) {
+			log.Printf("[%s %d] Non-Admin user tried to use /%s", msg.From.UserName, msg.From.ID, msg.Command())
+			ReplyText(app.Bot, msg, app.Message(msg, EventAdminOnly, MessageData{}, "Only the admin can use that command 😠"))
+			return
+		}
+		switch msg.Command() {
+		case "broadcast":
+			userIds := append(app.AccessList.Users(), app.AuthorizedUserIds...)
+			app.Broadcast(msg, userIds)
+		case "test":
+			app.TestDownload(msg)
+		case "stats":
+			data := app.Stats.Report()
+			ReplyText(app.Bot, msg, app.Message(msg, EventStats, data, StatsReport(data)))
+		case "maintenance":
+			app.SwitchMaintenance(msg)
+		case "config":
+			log.Printf("[%s %d] Reporting the configuration", msg.From.UserName, msg.From.ID)
+			ReplyText(app.Bot, msg, fmt.Sprintf("TOKEN: %s\n%s", RedactToken(app.Bot.Token), app.Config.Report()))
+		}
+	default:
+		ReplyText(app.Bot, msg, app.Message(msg, EventUsage, MessageData{}, UsageMessage))
+	}
+}
+
+// Broadcast sends the arguments of the /broadcast command msg to every authorized user
+// and tells the admin how many of them were reached. Users who never started a chat
+// with the bot can not be messaged.
+func (app *App) Broadcast(msg *tgbotapi.Message, authorizedUserIds []int64) {
+	text := strings.TrimSpace(msg.CommandArguments())
+	if text == "" {
+		app.ReplyUsage(msg, "/broadcast <text>")
+		return
+	}
+	if len(authorizedUserIds) == 0 {
+		ReplyText(app.Bot, msg, app.Message(msg, EventBroadcastNobody, MessageData{}, "There are no authorized users to broadcast to (everyone can use me)"))
+		return
+	}
+	reached, failed := 0, 0
+	for _, userId := range authorizedUserIds {
+		if _, err := SendWithRetry(app.Bot, tgbotapi.NewMessage(userId, text)); err != nil {
+			log.Printf("[%s %d] Unable to broadcast to user %d: %s", msg.From.UserName, msg.From.ID, userId, err)
+			failed++
+			continue
+		}
+		reached++
+	}
+	log.Printf("[%s %d] Broadcast reached %d users, %d failed", msg.From.UserName, msg.From.ID, reached, failed)
+	data := MessageData{Count: reached, Failed: failed}
+	ReplyText(app.Bot, msg, app.Message(msg, EventBroadcastDone, data, fmt.Sprintf("Broadcast reached %d users, %d failed", reached, failed)))
+}
+
+// ReplyUsage replies to the command msg with its usage, like /search <terms>.
+func (app *App) ReplyUsage(msg *tgbotapi.Message, usage string) {
+	ReplyText(app.Bot, msg, app.Message(msg, EventCommandUsage, MessageData{Usage: usage}, "Usage: "+usage))
+}
+
+// ReplyInvalidRequest replies to the command msg that the request in its arguments is
+// not valid because of err.
+func (app *App) ReplyInvalidRequest(msg *tgbotapi.Message, err error) {
+	ReplyText(app.Bot, msg, app.Message(msg, EventInvalidRequest, MessageData{Error: err.Error()}, fmt.Sprintf("❌ Invalid request: %s", err)))
+}
+
+// ReportQuota replies to the /quota command msg with how many requests the user made
+// today and how many they have left.
+func (app *App) ReportQuota(msg *tgbotapi.Message) {
+	used := app.Quotas.Used(msg.From.ID)
+	limit := app.Quotas.Limit()
+	if app.Config.IsAdmin(msg.From.ID) {
+		limit = 0
+	}
+	var text string
+	switch {
+	case limit == 0:
+		text = fmt.Sprintf("You made %d requests today, there is no limit 😺", used)
+	case used >= limit:
+		text = fmt.Sprintf("You made your %d requests of today, come back tomorrow 😿", limit)
+	default:
+		text = fmt.Sprintf("You made %d requests today, %d left of %d", used, limit-used, limit)
+	}
+	// Max is 0 when there is no limit
+	ReplyText(app.Bot, msg, app.Message(msg, EventQuota, MessageData{Count: used, Max: limit}, text))
+}
+
+// Search replies to the /search command msg with the top results of the search and an
+// inline button to download each of them.
+func (app *App) Search(msg *tgbotapi.Message) {
+	terms := strings.TrimSpace(msg.CommandArguments())
+	if terms == "" {
+		app.ReplyUsage(msg, "/search <terms>")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), app.Config.MaxRequestDuration)
+	defer cancel()
+	results, err := SearchVideos(ctx, app.Config, terms, SearchResultsCount)
+	if err != nil {
+		log.Printf("[%s %d] Unable to complete search %s: %s", msg.From.UserName, msg.From.ID, terms, err)
+		ReplyText(app.Bot, msg, app.Message(msg, EventSearchFailed, MessageData{Error: err.Error()}, "I'm sorry I was not able to search that ☹"))
+		return
+	}
+	if len(results) == 0 {
+		ReplyText(app.Bot, msg, app.Message(msg, EventSearchNotFound, MessageData{}, "I did not find anything 🙀"))
+		return
+	}
+	lines := []string{}
+	rows := [][]tgbotapi.InlineKeyboardButton{}
+	for i, result := range results {
+		downloadConfig, err := LoadDownloadConfigFromMsg(result.Url)
+		if err != nil {
+			log.Printf("[%s %d] Skipping search result %s: %s", msg.From.UserName, msg.From.ID, result.Url, err)
+			continue
+		}
+		id := app.PendingDownloads.Add(msg, downloadConfig)
+		lines = append(lines, fmt.Sprintf("%d. %s\n%s", i+1, result.Title, result.Url))
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("⬇️ %d", i+1), CallbackSearch+id),
+		))
+	}
+	reply := tgbotapi.NewMessage(msg.Chat.ID, strings.Join(lines, "\n\n"))
+	reply.ReplyToMessageID = msg.MessageID
+	reply.DisableWebPagePreview = true
+	reply.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	if _, err := SendWithRetry(app.Bot, reply); err != nil {
+		log.Printf("[%s %d] Unable to send message: %s", msg.From.UserName, msg.From.ID, err)
+	}
+}
+
+// MaxListedChapters is how many chapters of a video are listed, Telegram limits the
+// length (and the buttons) of a message.
+const MaxListedChapters = 40
+
+// ListChapters replies to the /chapters command msg with the chapters of the video and
+// an inline button to download each of them.
+func (app *App) ListChapters(msg *tgbotapi.Message) {
+	request := strings.TrimSpace(msg.CommandArguments())
+	if request == "" {
+		app.ReplyUsage(msg, "/chapters <url>")
+		return
+	}
+	downloadConfig, err := LoadDownloadConfigFromMsg(request)
+	if err != nil {
+		app.ReplyInvalidRequest(msg, err)
+		return
+	}
+	videoUrl, err := NormalizeUrl(app.Config, downloadConfig.VideoUrl)
+	if err != nil {
+		log.Printf("[%s %d] Keeping the short URL: %s", msg.From.UserName, msg.From.ID, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), app.Config.MaxRequestDuration)
+	defer cancel()
+	info, err := FetchVideoInfo(ctx, app.Config, videoUrl.String())
+	if err != nil {
+		log.Printf("[%s %d] Unable to list the chapters of %s: %s", msg.From.UserName, msg.From.ID, videoUrl, err)
+		ReplyText(app.Bot, msg, app.Message(msg, EventFailed, MessageData{Url: videoUrl.String(), Error: err.Error()}, "I'm sorry I was not able to get the chapters of your video ☹"))
+		return
+	}
+	if len(info.Chapters) == 0 {
+		ReplyText(app.Bot, msg, app.Message(msg, EventNoChapters, MessageData{Url: videoUrl.String()}, "That video has no chapters 🙀"))
+		return
+	}
+	lines := []string{}
+	buttons := []tgbotapi.InlineKeyboardButton{}
+	chapters := info.Chapters
+	if len(chapters) > MaxListedChapters {
+		chapters = chapters[:MaxListedChapters]
+	}
+	for i, chapter := range chapters {
+		span := fmt.Sprintf("%s-%s", Second2Spot(chapter.StartTime), Second2Spot(chapter.EndTime))
+		lines = append(lines, fmt.Sprintf("%d. %s %s", i+1, span, chapter.Title))
+		chapterConfig, err := LoadDownloadConfigFromMsg(videoUrl.String() + " " + span)
+		if err != nil {
+			log.Printf("[%s %d] Skipping chapter %s: %s", msg.From.UserName, msg.From.ID, span, err)
+			continue
+		}
+		id := app.PendingDownloads.Add(msg, chapterConfig)
+		buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("⬇️ %d", i+1), CallbackSearch+id))
+	}
+	if omitted := len(info.Chapters) - len(chapters); omitted > 0 {
+		lines = append(lines, app.Message(msg, EventMoreChapters, MessageData{Count: omitted}, fmt.Sprintf("... and %d more", omitted)))
+	}
+	rows := [][]tgbotapi.InlineKeyboardButton{}
+	for start := 0; start < len(buttons); start += 5 {
+		end := start + 5
+		if end > len(buttons) {
+			end = len(buttons)
+		}
+		rows = append(rows, buttons[start:end])
+	}
+	data := MessageData{Url: videoUrl.String(), Title: info.Title, Count: len(info.Chapters)}
+	header := app.Message(msg, EventChapters, data, fmt.Sprintf("Chapters of %s (tap a number to download that chapter):", info.Title))
+	text := header + "\n\n" + strings.Join(lines, "\n")
+	reply := tgbotapi.NewMessage(msg.Chat.ID, text)
+	reply.ReplyToMessageID = msg.MessageID
+	reply.DisableWebPagePreview = true
+	if len(rows) != 0 {
+		reply.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	}
+	if _, err := SendWithRetry(app.Bot, reply); err != nil {
+		log.Printf("[%s %d] Unable to send message: %s", msg.From.UserName, msg.From.ID, err)
+	}
+}
+
+// TestDownload runs the whole download pipeline for the request in the arguments of the
+// /test command msg and reports how it went, the file is removed instead of uploaded.
+func (app *App) TestDownload(msg *tgbotapi.Message) {
+	request := strings.TrimSpace(msg.CommandArguments())
+	if request == "" {
+		app.ReplyUsage(msg, "/test <url> [options]")
+		return
+	}
+	downloadConfig, err := LoadDownloadConfigFromMsg(request)
+	if err != nil {
+		app.ReplyInvalidRequest(msg, err)
+		return
+	}
+	if downloadConfig.VideoUrl, err = NormalizeUrl(app.Config, downloadConfig.VideoUrl); err != nil {
+		log.Printf("[%s %d] Keeping the short URL: %s", msg.From.UserName, msg.From.ID, err)
+	}
+	ReplyText(app.Bot, msg, app.Message(msg, EventTestStarted, MessageData{Url: downloadConfig.VideoUrl.String()}, "Ok, testing the download..."))
+	ctx, cancel := context.WithTimeout(context.Background(), app.Config.RequestTimeout(downloadConfig))
+	defer cancel()
+	start := time.Now()
+	err = ResolveDownloadConfig(ctx, app.Config, downloadConfig)
+	var videoFilename string
+	if err == nil {
+		videoFilename, err = DownloadVideo(ctx, app.Config, downloadConfig)
+	}
+	elapsed := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		log.Printf("[%s %d] Test of %s failed after %s: %s", msg.From.UserName, msg.From.ID, request, elapsed, err)
+		data := MessageData{Url: downloadConfig.VideoUrl.String(), Elapsed: elapsed.String(), Error: err.Error()}
+		ReplyText(app.Bot, msg, app.Message(msg, EventTestFailed, data, fmt.Sprintf("❌ Failed after %s: %s", elapsed, err)))
+		return
+	}
+	defer os.Remove(videoFilename)
+	size := OutputsSize([]Output{{Filename: videoFilename}})
+	log.Printf("[%s %d] Test of %s succeeded elapsed=%s bytes=%d", msg.From.UserName, msg.From.ID, request, elapsed, size)
+	data := MessageData{Url: downloadConfig.VideoUrl.String(), Elapsed: elapsed.String(), Size: FormatBytes(size)}
+	ReplyText(app.Bot, msg, app.Message(msg, EventTestDone, data, fmt.Sprintf("✅ Downloaded in %s, %d bytes (%s)", elapsed, size, data.Size)))
+}
@@ -0,0 +1,799 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultMaxUploadBytes is the biggest file a bot can upload using the Telegram Bot API
+// (50 MB).
+const DefaultMaxUploadBytes = 50 * 1024 * 1024
+
+// The presets package several yt-dlp and ffmpeg options behind the PRESET environment
+// variable.
+const (
+	// PresetDefault downloads the format 18 (360p mp4).
+	PresetDefault = ""
+	// PresetTelegram prefers h264/aac mp4 videos with the moov atom at the start, they
+	// play reliably (and while downloading) in Telegram.
+	PresetTelegram = "telegram"
+	// PresetArchive keeps the best original streams in an mkv container.
+	PresetArchive = "archive"
+)
+
+// The values of PUBLIC_LINKS, which files are published in PUBLIC_DIR.
+const (
+	// PublicLinksLarge publishes the files over the upload limit instead of refusing
+	// them.
+	PublicLinksLarge = "large"
+	// PublicLinksAlways publishes every file instead of uploading it.
+	PublicLinksAlways = "always"
+	// PublicLinksBoth publishes every file besides uploading it.
+	PublicLinksBoth = "both"
+)
+
+// DefaultPublicRetention is how long the published files are kept when
+// PUBLIC_RETENTION is not set.
+const DefaultPublicRetention = 24 * time.Hour
+
+// DefaultMaxOutputFiles is how many files a single request can produce when
+// MAX_OUTPUT_FILES is not set.
+const DefaultMaxOutputFiles = 20
+
+// DefaultMaxListUrls is how many URLs a list of requests can have when MAX_LIST_URLS is
+// not set.
+const DefaultMaxListUrls = 10
+
+// DefaultPrivateMaxHeight and DefaultGroupMaxHeight are the heights (in pixels) the
+// videos requested in private chats and in groups are downloaded at most when
+// PRIVATE_MAX_HEIGHT and GROUP_MAX_HEIGHT are not set. The groups get less since every
+// member downloads what is sent there.
+const (
+	DefaultPrivateMaxHeight = 1080
+	DefaultGroupMaxHeight   = 480
+)
+
+// DefaultMaxRequestDuration is how long a request can take (downloading and processing
+// the video) when MAX_REQUEST_DURATION is not set.
+const DefaultMaxRequestDuration = 10 * time.Minute
+
+// DefaultYtdlpStaleDays is how old (in days) yt-dlp can be before the failed downloads
+// suggest updating it, when YTDLP_STALE_DAYS is not set.
+const DefaultYtdlpStaleDays = 60
+
+// DefaultGreeting is the reply to /start when GREETING is not set.
+const DefaultGreeting = "Hi! 😺 Choose what you want below and then paste the URL of the video, or just send me the URL."
+
+// Config holds the settings of the bot, they are loaded from environment variables when
+// the bot starts.
+type Config struct {
+	// MaxUploadBytes is the size of the biggest file the bot will try to upload (taken
+	// from MAX_UPLOAD_BYTES).
+	MaxUploadBytes int64
+	// FitByDefault makes every video request behave as if the user had used the fit word
+	// (taken from FIT_BY_DEFAULT).
+	FitByDefault bool
+	// FormatFallback retries the downloads with the best format when the requested one
+	// is not available (taken from FORMAT_FALLBACK).
+	FormatFallback bool
+	// SourceByDefault makes every request behave as if the user had used the source word
+	// (taken from SOURCE_BY_DEFAULT).
+	SourceByDefault bool
+	// AllowedExtractors are the only yt-dlp extractors that can be used, when empty all
+	// of them are allowed (taken from ALLOWED_EXTRACTORS).
+	AllowedExtractors []string
+	// DeniedExtractors are yt-dlp extractors that can never be used (taken from
+	// DENIED_EXTRACTORS).
+	DeniedExtractors []string
+	// YtdlpExtraArgs are appended to every yt-dlp command (taken from YTDLP_EXTRA_ARGS,
+	// split on white space). Only the operator can set them, never the users.
+	YtdlpExtraArgs []string
+	// Preset is one of PresetDefault, PresetTelegram or PresetArchive (taken from
+	// PRESET).
+	Preset string
+	// Faststart moves the moov atom of the mp4 videos to the front so Telegram can play
+	// them before they are fully downloaded (taken from FASTSTART, the telegram preset
+	// always enables it).
+	Faststart bool
+	// PlaybackSafe transcodes the videos Telegram can not play inline (the ones that are
+	// not h264 with aac in mp4, like VP9 in webm) before sending them (taken from
+	// PLAYBACK_SAFE).
+	PlaybackSafe bool
+	// EmbedMetadata embeds the metadata of the video (title, uploader, upload date...)
+	// in the downloaded files (taken from EMBED_METADATA, the archive preset always
+	// enables it).
+	EmbedMetadata bool
+	// MaxClipDuration is the longest span a user can cut (taken from MAX_CLIP_DURATION),
+	// 0 means any span.
+	MaxClipDuration time.Duration
+	// EmbedSubsLang is the language (or comma separated languages) of the subtitles
+	// embedded in every video (taken from EMBED_SUBS_LANG), when empty no subtitles are
+	// embedded.
+	EmbedSubsLang string
+	// MaxRequestDuration is how long a request can take downloading and processing the
+	// video before it is cancelled (taken from MAX_REQUEST_DURATION).
+	MaxRequestDuration time.Duration
+	// YtdlpRateLimit is the most bytes per second each download can take, like 2M (taken
+	// from YTDLP_RATE_LIMIT), when empty the downloads are not throttled.
+	YtdlpRateLimit string
+	// YtdlpStaleAfter is how old yt-dlp can be before the failed downloads suggest
+	// updating it (taken from YTDLP_STALE_DAYS), 0 means it is never suggested.
+	YtdlpStaleAfter time.Duration
+	// DownloadSpacing is the minimum time between the start of two yt-dlp runs, the
+	// downloads and the lookups alike (taken from DOWNLOAD_SPACING), it keeps the bot
+	// from looking like a scraper to the sites.
+	DownloadSpacing time.Duration
+	// DownloadWorkers, CutWorkers and UploadWorkers are how many requests can download,
+	// cut (and process) and upload their files at the same time (taken from
+	// DOWNLOAD_WORKERS, CUT_WORKERS and UPLOAD_WORKERS), 0 means any number.
+	DownloadWorkers int
+	CutWorkers      int
+	UploadWorkers   int
+	// StateDir is the directory where the bot persists its state between restarts (taken
+	// from STATE_DIR), when empty nothing is persisted.
+	StateDir string
+	// AdminUserIds are the users allowed to use the admin commands (taken from
+	// ADMIN_USERS).
+	AdminUserIds []int64
+	// DeniedLogChat is the chat (like a private channel of the operator) where the
+	// attempts of the unauthorized users are reported (taken from DENIED_LOG_CHAT), 0
+	// means they are only logged.
+	DeniedLogChat int64
+	// LogDownloadStats adds the elapsed time and the size of the files to the log line
+	// of every completed request (taken from LOG_DOWNLOAD_STATS).
+	LogDownloadStats bool
+	// MaxOutputFiles is how many files a single request can produce, the rest are left
+	// out (taken from MAX_OUTPUT_FILES).
+	MaxOutputFiles int
+	// MaxListUrls is how many URLs a list of requests sent as a document can have, the
+	// longer lists are rejected (taken from MAX_LIST_URLS).
+	MaxListUrls int
+	// DryRun makes the bot download and process the videos without uploading them
+	// (taken from DRY_RUN).
+	DryRun bool
+	// WebhookUrl receives a JSON POST when a download completes or fails (taken from
+	// WEBHOOK_URL), empty means nothing is posted.
+	WebhookUrl string
+	// ApiAddr is the address (like :8080) the API to request downloads over HTTP listens
+	// at (taken from API_ADDR), empty means there is no API.
+	ApiAddr string
+	// ApiSecret is the secret the requests to the API must have (taken from API_SECRET).
+	ApiSecret string
+	// ApiChat is the chat the files of the requests to the API are sent to (taken from
+	// API_CHAT).
+	ApiChat int64
+	// SurfaceWarnings makes the bot tell the users about the warnings of yt-dlp that
+	// match the WarningRules (taken from SURFACE_WARNINGS).
+	SurfaceWarnings bool
+	// WarningRules tell what the warnings of yt-dlp mean for the users (taken from the
+	// JSON file of WARNING_RULES_FILE).
+	WarningRules []WarningRule
+	// MessagesFile is the file with the templates of the customized replies (taken from
+	// MESSAGES_FILE), see Messages.
+	MessagesFile string
+	// MessagesDir is the directory with the catalogs of the replies translated to each
+	// language, like es.tmpl (taken from MESSAGES_DIR).
+	MessagesDir string
+	// MaxUsers is how many users can be approved through /request_access (taken from
+	// MAX_USERS), 0 means any number.
+	MaxUsers int
+	// TimestampFont is the font file the timestamp option burns the time with (taken from
+	// TIMESTAMP_FONT), when empty the option is rejected.
+	TimestampFont string
+	// BumperIntro and BumperOutro are the videos added before and after the video of the
+	// requests with the bumper word (taken from BUMPER_INTRO and BUMPER_OUTRO), when
+	// empty nothing is added there.
+	BumperIntro string
+	BumperOutro string
+	// ShortenerHosts are the hosts of the URL shorteners expanded before downloading
+	// (taken from SHORTENER_HOSTS).
+	ShortenerHosts []string
+	// TrackingParams are the query params stripped from the URLs before downloading
+	// (taken from TRACKING_PARAMS).
+	TrackingParams []string
+	// MirrorHosts are the alternative hosts of each host tried in order when a download
+	// from it fails (taken from MIRROR_HOSTS).
+	MirrorHosts map[string][]string
+	// RateLimitPerUser and RateLimitPerChat are how many requests per minute each user
+	// and each group can make (taken from RATE_LIMIT_PER_USER_MIN and
+	// RATE_LIMIT_PER_CHAT_MIN), 0 means any number.
+	RateLimitPerUser int
+	RateLimitPerChat int
+	// DailyQuota is how many requests a day every user (but the admins) can make (taken
+	// from DAILY_QUOTA), 0 means any number.
+	DailyQuota int
+	// PublicDir is the directory (served by a web server at PublicUrl) where files are
+	// published to send a link instead of the file (taken from PUBLIC_DIR), when empty
+	// nothing is published.
+	PublicDir string
+	// PublicUrl is the URL PublicDir is served at (taken from PUBLIC_URL).
+	PublicUrl string
+	// PublicLinks is one of PublicLinksLarge, PublicLinksAlways or PublicLinksBoth
+	// (taken from PUBLIC_LINKS).
+	PublicLinks string
+	// PublicRetention is how long the published files are kept (taken from
+	// PUBLIC_RETENTION).
+	PublicRetention time.Duration
+	// Greeting is the reply to /start (taken from GREETING).
+	Greeting string
+	// GroupTrigger is a prefix (like !dl) that addresses a group message to the bot
+	// besides mentioning it or replying to it (taken from GROUP_TRIGGER).
+	GroupTrigger string
+	// PrivateMaxHeight and GroupMaxHeight are the height (in pixels) the videos requested
+	// in private chats and in groups are downloaded at most (taken from
+	// PRIVATE_MAX_HEIGHT and GROUP_MAX_HEIGHT, DefaultPrivateMaxHeight and
+	// DefaultGroupMaxHeight when not set), unless the users ask for a quality. 0 means
+	// the default format of the preset.
+	PrivateMaxHeight int
+	GroupMaxHeight   int
+	// GroupIntro is posted when the bot is added to a group (taken from GROUP_INTRO),
+	// when empty nothing is posted.
+	GroupIntro string
+	// SelfTest makes the bot download a tiny video at startup and refuse to start when it
+	// fails (taken from SELFTEST).
+	SelfTest bool
+	// SelfTestUrl is the video downloaded by the self-test (taken from SELFTEST_URL).
+	SelfTestUrl string
+	// DeleteRequests makes the bot delete the request messages once their files were sent
+	// (taken from DELETE_REQUESTS).
+	DeleteRequests bool
+	// LeaveUnauthorizedGroups makes the bot leave the groups it is added to by users not
+	// authorized there (taken from LEAVE_UNAUTHORIZED_GROUPS).
+	LeaveUnauthorizedGroups bool
+}
+
+// IsAdmin reports whether the user userId can use the admin commands.
+func (c *Config) IsAdmin(userId int64) bool {
+	for _, adminUserId := range c.AdminUserIds {
+		if userId == adminUserId {
+			return true
+		}
+	}
+	return false
+}
+
+// StateFile returns the path of the state file name inside StateDir, or an empty string
+// when the state is not persisted.
+func (c *Config) StateFile(name string) string {
+	if c.StateDir == "" {
+		return ""
+	}
+	return filepath.Join(c.StateDir, name)
+}
+
+// RequestTimeout returns how long the request downloadConfig can take, recordings get
+// their duration on top of MaxRequestDuration.
+func (c *Config) RequestTimeout(downloadConfig *DownloadConfig) time.Duration {
+	return c.MaxRequestDuration + downloadConfig.RecordDuration
+}
+
+// ChatMaxHeight returns the height (in pixels) the videos requested in a private chat
+// (or in a group) are downloaded at most when the users do not ask for a quality, 0
+// means the default format of the preset.
+func (c *Config) ChatMaxHeight(private bool) int {
+	if private {
+		return c.PrivateMaxHeight
+	}
+	return c.GroupMaxHeight
+}
+
+// HasBumpers reports whether there is an intro or an outro to add with the bumper word.
+func (c *Config) HasBumpers() bool {
+	return c.BumperIntro != "" || c.BumperOutro != ""
+}
+
+// FiltersExtractors reports whether the extractor of a video must be checked before
+// downloading it.
+func (c *Config) FiltersExtractors() bool {
+	return len(c.AllowedExtractors) != 0 || len(c.DeniedExtractors) != 0
+}
+
+// LoadConfig reads the settings of the bot from the environment variables.
+func LoadConfig() (*Config, error) {
+	var err error
+	config := &Config{}
+	config.MaxUploadBytes, err = EnvInt64("MAX_UPLOAD_BYTES", DefaultMaxUploadBytes)
+	if err != nil {
+		return nil, err
+	}
+	if config.MaxUploadBytes <= 0 {
+		return nil, fmt.Errorf("MAX_UPLOAD_BYTES must be greater than 0")
+	}
+	maxOutputFiles, err := EnvInt64("MAX_OUTPUT_FILES", DefaultMaxOutputFiles)
+	if err != nil {
+		return nil, err
+	}
+	if maxOutputFiles <= 0 {
+		return nil, fmt.Errorf("MAX_OUTPUT_FILES must be greater than 0")
+	}
+	config.MaxOutputFiles = int(maxOutputFiles)
+	maxListUrls, err := EnvInt64("MAX_LIST_URLS", DefaultMaxListUrls)
+	if err != nil {
+		return nil, err
+	}
+	if maxListUrls <= 0 {
+		return nil, fmt.Errorf("MAX_LIST_URLS must be greater than 0")
+	}
+	config.MaxListUrls = int(maxListUrls)
+	config.FitByDefault, err = EnvBool("FIT_BY_DEFAULT", false)
+	if err != nil {
+		return nil, err
+	}
+	config.FormatFallback, err = EnvBool("FORMAT_FALLBACK", true)
+	if err != nil {
+		return nil, err
+	}
+	config.SourceByDefault, err = EnvBool("SOURCE_BY_DEFAULT", false)
+	if err != nil {
+		return nil, err
+	}
+	config.AllowedExtractors = EnvList("ALLOWED_EXTRACTORS")
+	config.DeniedExtractors = EnvList("DENIED_EXTRACTORS")
+	config.YtdlpExtraArgs = strings.Fields(os.Getenv("YTDLP_EXTRA_ARGS"))
+	if err := ValidateYtdlpExtraArgs(config.YtdlpExtraArgs); err != nil {
+		return nil, err
+	}
+	config.Faststart, err = EnvBool("FASTSTART", false)
+	if err != nil {
+		return nil, err
+	}
+	config.PlaybackSafe, err = EnvBool("PLAYBACK_SAFE", false)
+	if err != nil {
+		return nil, err
+	}
+	config.EmbedMetadata, err = EnvBool("EMBED_METADATA", false)
+	if err != nil {
+		return nil, err
+	}
+	config.MaxClipDuration, err = EnvDuration("MAX_CLIP_DURATION", 0)
+	if err != nil {
+		return nil, err
+	}
+	config.EmbedSubsLang = strings.TrimSpace(os.Getenv("EMBED_SUBS_LANG"))
+	if config.EmbedSubsLang != "" && !SubsLangPattern.MatchString(config.EmbedSubsLang) {
+		return nil, fmt.Errorf("EMBED_SUBS_LANG must be language codes separated by commas (like es or en,es), not %s", config.EmbedSubsLang)
+	}
+	config.MaxRequestDuration, err = EnvDuration("MAX_REQUEST_DURATION", DefaultMaxRequestDuration)
+	if err != nil {
+		return nil, err
+	}
+	if config.MaxRequestDuration == 0 {
+		return nil, fmt.Errorf("MAX_REQUEST_DURATION must be greater than 0")
+	}
+	config.YtdlpRateLimit = strings.TrimSpace(os.Getenv("YTDLP_RATE_LIMIT"))
+	if config.YtdlpRateLimit != "" && !RateLimitPattern.MatchString(config.YtdlpRateLimit) {
+		return nil, fmt.Errorf("YTDLP_RATE_LIMIT must be a rate in bytes per second like 500K or 2M, not %s", config.YtdlpRateLimit)
+	}
+	ytdlpStaleDays, err := EnvInt64("YTDLP_STALE_DAYS", DefaultYtdlpStaleDays)
+	if err != nil {
+		return nil, err
+	}
+	if ytdlpStaleDays < 0 {
+		return nil, fmt.Errorf("YTDLP_STALE_DAYS can not be negative")
+	}
+	config.YtdlpStaleAfter = time.Duration(ytdlpStaleDays) * 24 * time.Hour
+	config.DownloadSpacing, err = EnvDuration("DOWNLOAD_SPACING", 0)
+	if err != nil {
+		return nil, err
+	}
+	for env, workers := range map[string]*int{"DOWNLOAD_WORKERS": &config.DownloadWorkers, "CUT_WORKERS": &config.CutWorkers, "UPLOAD_WORKERS": &config.UploadWorkers} {
+		count, err := EnvInt64(env, 0)
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return nil, fmt.Errorf("%s can not be negative", env)
+		}
+		*workers = int(count)
+	}
+	config.StateDir = strings.TrimSpace(os.Getenv("STATE_DIR"))
+	if config.StateDir != "" {
+		if err := os.MkdirAll(config.StateDir, 0755); err != nil {
+			return nil, fmt.Errorf("unable to create STATE_DIR %s: %s", config.StateDir, err)
+		}
+	}
+	for _, adminUserId := range EnvList("ADMIN_USERS") {
+		id, err := strconv.ParseInt(adminUserId, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse %s from ADMIN_USERS (environment variable) into an int64: %s", adminUserId, err)
+		}
+		config.AdminUserIds = append(config.AdminUserIds, id)
+	}
+	config.DeniedLogChat, err = EnvInt64("DENIED_LOG_CHAT", 0)
+	if err != nil {
+		return nil, err
+	}
+	config.LogDownloadStats, err = EnvBool("LOG_DOWNLOAD_STATS", true)
+	if err != nil {
+		return nil, err
+	}
+	config.DryRun, err = EnvBool("DRY_RUN", false)
+	if err != nil {
+		return nil, err
+	}
+	maxUsers, err := EnvInt64("MAX_USERS", 0)
+	if err != nil {
+		return nil, err
+	}
+	if maxUsers < 0 {
+		return nil, fmt.Errorf("MAX_USERS can not be negative")
+	}
+	config.MaxUsers = int(maxUsers)
+	dailyQuota, err := EnvInt64("DAILY_QUOTA", 0)
+	if err != nil {
+		return nil, err
+	}
+	if dailyQuota < 0 {
+		return nil, fmt.Errorf("DAILY_QUOTA can not be negative")
+	}
+	config.DailyQuota = int(dailyQuota)
+	rateLimitPerUser, err := EnvInt64("RATE_LIMIT_PER_USER_MIN", 0)
+	if err != nil {
+		return nil, err
+	}
+	if rateLimitPerUser < 0 {
+		return nil, fmt.Errorf("RATE_LIMIT_PER_USER_MIN can not be negative")
+	}
+	config.RateLimitPerUser = int(rateLimitPerUser)
+	rateLimitPerChat, err := EnvInt64("RATE_LIMIT_PER_CHAT_MIN", 0)
+	if err != nil {
+		return nil, err
+	}
+	if rateLimitPerChat < 0 {
+		return nil, fmt.Errorf("RATE_LIMIT_PER_CHAT_MIN can not be negative")
+	}
+	config.RateLimitPerChat = int(rateLimitPerChat)
+	config.MessagesFile = strings.TrimSpace(os.Getenv("MESSAGES_FILE"))
+	config.MessagesDir = strings.TrimSpace(os.Getenv("MESSAGES_DIR"))
+	config.WebhookUrl = strings.TrimSpace(os.Getenv("WEBHOOK_URL"))
+	if config.WebhookUrl != "" {
+		if webhookUrl, err := url.Parse(config.WebhookUrl); err != nil || (webhookUrl.Scheme != "http" && webhookUrl.Scheme != "https") || webhookUrl.Host == "" {
+			return nil, fmt.Errorf("WEBHOOK_URL must be an http(s) URL, not %q", config.WebhookUrl)
+		}
+	}
+	config.ApiAddr = strings.TrimSpace(os.Getenv("API_ADDR"))
+	config.ApiSecret = strings.TrimSpace(os.Getenv("API_SECRET"))
+	config.ApiChat, err = EnvInt64("API_CHAT", 0)
+	if err != nil {
+		return nil, err
+	}
+	if config.ApiAddr != "" && (config.ApiSecret == "" || config.ApiChat == 0) {
+		return nil, fmt.Errorf("API_ADDR needs API_SECRET and API_CHAT")
+	}
+	config.SurfaceWarnings, err = EnvBool("SURFACE_WARNINGS", false)
+	if err != nil {
+		return nil, err
+	}
+	config.WarningRules, err = LoadWarningRules(strings.TrimSpace(os.Getenv("WARNING_RULES_FILE")))
+	if err != nil {
+		return nil, fmt.Errorf("unable to load WARNING_RULES_FILE: %s", err)
+	}
+	for env, filename := range map[string]*string{"BUMPER_INTRO": &config.BumperIntro, "BUMPER_OUTRO": &config.BumperOutro, "TIMESTAMP_FONT": &config.TimestampFont} {
+		*filename = strings.TrimSpace(os.Getenv(env))
+		if *filename == "" {
+			continue
+		}
+		if _, err := os.Stat(*filename); err != nil {
+			return nil, fmt.Errorf("unable to use %s as %s: %s", *filename, env, err)
+		}
+	}
+	config.ShortenerHosts = EnvList("SHORTENER_HOSTS")
+	if len(config.ShortenerHosts) == 0 {
+		config.ShortenerHosts = DefaultShortenerHosts
+	}
+	config.TrackingParams = EnvList("TRACKING_PARAMS")
+	if len(config.TrackingParams) == 0 {
+		config.TrackingParams = DefaultTrackingParams
+	}
+	config.MirrorHosts, err = ParseMirrorHosts(EnvList("MIRROR_HOSTS"))
+	if err != nil {
+		return nil, err
+	}
+	config.Greeting = strings.TrimSpace(os.Getenv("GREETING"))
+	if config.Greeting == "" {
+		config.Greeting = DefaultGreeting
+	}
+	config.GroupTrigger = strings.TrimSpace(os.Getenv("GROUP_TRIGGER"))
+	privateMaxHeight, err := EnvInt64("PRIVATE_MAX_HEIGHT", DefaultPrivateMaxHeight)
+	if err != nil {
+		return nil, err
+	}
+	groupMaxHeight, err := EnvInt64("GROUP_MAX_HEIGHT", DefaultGroupMaxHeight)
+	if err != nil {
+		return nil, err
+	}
+	for env, maxHeight := range map[string]int64{"PRIVATE_MAX_HEIGHT": privateMaxHeight, "GROUP_MAX_HEIGHT": groupMaxHeight} {
+		if maxHeight != 0 && (maxHeight < MinScale || maxHeight > MaxScale) {
+			return nil, fmt.Errorf("%s must be 0 or between %d and %d", env, MinScale, MaxScale)
+		}
+	}
+	config.PrivateMaxHeight, config.GroupMaxHeight = int(privateMaxHeight), int(groupMaxHeight)
+	config.GroupIntro = strings.TrimSpace(os.Getenv("GROUP_INTRO"))
+	config.SelfTest, err = EnvBool("SELFTEST", false)
+	if err != nil {
+		return nil, err
+	}
+	config.SelfTestUrl = EnvString("SELFTEST_URL", DefaultSelfTestUrl)
+	config.DeleteRequests, err = EnvBool("DELETE_REQUESTS", false)
+	if err != nil {
+		return nil, err
+	}
+	config.LeaveUnauthorizedGroups, err = EnvBool("LEAVE_UNAUTHORIZED_GROUPS", false)
+	if err != nil {
+		return nil, err
+	}
+	config.PublicDir = strings.TrimSpace(os.Getenv("PUBLIC_DIR"))
+	if config.PublicDir != "" {
+		if err := os.MkdirAll(config.PublicDir, 0755); err != nil {
+			return nil, fmt.Errorf("unable to create PUBLIC_DIR %s: %s", config.PublicDir, err)
+		}
+		config.PublicUrl = strings.TrimSpace(os.Getenv("PUBLIC_URL"))
+		if publicUrl, err := url.Parse(config.PublicUrl); err != nil || (publicUrl.Scheme != "http" && publicUrl.Scheme != "https") || publicUrl.Host == "" {
+			return nil, fmt.Errorf("PUBLIC_URL must be the http(s) URL PUBLIC_DIR is served at, not %q", config.PublicUrl)
+		}
+	}
+	config.PublicLinks = strings.ToLower(EnvString("PUBLIC_LINKS", PublicLinksLarge))
+	switch config.PublicLinks {
+	case PublicLinksLarge, PublicLinksAlways, PublicLinksBoth:
+	default:
+		return nil, fmt.Errorf("PUBLIC_LINKS must be %s, %s or %s, not %s", PublicLinksLarge, PublicLinksAlways, PublicLinksBoth, config.PublicLinks)
+	}
+	config.PublicRetention, err = EnvDuration("PUBLIC_RETENTION", DefaultPublicRetention)
+	if err != nil {
+		return nil, err
+	}
+	if config.PublicRetention == 0 {
+		return nil, fmt.Errorf("PUBLIC_RETENTION must be greater than 0")
+	}
+	config.Preset = strings.ToLower(strings.TrimSpace(os.Getenv("PRESET")))
+	switch config.Preset {
+	case PresetDefault, PresetTelegram, PresetArchive:
+	default:
+		return nil, fmt.Errorf("PRESET must be %s or %s, not %s", PresetTelegram, PresetArchive, config.Preset)
+	}
+	if config.Preset == PresetTelegram {
+		config.Faststart = true
+	}
+	if config.Preset == PresetArchive {
+		config.EmbedMetadata = true
+	}
+	if config.PlaybackSafe && config.Preset == PresetArchive {
+		return nil, fmt.Errorf("PLAYBACK_SAFE can not be used with the archive preset, which keeps the original streams")
+	}
+	return config, nil
+}
+
+// Report lists the effective settings (after the defaults and the presets are applied)
+// by the environment variable they are taken from, for the /config command. The
+// secrets are redacted.
+func (c *Config) Report() string {
+	limit := func(n int64) string {
+		if n == 0 {
+			return "any"
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	list := func(items []string) string {
+		if len(items) == 0 {
+			return "none"
+		}
+		return strings.Join(items, ", ")
+	}
+	mirrorHosts := []string{}
+	for host, mirrors := range c.MirrorHosts {
+		for _, mirror := range mirrors {
+			mirrorHosts = append(mirrorHosts, host+"="+mirror)
+		}
+	}
+	sort.Strings(mirrorHosts)
+	lines := []string{
+		"Limits:",
+		fmt.Sprintf("  MAX_UPLOAD_BYTES: %s", FormatBytes(c.MaxUploadBytes)),
+		fmt.Sprintf("  MAX_OUTPUT_FILES: %d", c.MaxOutputFiles),
+		fmt.Sprintf("  MAX_LIST_URLS: %d", c.MaxListUrls),
+		fmt.Sprintf("  MAX_CLIP_DURATION: %s", c.MaxClipDuration),
+		fmt.Sprintf("  DAILY_QUOTA: %s", limit(int64(c.DailyQuota))),
+		fmt.Sprintf("  RATE_LIMIT_PER_USER_MIN: %s", limit(int64(c.RateLimitPerUser))),
+		fmt.Sprintf("  RATE_LIMIT_PER_CHAT_MIN: %s", limit(int64(c.RateLimitPerChat))),
+		fmt.Sprintf("  MAX_USERS: %s", limit(int64(c.MaxUsers))),
+		"Workers and timeouts:",
+		fmt.Sprintf("  DOWNLOAD_WORKERS: %s", limit(int64(c.DownloadWorkers))),
+		fmt.Sprintf("  CUT_WORKERS: %s", limit(int64(c.CutWorkers))),
+		fmt.Sprintf("  UPLOAD_WORKERS: %s", limit(int64(c.UploadWorkers))),
+		fmt.Sprintf("  MAX_REQUEST_DURATION: %s", c.MaxRequestDuration),
+		fmt.Sprintf("  DOWNLOAD_SPACING: %s", c.DownloadSpacing),
+		fmt.Sprintf("  YTDLP_RATE_LIMIT: %s", EnvValue(c.YtdlpRateLimit)),
+		"Format:",
+		fmt.Sprintf("  PRESET: %s", EnvValue(c.Preset)),
+		fmt.Sprintf("  FIT_BY_DEFAULT: %t", c.FitByDefault),
+		fmt.Sprintf("  PRIVATE_MAX_HEIGHT: %d", c.PrivateMaxHeight),
+		fmt.Sprintf("  GROUP_MAX_HEIGHT: %d", c.GroupMaxHeight),
+		fmt.Sprintf("  SOURCE_BY_DEFAULT: %t", c.SourceByDefault),
+		fmt.Sprintf("  FORMAT_FALLBACK: %t", c.FormatFallback),
+		fmt.Sprintf("  FASTSTART: %t", c.Faststart),
+		fmt.Sprintf("  PLAYBACK_SAFE: %t", c.PlaybackSafe),
+		fmt.Sprintf("  EMBED_METADATA: %t", c.EmbedMetadata),
+		fmt.Sprintf("  EMBED_SUBS_LANG: %s", EnvValue(c.EmbedSubsLang)),
+		fmt.Sprintf("  TIMESTAMP_FONT: %s", EnvValue(c.TimestampFont)),
+		"yt-dlp:",
+		fmt.Sprintf("  YTDLP_EXTRA_ARGS: %s", EnvValue(strings.Join(RedactYtdlpArgs(c.YtdlpExtraArgs), " "))),
+		fmt.Sprintf("  ALLOWED_EXTRACTORS: %s", list(c.AllowedExtractors)),
+		fmt.Sprintf("  DENIED_EXTRACTORS: %s", list(c.DeniedExtractors)),
+		fmt.Sprintf("  MIRROR_HOSTS: %s", list(mirrorHosts)),
+		fmt.Sprintf("  YTDLP_STALE_DAYS: %d", int(c.YtdlpStaleAfter.Hours()/24)),
+		"Other:",
+		fmt.Sprintf("  STATE_DIR: %s", EnvValue(c.StateDir)),
+		fmt.Sprintf("  ADMIN_USERS: %d users", len(c.AdminUserIds)),
+		fmt.Sprintf("  DRY_RUN: %t", c.DryRun),
+		fmt.Sprintf("  DELETE_REQUESTS: %t", c.DeleteRequests),
+		fmt.Sprintf("  SURFACE_WARNINGS: %t (%d rules)", c.SurfaceWarnings, len(c.WarningRules)),
+		fmt.Sprintf("  WEBHOOK_URL: %s", EnvValue(RedactUrl(c.WebhookUrl))),
+		fmt.Sprintf("  API_ADDR: %s", EnvValue(c.ApiAddr)),
+		fmt.Sprintf("  API_CHAT: %d", c.ApiChat),
+		fmt.Sprintf("  PUBLIC_DIR: %s", EnvValue(c.PublicDir)),
+		fmt.Sprintf("  PUBLIC_URL: %s", EnvValue(RedactUrl(c.PublicUrl))),
+		fmt.Sprintf("  PUBLIC_LINKS: %s", c.PublicLinks),
+		fmt.Sprintf("  PUBLIC_RETENTION: %s", c.PublicRetention),
+	}
+	return strings.Join(lines, "\n")
+}
+
+// EnvValue returns value, or "not set" when it is empty.
+func EnvValue(value string) string {
+	if value == "" {
+		return "not set"
+	}
+	return value
+}
+
+// SecretYtdlpOptions are the options of yt-dlp whose values are secrets (or point to
+// them, like the cookies file).
+var SecretYtdlpOptions = []string{"--cookies", "--cookies-from-browser", "-u", "--username", "-p", "--password", "-2", "--twofactor", "--video-password", "--ap-username", "--ap-password", "--netrc-location", "--client-certificate", "--client-certificate-key", "--client-certificate-password"}
+
+// RedactYtdlpArgs returns args with the values of the SecretYtdlpOptions replaced by
+// ***, given as --option value or as --option=value.
+func RedactYtdlpArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	copy(redacted, args)
+	for i := 0; i < len(redacted); i++ {
+		for _, option := range SecretYtdlpOptions {
+			if redacted[i] == option && i+1 < len(redacted) {
+				redacted[i+1] = "***"
+				i++
+				break
+			}
+			if strings.HasPrefix(redacted[i], option+"=") {
+				redacted[i] = option + "=***"
+				break
+			}
+		}
+	}
+	return redacted
+}
+
+// RedactUrl returns rawUrl with its credentials and its query (where the tokens usually
+// are) redacted.
+func RedactUrl(rawUrl string) string {
+	parsedUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return "***"
+	}
+	if parsedUrl.User != nil {
+		parsedUrl.User = url.User("redacted")
+	}
+	if parsedUrl.RawQuery != "" {
+		parsedUrl.RawQuery = "redacted"
+	}
+	return parsedUrl.String()
+}
+
+// RedactToken returns the token of the bot with its secret part (after the bot id)
+// replaced by ***.
+func RedactToken(token string) string {
+	botId, _, found := strings.Cut(token, ":")
+	if !found {
+		return "***"
+	}
+	return botId + ":***"
+}
+
+// SubsLangPattern matches the values of EMBED_SUBS_LANG, like es, en-US or en,es.
+var SubsLangPattern = regexp.MustCompile(`^[A-Za-z0-9-]+(,[A-Za-z0-9-]+)*$`)
+
+// RateLimitPattern matches the values of YTDLP_RATE_LIMIT, like 500K, 2M or 1.5M.
+var RateLimitPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[KkMmGg]?$`)
+
+// ShellMetacharacters are rejected in YTDLP_EXTRA_ARGS. The commands are not run
+// through a shell, but an argument with any of these characters is almost surely a
+// mistake (or worse).
+const ShellMetacharacters = "|&;<>()$`\\\"'*?[]#~{}!\n"
+
+// ValidateYtdlpExtraArgs checks the extra arguments for yt-dlp do not contain shell
+// metacharacters.
+func ValidateYtdlpExtraArgs(args []string) error {
+	for _, arg := range args {
+		if i := strings.IndexAny(arg, ShellMetacharacters); i != -1 {
+			return fmt.Errorf("YTDLP_EXTRA_ARGS argument %s contains the forbidden character %q", arg, arg[i])
+		}
+	}
+	return nil
+}
+
+// EnvString returns the environment variable env, if the variable is not set it returns
+// defaultValue.
+func EnvString(env string, defaultValue string) string {
+	content := strings.TrimSpace(os.Getenv(env))
+	if content == "" {
+		return defaultValue
+	}
+	return content
+}
+
+// FormatBytes formats size as megabytes, like 12.3 MB.
+func FormatBytes(size int64) string {
+	return fmt.Sprintf("%.1f MB", float64(size)/1024/1024)
+}
+
+// EnvInt64 parses the environment variable env as an int64, if the variable is not set
+// it returns defaultValue.
+func EnvInt64(env string, defaultValue int64) (int64, error) {
+	content := strings.TrimSpace(os.Getenv(env))
+	if content == "" {
+		return defaultValue, nil
+	}
+	value, err := strconv.ParseInt(content, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse %s (environment variable) into an int64: %s", env, err)
+	}
+	return value, nil
+}
+
+// EnvDuration parses the environment variable env as a time.Duration (like 5s or 1m),
+// if the variable is not set it returns defaultValue.
+func EnvDuration(env string, defaultValue time.Duration) (time.Duration, error) {
+	content := strings.TrimSpace(os.Getenv(env))
+	if content == "" {
+		return defaultValue, nil
+	}
+	value, err := time.ParseDuration(content)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse %s (environment variable) into a duration: %s", env, err)
+	}
+	if value < 0 {
+		return 0, fmt.Errorf("%s (environment variable) can not be negative", env)
+	}
+	return value, nil
+}
+
+// EnvBool parses the environment variable env as a bool, if the variable is not set it
+// returns defaultValue.
+func EnvBool(env string, defaultValue bool) (bool, error) {
+	content := strings.TrimSpace(os.Getenv(env))
+	if content == "" {
+		return defaultValue, nil
+	}
+	value, err := strconv.ParseBool(content)
+	if err != nil {
+		return false, fmt.Errorf("unable to parse %s (environment variable) into a bool: %s", env, err)
+	}
+	return value, nil
+}
+
+// EnvList splits the comma separated environment variable env, empty items are ignored.
+func EnvList(env string) []string {
+	items := []string{}
+	for _, item := range strings.Split(os.Getenv(env), ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestChatMaxHeight(t *testing.T) {
+	fakeYtdlp(t)
+	tests := []struct {
+		name        string
+		privateEnv  string
+		groupEnv    string
+		wantPrivate int
+		wantGroup   int
+	}{
+		{"defaults", "", "", DefaultPrivateMaxHeight, DefaultGroupMaxHeight},
+		{"set", "720", "360", 720, 360},
+		{"default format", "0", "0", 0, 0},
+	}
+	for _, test := range tests {
+		t.Setenv("PRIVATE_MAX_HEIGHT", test.privateEnv)
+		t.Setenv("GROUP_MAX_HEIGHT", test.groupEnv)
+		config, err := LoadConfig()
+		if err != nil {
+			t.Fatalf("%s: LoadConfig returned error: %s", test.name, err)
+		}
+		if got := config.ChatMaxHeight(true); got != test.wantPrivate {
+			t.Errorf("%s: ChatMaxHeight(true) = %d, want %d", test.name, got, test.wantPrivate)
+		}
+		if got := config.ChatMaxHeight(false); got != test.wantGroup {
+			t.Errorf("%s: ChatMaxHeight(false) = %d, want %d", test.name, got, test.wantGroup)
+		}
+	}
+}
+
+func TestLoadConfigRejectsPlaybackSafeArchive(t *testing.T) {
+	fakeYtdlp(t)
+	t.Setenv("PLAYBACK_SAFE", "true")
+	t.Setenv("PRESET", PresetArchive)
+	if _, err := LoadConfig(); err == nil {
+		t.Errorf("LoadConfig returned no error with PLAYBACK_SAFE and the archive preset")
+	}
+	t.Setenv("PRESET", PresetTelegram)
+	if _, err := LoadConfig(); err != nil {
+		t.Errorf("LoadConfig returned error with PLAYBACK_SAFE and the telegram preset: %s", err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Prefixes of the callback data of the confirmation buttons, they are followed by the
+// id of the pending download.
+const (
+	CallbackConfirm = "confirm:"
+	CallbackCancel  = "cancel:"
+	// CallbackSearch picks a result of /search (or a chapter, or a URL of a message with
+	// several URLs).
+	CallbackSearch = "search:"
+)
+
+// PendingDownloadTTL is how long a download waits to be confirmed before it is
+// forgotten.
+const PendingDownloadTTL = 10 * time.Minute
+
+// PendingDownload is a download waiting for the user to confirm it (or to pick it among
+// other downloads).
+type PendingDownload struct {
+	Msg            *tgbotapi.Message
+	DownloadConfig *DownloadConfig
+	CreatedAt      time.Time
+}
+
+// PendingDownloads holds the downloads waiting for confirmation, it is safe for
+// concurrent use.
+type PendingDownloads struct {
+	mu      sync.Mutex
+	nextId  int
+	pending map[string]*PendingDownload
+}
+
+// NewPendingDownloads creates an empty PendingDownloads.
+func NewPendingDownloads() *PendingDownloads {
+	return &PendingDownloads{pending: map[string]*PendingDownload{}}
+}
+
+// Add keeps the download requested in msg waiting and returns its id. Expired downloads
+// are forgotten.
+func (p *PendingDownloads) Add(msg *tgbotapi.Message, downloadConfig *DownloadConfig) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for id, pending := range p.pending {
+		if now.Sub(pending.CreatedAt) > PendingDownloadTTL {
+			delete(p.pending, id)
+		}
+	}
+	p.nextId++
+	id := strconv.Itoa(p.nextId)
+	p.pending[id] = &PendingDownload{
+		Msg:            msg,
+		DownloadConfig: downloadConfig,
+		CreatedAt:      now,
+	}
+	return id
+}
+
+// Take removes and returns the download id, only the user who requested it (userId) can
+// take it.
+func (p *PendingDownloads) Take(id string, userId int64) (*PendingDownload, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pending, ok := p.pending[id]
+	if !ok || pending.Msg.From.ID != userId || time.Since(pending.CreatedAt) > PendingDownloadTTL {
+		return nil, false
+	}
+	delete(p.pending, id)
+	return pending, true
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// UpdateDispatcher hands the updates to a goroutine per chat, so the updates of a chat
+// are handled in order (like the keyboard modes, which apply to the next message) while
+// a slow update (like /meta fetching the metadata) does not hold the updates of the
+// other chats. The goroutine of a chat ends when its updates run out.
+type UpdateDispatcher struct {
+	mu sync.Mutex
+	// pending holds the updates waiting for the goroutine of each chat, a chat is only
+	// in it while its goroutine runs.
+	pending map[int64][]tgbotapi.Update
+	handle  func(tgbotapi.Update)
+}
+
+// NewUpdateDispatcher creates an UpdateDispatcher handling the updates with handle.
+func NewUpdateDispatcher(handle func(tgbotapi.Update)) *UpdateDispatcher {
+	return &UpdateDispatcher{pending: map[int64][]tgbotapi.Update{}, handle: handle}
+}
+
+// Dispatch queues update for the goroutine of its chat, starting it when needed.
+func (d *UpdateDispatcher) Dispatch(update tgbotapi.Update) {
+	chatId := UpdateChatId(update)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	updates, running := d.pending[chatId]
+	d.pending[chatId] = append(updates, update)
+	if !running {
+		go d.run(chatId)
+	}
+}
+
+// run handles the updates of the chat chatId one after the other until there are none.
+func (d *UpdateDispatcher) run(chatId int64) {
+	for {
+		d.mu.Lock()
+		updates := d.pending[chatId]
+		if len(updates) == 0 {
+			delete(d.pending, chatId)
+			d.mu.Unlock()
+			return
+		}
+		update := updates[0]
+		d.pending[chatId] = updates[1:]
+		d.mu.Unlock()
+		d.handle(update)
+	}
+}
+
+// UpdateChatId returns the id of the chat update belongs to, the updates without a chat
+// (like the presses on the buttons of inline messages) are handled as from the chat of
+// their user.
+func UpdateChatId(update tgbotapi.Update) int64 {
+	switch {
+	case update.Message != nil:
+		return update.Message.Chat.ID
+	case update.CallbackQuery != nil && update.CallbackQuery.Message != nil:
+		return update.CallbackQuery.Message.Chat.ID
+	case update.CallbackQuery != nil:
+		return update.CallbackQuery.From.ID
+	case update.MyChatMember != nil:
+		return update.MyChatMember.Chat.ID
+	default:
+		return 0
+	}
+}
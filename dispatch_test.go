@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func chatUpdate(updateId int, chatId int64) tgbotapi.Update {
+	return tgbotapi.Update{UpdateID: updateId, Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: chatId}}}
+}
+
+func TestUpdateDispatcherKeepsTheOrderOfAChat(t *testing.T) {
+	var mu sync.Mutex
+	handled := []int{}
+	var wg sync.WaitGroup
+	dispatcher := NewUpdateDispatcher(func(update tgbotapi.Update) {
+		defer wg.Done()
+		mu.Lock()
+		handled = append(handled, update.UpdateID)
+		mu.Unlock()
+	})
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		dispatcher.Dispatch(chatUpdate(i, 1))
+	}
+	wg.Wait()
+	for i, updateId := range handled {
+		if updateId != i {
+			t.Fatalf("the updates of the chat were handled in the order %v", handled)
+		}
+	}
+}
+
+func TestUpdateDispatcherDoesNotHoldTheOtherChats(t *testing.T) {
+	release := make(chan struct{})
+	handled := make(chan int64, 2)
+	dispatcher := NewUpdateDispatcher(func(update tgbotapi.Update) {
+		if update.Message.Chat.ID == 1 {
+			<-release
+		}
+		handled <- update.Message.Chat.ID
+	})
+	dispatcher.Dispatch(chatUpdate(1, 1))
+	dispatcher.Dispatch(chatUpdate(2, 2))
+	select {
+	case chatId := <-handled:
+		if chatId != 2 {
+			t.Errorf("the update of the chat %d was handled first, want the one of the chat 2", chatId)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the update of the chat 2 waited for the slow update of the chat 1")
+	}
+	close(release)
+	<-handled
+}
@@ -0,0 +1,854 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// FitQualities are the video heights tried (in order) when a video must fit the upload
+// limit.
+var FitQualities = []int{720, 480, 360}
+
+// YtdlpFormat returns the yt-dlp format selector for a video of at most maxHeight
+// pixels (0 means any height) according to preset.
+func YtdlpFormat(preset string, audioOnly bool, maxHeight int) string {
+	height := ""
+	if maxHeight > 0 {
+		height = fmt.Sprintf("[height<=%d]", maxHeight)
+	}
+	switch {
+	case preset == PresetArchive && audioOnly:
+		return "ba/b"
+	case preset == PresetArchive:
+		return fmt.Sprintf("bv*%s+ba/b%s", height, height)
+	case preset == PresetTelegram && !audioOnly:
+		return fmt.Sprintf("bv*%s[vcodec^=avc1]+ba[acodec^=mp4a]/b%s[vcodec^=avc1][ext=mp4]/bv*%s[ext=mp4]+ba[ext=m4a]/b%s[ext=mp4]", height, height, height, height)
+	case maxHeight > 0:
+		return fmt.Sprintf("bv*%s[ext=mp4]+ba[ext=m4a]/b%s[ext=mp4]/b%s", height, height, height)
+	default:
+		return "18"
+	}
+}
+
+// ResumableFilename returns the name (without extension) of the file where the yt-dlp
+// command with the arguments ytdlpArgs (the URL included) saves the video. It is derived
+// from the arguments so the same request is always saved in the same file.
+func ResumableFilename(ytdlpArgs []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(ytdlpArgs, "\x00")))
+	return "gatonaranja." + hex.EncodeToString(sum[:8])
+}
+
+// ResumableLocks are held while yt-dlp writes a resumable file (and until it is claimed
+// by its job), the requests for the same URL and format would write the same file.
+var ResumableLocks = NewPathLocks()
+
+// ClaimDownloadedFile renames the resumable file videoFilename after the job jobId, so
+// the next request for the same URL and format downloads its own file instead of
+// sharing (and removing) this one.
+func ClaimDownloadedFile(videoFilename, jobId string) (string, error) {
+	claimedFilename, err := DerivedTempPath(videoFilename, "-"+jobId, "")
+	if err != nil {
+		return "", fmt.Errorf("unable to claim the downloaded file %s: %s", videoFilename, err)
+	}
+	if err := os.Rename(videoFilename, claimedFilename); err != nil {
+		return "", fmt.Errorf("unable to claim the downloaded file %s: %s", videoFilename, err)
+	}
+	return claimedFilename, nil
+}
+
+// YtdlpAudioLanguageFormat returns the yt-dlp format selector for a video of at most
+// maxHeight pixels (0 means any height) with the audio track in language.
+func YtdlpAudioLanguageFormat(audioOnly bool, maxHeight int, language string) string {
+	// dubbed tracks are usually tagged with a region too, like es-US
+	audio := fmt.Sprintf("ba[language^=%s]", language)
+	if audioOnly {
+		return audio
+	}
+	height := ""
+	if maxHeight > 0 {
+		height = fmt.Sprintf("[height<=%d]", maxHeight)
+	}
+	return fmt.Sprintf("bv*%s[ext=mp4]+%s/bv*%s+%s", height, audio, height, audio)
+}
+
+// BuildYtdlpCmd returns the path of yt-dlp, the name of the file where the video will be
+// saved and the arguments to download the video as asked in downloadConfig.
+func BuildYtdlpCmd(config *Config, downloadConfig *DownloadConfig) (string, string, []string, error) {
+	var (
+		videoUrl  = downloadConfig.VideoUrl.String()
+		audioOnly = downloadConfig.AudioOnly
+		maxHeight = downloadConfig.MaxHeight
+	)
+	ytdlpPath, err := exec.LookPath("yt-dlp")
+	if err != nil {
+		return "", "", nil, fmt.Errorf("yt-dlp is not installed: %s", err)
+	}
+	ytdlpArgs := []string{}
+	if audioOnly {
+		audioFormat := "mp3"
+		if len(downloadConfig.AudioFormats) != 0 {
+			// the audio is extracted as is, it is transcoded to each format afterwards
+			audioFormat = "best"
+		}
+		ytdlpArgs = append(ytdlpArgs, "-x", "--audio-format", audioFormat)
+		// the formats get the layout when transcoded, the best audio is not re-encoded
+		if layoutArgs := downloadConfig.AudioLayoutArgs(); len(layoutArgs) != 0 && len(downloadConfig.AudioFormats) == 0 {
+			ytdlpArgs = append(ytdlpArgs, "--postprocessor-args", "ExtractAudio:"+strings.Join(layoutArgs, " "))
+		}
+	}
+	if downloadConfig.RecordDuration > 0 {
+		// live streams rarely offer the default format, take the best one and record from
+		// the live edge (not from the start) until ffmpeg reaches the duration
+		ytdlpArgs = append(
+			ytdlpArgs,
+			"-f", "b/bv*+ba",
+			"--no-live-from-start",
+			"--downloader", "ffmpeg",
+			"--downloader-args", fmt.Sprintf("ffmpeg_i:-t %d", int(downloadConfig.RecordDuration.Seconds())),
+		)
+	} else if downloadConfig.AnyFormat {
+		ytdlpArgs = append(ytdlpArgs, "-f", "b/bv*+ba")
+	} else if downloadConfig.AudioLanguage != "" {
+		ytdlpArgs = append(ytdlpArgs, "-f", YtdlpAudioLanguageFormat(audioOnly, maxHeight, downloadConfig.AudioLanguage))
+	} else if len(downloadConfig.AudioFormats) != 0 {
+		ytdlpArgs = append(ytdlpArgs, "-f", "ba/b")
+	} else {
+		ytdlpArgs = append(ytdlpArgs, "-f", YtdlpFormat(config.Preset, audioOnly, maxHeight))
+	}
+	mergeFormat := "mp4"
+	if config.Preset == PresetArchive {
+		// mkv can hold the original streams whatever their codecs are
+		mergeFormat = "mkv"
+	}
+	if (maxHeight > 0 || config.Preset != PresetDefault || downloadConfig.AudioLanguage != "") && !audioOnly {
+		ytdlpArgs = append(ytdlpArgs, "--merge-output-format", mergeFormat)
+	}
+	if config.EmbedSubsLang != "" && !audioOnly {
+		// videos without subtitles in the language are downloaded anyway, yt-dlp only
+		// warns about them
+		ytdlpArgs = append(ytdlpArgs, "--embed-subs", "--sub-langs", config.EmbedSubsLang)
+	}
+	if config.YtdlpRateLimit != "" {
+		ytdlpArgs = append(ytdlpArgs, "--limit-rate", config.YtdlpRateLimit)
+	}
+	if config.EmbedMetadata {
+		// the upload date ends up in the date tag, media libraries sort by it
+		ytdlpArgs = append(ytdlpArgs, "--embed-metadata")
+	}
+	if downloadConfig.SampleSeconds > 0 {
+		ytdlpArgs = append(ytdlpArgs, "--download-sections", fmt.Sprintf("*0-%d", downloadConfig.SampleSeconds))
+	}
+	ytdlpArgs = append(ytdlpArgs, config.YtdlpExtraArgs...)
+	ytdlpArgs = append(ytdlpArgs, videoUrl)
+	outputFilenameExt := "." + mergeFormat
+	if audioOnly {
+		outputFilenameExt = ".mp3"
+	}
+	var outputFilename string
+	if downloadConfig.RecordDuration > 0 {
+		// a recording can not be resumed, the stream has moved on
+		f, err := os.CreateTemp(TempDir(), "gatonaranja.*"+outputFilenameExt)
+		if err != nil {
+			return "", "", nil, fmt.Errorf("unable to create temp file to save the downloaded video: %s", err)
+		}
+		outputFilename = f.Name()
+		f.Close()
+		err = os.Remove(outputFilename)
+		if err != nil {
+			return "", "", nil, fmt.Errorf("unable to remove temp file to save the downloaded video: %s", err)
+		}
+	} else {
+		// the same request always writes to the same file, so yt-dlp can resume the .part
+		// file an interrupted download (or a restart of the bot) left behind
+		outputFilename, err = SafeTempPath(ResumableFilename(ytdlpArgs) + outputFilenameExt)
+		if err != nil {
+			return "", "", nil, fmt.Errorf("unable to build the name of the file to save the downloaded video: %s", err)
+		}
+		ytdlpArgs = append(ytdlpArgs, "--continue")
+	}
+	ytdlpArgs = append(ytdlpArgs, "-o", outputFilename)
+	return ytdlpPath, outputFilename, ytdlpArgs, nil
+}
+
+// MaxStderrTail is how many bytes of the end of the stderr of a failed command are kept
+// in its error.
+const MaxStderrTail = 500
+
+// StderrTail returns the end of the stderr of a command, where the reason of the
+// failure usually is.
+func StderrTail(stderr string) string {
+	stderr = strings.TrimSpace(stderr)
+	if len(stderr) > MaxStderrTail {
+		// the cut may split a multibyte character
+		stderr = "..." + strings.ToValidUTF8(stderr[len(stderr)-MaxStderrTail:], "")
+	}
+	return stderr
+}
+
+// FormatUnavailablePattern matches the errors of yt-dlp when the video does not have the
+// requested format (unlike the network errors, retrying with the same format is futile).
+var FormatUnavailablePattern = regexp.MustCompile(`(?i)requested format (is )?not available`)
+
+// FetchVideo runs yt-dlp to download the video and returns the name of the downloaded
+// file, without any post-processing. When the requested format is not available it is
+// retried once with the best format (with FORMAT_FALLBACK), and when the download fails
+// otherwise it is retried from the mirrors of the host of the video (MIRROR_HOSTS) in
+// order, the error of the first try is returned when every mirror fails too.
+func FetchVideo(ctx context.Context, config *Config, downloadConfig *DownloadConfig) (string, error) {
+	videoFilename, err := fetchVideo(ctx, config, downloadConfig)
+	if err == nil {
+		return videoFilename, nil
+	}
+	if config.FormatFallback && !downloadConfig.AnyFormat && FormatUnavailablePattern.MatchString(err.Error()) {
+		log.Printf("[job=%s] Retrying the download with the best format: %s", downloadConfig.JobId, err)
+		anyConfig := *downloadConfig
+		anyConfig.AnyFormat = true
+		videoFilename, err := fetchVideo(ctx, config, &anyConfig)
+		if err != nil {
+			return "", err
+		}
+		if downloadConfig.OnFormatFallback != nil {
+			downloadConfig.OnFormatFallback()
+		}
+		return videoFilename, nil
+	}
+	for _, mirrorUrl := range MirrorUrls(config, downloadConfig.VideoUrl) {
+		if ctx.Err() != nil {
+			break
+		}
+		log.Printf("[job=%s] Retrying the download from the mirror %s: %s", downloadConfig.JobId, mirrorUrl.Host, err)
+		mirrorConfig := *downloadConfig
+		mirrorConfig.VideoUrl = mirrorUrl
+		videoFilename, mirrorErr := fetchVideo(ctx, config, &mirrorConfig)
+		if mirrorErr == nil {
+			return videoFilename, nil
+		}
+		log.Printf("[job=%s] Unable to download from the mirror %s: %s", downloadConfig.JobId, mirrorUrl.Host, mirrorErr)
+	}
+	return "", err
+}
+
+// fetchVideo is FetchVideo without the mirrors.
+func fetchVideo(ctx context.Context, config *Config, downloadConfig *DownloadConfig) (string, error) {
+	videoUrl := downloadConfig.VideoUrl.String()
+	ytdlpPath, videoFilename, ytdlpArgs, err := BuildYtdlpCmd(config, downloadConfig)
+	if err != nil {
+		return "", fmt.Errorf("unable to download video %s: %s", videoUrl, err)
+	}
+	if downloadConfig.RecordDuration > 0 {
+		// ffmpeg stops by itself at the duration, the deadline is a hard cap in case the
+		// stream hangs
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, downloadConfig.RecordDuration+RecordGracePeriod)
+		defer cancel()
+	} else {
+		unlock, err := ResumableLocks.Lock(ctx, videoFilename)
+		if err != nil {
+			return "", fmt.Errorf("unable to download video %s: %s", videoUrl, err)
+		}
+		defer unlock()
+	}
+	if err := RunYtdlp(ctx, config, downloadConfig, ytdlpPath, ytdlpArgs); err != nil {
+		return "", err
+	}
+	videoFilename, err = ProducedFilename(videoFilename)
+	if err != nil {
+		return "", fmt.Errorf("unable to download video %s: %s", videoUrl, err)
+	}
+	if downloadConfig.RecordDuration > 0 {
+		return videoFilename, nil
+	}
+	return ClaimDownloadedFile(videoFilename, downloadConfig.JobId)
+}
+
+// FetchVideos is like FetchVideo but for the posts with several videos (like the
+// Twitter/X ones), it returns the names of every downloaded file in order.
+func FetchVideos(ctx context.Context, config *Config, downloadConfig *DownloadConfig) ([]string, error) {
+	videoUrl := downloadConfig.VideoUrl.String()
+	ytdlpPath, videoFilename, ytdlpArgs, err := BuildYtdlpCmd(config, downloadConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to download video %s: %s", videoUrl, err)
+	}
+	// yt-dlp would write every video to the same file, number them instead
+	videoFilenameExt := filepath.Ext(videoFilename)
+	ytdlpArgs[len(ytdlpArgs)-1] = strings.TrimSuffix(videoFilename, videoFilenameExt) + "-%(autonumber)s" + videoFilenameExt
+	unlock, err := ResumableLocks.Lock(ctx, videoFilename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to download video %s: %s", videoUrl, err)
+	}
+	defer unlock()
+	if err := RunYtdlp(ctx, config, downloadConfig, ytdlpPath, ytdlpArgs); err != nil {
+		return nil, err
+	}
+	videoFilenames, err := ProducedFilenames(strings.TrimSuffix(videoFilename, videoFilenameExt) + "-")
+	if err != nil {
+		return nil, fmt.Errorf("unable to download video %s: %s", videoUrl, err)
+	}
+	for i, videoFilename := range videoFilenames {
+		videoFilenames[i], err = ClaimDownloadedFile(videoFilename, downloadConfig.JobId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return videoFilenames, nil
+}
+
+// RunYtdlp runs yt-dlp with the arguments ytdlpArgs (built by BuildYtdlpCmd) reporting
+// the progress to the OnProgress of downloadConfig and its stderr to the OnStderr of
+// downloadConfig (if any).
+func RunYtdlp(ctx context.Context, config *Config, downloadConfig *DownloadConfig, ytdlpPath string, ytdlpArgs []string) error {
+	videoUrl := downloadConfig.VideoUrl.String()
+	if downloadConfig.OnProgress != nil {
+		// the progress options are left out of BuildYtdlpCmd, they must not change the
+		// name of the resumable file
+		ytdlpArgs = append(ytdlpArgs, "--newline", "--progress-template", ProgressTemplate)
+	}
+	downloadCmd := exec.CommandContext(ctx, ytdlpPath, ytdlpArgs...)
+	var stderr bytes.Buffer
+	downloadCmd.Stderr = &stderr
+	var stdout io.ReadCloser
+	if downloadConfig.OnProgress != nil {
+		var err error
+		stdout, err = downloadCmd.StdoutPipe()
+		if err != nil {
+			return fmt.Errorf("unable to download video %s: %s", videoUrl, err)
+		}
+	}
+	var runErr error
+	err := DownloadStage.Run(ctx, downloadConfig.Priority, downloadConfig.OnQueued, func() {
+		log.Printf("[job=%s] Running %s", downloadConfig.JobId, downloadCmd)
+		if err := StartSpacedYtdlp(config, downloadCmd); err != nil {
+			runErr = fmt.Errorf("unable to download video %s: %s", videoUrl, err)
+			return
+		}
+		if stdout != nil {
+			ReadProgress(stdout, downloadConfig.OnProgress)
+		}
+		if err := downloadCmd.Wait(); err != nil {
+			runErr = fmt.Errorf("unable to download video %s: %s: %s", videoUrl, err, StderrTail(stderr.String()))
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("unable to download video %s: %s", videoUrl, err)
+	}
+	if runErr != nil {
+		return runErr
+	}
+	if downloadConfig.OnStderr != nil {
+		downloadConfig.OnStderr(stderr.String())
+	}
+	return nil
+}
+
+// ProducedFilename returns the name of the file yt-dlp actually wrote when asked to write
+// filename. yt-dlp may change the extension (like when the audio conversion falls back
+// to another format), in that case the file with the same name and another extension is
+// returned.
+func ProducedFilename(filename string) (string, error) {
+	if _, err := os.Stat(filename); err == nil {
+		return filename, nil
+	}
+	dir := filepath.Dir(filename)
+	prefix := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename)) + "."
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("unable to find the downloaded file %s: %s", filename, err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		// the leftovers of yt-dlp (like name.mp4.part or name.es.vtt) are not the
+		// downloaded file
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || strings.Contains(strings.TrimPrefix(name, prefix), ".") {
+			continue
+		}
+		return filepath.Join(dir, name), nil
+	}
+	return "", fmt.Errorf("unable to find the downloaded file %s", filename)
+}
+
+// ProducedFilenames returns the names (sorted) of the files yt-dlp wrote when asked to
+// number them after prefix, like prefix00001.mp4 and prefix00002.mp4.
+func ProducedFilenames(prefix string) ([]string, error) {
+	dir := filepath.Dir(prefix)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find the downloaded files %s*: %s", prefix, err)
+	}
+	filenames := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		// the leftovers of yt-dlp (like name.mp4.part or name.es.vtt) are not downloaded
+		// files
+		if entry.IsDir() || !strings.HasPrefix(name, filepath.Base(prefix)) || strings.Count(name[len(filepath.Base(prefix)):], ".") != 1 {
+			continue
+		}
+		filenames = append(filenames, filepath.Join(dir, name))
+	}
+	if len(filenames) == 0 {
+		return nil, fmt.Errorf("unable to find the downloaded files %s*", prefix)
+	}
+	// os.ReadDir sorts by name and the numbers are zero padded
+	return filenames, nil
+}
+
+// ProcessVideo cuts, filters, mutes and remuxes the downloaded file videoFilename (on a
+// worker of the cut stage) as asked in downloadConfig and returns the name of the
+// resulting file. videoFilename is never removed (it is returned as is when there is
+// nothing to do), but the intermediate files are.
+func ProcessVideo(ctx context.Context, config *Config, downloadConfig *DownloadConfig, videoFilename string) (string, error) {
+	var processedVideoFilename string
+	var processErr error
+	err := CutStage.Run(ctx, downloadConfig.Priority, nil, func() {
+		processedVideoFilename, processErr = processVideo(ctx, config, downloadConfig, videoFilename)
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to download video %s: %s", downloadConfig.VideoUrl, err)
+	}
+	return processedVideoFilename, processErr
+}
+
+// processVideo is ProcessVideo out of the cut stage.
+func processVideo(ctx context.Context, config *Config, downloadConfig *DownloadConfig, videoFilename string) (string, error) {
+	videoUrl := downloadConfig.VideoUrl.String()
+	originalVideoFilename := videoFilename
+	if downloadConfig.NeedsDuration() {
+		duration, err := ProbeDuration(ctx, videoFilename)
+		if err != nil {
+			return "", fmt.Errorf("unable to download video %s: %s", videoUrl, err)
+		}
+		downloadConfig.Duration = duration
+		if downloadConfig.EndPercent != 0 {
+			if err := downloadConfig.ApplyPercentSpan(); err != nil {
+				return "", err
+			}
+			if err := CheckClipDuration(config, downloadConfig); err != nil {
+				return "", err
+			}
+		}
+	}
+	// removeIntermediate removes the file the last step worked on, unless it is the
+	// original one
+	removeIntermediate := func(filename string) {
+		if filename != originalVideoFilename {
+			os.Remove(filename)
+		}
+	}
+	// cutConfig is the request with the spots actually cut
+	cutConfig := downloadConfig
+	if downloadConfig.HasSpan() {
+		if downloadConfig.Scene {
+			// the snapped spots only apply to this cut, the request keeps the asked ones
+			snappedConfig := *downloadConfig
+			SnapSpanToScenes(ctx, &snappedConfig, videoFilename)
+			cutConfig = &snappedConfig
+		}
+		cutVideoFilename, err := CutVideo(ctx, config, cutConfig, videoFilename)
+		removeIntermediate(videoFilename)
+		if err != nil {
+			return "", fmt.Errorf("unable to download video %s: %s", videoUrl, err)
+		}
+		videoFilename = cutVideoFilename
+	} else if downloadConfig.CutsBookends() {
+		// the filters (if any) are applied while cutting
+		bookendsVideoFilename, err := CutBookends(ctx, config, downloadConfig, videoFilename)
+		removeIntermediate(videoFilename)
+		if err != nil {
+			return "", fmt.Errorf("unable to download video %s: %s", videoUrl, err)
+		}
+		videoFilename = bookendsVideoFilename
+	} else if videoFilters := downloadConfig.VideoFilters(); len(videoFilters) != 0 {
+		filteredVideoFilename, err := FilterVideo(ctx, config, videoFilename, videoFilters)
+		removeIntermediate(videoFilename)
+		if err != nil {
+			return "", fmt.Errorf("unable to download video %s: %s", videoUrl, err)
+		}
+		videoFilename = filteredVideoFilename
+	}
+	if downloadConfig.Crop != "" {
+		croppedVideoFilename, err := CropVideo(ctx, config, downloadConfig, videoFilename)
+		// the videos that already have the aspect ratio are kept as they are
+		if croppedVideoFilename != videoFilename {
+			removeIntermediate(videoFilename)
+		}
+		if err != nil {
+			return "", fmt.Errorf("unable to download video %s: %s", videoUrl, err)
+		}
+		videoFilename = croppedVideoFilename
+	}
+	if downloadConfig.Timestamp != "" {
+		// the time is burned before changing the speed, so it runs at the speed too
+		timestampVideoFilename, err := BurnTimestamp(ctx, config, cutConfig, videoFilename)
+		removeIntermediate(videoFilename)
+		if err != nil {
+			return "", fmt.Errorf("unable to download video %s: %s", videoUrl, err)
+		}
+		videoFilename = timestampVideoFilename
+	}
+	if downloadConfig.Mute {
+		mutedVideoFilename, err := RemoveAudio(ctx, videoFilename)
+		removeIntermediate(videoFilename)
+		if err != nil {
+			return "", fmt.Errorf("unable to download video %s: %s", videoUrl, err)
+		}
+		videoFilename = mutedVideoFilename
+	}
+	if downloadConfig.Speed != 0 {
+		// the speed is changed before dubbing, the dub plays as recorded
+		spedVideoFilename, err := ChangeSpeed(ctx, config, downloadConfig, videoFilename)
+		removeIntermediate(videoFilename)
+		if err != nil {
+			return "", fmt.Errorf("unable to download video %s: %s", videoUrl, err)
+		}
+		videoFilename = spedVideoFilename
+	}
+	if downloadConfig.LoopSeconds != 0 {
+		loopedVideoFilename, err := LoopVideo(ctx, config, downloadConfig, videoFilename)
+		// the videos that already last long enough are kept as they are
+		if loopedVideoFilename != videoFilename {
+			removeIntermediate(videoFilename)
+		}
+		if err != nil {
+			return "", fmt.Errorf("unable to download video %s: %s", videoUrl, err)
+		}
+		videoFilename = loopedVideoFilename
+	}
+	if downloadConfig.DubAudioFilename != "" {
+		dubbedVideoFilename, err := ReplaceAudio(ctx, config, videoFilename, downloadConfig.DubAudioFilename)
+		removeIntermediate(videoFilename)
+		if err != nil {
+			return "", fmt.Errorf("unable to download video %s: %s", videoUrl, err)
+		}
+		videoFilename = dubbedVideoFilename
+	}
+	if downloadConfig.Bumper {
+		bumperVideoFilename, err := AddBumpers(ctx, config, downloadConfig, videoFilename)
+		removeIntermediate(videoFilename)
+		if err != nil {
+			return "", fmt.Errorf("unable to download video %s: %s", videoUrl, err)
+		}
+		videoFilename = bumperVideoFilename
+	}
+	if downloadConfig.TargetBytes != 0 {
+		duration := downloadConfig.Duration
+		if downloadConfig.HasSpan() {
+			duration = downloadConfig.EndSecond - downloadConfig.StartSecond
+		} else if downloadConfig.CutsBookends() {
+			duration = float64(2 * downloadConfig.Bookends)
+		}
+		duration = downloadConfig.PlayedSeconds(duration)
+		if downloadConfig.LoopSeconds != 0 {
+			duration = float64(downloadConfig.LoopSeconds)
+		}
+		compressedVideoFilename, err := CompressVideo(ctx, config, videoFilename, duration, downloadConfig.TargetBytes, downloadConfig.Mute)
+		removeIntermediate(videoFilename)
+		if err != nil {
+			return "", fmt.Errorf("unable to download video %s: %s", videoUrl, err)
+		}
+		videoFilename = compressedVideoFilename
+	}
+	// cut, filtered, cropped, sped, looped, dubbed, bumpered and compressed videos
+	// already got faststart from ffmpeg
+	if config.Faststart && !downloadConfig.HasSpan() && !downloadConfig.CutsBookends() && len(downloadConfig.VideoFilters()) == 0 && downloadConfig.Crop == "" && downloadConfig.Timestamp == "" && downloadConfig.Speed == 0 && downloadConfig.LoopSeconds == 0 && downloadConfig.TargetBytes == 0 && downloadConfig.DubAudioFilename == "" && !downloadConfig.Bumper && !downloadConfig.AudioOnly && filepath.Ext(videoFilename) == ".mp4" {
+		faststartVideoFilename, err := RemuxFaststart(ctx, videoFilename)
+		removeIntermediate(videoFilename)
+		if err != nil {
+			return "", fmt.Errorf("unable to download video %s: %s", videoUrl, err)
+		}
+		videoFilename = faststartVideoFilename
+	}
+	// the GIFs and the contact sheets are made from the video, it is never sent
+	if config.PlaybackSafe && !downloadConfig.AudioOnly && downloadConfig.GifFps == 0 && downloadConfig.Thumbnails == 0 {
+		videoCodec, audioCodec, err := ProbeCodecs(ctx, videoFilename)
+		if err != nil {
+			log.Printf("[job=%s] Sending the video as is: %s", downloadConfig.JobId, err)
+		} else if !IsPlaybackSafe(filepath.Ext(videoFilename), videoCodec, audioCodec) {
+			log.Printf("[job=%s] Transcoding the %s video for playback (video=%s audio=%s)", downloadConfig.JobId, filepath.Ext(videoFilename), videoCodec, audioCodec)
+			playbackVideoFilename, err := MakePlaybackSafe(ctx, config, videoFilename, videoCodec, audioCodec)
+			removeIntermediate(videoFilename)
+			if err != nil {
+				return "", fmt.Errorf("unable to download video %s: %s", videoUrl, err)
+			}
+			videoFilename = playbackVideoFilename
+		}
+	}
+	return videoFilename, nil
+}
+
+func DownloadVideo(ctx context.Context, config *Config, downloadConfig *DownloadConfig) (string, error) {
+	videoFilename, err := FetchVideo(ctx, config, downloadConfig)
+	if err != nil && downloadConfig.SampleSeconds != 0 && ctx.Err() == nil {
+		// not every site supports ranged downloads, the whole video is downloaded and cut
+		log.Printf("[job=%s] Downloading the whole video to cut the sample: %s", downloadConfig.JobId, err)
+		fullConfig := *downloadConfig
+		fullConfig.SampleSeconds = 0
+		videoFilename, err = FetchVideo(ctx, config, &fullConfig)
+	}
+	if err != nil {
+		return "", err
+	}
+	processedVideoFilename, err := ProcessVideo(ctx, config, downloadConfig, videoFilename)
+	if processedVideoFilename != videoFilename {
+		os.Remove(videoFilename)
+	}
+	if err != nil {
+		return "", err
+	}
+	return processedVideoFilename, nil
+}
+
+// DownloadVideos is like DownloadVideo but for the posts with several videos (like the
+// Twitter/X ones), every video is processed the same way. It returns the names of the
+// processed files in order.
+func DownloadVideos(ctx context.Context, config *Config, downloadConfig *DownloadConfig) ([]string, error) {
+	videoFilenames, err := FetchVideos(ctx, config, downloadConfig)
+	if err != nil {
+		return nil, err
+	}
+	return ProcessVideos(ctx, config, downloadConfig, videoFilenames)
+}
+
+// ProcessVideos processes every video of videoFilenames (the videos of a post) as asked
+// in downloadConfig, see ProcessVideo. It returns the names of the processed files in
+// order, the downloaded files are removed.
+func ProcessVideos(ctx context.Context, config *Config, downloadConfig *DownloadConfig, videoFilenames []string) ([]string, error) {
+	processedVideoFilenames := []string{}
+	for i, videoFilename := range videoFilenames {
+		// ProcessVideo fills in the duration (and the spots of the pct option) of the
+		// video it processes, every video has its own
+		videoConfig := *downloadConfig
+		processedVideoFilename, err := ProcessVideo(ctx, config, &videoConfig, videoFilename)
+		if processedVideoFilename != videoFilename {
+			os.Remove(videoFilename)
+		}
+		if err != nil {
+			for _, filename := range append(processedVideoFilenames, videoFilenames[i+1:]...) {
+				os.Remove(filename)
+			}
+			return nil, err
+		}
+		processedVideoFilenames = append(processedVideoFilenames, processedVideoFilename)
+	}
+	return processedVideoFilenames, nil
+}
+
+// DownloadVideoAndCut downloads the video once and returns both the name of the full
+// video and the name of the cut video.
+func DownloadVideoAndCut(ctx context.Context, config *Config, downloadConfig *DownloadConfig) (string, string, error) {
+	videoFilename, err := FetchVideo(ctx, config, downloadConfig)
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(videoFilename)
+	cutVideoFilename, err := ProcessVideo(ctx, config, downloadConfig, videoFilename)
+	if err != nil {
+		return "", "", err
+	}
+	fullConfig := *downloadConfig
+	fullConfig.StartSecond = InvalidVideoSecond
+	fullConfig.EndSecond = InvalidVideoSecond
+	fullConfig.StartPercent = 0
+	fullConfig.EndPercent = 0
+	fullConfig.Bookends = 0
+	fullVideoFilename, err := ProcessVideo(ctx, config, &fullConfig, videoFilename)
+	if err != nil {
+		os.Remove(cutVideoFilename)
+		return "", "", err
+	}
+	if fullVideoFilename == videoFilename {
+		// keep the full video, the deferred removal is for the intermediate file only
+		keptVideoFilename, err := DerivedTempPath(videoFilename, "-full", "")
+		if err != nil {
+			os.Remove(cutVideoFilename)
+			return "", "", fmt.Errorf("unable to keep the full video: %s", err)
+		}
+		if err := os.Rename(videoFilename, keptVideoFilename); err != nil {
+			os.Remove(cutVideoFilename)
+			return "", "", fmt.Errorf("unable to keep the full video: %s", err)
+		}
+		fullVideoFilename = keptVideoFilename
+	}
+	return fullVideoFilename, cutVideoFilename, nil
+}
+
+// DownloadContactSheet downloads the video (cutting it if asked) and returns the name of
+// a contact sheet of it.
+func DownloadContactSheet(ctx context.Context, config *Config, downloadConfig *DownloadConfig) (string, error) {
+	videoFilename, err := DownloadVideo(ctx, config, downloadConfig)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(videoFilename)
+	duration := downloadConfig.Duration
+	if downloadConfig.HasSpan() {
+		duration = downloadConfig.EndSecond - downloadConfig.StartSecond
+	} else if downloadConfig.CutsBookends() {
+		duration = float64(2 * downloadConfig.Bookends)
+	}
+	return ContactSheet(ctx, videoFilename, downloadConfig.Thumbnails, duration)
+}
+
+// DownloadAudioFormats downloads the best audio of the video of downloadConfig once
+// and transcodes it to each of its AudioFormats, it returns the names of the files in
+// the same order.
+func DownloadAudioFormats(ctx context.Context, config *Config, downloadConfig *DownloadConfig) ([]string, error) {
+	audioFilename, err := DownloadVideo(ctx, config, downloadConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(audioFilename)
+	audioFilenames := []string{}
+	for _, format := range downloadConfig.AudioFormats {
+		transcodedFilename, err := TranscodeAudio(ctx, audioFilename, format, downloadConfig.AudioLayoutArgs())
+		if err != nil {
+			for _, audioFilename := range audioFilenames {
+				os.Remove(audioFilename)
+			}
+			return nil, fmt.Errorf("unable to download video %s: %s", downloadConfig.VideoUrl, err)
+		}
+		audioFilenames = append(audioFilenames, transcodedFilename)
+	}
+	return audioFilenames, nil
+}
+
+// DownloadQualities downloads the video of downloadConfig once per each of its
+// Qualities (at most maxFiles of them, one after the other), it returns the names of the
+// files in the same order and how many qualities were left out.
+func DownloadQualities(ctx context.Context, config *Config, downloadConfig *DownloadConfig, maxFiles int) ([]string, int, error) {
+	qualities := downloadConfig.Qualities
+	omitted := 0
+	if len(qualities) > maxFiles {
+		qualities, omitted = qualities[:maxFiles], len(qualities)-maxFiles
+	}
+	videoFilenames := []string{}
+	for _, quality := range qualities {
+		qualityConfig := *downloadConfig
+		qualityConfig.MaxHeight = quality
+		videoFilename, err := DownloadVideo(ctx, config, &qualityConfig)
+		if err != nil {
+			for _, videoFilename := range videoFilenames {
+				os.Remove(videoFilename)
+			}
+			return nil, 0, err
+		}
+		videoFilenames = append(videoFilenames, videoFilename)
+	}
+	return videoFilenames, omitted, nil
+}
+
+// DownloadGif downloads the cut of the video of downloadConfig and converts it to a GIF,
+// it returns the name of the GIF.
+func DownloadGif(ctx context.Context, config *Config, downloadConfig *DownloadConfig) (string, error) {
+	videoFilename, err := DownloadVideo(ctx, config, downloadConfig)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(videoFilename)
+	duration := downloadConfig.EndSecond - downloadConfig.StartSecond
+	if downloadConfig.CutsBookends() {
+		duration = float64(2 * downloadConfig.Bookends)
+	}
+	duration = downloadConfig.PlayedSeconds(duration)
+	if duration > MaxGifSeconds {
+		return "", fmt.Errorf("unable to convert to GIF: the cut lasts %s seconds, the longest GIF lasts %d seconds", FormatSeconds(duration), MaxGifSeconds)
+	}
+	return ConvertToGif(ctx, videoFilename, downloadConfig.GifFps, downloadConfig.GifWidth)
+}
+
+const (
+	// PreviewSeconds is how long the clip sent by the preview word lasts.
+	PreviewSeconds = 5
+	// PreviewHeight is the height (in pixels) of the clip sent by the preview word.
+	PreviewHeight = 240
+)
+
+// DownloadPreview downloads only the first PreviewSeconds of the video (of the cut, if
+// any) in a low quality and returns the name of a muted clip of them scaled to
+// PreviewHeight. It is quick, so it can be sent while the full video downloads.
+func DownloadPreview(ctx context.Context, config *Config, downloadConfig *DownloadConfig) (string, error) {
+	videoUrl := downloadConfig.VideoUrl.String()
+	ytdlpPath, err := exec.LookPath("yt-dlp")
+	if err != nil {
+		return "", fmt.Errorf("unable to download the preview of %s: yt-dlp is not installed: %s", videoUrl, err)
+	}
+	f, err := os.CreateTemp(TempDir(), "gatonaranja.*-preview.mp4")
+	if err != nil {
+		return "", fmt.Errorf("unable to download the preview of %s: %s", videoUrl, err)
+	}
+	sourceFilename := f.Name()
+	f.Close()
+	defer os.Remove(sourceFilename)
+	startSecond := 0.0
+	if downloadConfig.HasSpan() {
+		startSecond = downloadConfig.StartSecond
+	}
+	ytdlpArgs := []string{
+		// the preview has no audio, the smallest video that still looks fine is enough
+		"-f", fmt.Sprintf("bv*[height<=%d]/wv*/w", 2*PreviewHeight),
+		"--download-sections", fmt.Sprintf("*%s-%s", FormatSeconds(startSecond), FormatSeconds(startSecond+PreviewSeconds)),
+		"--force-overwrites",
+	}
+	ytdlpArgs = append(ytdlpArgs, config.YtdlpExtraArgs...)
+	ytdlpArgs = append(ytdlpArgs, videoUrl, "-o", sourceFilename)
+	var stderr bytes.Buffer
+	downloadCmd := exec.CommandContext(ctx, ytdlpPath, ytdlpArgs...)
+	downloadCmd.Stderr = &stderr
+	log.Printf("[job=%s] Running %s", downloadConfig.JobId, downloadCmd)
+	if err := RunSpacedYtdlp(config, downloadCmd); err != nil {
+		return "", fmt.Errorf("unable to download the preview of %s: %s: %s", videoUrl, err, StderrTail(stderr.String()))
+	}
+	return MakePreview(ctx, sourceFilename)
+}
+
+// FitQualitiesUpTo returns the FitQualities of at most maxHeight pixels (all of them
+// when it is 0), starting with maxHeight itself when it is lower than all of them.
+func FitQualitiesUpTo(maxHeight int) []int {
+	if maxHeight == 0 {
+		return FitQualities
+	}
+	qualities := []int{}
+	for _, quality := range FitQualities {
+		if quality <= maxHeight {
+			qualities = append(qualities, quality)
+		}
+	}
+	if len(qualities) == 0 || (maxHeight < FitQualities[0] && qualities[0] != maxHeight) {
+		qualities = append([]int{maxHeight}, qualities...)
+	}
+	return qualities
+}
+
+// DownloadVideoToFit downloads the video trying the FitQualities (up to its MaxHeight)
+// one by one until the resulting file fits the upload limit. It returns the name of the
+// file and the quality (height in pixels) that was used.
+func DownloadVideoToFit(ctx context.Context, config *Config, downloadConfig *DownloadConfig) (string, int, error) {
+	fitConfig := *downloadConfig
+	qualities := FitQualitiesUpTo(downloadConfig.MaxHeight)
+	for _, quality := range qualities {
+		fitConfig.MaxHeight = quality
+		videoFilename, err := DownloadVideo(ctx, config, &fitConfig)
+		if err != nil {
+			return "", 0, err
+		}
+		info, err := os.Stat(videoFilename)
+		if err != nil {
+			os.Remove(videoFilename)
+			return "", 0, fmt.Errorf("unable to get the size of %s: %s", videoFilename, err)
+		}
+		if info.Size() <= config.MaxUploadBytes {
+			return videoFilename, quality, nil
+		}
+		log.Printf("[job=%s] Video %s at %dp weighs %d bytes, it does not fit in %d bytes", downloadConfig.JobId, downloadConfig.VideoUrl, quality, info.Size(), config.MaxUploadBytes)
+		os.Remove(videoFilename)
+	}
+	return "", 0, fmt.Errorf("video %s does not fit in %d bytes even at %dp", downloadConfig.VideoUrl, config.MaxUploadBytes, qualities[len(qualities)-1])
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeYtdlp puts an empty yt-dlp first in the PATH, BuildYtdlpCmd only looks for it.
+func fakeYtdlp(t *testing.T) {
+	t.Helper()
+	fakeTools(t, map[string]string{"yt-dlp": ""})
+}
+
+// fakeTools makes the PATH hold only the programs of scripts (name to the body of a
+// shell script).
+func fakeTools(t *testing.T, scripts map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+			t.Fatalf("unable to write the fake %s: %s", name, err)
+		}
+	}
+	t.Setenv("PATH", dir)
+}
+
+func TestBuildYtdlpCmdEmbedsMetadata(t *testing.T) {
+	fakeYtdlp(t)
+	tests := []struct {
+		name          string
+		preset        string
+		embedMetadata string
+		want          bool
+	}{
+		{"default", "", "", false},
+		{"EMBED_METADATA", "", "true", true},
+		{"archive preset", PresetArchive, "", true},
+		{"telegram preset", PresetTelegram, "", false},
+	}
+	for _, test := range tests {
+		t.Setenv("PRESET", test.preset)
+		t.Setenv("EMBED_METADATA", test.embedMetadata)
+		config, err := LoadConfig()
+		if err != nil {
+			t.Fatalf("%s: LoadConfig returned error: %s", test.name, err)
+		}
+		downloadConfig, err := LoadDownloadConfigFromMsg("https://youtu.be/dQw4w9WgXcQ")
+		if err != nil {
+			t.Fatalf("%s: LoadDownloadConfigFromMsg returned error: %s", test.name, err)
+		}
+		_, _, ytdlpArgs, err := BuildYtdlpCmd(config, downloadConfig)
+		if err != nil {
+			t.Fatalf("%s: BuildYtdlpCmd returned error: %s", test.name, err)
+		}
+		embedded := false
+		for _, arg := range ytdlpArgs {
+			if arg == "--embed-metadata" {
+				embedded = true
+			}
+		}
+		if embedded != test.want {
+			t.Errorf("%s: BuildYtdlpCmd args %v have --embed-metadata %t, want %t", test.name, ytdlpArgs, embedded, test.want)
+		}
+	}
+}
+
+func TestClaimDownloadedFile(t *testing.T) {
+	videoFilename, err := SafeTempPath(ResumableFilename([]string{"-f", "18", t.Name()}) + ".mp4")
+	if err != nil {
+		t.Fatalf("unable to build the resumable file name: %s", err)
+	}
+	if err := os.WriteFile(videoFilename, []byte("video"), 0o600); err != nil {
+		t.Fatalf("unable to write %s: %s", videoFilename, err)
+	}
+	claimedFilename, err := ClaimDownloadedFile(videoFilename, "abc123")
+	if err != nil {
+		t.Fatalf("ClaimDownloadedFile returned error: %s", err)
+	}
+	defer os.Remove(claimedFilename)
+	if want := strings.TrimSuffix(videoFilename, ".mp4") + "-abc123.mp4"; claimedFilename != want {
+		t.Errorf("ClaimDownloadedFile = %s, want %s", claimedFilename, want)
+	}
+	if _, err := os.Stat(videoFilename); !os.IsNotExist(err) {
+		t.Errorf("the resumable file %s is still there, the next request would share it", videoFilename)
+	}
+}
+
+func TestProcessVideosProbesEveryVideo(t *testing.T) {
+	tempDir := t.TempDir()
+	t.Setenv("TMPDIR", tempDir)
+	ffmpegLog := filepath.Join(tempDir, "ffmpeg.log")
+	// the first video lasts 100 seconds and the second one 40, ffmpeg logs its
+	// arguments and creates its output (the last argument)
+	fakeTools(t, map[string]string{
+		"yt-dlp": "",
+		"ffprobe": `case "$*" in *first*) echo 100 ;; *) echo 40 ;; esac
+`,
+		"ffmpeg": `echo "$@" >> ` + ffmpegLog + `
+for arg; do last=$arg; done
+: > "$last"
+`,
+	})
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig returned error: %s", err)
+	}
+	cutStage := CutStage
+	CutStage = NewStage("cut", 0)
+	t.Cleanup(func() { CutStage = cutStage })
+	downloadConfig, err := LoadDownloadConfigFromMsg("https://x.com/gato/status/1 pct:50-100")
+	if err != nil {
+		t.Fatalf("LoadDownloadConfigFromMsg returned error: %s", err)
+	}
+	videoFilenames := []string{}
+	for _, name := range []string{"first.mp4", "second.mp4"} {
+		videoFilename := filepath.Join(tempDir, name)
+		if err := os.WriteFile(videoFilename, nil, 0o644); err != nil {
+			t.Fatalf("unable to write %s: %s", name, err)
+		}
+		videoFilenames = append(videoFilenames, videoFilename)
+	}
+	if _, err := ProcessVideos(context.Background(), config, downloadConfig, videoFilenames); err != nil {
+		t.Fatalf("ProcessVideos returned error: %s", err)
+	}
+	content, err := os.ReadFile(ffmpegLog)
+	if err != nil {
+		t.Fatalf("unable to read the ffmpeg log: %s", err)
+	}
+	runs := strings.Split(strings.TrimSpace(string(content)), "\n")
+	wants := []string{"-ss 50 -i " + videoFilenames[0] + " -t 50 ", "-ss 20 -i " + videoFilenames[1] + " -t 20 "}
+	if len(runs) != len(wants) {
+		t.Fatalf("ffmpeg ran %d times, want %d: %q", len(runs), len(wants), runs)
+	}
+	for i, want := range wants {
+		if !strings.Contains(runs[i], want) {
+			t.Errorf("ffmpeg run %d = %q, want it to contain %q", i, runs[i], want)
+		}
+	}
+	if downloadConfig.Duration != 0 {
+		t.Errorf("ProcessVideos set the duration of the request to %g", downloadConfig.Duration)
+	}
+}
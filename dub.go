@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// DubWord starts the requests that replace the audio of the video with the audio (or
+// voice note) the message replies to, like:
+//
+//	dubwith https://youtu.be/dQw4w9WgXcQ 0:10-0:51
+const DubWord = "dubwith"
+
+// DubRequest reports whether the message msg is a dubwith request, if it is it returns
+// the id of the replied audio (empty when msg does not reply to an audio) and the
+// request without the word.
+func DubRequest(msg *tgbotapi.Message) (string, string, bool) {
+	fields := strings.Fields(msg.Text)
+	if len(fields) == 0 || !strings.EqualFold(fields[0], DubWord) {
+		return "", "", false
+	}
+	request := strings.Join(fields[1:], " ")
+	replied := msg.ReplyToMessage
+	switch {
+	case replied == nil:
+		return "", request, true
+	case replied.Audio != nil:
+		return replied.Audio.FileID, request, true
+	case replied.Voice != nil:
+		return replied.Voice.FileID, request, true
+	default:
+		return "", request, true
+	}
+}
+
+// CheckDub returns an error when the options of the dubwith request downloadConfig
+// leave no video to dub.
+func CheckDub(downloadConfig *DownloadConfig) error {
+	if downloadConfig.AudioOnly || downloadConfig.Mute || downloadConfig.Thumbnails != 0 || downloadConfig.GifFps != 0 {
+		return fmt.Errorf("the %s word can not be used with the audio, chapters or mute words nor the thumbnails or gif options", DubWord)
+	}
+	return nil
+}
@@ -0,0 +1,1163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// CutVideo cuts the span of downloadConfig out of videoFilename and returns the name of
+// the cut file.
+func CutVideo(ctx context.Context, config *Config, downloadConfig *DownloadConfig, videoFilename string) (string, error) {
+	return CutVideoAs(ctx, config, downloadConfig, videoFilename, "-cut")
+}
+
+// CutVideoAs is like CutVideo, but the name of the cut file is derived from
+// videoFilename with suffix (so several cuts of the same file do not clash).
+func CutVideoAs(ctx context.Context, config *Config, downloadConfig *DownloadConfig, videoFilename, suffix string) (string, error) {
+	var (
+		startSecond  = downloadConfig.StartSecond
+		endSecond    = downloadConfig.EndSecond
+		audioOnly    = downloadConfig.AudioOnly
+		videoFilters = downloadConfig.VideoFilters()
+	)
+	// ffmpeg happily accepts a zero or negative -t, producing an empty file (and a NaN
+	// fails every comparison)
+	if math.IsNaN(startSecond) || math.IsNaN(endSecond) || startSecond < 0 || endSecond-startSecond <= 0 {
+		return "", fmt.Errorf("unable to cut video: invalid span from second %s to second %s", FormatSeconds(startSecond), FormatSeconds(endSecond))
+	}
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return "", fmt.Errorf("unable to cut video: %s", err)
+	}
+	videoFilenameExt := filepath.Ext(videoFilename)
+	finalVideoFilenameExt := videoFilenameExt
+	// the audio extracted as is keeps its container, it is transcoded after the cut
+	if audioOnly && len(downloadConfig.AudioFormats) == 0 {
+		finalVideoFilenameExt = ".mp3"
+	}
+	finalVideoFilename, err := DerivedTempPath(videoFilename, suffix, finalVideoFilenameExt)
+	if err != nil {
+		return "", fmt.Errorf("unable to cut video: %s", err)
+	}
+	outputArgs := []string{}
+	if config.Faststart && !audioOnly && videoFilenameExt == ".mp4" {
+		outputArgs = append(outputArgs, "-movflags", "+faststart")
+	}
+	// try first a fast cut copying the streams, it is quick but it may fail for some
+	// containers, in that case retry once re-encoding the video with accurate seeking
+	// (filters always need a re-encode, so the fast cut is skipped for them)
+	if len(videoFilters) == 0 {
+		fastCutArgs := []string{
+			"-y",
+			"-ss",
+			FormatSeconds(startSecond),
+			"-i",
+			videoFilename,
+			"-t",
+			FormatSeconds(endSecond - startSecond),
+			"-c",
+			"copy",
+		}
+		fastCutArgs = append(fastCutArgs, outputArgs...)
+		fastCutCmd := exec.CommandContext(ctx, ffmpegPath, append(fastCutArgs, finalVideoFilename)...)
+		err = fastCutCmd.Run()
+		if err == nil {
+			return finalVideoFilename, nil
+		}
+		log.Printf("[job=%s] Unable to make a fast cut of %s (%s), falling back to an accurate cut", downloadConfig.JobId, videoFilename, err)
+	}
+	accurateCutArgs := []string{
+		"-y",
+		"-i",
+		videoFilename,
+		"-ss",
+		FormatSeconds(startSecond),
+		"-t",
+		FormatSeconds(endSecond - startSecond),
+	}
+	if len(videoFilters) != 0 {
+		accurateCutArgs = append(accurateCutArgs, "-vf", strings.Join(videoFilters, ","))
+	}
+	if config.Preset == PresetTelegram && !audioOnly {
+		accurateCutArgs = append(accurateCutArgs, "-c:v", "libx264", "-c:a", "aac")
+	}
+	accurateCutArgs = append(accurateCutArgs, outputArgs...)
+	accurateCutCmd := exec.CommandContext(ctx, ffmpegPath, append(accurateCutArgs, finalVideoFilename)...)
+	if err := accurateCutCmd.Run(); err != nil {
+		return "", fmt.Errorf("unable to cut video: %s", err)
+	}
+	return finalVideoFilename, nil
+}
+
+// CutBookends cuts the first and the last Bookends seconds of videoFilename (whose
+// Duration must be known) and stitches them together, it returns the name of the
+// stitched file.
+func CutBookends(ctx context.Context, config *Config, downloadConfig *DownloadConfig, videoFilename string) (string, error) {
+	length := float64(downloadConfig.Bookends)
+	head := *downloadConfig
+	head.StartSecond, head.EndSecond = 0, length
+	tail := *downloadConfig
+	tail.StartSecond, tail.EndSecond = downloadConfig.Duration-length, downloadConfig.Duration
+	headFilename, err := CutVideoAs(ctx, config, &head, videoFilename, "-head")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(headFilename)
+	tailFilename, err := CutVideoAs(ctx, config, &tail, videoFilename, "-tail")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tailFilename)
+	return ConcatVideos(ctx, config, []string{headFilename, tailFilename}, "-bookends")
+}
+
+// ConcatVideos stitches the videos (of the same format) one after the other copying
+// the streams, the name of the stitched file is derived from the first video with
+// suffix.
+func ConcatVideos(ctx context.Context, config *Config, videoFilenames []string, suffix string) (string, error) {
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return "", fmt.Errorf("unable to concat videos: %s", err)
+	}
+	concatVideoFilename, err := DerivedTempPath(videoFilenames[0], suffix, "")
+	if err != nil {
+		return "", fmt.Errorf("unable to concat videos: %s", err)
+	}
+	listFilename, err := DerivedTempPath(videoFilenames[0], suffix+"-list", ".txt")
+	if err != nil {
+		return "", fmt.Errorf("unable to concat videos: %s", err)
+	}
+	// the names come from SafeTempPath, they have no quotes to escape
+	list := ""
+	for _, videoFilename := range videoFilenames {
+		list += fmt.Sprintf("file '%s'\n", videoFilename)
+	}
+	if err := os.WriteFile(listFilename, []byte(list), 0644); err != nil {
+		return "", fmt.Errorf("unable to concat videos: %s", err)
+	}
+	defer os.Remove(listFilename)
+	concatArgs := []string{
+		"-y",
+		"-f",
+		"concat",
+		"-safe",
+		"0",
+		"-i",
+		listFilename,
+		"-c",
+		"copy",
+	}
+	if config.Faststart && filepath.Ext(concatVideoFilename) == ".mp4" {
+		concatArgs = append(concatArgs, "-movflags", "+faststart")
+	}
+	concatCmd := exec.CommandContext(ctx, ffmpegPath, append(concatArgs, concatVideoFilename)...)
+	if err := concatCmd.Run(); err != nil {
+		return "", fmt.Errorf("unable to concat videos: %s", err)
+	}
+	return concatVideoFilename, nil
+}
+
+// Telegram limits of the thumbnail of an uploaded video.
+const (
+	MaxCoverSide  = 320
+	MaxCoverBytes = 200 * 1024
+)
+
+// DownloadCover downloads the thumbnail of the video of downloadConfig and scales it
+// down to the limits of Telegram, it returns the name of the resulting JPEG.
+func DownloadCover(ctx context.Context, config *Config, downloadConfig *DownloadConfig) (string, error) {
+	ytdlpPath, err := exec.LookPath("yt-dlp")
+	if err != nil {
+		return "", fmt.Errorf("unable to download thumbnail: %s", err)
+	}
+	f, err := os.CreateTemp(TempDir(), "gatonaranja.*")
+	if err != nil {
+		return "", fmt.Errorf("unable to download thumbnail: %s", err)
+	}
+	baseFilename := f.Name()
+	f.Close()
+	os.Remove(baseFilename)
+	ytdlpArgs := []string{"--skip-download", "--write-thumbnail", "--convert-thumbnails", "jpg"}
+	ytdlpArgs = append(ytdlpArgs, config.YtdlpExtraArgs...)
+	ytdlpArgs = append(ytdlpArgs, "-o", baseFilename+".%(ext)s", downloadConfig.VideoUrl.String())
+	var stderr bytes.Buffer
+	thumbnailCmd := exec.CommandContext(ctx, ytdlpPath, ytdlpArgs...)
+	thumbnailCmd.Stderr = &stderr
+	if err := RunSpacedYtdlp(config, thumbnailCmd); err != nil {
+		return "", fmt.Errorf("unable to download thumbnail: %s: %s", err, StderrTail(stderr.String()))
+	}
+	// videos without thumbnail download nothing
+	thumbnailFilename, err := ProducedFilename(baseFilename + ".jpg")
+	if err != nil {
+		return "", fmt.Errorf("unable to download thumbnail: %s", err)
+	}
+	defer os.Remove(thumbnailFilename)
+	return ScaleCover(ctx, thumbnailFilename)
+}
+
+// ScaleCover scales the image imageFilename down to MaxCoverSide pixels per side and
+// lowers its JPEG quality until it weighs less than MaxCoverBytes, it returns the name
+// of the resulting JPEG.
+func ScaleCover(ctx context.Context, imageFilename string) (string, error) {
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return "", fmt.Errorf("unable to scale thumbnail: %s", err)
+	}
+	coverFilename, err := DerivedTempPath(imageFilename, "-cover", ".jpg")
+	if err != nil {
+		return "", fmt.Errorf("unable to scale thumbnail: %s", err)
+	}
+	// the qualities of the mjpeg encoder go from 2 (best) to 31 (worst)
+	for _, quality := range []int{2, 5, 10, 20, 31} {
+		scaleCmd := exec.CommandContext(
+			ctx,
+			ffmpegPath,
+			"-y",
+			"-i",
+			imageFilename,
+			"-vf",
+			fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease", MaxCoverSide, MaxCoverSide),
+			"-q:v",
+			strconv.Itoa(quality),
+			"-frames:v",
+			"1",
+			coverFilename,
+		)
+		if err := scaleCmd.Run(); err != nil {
+			os.Remove(coverFilename)
+			return "", fmt.Errorf("unable to scale thumbnail: %s", err)
+		}
+		if info, err := os.Stat(coverFilename); err == nil && info.Size() < MaxCoverBytes {
+			return coverFilename, nil
+		}
+	}
+	os.Remove(coverFilename)
+	return "", fmt.Errorf("unable to scale thumbnail: it weighs more than %d bytes", MaxCoverBytes)
+}
+
+// BumperFps is the framerate of the videos with bumpers, unless the fps option asks for
+// another one.
+const BumperFps = 30
+
+// AddBumpers concatenates the intro and the outro of the operator (whichever are set)
+// around the video videoFilename and returns the name of the resulting video. The
+// bumpers are scaled (keeping their aspect ratio), padded and resampled to match the
+// video, so they can have any resolution and codecs.
+func AddBumpers(ctx context.Context, config *Config, downloadConfig *DownloadConfig, videoFilename string) (string, error) {
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return "", fmt.Errorf("unable to add bumpers: %s", err)
+	}
+	width, height, err := ProbeVideoSize(ctx, videoFilename)
+	if err != nil {
+		return "", fmt.Errorf("unable to add bumpers: %s", err)
+	}
+	bumperVideoFilename, err := DerivedTempPath(videoFilename, "-bumper", ".mp4")
+	if err != nil {
+		return "", fmt.Errorf("unable to add bumpers: %s", err)
+	}
+	inputs := []string{}
+	if config.BumperIntro != "" {
+		inputs = append(inputs, config.BumperIntro)
+	}
+	inputs = append(inputs, videoFilename)
+	if config.BumperOutro != "" {
+		inputs = append(inputs, config.BumperOutro)
+	}
+	fps := BumperFps
+	if downloadConfig.Fps != 0 {
+		fps = downloadConfig.Fps
+	}
+	bumperArgs := []string{"-y"}
+	filters := []string{}
+	segments := ""
+	for i, input := range inputs {
+		bumperArgs = append(bumperArgs, "-i", input)
+		filters = append(filters, fmt.Sprintf("[%d:v]scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1,fps=%d,format=yuv420p[v%d]", i, width, height, width, height, fps, i))
+		segments += fmt.Sprintf("[v%d]", i)
+		if !downloadConfig.Mute {
+			filters = append(filters, fmt.Sprintf("[%d:a]aresample=48000,aformat=channel_layouts=stereo[a%d]", i, i))
+			segments += fmt.Sprintf("[a%d]", i)
+		}
+	}
+	if downloadConfig.Mute {
+		filters = append(filters, fmt.Sprintf("%sconcat=n=%d:v=1:a=0[v]", segments, len(inputs)))
+	} else {
+		filters = append(filters, fmt.Sprintf("%sconcat=n=%d:v=1:a=1[v][a]", segments, len(inputs)))
+	}
+	bumperArgs = append(bumperArgs, "-filter_complex", strings.Join(filters, ";"), "-map", "[v]")
+	if !downloadConfig.Mute {
+		bumperArgs = append(bumperArgs, "-map", "[a]", "-c:a", "aac")
+	}
+	bumperArgs = append(bumperArgs, "-c:v", "libx264")
+	if config.Faststart {
+		bumperArgs = append(bumperArgs, "-movflags", "+faststart")
+	}
+	var stderr bytes.Buffer
+	bumperCmd := exec.CommandContext(ctx, ffmpegPath, append(bumperArgs, bumperVideoFilename)...)
+	bumperCmd.Stderr = &stderr
+	if err := bumperCmd.Run(); err != nil {
+		return "", fmt.Errorf("unable to add bumpers: %s: %s", err, StderrTail(stderr.String()))
+	}
+	return bumperVideoFilename, nil
+}
+
+// ProbeVideoSize returns the width and the height (in pixels) of the first video stream
+// of filename using ffprobe.
+func ProbeVideoSize(ctx context.Context, filename string) (int, int, error) {
+	ffprobePath, err := exec.LookPath("ffprobe")
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to probe the size of %s: %s", filename, err)
+	}
+	output, err := exec.CommandContext(
+		ctx,
+		ffprobePath,
+		"-v",
+		"error",
+		"-select_streams",
+		"v:0",
+		"-show_entries",
+		"stream=width,height",
+		"-of",
+		"csv=p=0:s=x",
+		filename,
+	).Output()
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to probe the size of %s: %s", filename, err)
+	}
+	var width, height int
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(output)), "%dx%d", &width, &height); err != nil || width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("unable to probe the size of %s: ffprobe reported %q", filename, strings.TrimSpace(string(output)))
+	}
+	return width, height, nil
+}
+
+// ContactSheet takes as many evenly spaced frames of the video videoFilename (of
+// duration seconds) as frames says and tiles them in a grid in a single image, it
+// returns the name of the image.
+func ContactSheet(ctx context.Context, videoFilename string, frames int, duration float64) (string, error) {
+	if duration <= 0 {
+		return "", fmt.Errorf("unable to make contact sheet: the duration of the video is unknown")
+	}
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return "", fmt.Errorf("unable to make contact sheet: %s", err)
+	}
+	contactSheetFilename, err := DerivedTempPath(videoFilename, "-sheet", ".jpg")
+	if err != nil {
+		return "", fmt.Errorf("unable to make contact sheet: %s", err)
+	}
+	// one frame every interval seconds, the grid is as square as possible
+	interval := duration / float64(frames)
+	columns := int(math.Ceil(math.Sqrt(float64(frames))))
+	rows := int(math.Ceil(float64(frames) / float64(columns)))
+	sheetCmd := exec.CommandContext(
+		ctx,
+		ffmpegPath,
+		"-y",
+		"-i",
+		videoFilename,
+		"-vf",
+		fmt.Sprintf("fps=1/%s,scale=%d:-2,tile=%dx%d", FormatSeconds(interval), ContactSheetFrameWidth, columns, rows),
+		"-frames:v",
+		"1",
+		contactSheetFilename,
+	)
+	if err := sheetCmd.Run(); err != nil {
+		return "", fmt.Errorf("unable to make contact sheet: %s", err)
+	}
+	return contactSheetFilename, nil
+}
+
+// TranscodeAudio encodes the audio audioFilename in format (one of AudioCodecs) with the
+// extra layoutArgs (see AudioLayoutArgs) and returns the name of the resulting file.
+func TranscodeAudio(ctx context.Context, audioFilename, format string, layoutArgs []string) (string, error) {
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return "", fmt.Errorf("unable to transcode audio to %s: %s", format, err)
+	}
+	// the suffix keeps the file apart from the source when it is already in format
+	transcodedFilename, err := DerivedTempPath(audioFilename, "-"+format, "."+format)
+	if err != nil {
+		return "", fmt.Errorf("unable to transcode audio to %s: %s", format, err)
+	}
+	transcodeArgs := []string{"-y", "-i", audioFilename, "-vn"}
+	transcodeArgs = append(transcodeArgs, AudioCodecs[format]...)
+	transcodeArgs = append(transcodeArgs, layoutArgs...)
+	var stderr bytes.Buffer
+	transcodeCmd := exec.CommandContext(ctx, ffmpegPath, append(transcodeArgs, transcodedFilename)...)
+	transcodeCmd.Stderr = &stderr
+	if err := transcodeCmd.Run(); err != nil {
+		return "", fmt.Errorf("unable to transcode audio to %s: %s: %s", format, err, StderrTail(stderr.String()))
+	}
+	return transcodedFilename, nil
+}
+
+// ConvertToGif converts the video videoFilename to a GIF of fps frames per second and
+// width pixels wide and returns the name of the GIF. The palette is generated from the
+// video itself, which looks much better than the generic one.
+func ConvertToGif(ctx context.Context, videoFilename string, fps, width int) (string, error) {
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return "", fmt.Errorf("unable to convert to GIF: %s", err)
+	}
+	gifFilename, err := DerivedTempPath(videoFilename, "-gif", ".gif")
+	if err != nil {
+		return "", fmt.Errorf("unable to convert to GIF: %s", err)
+	}
+	var stderr bytes.Buffer
+	gifCmd := exec.CommandContext(
+		ctx,
+		ffmpegPath,
+		"-y",
+		"-i",
+		videoFilename,
+		"-vf",
+		fmt.Sprintf("fps=%d,scale=%d:-1:flags=lanczos,split[frames][source];[source]palettegen[palette];[frames][palette]paletteuse", fps, width),
+		"-loop",
+		"0",
+		gifFilename,
+	)
+	gifCmd.Stderr = &stderr
+	if err := gifCmd.Run(); err != nil {
+		return "", fmt.Errorf("unable to convert to GIF: %s: %s", err, StderrTail(stderr.String()))
+	}
+	return gifFilename, nil
+}
+
+// SplitChapters splits the audio audioFilename in one file per chapter (copying the
+// streams) and returns the names of the files in the same order as chapters.
+func SplitChapters(ctx context.Context, audioFilename string, chapters []Chapter) ([]string, error) {
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, fmt.Errorf("unable to split chapters: %s", err)
+	}
+	chapterFilenames := []string{}
+	for i, chapter := range chapters {
+		chapterFilename, err := DerivedTempPath(audioFilename, fmt.Sprintf("-chapter%03d", i+1), "")
+		if err != nil {
+			for _, chapterFilename := range chapterFilenames {
+				os.Remove(chapterFilename)
+			}
+			return nil, fmt.Errorf("unable to split chapters: %s", err)
+		}
+		splitCmd := exec.CommandContext(
+			ctx,
+			ffmpegPath,
+			"-y",
+			"-i",
+			audioFilename,
+			"-ss",
+			fmt.Sprint(chapter.StartTime),
+			"-to",
+			fmt.Sprint(chapter.EndTime),
+			"-c",
+			"copy",
+			chapterFilename,
+		)
+		if err := splitCmd.Run(); err != nil {
+			for _, chapterFilename := range chapterFilenames {
+				os.Remove(chapterFilename)
+			}
+			return nil, fmt.Errorf("unable to split chapter %d (%s): %s", i+1, chapter.Title, err)
+		}
+		chapterFilenames = append(chapterFilenames, chapterFilename)
+	}
+	return chapterFilenames, nil
+}
+
+// TargetAudioBitrate is the bitrate (in bits per second) of the audio of the videos
+// compressed with the target option.
+const TargetAudioBitrate = 128 * 1000
+
+// MinTargetVideoBitrate is the lowest video bitrate (in bits per second) worth
+// encoding, below it the video is unwatchable.
+const MinTargetVideoBitrate = 100 * 1000
+
+// TargetVideoBitrate returns the video bitrate (in bits per second) for a video of
+// duration seconds to weigh about targetBytes, given the bitrate of its audio.
+func TargetVideoBitrate(targetBytes int64, duration float64, audioBitrate int64) (int64, error) {
+	if duration <= 0 {
+		return 0, fmt.Errorf("the duration of the video is unknown")
+	}
+	// leave some room for the container overhead
+	totalBitrate := int64(float64(targetBytes) * 8 * 0.97 / duration)
+	videoBitrate := totalBitrate - audioBitrate
+	if videoBitrate < MinTargetVideoBitrate {
+		return 0, fmt.Errorf("%d bytes are too few for %.0f seconds of video", targetBytes, duration)
+	}
+	return videoBitrate, nil
+}
+
+// CompressVideo re-encodes the video videoFilename (of duration seconds) with a two-pass
+// h264 encoding so it weighs about targetBytes and returns the name of the compressed
+// file.
+func CompressVideo(ctx context.Context, config *Config, videoFilename string, duration float64, targetBytes int64, mute bool) (string, error) {
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return "", fmt.Errorf("unable to compress video: %s", err)
+	}
+	audioBitrate := int64(TargetAudioBitrate)
+	if mute {
+		audioBitrate = 0
+	}
+	videoBitrate, err := TargetVideoBitrate(targetBytes, duration, audioBitrate)
+	if err != nil {
+		return "", fmt.Errorf("unable to compress video: %s", err)
+	}
+	compressedVideoFilename, err := DerivedTempPath(videoFilename, "-target", ".mp4")
+	if err != nil {
+		return "", fmt.Errorf("unable to compress video: %s", err)
+	}
+	passLogFile, err := DerivedTempPath(videoFilename, "-passlog", ".log")
+	if err != nil {
+		return "", fmt.Errorf("unable to compress video: %s", err)
+	}
+	// ffmpeg adds the stream index to the name of the log files
+	defer os.Remove(passLogFile + "-0.log")
+	defer os.Remove(passLogFile + "-0.log.mbtree")
+	firstPassCmd := exec.CommandContext(
+		ctx,
+		ffmpegPath,
+		"-y",
+		"-i",
+		videoFilename,
+		"-c:v",
+		"libx264",
+		"-b:v",
+		fmt.Sprint(videoBitrate),
+		"-pass",
+		"1",
+		"-passlogfile",
+		passLogFile,
+		"-an",
+		"-f",
+		"null",
+		os.DevNull,
+	)
+	if err := firstPassCmd.Run(); err != nil {
+		return "", fmt.Errorf("unable to compress video (first pass): %s", err)
+	}
+	secondPassArgs := []string{
+		"-y",
+		"-i",
+		videoFilename,
+		"-c:v",
+		"libx264",
+		"-b:v",
+		fmt.Sprint(videoBitrate),
+		"-pass",
+		"2",
+		"-passlogfile",
+		passLogFile,
+	}
+	if mute {
+		secondPassArgs = append(secondPassArgs, "-an")
+	} else {
+		secondPassArgs = append(secondPassArgs, "-c:a", "aac", "-b:a", fmt.Sprint(audioBitrate))
+	}
+	if config.Faststart {
+		secondPassArgs = append(secondPassArgs, "-movflags", "+faststart")
+	}
+	secondPassCmd := exec.CommandContext(ctx, ffmpegPath, append(secondPassArgs, compressedVideoFilename)...)
+	if err := secondPassCmd.Run(); err != nil {
+		return "", fmt.Errorf("unable to compress video (second pass): %s", err)
+	}
+	return compressedVideoFilename, nil
+}
+
+// FilterVideo re-encodes the whole video videoFilename applying the ffmpeg video filters
+// and returns the name of the filtered file.
+func FilterVideo(ctx context.Context, config *Config, videoFilename string, videoFilters []string) (string, error) {
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return "", fmt.Errorf("unable to filter video: %s", err)
+	}
+	videoFilenameExt := filepath.Ext(videoFilename)
+	filteredVideoFilename, err := DerivedTempPath(videoFilename, "-filtered", "")
+	if err != nil {
+		return "", fmt.Errorf("unable to filter video: %s", err)
+	}
+	filterArgs := []string{
+		"-y",
+		"-i",
+		videoFilename,
+		"-vf",
+		strings.Join(videoFilters, ","),
+	}
+	if config.Preset == PresetTelegram {
+		filterArgs = append(filterArgs, "-c:v", "libx264", "-c:a", "aac")
+	}
+	if config.Faststart && videoFilenameExt == ".mp4" {
+		filterArgs = append(filterArgs, "-movflags", "+faststart")
+	}
+	filterCmd := exec.CommandContext(ctx, ffmpegPath, append(filterArgs, filteredVideoFilename)...)
+	if err := filterCmd.Run(); err != nil {
+		return "", fmt.Errorf("unable to filter video: %s", err)
+	}
+	return filteredVideoFilename, nil
+}
+
+// ProbeDuration returns the duration (in seconds) of the media file filename using
+// ffprobe, it is the fallback for the sites that do not report the duration.
+func ProbeDuration(ctx context.Context, filename string) (float64, error) {
+	ffprobePath, err := exec.LookPath("ffprobe")
+	if err != nil {
+		return 0, fmt.Errorf("unable to probe the duration of %s: %s", filename, err)
+	}
+	output, err := exec.CommandContext(
+		ctx,
+		ffprobePath,
+		"-v",
+		"error",
+		"-show_entries",
+		"format=duration",
+		"-of",
+		"default=noprint_wrappers=1:nokey=1",
+		filename,
+	).Output()
+	if err != nil {
+		return 0, fmt.Errorf("unable to probe the duration of %s: %s", filename, err)
+	}
+	duration, err := strconv.ParseFloat(strings.TrimSpace(string(output)), 64)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("unable to probe the duration of %s: ffprobe reported %q", filename, strings.TrimSpace(string(output)))
+	}
+	return duration, nil
+}
+
+// LoopVideo repeats videoFilename (video and audio) as many times as needed to last the
+// LoopSeconds of downloadConfig and returns the name of the looped file, the streams are
+// re-encoded so the joints are seamless. Videos that already last that long are
+// returned as they are.
+func LoopVideo(ctx context.Context, config *Config, downloadConfig *DownloadConfig, videoFilename string) (string, error) {
+	duration, err := ProbeDuration(ctx, videoFilename)
+	if err != nil {
+		return "", fmt.Errorf("unable to loop video: %s", err)
+	}
+	target := float64(downloadConfig.LoopSeconds)
+	if duration >= target {
+		log.Printf("[job=%s] Not looping %s since it already lasts %s seconds", downloadConfig.JobId, videoFilename, FormatSeconds(duration))
+		return videoFilename, nil
+	}
+	repeats := int(math.Ceil(target / duration))
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return "", fmt.Errorf("unable to loop video: %s", err)
+	}
+	loopedVideoFilename, err := DerivedTempPath(videoFilename, "-loop", "")
+	if err != nil {
+		return "", fmt.Errorf("unable to loop video: %s", err)
+	}
+	loopArgs := []string{
+		"-y",
+		// the input is read once plus the extra loops
+		"-stream_loop",
+		strconv.Itoa(repeats - 1),
+		"-i",
+		videoFilename,
+		"-t",
+		FormatSeconds(target),
+	}
+	if !downloadConfig.AudioOnly {
+		loopArgs = append(loopArgs, "-c:v", "libx264", "-c:a", "aac")
+		if config.Faststart && filepath.Ext(videoFilename) == ".mp4" {
+			loopArgs = append(loopArgs, "-movflags", "+faststart")
+		}
+	}
+	var stderr bytes.Buffer
+	loopCmd := exec.CommandContext(ctx, ffmpegPath, append(loopArgs, loopedVideoFilename)...)
+	loopCmd.Stderr = &stderr
+	if err := loopCmd.Run(); err != nil {
+		return "", fmt.Errorf("unable to loop video: %s: %s", err, StderrTail(stderr.String()))
+	}
+	return loopedVideoFilename, nil
+}
+
+// AtempoFilters returns the chain of atempo filters that changes the tempo of an audio by
+// speed, a single atempo only takes factors from 0.5 to 2.
+func AtempoFilters(speed float64) []string {
+	filters := []string{}
+	for speed > 2 {
+		filters = append(filters, "atempo=2")
+		speed /= 2
+	}
+	for speed < 0.5 {
+		filters = append(filters, "atempo=0.5")
+		speed /= 0.5
+	}
+	return append(filters, "atempo="+strconv.FormatFloat(speed, 'f', -1, 64))
+}
+
+// CropAspects are the aspect ratios (width:height) of the modes of the crop option.
+var CropAspects = map[string][2]int{
+	"square":   {1, 1},
+	"vertical": {9, 16},
+}
+
+// ParseCrop parses the mode of the crop option, it must be one of CropAspects.
+func ParseCrop(value string) (string, error) {
+	if _, ok := CropAspects[value]; !ok {
+		return "", fmt.Errorf("unknown crop mode %q, use square or vertical", value)
+	}
+	return value, nil
+}
+
+// CropGeometry returns the width, the height and the left and top offsets (in pixels)
+// of the largest area of aspect (width:height) centered in a frame of width by height.
+// The sizes are even, as the encoders need.
+func CropGeometry(width, height int, aspect [2]int) (int, int, int, int) {
+	cropWidth, cropHeight := width, height
+	if width*aspect[1] > height*aspect[0] {
+		// the frame is wider than the aspect, the sides are cut
+		cropWidth = height * aspect[0] / aspect[1]
+	} else {
+		cropHeight = width * aspect[1] / aspect[0]
+	}
+	cropWidth -= cropWidth % 2
+	cropHeight -= cropHeight % 2
+	return cropWidth, cropHeight, (width - cropWidth) / 2, (height - cropHeight) / 2
+}
+
+// CropVideo center-crops videoFilename to the aspect ratio of the Crop of downloadConfig
+// and returns the name of the cropped file, the video is re-encoded and the audio
+// copied. Videos that already have that aspect ratio are returned as they are.
+func CropVideo(ctx context.Context, config *Config, downloadConfig *DownloadConfig, videoFilename string) (string, error) {
+	width, height, err := ProbeVideoSize(ctx, videoFilename)
+	if err != nil {
+		return "", fmt.Errorf("unable to crop video: %s", err)
+	}
+	cropWidth, cropHeight, x, y := CropGeometry(width, height, CropAspects[downloadConfig.Crop])
+	if cropWidth == width && cropHeight == height {
+		log.Printf("[job=%s] Not cropping %s since it is already %s", downloadConfig.JobId, videoFilename, downloadConfig.Crop)
+		return videoFilename, nil
+	}
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return "", fmt.Errorf("unable to crop video: %s", err)
+	}
+	croppedVideoFilename, err := DerivedTempPath(videoFilename, "-crop", "")
+	if err != nil {
+		return "", fmt.Errorf("unable to crop video: %s", err)
+	}
+	cropArgs := []string{
+		"-y",
+		"-i",
+		videoFilename,
+		"-filter:v",
+		fmt.Sprintf("crop=%d:%d:%d:%d", cropWidth, cropHeight, x, y),
+		"-c:v",
+		"libx264",
+		"-c:a",
+		"copy",
+	}
+	if config.Faststart && filepath.Ext(videoFilename) == ".mp4" {
+		cropArgs = append(cropArgs, "-movflags", "+faststart")
+	}
+	var stderr bytes.Buffer
+	cropCmd := exec.CommandContext(ctx, ffmpegPath, append(cropArgs, croppedVideoFilename)...)
+	cropCmd.Stderr = &stderr
+	if err := cropCmd.Run(); err != nil {
+		return "", fmt.Errorf("unable to crop video: %s: %s", err, StderrTail(stderr.String()))
+	}
+	return croppedVideoFilename, nil
+}
+
+// The timelines of the timestamp option: the time of the clip (starting at 0:00) or the
+// time of the original video (starting where the cut starts).
+const (
+	TimestampClip   = "clip"
+	TimestampSource = "source"
+)
+
+// EscapeFilterValue escapes value to be used as the value of an option of an ffmpeg
+// filter, like a path.
+func EscapeFilterValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `:`, `\:`, `'`, `\'`).Replace(value)
+}
+
+// BurnTimestamp burns the running time (in the timeline of the Timestamp of
+// downloadConfig) into the bottom right corner of videoFilename with the font of
+// TIMESTAMP_FONT, it returns the name of the resulting file. The video is re-encoded
+// and the audio copied.
+func BurnTimestamp(ctx context.Context, config *Config, downloadConfig *DownloadConfig, videoFilename string) (string, error) {
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return "", fmt.Errorf("unable to burn the timestamp: %s", err)
+	}
+	timestampVideoFilename, err := DerivedTempPath(videoFilename, "-timestamp", "")
+	if err != nil {
+		return "", fmt.Errorf("unable to burn the timestamp: %s", err)
+	}
+	offset := 0.0
+	if downloadConfig.Timestamp == TimestampSource && downloadConfig.HasSpan() {
+		offset = downloadConfig.StartSecond
+	}
+	drawtext := fmt.Sprintf(
+		"drawtext=fontfile=%s:text='%%{pts\\:hms\\:%s}':x=w-tw-h/40:y=h-th-h/40:fontsize=h/20:fontcolor=white:box=1:boxcolor=black@0.5:boxborderw=h/160",
+		EscapeFilterValue(config.TimestampFont),
+		FormatSeconds(offset),
+	)
+	timestampArgs := []string{
+		"-y",
+		"-i",
+		videoFilename,
+		"-filter:v",
+		drawtext,
+		"-c:v",
+		"libx264",
+		"-c:a",
+		"copy",
+	}
+	if config.Faststart && filepath.Ext(videoFilename) == ".mp4" {
+		timestampArgs = append(timestampArgs, "-movflags", "+faststart")
+	}
+	var stderr bytes.Buffer
+	timestampCmd := exec.CommandContext(ctx, ffmpegPath, append(timestampArgs, timestampVideoFilename)...)
+	timestampCmd.Stderr = &stderr
+	if err := timestampCmd.Run(); err != nil {
+		return "", fmt.Errorf("unable to burn the timestamp: %s: %s", err, StderrTail(stderr.String()))
+	}
+	return timestampVideoFilename, nil
+}
+
+// SceneSnapWindow is how far (in seconds) the ends of a cut can move to a scene change,
+// and SceneThreshold how different two frames must be (from 0 to 1) to be a scene
+// change.
+const (
+	SceneSnapWindow = 3.0
+	SceneThreshold  = 0.3
+)
+
+// ScenePtsPattern matches the time of the frames reported by the showinfo filter.
+var ScenePtsPattern = regexp.MustCompile(`pts_time:([0-9.]+)`)
+
+// DetectScenes returns the seconds of videoFilename between from and to where a new
+// scene starts, using the scene detection of ffmpeg.
+func DetectScenes(ctx context.Context, videoFilename string, from, to float64) ([]float64, error) {
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, fmt.Errorf("unable to detect scenes: %s", err)
+	}
+	var stderr bytes.Buffer
+	sceneCmd := exec.CommandContext(
+		ctx,
+		ffmpegPath,
+		"-ss",
+		FormatSeconds(from),
+		"-t",
+		FormatSeconds(to-from),
+		"-i",
+		videoFilename,
+		"-an",
+		"-vf",
+		fmt.Sprintf("select=gt(scene\\,%g),showinfo", SceneThreshold),
+		"-f",
+		"null",
+		"-",
+	)
+	sceneCmd.Stderr = &stderr
+	if err := sceneCmd.Run(); err != nil {
+		return nil, fmt.Errorf("unable to detect scenes: %s: %s", err, StderrTail(stderr.String()))
+	}
+	scenes := []float64{}
+	for _, match := range ScenePtsPattern.FindAllStringSubmatch(stderr.String(), -1) {
+		// the times start at 0 where the detection starts
+		if second, err := strconv.ParseFloat(match[1], 64); err == nil {
+			scenes = append(scenes, from+second)
+		}
+	}
+	return scenes, nil
+}
+
+// SnapToScene returns the scene change of scenes nearest to second, or second itself
+// when none is within SceneSnapWindow seconds.
+func SnapToScene(second float64, scenes []float64) float64 {
+	snapped := second
+	for _, scene := range scenes {
+		if distance := math.Abs(scene - second); distance <= SceneSnapWindow && distance < math.Abs(snapped-second) {
+			snapped = scene
+		}
+	}
+	return snapped
+}
+
+// SnapSpanToScenes moves the ends of the cut of downloadConfig to the nearest scene
+// changes of videoFilename. When the detection fails or finds nothing nearby the exact
+// spots are kept.
+func SnapSpanToScenes(ctx context.Context, downloadConfig *DownloadConfig, videoFilename string) {
+	snapped := []float64{}
+	for _, second := range []float64{downloadConfig.StartSecond, downloadConfig.EndSecond} {
+		scenes, err := DetectScenes(ctx, videoFilename, math.Max(second-SceneSnapWindow, 0), second+SceneSnapWindow)
+		if err != nil {
+			log.Printf("[job=%s] Cutting at the exact spots: %s", downloadConfig.JobId, err)
+			return
+		}
+		snapped = append(snapped, SnapToScene(second, scenes))
+	}
+	if snapped[0] >= snapped[1] {
+		log.Printf("[job=%s] Cutting at the exact spots: the nearest scene changes leave nothing to cut", downloadConfig.JobId)
+		return
+	}
+	log.Printf("[job=%s] Snapped the cut %s-%s to the scene changes %s-%s", downloadConfig.JobId, Second2Spot(downloadConfig.StartSecond), Second2Spot(downloadConfig.EndSecond), Second2Spot(snapped[0]), Second2Spot(snapped[1]))
+	downloadConfig.StartSecond, downloadConfig.EndSecond = snapped[0], snapped[1]
+}
+
+// ChangeSpeed changes the speed of videoFilename (of its video with setpts and of its
+// audio with atempo, unless it is muted) by the Speed of downloadConfig and returns the
+// name of the resulting file. Both streams must be re-encoded.
+func ChangeSpeed(ctx context.Context, config *Config, downloadConfig *DownloadConfig, videoFilename string) (string, error) {
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return "", fmt.Errorf("unable to change the speed: %s", err)
+	}
+	videoFilenameExt := filepath.Ext(videoFilename)
+	spedVideoFilename, err := DerivedTempPath(videoFilename, "-speed", "")
+	if err != nil {
+		return "", fmt.Errorf("unable to change the speed: %s", err)
+	}
+	speed := strconv.FormatFloat(downloadConfig.Speed, 'f', -1, 64)
+	speedArgs := []string{"-y", "-i", videoFilename}
+	if !downloadConfig.AudioOnly {
+		speedArgs = append(speedArgs, "-filter:v", fmt.Sprintf("setpts=PTS/%s", speed))
+		if config.Preset == PresetTelegram {
+			speedArgs = append(speedArgs, "-c:v", "libx264", "-c:a", "aac")
+		}
+		if config.Faststart && videoFilenameExt == ".mp4" {
+			speedArgs = append(speedArgs, "-movflags", "+faststart")
+		}
+	}
+	if !downloadConfig.Mute {
+		speedArgs = append(speedArgs, "-filter:a", strings.Join(AtempoFilters(downloadConfig.Speed), ","))
+	}
+	var stderr bytes.Buffer
+	speedCmd := exec.CommandContext(ctx, ffmpegPath, append(speedArgs, spedVideoFilename)...)
+	speedCmd.Stderr = &stderr
+	if err := speedCmd.Run(); err != nil {
+		return "", fmt.Errorf("unable to change the speed: %s: %s", err, StderrTail(stderr.String()))
+	}
+	return spedVideoFilename, nil
+}
+
+// RemoveAudio strips the audio streams of videoFilename without re-encoding the video
+// and returns the name of the muted file.
+func RemoveAudio(ctx context.Context, videoFilename string) (string, error) {
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return "", fmt.Errorf("unable to remove audio: %s", err)
+	}
+	mutedVideoFilename, err := DerivedTempPath(videoFilename, "-muted", "")
+	if err != nil {
+		return "", fmt.Errorf("unable to remove audio: %s", err)
+	}
+	muteCmd := exec.CommandContext(
+		ctx,
+		ffmpegPath,
+		"-y",
+		"-i",
+		videoFilename,
+		"-c",
+		"copy",
+		"-an",
+		mutedVideoFilename,
+	)
+	if err := muteCmd.Run(); err != nil {
+		return "", fmt.Errorf("unable to remove audio: %s", err)
+	}
+	return mutedVideoFilename, nil
+}
+
+// ReplaceAudio replaces the audio of the video videoFilename with the audio
+// audioFilename (copying the video, the audio is encoded to aac) and returns the name of
+// the dubbed video. The video lasts as long as the shortest of both.
+func ReplaceAudio(ctx context.Context, config *Config, videoFilename, audioFilename string) (string, error) {
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return "", fmt.Errorf("unable to replace audio: %s", err)
+	}
+	dubbedVideoFilename, err := DerivedTempPath(videoFilename, "-dubbed", "")
+	if err != nil {
+		return "", fmt.Errorf("unable to replace audio: %s", err)
+	}
+	dubArgs := []string{
+		"-y",
+		"-i",
+		videoFilename,
+		"-i",
+		audioFilename,
+		"-map",
+		"0:v:0",
+		"-map",
+		"1:a:0",
+		"-c:v",
+		"copy",
+		"-c:a",
+		"aac",
+		"-shortest",
+	}
+	if config.Faststart && filepath.Ext(dubbedVideoFilename) == ".mp4" {
+		dubArgs = append(dubArgs, "-movflags", "+faststart")
+	}
+	var stderr bytes.Buffer
+	dubCmd := exec.CommandContext(ctx, ffmpegPath, append(dubArgs, dubbedVideoFilename)...)
+	dubCmd.Stderr = &stderr
+	if err := dubCmd.Run(); err != nil {
+		return "", fmt.Errorf("unable to replace audio: %s: %s", err, StderrTail(stderr.String()))
+	}
+	return dubbedVideoFilename, nil
+}
+
+// ProbeCodecs returns the codecs (like h264 and aac) of the first video stream and of the
+// first audio stream of filename using ffprobe, empty for the streams it does not have.
+func ProbeCodecs(ctx context.Context, filename string) (string, string, error) {
+	ffprobePath, err := exec.LookPath("ffprobe")
+	if err != nil {
+		return "", "", fmt.Errorf("unable to probe the codecs of %s: %s", filename, err)
+	}
+	output, err := exec.CommandContext(
+		ctx,
+		ffprobePath,
+		"-v",
+		"error",
+		"-show_entries",
+		"stream=codec_type,codec_name",
+		"-of",
+		"csv=p=0",
+		filename,
+	).Output()
+	if err != nil {
+		return "", "", fmt.Errorf("unable to probe the codecs of %s: %s", filename, err)
+	}
+	videoCodec, audioCodec := "", ""
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		codec, codecType, _ := strings.Cut(strings.TrimSpace(line), ",")
+		switch {
+		case codecType == "video" && videoCodec == "":
+			videoCodec = codec
+		case codecType == "audio" && audioCodec == "":
+			audioCodec = codec
+		}
+	}
+	if videoCodec == "" {
+		return "", "", fmt.Errorf("unable to probe the codecs of %s: it has no video", filename)
+	}
+	return videoCodec, audioCodec, nil
+}
+
+// IsPlaybackSafe reports whether Telegram plays inline a video with the extension ext
+// and the codecs videoCodec and audioCodec (empty when it has no audio).
+func IsPlaybackSafe(ext, videoCodec, audioCodec string) bool {
+	return ext == ".mp4" && videoCodec == "h264" && (audioCodec == "" || audioCodec == "aac")
+}
+
+// MakePlaybackSafe transcodes the video videoFilename (with the codecs videoCodec and
+// audioCodec) to h264 and aac in mp4 so Telegram plays it inline, the streams already in
+// those codecs are copied. It returns the name of the resulting file.
+func MakePlaybackSafe(ctx context.Context, config *Config, videoFilename, videoCodec, audioCodec string) (string, error) {
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return "", fmt.Errorf("unable to transcode video for playback: %s", err)
+	}
+	playbackVideoFilename, err := DerivedTempPath(videoFilename, "-playback", ".mp4")
+	if err != nil {
+		return "", fmt.Errorf("unable to transcode video for playback: %s", err)
+	}
+	playbackArgs := []string{"-y", "-i", videoFilename}
+	if videoCodec == "h264" {
+		playbackArgs = append(playbackArgs, "-c:v", "copy")
+	} else {
+		// yuv420p is the only pixel format every player decodes
+		playbackArgs = append(playbackArgs, "-c:v", "libx264", "-pix_fmt", "yuv420p")
+	}
+	if audioCodec == "aac" {
+		playbackArgs = append(playbackArgs, "-c:a", "copy")
+	} else {
+		playbackArgs = append(playbackArgs, "-c:a", "aac", "-b:a", "192k")
+	}
+	if config.Faststart {
+		playbackArgs = append(playbackArgs, "-movflags", "+faststart")
+	}
+	var stderr bytes.Buffer
+	playbackCmd := exec.CommandContext(ctx, ffmpegPath, append(playbackArgs, playbackVideoFilename)...)
+	playbackCmd.Stderr = &stderr
+	if err := playbackCmd.Run(); err != nil {
+		return "", fmt.Errorf("unable to transcode video for playback: %s: %s", err, StderrTail(stderr.String()))
+	}
+	return playbackVideoFilename, nil
+}
+
+// RemuxFaststart moves the moov atom of the mp4 video videoFilename to the front of the
+// file (without re-encoding it) and returns the name of the remuxed file.
+func RemuxFaststart(ctx context.Context, videoFilename string) (string, error) {
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return "", fmt.Errorf("unable to remux video: %s", err)
+	}
+	faststartVideoFilename, err := DerivedTempPath(videoFilename, "-faststart", "")
+	if err != nil {
+		return "", fmt.Errorf("unable to remux video: %s", err)
+	}
+	remuxCmd := exec.CommandContext(
+		ctx,
+		ffmpegPath,
+		"-y",
+		"-i",
+		videoFilename,
+		"-c",
+		"copy",
+		"-movflags",
+		"+faststart",
+		faststartVideoFilename,
+	)
+	if err := remuxCmd.Run(); err != nil {
+		return "", fmt.Errorf("unable to remux video: %s", err)
+	}
+	return faststartVideoFilename, nil
+}
+
+// MakePreview converts the first PreviewSeconds of videoFilename to a muted clip scaled
+// to PreviewHeight and returns the name of the clip.
+func MakePreview(ctx context.Context, videoFilename string) (string, error) {
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return "", fmt.Errorf("unable to make the preview: %s", err)
+	}
+	previewFilename, err := DerivedTempPath(videoFilename, "-small", ".mp4")
+	if err != nil {
+		return "", fmt.Errorf("unable to make the preview: %s", err)
+	}
+	var stderr bytes.Buffer
+	previewCmd := exec.CommandContext(
+		ctx,
+		ffmpegPath,
+		"-y",
+		"-i",
+		videoFilename,
+		"-t",
+		strconv.Itoa(PreviewSeconds),
+		"-an",
+		"-vf",
+		fmt.Sprintf("scale=-2:%d", PreviewHeight),
+		"-c:v",
+		"libx264",
+		"-preset",
+		"veryfast",
+		"-movflags",
+		"+faststart",
+		previewFilename,
+	)
+	previewCmd.Stderr = &stderr
+	if err := previewCmd.Run(); err != nil {
+		return "", fmt.Errorf("unable to make the preview: %s: %s", err, StderrTail(stderr.String()))
+	}
+	return previewFilename, nil
+}
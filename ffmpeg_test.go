@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeFfmpeg puts a fake ffmpeg in the PATH that, like the real one, refuses to
+// overwrite its output (the last argument) without -y, and otherwise creates it. It
+// returns a video in the temp dir to work on.
+func fakeFfmpeg(t *testing.T) string {
+	t.Helper()
+	t.Setenv("TMPDIR", t.TempDir())
+	fakeTools(t, map[string]string{"ffmpeg": `overwrite=false
+for arg; do
+	[ "$arg" = -y ] && overwrite=true
+	last=$arg
+done
+if [ -e "$last" ] && [ $overwrite = false ]; then
+	echo "File '$last' already exists. Exiting." >&2
+	exit 1
+fi
+: > "$last"
+`})
+	videoFilename := filepath.Join(TempDir(), "video.mp4")
+	if err := os.WriteFile(videoFilename, nil, 0o644); err != nil {
+		t.Fatalf("unable to write the video: %s", err)
+	}
+	return videoFilename
+}
+
+// leaveDerivedFile creates the file derived from videoFilename with suffix, like the
+// one a failed request leaves behind.
+func leaveDerivedFile(t *testing.T, videoFilename, suffix string) {
+	t.Helper()
+	derivedFilename, err := DerivedTempPath(videoFilename, suffix, "")
+	if err != nil {
+		t.Fatalf("DerivedTempPath returned error: %s", err)
+	}
+	if err := os.WriteFile(derivedFilename, nil, 0o644); err != nil {
+		t.Fatalf("unable to write %s: %s", derivedFilename, err)
+	}
+}
+
+func TestRemoveAudioOverwritesLeftovers(t *testing.T) {
+	videoFilename := fakeFfmpeg(t)
+	leaveDerivedFile(t, videoFilename, "-muted")
+	if _, err := RemoveAudio(context.Background(), videoFilename); err != nil {
+		t.Errorf("RemoveAudio returned error: %s", err)
+	}
+}
+
+func TestCutVideoRejectsEmptySpan(t *testing.T) {
+	tests := []struct {
+		name        string
+		startSecond float64
+		endSecond   float64
+	}{
+		{"start equals end", 10, 10},
+		{"start after end", 20, 10},
+		{"negative start", -5, 10},
+		{"NaN start", math.NaN(), 10},
+		{"NaN end", 10, math.NaN()},
+	}
+	for _, test := range tests {
+		downloadConfig := &DownloadConfig{StartSecond: test.startSecond, EndSecond: test.endSecond}
+		// the span is checked before looking for ffmpeg, so the file does not need to exist
+		if _, err := CutVideo(context.Background(), &Config{}, downloadConfig, "video.mp4"); err == nil {
+			t.Errorf("%s: CutVideo from second %g to second %g returned no error", test.name, test.startSecond, test.endSecond)
+		}
+	}
+}
+
+func TestRemuxFaststartOverwritesLeftovers(t *testing.T) {
+	videoFilename := fakeFfmpeg(t)
+	leaveDerivedFile(t, videoFilename, "-faststart")
+	if _, err := RemuxFaststart(context.Background(), videoFilename); err != nil {
+		t.Errorf("RemuxFaststart returned error: %s", err)
+	}
+}
+
+func TestAtempoFilters(t *testing.T) {
+	tests := []struct {
+		speed float64
+		want  string
+	}{
+		{1.5, "atempo=1.5"},
+		{0.5, "atempo=0.5"},
+		{2, "atempo=2"},
+		{3, "atempo=2,atempo=1.5"},
+		{4, "atempo=2,atempo=2"},
+		{0.25, "atempo=0.5,atempo=0.5"},
+		{0.3, "atempo=0.5,atempo=0.6"},
+	}
+	for _, test := range tests {
+		if got := strings.Join(AtempoFilters(test.speed), ","); got != test.want {
+			t.Errorf("AtempoFilters(%g) = %s, want %s", test.speed, got, test.want)
+		}
+	}
+}
+
+func TestParseCrop(t *testing.T) {
+	for _, mode := range []string{"square", "vertical"} {
+		if got, err := ParseCrop(mode); got != mode || err != nil {
+			t.Errorf("ParseCrop(%q) = %q, %v, want %q, nil", mode, got, err, mode)
+		}
+	}
+	for _, mode := range []string{"", "Square", "horizontal", "16:9"} {
+		if _, err := ParseCrop(mode); err == nil {
+			t.Errorf("ParseCrop(%q) returned no error", mode)
+		}
+	}
+}
+
+func TestCropGeometry(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		aspect        [2]int
+		want          [4]int
+	}{
+		{"landscape to square", 1920, 1080, CropAspects["square"], [4]int{1080, 1080, 420, 0}},
+		{"landscape to vertical", 1920, 1080, CropAspects["vertical"], [4]int{606, 1080, 657, 0}},
+		{"portrait to square", 720, 1280, CropAspects["square"], [4]int{720, 720, 0, 280}},
+		{"already vertical", 1080, 1920, CropAspects["vertical"], [4]int{1080, 1920, 0, 0}},
+		{"odd sizes", 641, 361, CropAspects["square"], [4]int{360, 360, 140, 0}},
+	}
+	for _, test := range tests {
+		width, height, x, y := CropGeometry(test.width, test.height, test.aspect)
+		if got := [4]int{width, height, x, y}; got != test.want {
+			t.Errorf("%s: CropGeometry(%d, %d) = %v, want %v", test.name, test.width, test.height, got, test.want)
+		}
+	}
+}
+
+func TestTargetVideoBitrate(t *testing.T) {
+	tests := []struct {
+		name         string
+		targetBytes  int64
+		duration     float64
+		audioBitrate int64
+		want         int64
+		wantErr      bool
+	}{
+		{"with audio", 10 * 1000 * 1000, 100, TargetAudioBitrate, 776000 - TargetAudioBitrate, false},
+		{"muted", 10 * 1000 * 1000, 100, 0, 776000, false},
+		{"too few bytes", 1000 * 1000, 100, TargetAudioBitrate, 0, true},
+		{"unknown duration", 10 * 1000 * 1000, 0, TargetAudioBitrate, 0, true},
+	}
+	for _, test := range tests {
+		bitrate, err := TargetVideoBitrate(test.targetBytes, test.duration, test.audioBitrate)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: TargetVideoBitrate returned error %v, want error %t", test.name, err, test.wantErr)
+			continue
+		}
+		if bitrate != test.want {
+			t.Errorf("%s: TargetVideoBitrate = %d, want %d", test.name, bitrate, test.want)
+		}
+	}
+	// the bitrate leaves room for the container, the file stays under the target
+	bitrate, _ := TargetVideoBitrate(20*1024*1024, 300, TargetAudioBitrate)
+	if size := float64(bitrate+TargetAudioBitrate) * 300 / 8; size >= 20*1024*1024 {
+		t.Errorf("TargetVideoBitrate makes a file of %.0f bytes, over the target", size)
+	}
+}
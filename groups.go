@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"unicode/utf16"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// HandleMyChatMember processes the changes of the bot's own membership. When the bot is
+// added to a group it posts the intro (if any), or leaves the group if the user who added
+// it is not authorized there and LEAVE_UNAUTHORIZED_GROUPS is set.
+func (app *App) HandleMyChatMember(update *tgbotapi.ChatMemberUpdated) {
+	if !update.Chat.IsGroup() && !update.Chat.IsSuperGroup() {
+		return
+	}
+	wasMember := !update.OldChatMember.HasLeft() && !update.OldChatMember.WasKicked()
+	isMember := !update.NewChatMember.HasLeft() && !update.NewChatMember.WasKicked()
+	if wasMember || !isMember {
+		return
+	}
+	log.Printf("[%s %d] Added the bot to the group %s %d", update.From.UserName, update.From.ID, update.Chat.Title, update.Chat.ID)
+	if !app.IsAuthorized(update.From.ID, update.Chat.ID) {
+		if !app.Config.LeaveUnauthorizedGroups {
+			return
+		}
+		log.Printf("[%s %d] Leaving the group %s %d since it is not authorized", update.From.UserName, update.From.ID, update.Chat.Title, update.Chat.ID)
+		if _, err := RequestWithRetry(app.Bot, tgbotapi.LeaveChatConfig{ChatID: update.Chat.ID}); err != nil {
+			log.Printf("Unable to leave the group %d: %s", update.Chat.ID, err)
+		}
+		return
+	}
+	if app.Config.GroupIntro == "" {
+		return
+	}
+	if _, err := SendWithRetry(app.Bot, tgbotapi.NewMessage(update.Chat.ID, app.Config.GroupIntro)); err != nil {
+		log.Printf("Unable to send the intro to the group %d: %s", update.Chat.ID, err)
+	}
+}
+
+// GroupRequest returns the text of the request in the group message msg. In groups the
+// bot only answers the messages that mention it, reply to it or start with GROUP_TRIGGER,
+// the mention and the trigger are removed from the text.
+func (app *App) GroupRequest(msg *tgbotapi.Message) (string, bool) {
+	text := strings.TrimSpace(msg.Text)
+	mention := "@" + app.Bot.Self.UserName
+	for _, entity := range msg.Entities {
+		if entity.IsMention() && strings.EqualFold(EntityText(msg.Text, entity), mention) {
+			text = strings.TrimSpace(strings.Replace(msg.Text, EntityText(msg.Text, entity), "", 1))
+			return text, true
+		}
+	}
+	if app.Config.GroupTrigger != "" && strings.HasPrefix(text, app.Config.GroupTrigger) {
+		return strings.TrimSpace(strings.TrimPrefix(text, app.Config.GroupTrigger)), true
+	}
+	if msg.ReplyToMessage != nil && msg.ReplyToMessage.From != nil && msg.ReplyToMessage.From.ID == app.Bot.Self.ID {
+		return text, true
+	}
+	return "", false
+}
+
+// EntityText returns the part of text covered by entity, the offsets of the entities are
+// in UTF-16 code units.
+func EntityText(text string, entity tgbotapi.MessageEntity) string {
+	units := utf16.Encode([]rune(text))
+	if entity.Offset < 0 || entity.Length < 0 || entity.Offset+entity.Length > len(units) {
+		return ""
+	}
+	return string(utf16.Decode(units[entity.Offset : entity.Offset+entity.Length]))
+}
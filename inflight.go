@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// InFlightRequest is a request attached to a download in progress.
+type InFlightRequest struct {
+	Msg            *tgbotapi.Message
+	DownloadConfig *DownloadConfig
+}
+
+// InFlightDownloads holds the downloads in progress so identical requests made in the
+// meantime wait for them instead of downloading the same video again, it is safe for
+// concurrent use.
+type InFlightDownloads struct {
+	mu sync.Mutex
+	// waiters holds the requests waiting for each download in progress, by download key.
+	waiters map[string][]InFlightRequest
+}
+
+// NewInFlightDownloads creates an empty InFlightDownloads.
+func NewInFlightDownloads() *InFlightDownloads {
+	return &InFlightDownloads{waiters: map[string][]InFlightRequest{}}
+}
+
+// DownloadKey returns the key identifying the files the download downloadConfig
+// produces, requests with the same key get the same files. It is built from the options
+// that change the files, the ones that only change how they are delivered (like album,
+// name or withdesc) are left out. A new option must be added here when it changes the
+// files.
+func DownloadKey(downloadConfig *DownloadConfig) string {
+	c := downloadConfig
+	return fmt.Sprintf(
+		"%s span=%g-%g pct=%g-%g highlight=%t bookends=%d sample=%d scene=%t audio=%t formats=%v channels=%d rate=%d alang=%s mute=%t dub=%s chapters=%t both=%t thumbnails=%d qualities=%v gif=%d,%d scale=%d fps=%d loop=%d timestamp=%s crop=%s speed=%g fit=%t height=%d target=%d bumper=%t anyformat=%t",
+		c.VideoUrl, c.StartSecond, c.EndSecond, c.StartPercent, c.EndPercent, c.Highlight, c.Bookends, c.SampleSeconds, c.Scene,
+		c.AudioOnly, c.AudioFormats, c.AudioChannels, c.AudioSampleRate, c.AudioLanguage, c.Mute, c.DubAudioFileId,
+		c.Chapters, c.Both, c.Thumbnails, c.Qualities, c.GifFps, c.GifWidth, c.Scale, c.Fps, c.LoopSeconds,
+		c.Timestamp, c.Crop, c.Speed, c.Fit, c.MaxHeight, c.TargetBytes, c.Bumper, c.AnyFormat,
+	)
+}
+
+// Start reports whether the request msg must run its download, which is the case unless
+// an identical download is already in progress: then the request is attached to it and
+// whoever runs it delivers the files with Finish. It also returns the key to pass to
+// Finish, the download may change downloadConfig (like snapping its cut to the scenes)
+// before finishing. Recordings are never shared, since they start recording when
+// requested.
+func (d *InFlightDownloads) Start(msg *tgbotapi.Message, downloadConfig *DownloadConfig) (string, bool) {
+	if downloadConfig.RecordDuration > 0 {
+		return "", true
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := DownloadKey(downloadConfig)
+	if waiters, ok := d.waiters[key]; ok {
+		d.waiters[key] = append(waiters, InFlightRequest{Msg: msg, DownloadConfig: downloadConfig})
+		return key, false
+	}
+	d.waiters[key] = []InFlightRequest{}
+	return key, true
+}
+
+// Finish marks the download with the key key (returned by Start) as done and returns
+// the requests that were attached to it meanwhile.
+func (d *InFlightDownloads) Finish(key string) []InFlightRequest {
+	if key == "" {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	waiters := d.waiters[key]
+	delete(d.waiters, key)
+	return waiters
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func mustLoadDownloadConfig(t *testing.T, msg string) *DownloadConfig {
+	t.Helper()
+	downloadConfig, err := LoadDownloadConfigFromMsg(msg)
+	if err != nil {
+		t.Fatalf("LoadDownloadConfigFromMsg(%q) returned error: %s", msg, err)
+	}
+	return downloadConfig
+}
+
+func TestDownloadKey(t *testing.T) {
+	const videoUrl = "https://youtu.be/dQw4w9WgXcQ"
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"0:10-0:51", "0:10-0:51", true},
+		{"0:10-0:51", "0:10-0:51 album", true},
+		{"0:10-0:51", "0:10-0:51 name:my_clip", true},
+		{"0:10-0:51", "0:10-0:51 withdesc", true},
+		{"0:10-0:51", "0:10-0:51 source", true},
+		{"0:10-0:51", "0:10-0:51 preview", true},
+		{"0:10-0:51", "0:10-0:51 video", true},
+		{"0:10-0:51", "0:10-0:52", false},
+		{"0:10-0:51", "0:10-0:51 audio", false},
+		{"0:10-0:51", "0:10-0:51 mute", false},
+		{"0:10-0:51", "0:10-0:51 scene", false},
+		{"0:10-0:51", "0:10-0:51 speed:1.5", false},
+		{"0:10-0:51", "0:10-0:51 crop:square", false},
+		{"0:10-0:51", "0:10-0:51 quality:720", false},
+		{"audio:mp3", "audio:m4a", false},
+		{"audio:mono+16k", "audio:mono+48k", false},
+		{"pct:10-20", "pct:10-30", false},
+		{"multi:360,720", "multi:360,480", false},
+	}
+	for _, test := range tests {
+		a := DownloadKey(mustLoadDownloadConfig(t, videoUrl+" "+test.a))
+		b := DownloadKey(mustLoadDownloadConfig(t, videoUrl+" "+test.b))
+		if (a == b) != test.same {
+			t.Errorf("DownloadKey of %q and %q are the same: %t, want %t", test.a, test.b, a == b, test.same)
+		}
+	}
+	other := DownloadKey(mustLoadDownloadConfig(t, "https://youtu.be/jNQXAC9IVRw 0:10-0:51"))
+	if other == DownloadKey(mustLoadDownloadConfig(t, videoUrl+" 0:10-0:51")) {
+		t.Error("DownloadKey of two videos with the same options are the same")
+	}
+}
+
+func TestInFlightDownloadsConcurrentStart(t *testing.T) {
+	const requests = 50
+	inFlight := NewInFlightDownloads()
+	var wg sync.WaitGroup
+	keys := make(chan string, requests)
+	runners := make(chan int, requests)
+	for i := 0; i < requests; i++ {
+		downloadConfig := mustLoadDownloadConfig(t, "https://youtu.be/dQw4w9WgXcQ 0:10-0:51")
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key, started := inFlight.Start(&tgbotapi.Message{MessageID: i}, downloadConfig)
+			keys <- key
+			if started {
+				runners <- i
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(keys)
+	close(runners)
+	if len(runners) != 1 {
+		t.Fatalf("%d of %d identical requests started their download, want 1", len(runners), requests)
+	}
+	key := <-keys
+	for other := range keys {
+		if other != key {
+			t.Fatalf("identical requests got the keys %q and %q", key, other)
+		}
+	}
+	if waiters := inFlight.Finish(key); len(waiters) != requests-1 {
+		t.Errorf("Finish returned %d waiters, want %d", len(waiters), requests-1)
+	}
+	if waiters := inFlight.Finish(key); len(waiters) != 0 {
+		t.Errorf("a second Finish returned %d waiters, want 0", len(waiters))
+	}
+	if _, started := inFlight.Start(&tgbotapi.Message{}, mustLoadDownloadConfig(t, "https://youtu.be/dQw4w9WgXcQ 0:10-0:51")); !started {
+		t.Error("a request after Finish did not start its download")
+	}
+}
+
+func TestInFlightDownloadsConcurrentDifferentDownloads(t *testing.T) {
+	inFlight := NewInFlightDownloads()
+	spans := []string{"0:10-0:51", "0:10-0:52", "0:10-0:53", "0:10-0:54", "0:10-0:55"}
+	var wg sync.WaitGroup
+	for _, span := range spans {
+		downloadConfig := mustLoadDownloadConfig(t, "https://youtu.be/dQw4w9WgXcQ "+span)
+		wg.Add(1)
+		go func(span string) {
+			defer wg.Done()
+			key, started := inFlight.Start(&tgbotapi.Message{}, downloadConfig)
+			if !started {
+				t.Errorf("the download of %s waited for another download", span)
+				return
+			}
+			if waiters := inFlight.Finish(key); len(waiters) != 0 {
+				t.Errorf("the download of %s got %d waiters, want 0", span, len(waiters))
+			}
+		}(span)
+	}
+	wg.Wait()
+	if len(inFlight.waiters) != 0 {
+		t.Errorf("%d downloads are still in flight after finishing all of them", len(inFlight.waiters))
+	}
+}
+
+func TestInFlightDownloadsFinishAfterTheConfigChanges(t *testing.T) {
+	inFlight := NewInFlightDownloads()
+	downloadConfig := mustLoadDownloadConfig(t, "https://youtu.be/dQw4w9WgXcQ 0:10-0:51 scene")
+	key, _ := inFlight.Start(&tgbotapi.Message{}, downloadConfig)
+	if _, started := inFlight.Start(&tgbotapi.Message{}, mustLoadDownloadConfig(t, "https://youtu.be/dQw4w9WgXcQ 0:10-0:51 scene")); started {
+		t.Fatal("an identical request started its download")
+	}
+	// the cut snapped to the scene changes while downloading
+	downloadConfig.StartSecond, downloadConfig.EndSecond = 9, 52
+	if waiters := inFlight.Finish(key); len(waiters) != 1 {
+		t.Errorf("Finish returned %d waiters, want 1", len(waiters))
+	}
+	if len(inFlight.waiters) != 0 {
+		t.Errorf("%d downloads are still in flight after finishing", len(inFlight.waiters))
+	}
+}
+
+func TestInFlightDownloadsNeverShareRecordings(t *testing.T) {
+	inFlight := NewInFlightDownloads()
+	for i := 0; i < 2; i++ {
+		key, started := inFlight.Start(&tgbotapi.Message{}, mustLoadDownloadConfig(t, "https://youtube.com/live/jfKfPfyJRdk record:10m"))
+		if !started {
+			t.Errorf("recording %d waited for another recording", i+1)
+		}
+		if waiters := inFlight.Finish(key); len(waiters) != 0 {
+			t.Errorf("recording %d got %d waiters, want 0", i+1, len(waiters))
+		}
+	}
+}
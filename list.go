@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// ListExtension is the extension of the documents with a list of requests.
+const ListExtension = ".txt"
+
+// MaxListBytes is how big a document with a list of requests can be, a line per request
+// never needs more.
+const MaxListBytes = 64 * 1024
+
+// ListRequests returns the requests of the list content, a request per line (a URL and
+// its option words), leaving out the blank lines and the ones starting with #.
+func ListRequests(content string) []string {
+	requests := []string{}
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		requests = append(requests, line)
+	}
+	return requests
+}
+
+// ProcessList downloads (one after the other) every request of the list attached as a
+// document to msg. The lines that can not be parsed are reported and skipped, every
+// other line is a request of its own, with its own quota and rate limit.
+func (app *App) ProcessList(msg *tgbotapi.Message) {
+	document := msg.Document
+	if !strings.EqualFold(filepath.Ext(document.FileName), ListExtension) {
+		text := fmt.Sprintf("Send me a %s file with a URL (and its options) per line to download all of them 🙀", ListExtension)
+		ReplyText(app.Bot, msg, app.Message(msg, EventListUsage, MessageData{}, text))
+		return
+	}
+	if document.FileSize > MaxListBytes {
+		data := MessageData{Limit: fmt.Sprintf("%d KB", MaxListBytes/1024)}
+		ReplyText(app.Bot, msg, app.Message(msg, EventListTooBig, data, fmt.Sprintf("Your list is too big, it can be at most %s 🙀", data.Limit)))
+		return
+	}
+	listFilename, err := DownloadTelegramFile(app.Bot, document.FileID)
+	if err != nil {
+		log.Printf("[%s %d] Unable to get the list %s: %s", msg.From.UserName, msg.From.ID, document.FileName, err)
+		ReplyText(app.Bot, msg, app.Message(msg, EventFailed, MessageData{Error: err.Error()}, "I'm sorry I was not able to get your list ☹"))
+		return
+	}
+	content, err := os.ReadFile(listFilename)
+	os.Remove(listFilename)
+	if err != nil {
+		log.Printf("[%s %d] Unable to read the list %s: %s", msg.From.UserName, msg.From.ID, document.FileName, err)
+		ReplyText(app.Bot, msg, app.Message(msg, EventFailed, MessageData{Error: err.Error()}, "I'm sorry I was not able to get your list ☹"))
+		return
+	}
+	requests := ListRequests(string(content))
+	if len(requests) == 0 {
+		ReplyText(app.Bot, msg, app.Message(msg, EventListEmpty, MessageData{}, "Your list has no URLs 🙀"))
+		return
+	}
+	if len(requests) > app.Config.MaxListUrls {
+		log.Printf("[%s %d] Rejected list %s: it has %d URLs", msg.From.UserName, msg.From.ID, document.FileName, len(requests))
+		data := MessageData{Count: len(requests), Max: app.Config.MaxListUrls}
+		text := fmt.Sprintf("Your list has %d URLs, I can take at most %d of them in a list 🙀", len(requests), app.Config.MaxListUrls)
+		ReplyText(app.Bot, msg, app.Message(msg, EventListTooLong, data, text))
+		return
+	}
+	msgs := []*tgbotapi.Message{}
+	downloadConfigs := []*DownloadConfig{}
+	failures := []string{}
+	for i, request := range requests {
+		downloadConfig, err := LoadDownloadConfigFromMsg(request)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%d. %s: %s", i+1, request, err))
+			continue
+		}
+		if app.UserPreferences.WantsAudio(msg.From.ID) {
+			downloadConfig = AudioByDefault(request, downloadConfig)
+		}
+		// each request is replied (and logged) as if it were a message of its own
+		requestMsg := *msg
+		requestMsg.Text = request
+		msgs = append(msgs, &requestMsg)
+		downloadConfigs = append(downloadConfigs, downloadConfig)
+	}
+	log.Printf("[%s %d] Received list %s with %d requests (%d skipped)", msg.From.UserName, msg.From.ID, document.FileName, len(downloadConfigs), len(failures))
+	text := app.Message(msg, EventListAccepted, MessageData{Count: len(downloadConfigs)}, fmt.Sprintf("Ok, I will download the %d URLs of your list one after the other", len(downloadConfigs)))
+	if len(failures) != 0 {
+		skipped := strings.Join(failures, "\n")
+		text += "\n\n" + app.Message(msg, EventListSkipped, MessageData{Count: len(failures), Text: skipped}, "I skipped these lines since I do not understand them:\n"+skipped)
+	}
+	reply := tgbotapi.NewMessage(msg.Chat.ID, text)
+	reply.ReplyToMessageID = msg.MessageID
+	reply.DisableWebPagePreview = true
+	if _, err := SendWithRetry(app.Bot, reply); err != nil {
+		log.Printf("[%s %d] Unable to send message: %s", msg.From.UserName, msg.From.ID, err)
+	}
+	// a list takes long, do not keep the other users waiting
+	go func() {
+		for i, downloadConfig := range downloadConfigs {
+			if downloadConfig.IsExpensive() {
+				app.AskConfirmation(msgs[i], downloadConfig)
+				continue
+			}
+			app.ProcessDownload(msgs[i], downloadConfig)
+		}
+	}()
+}
@@ -1,15 +1,21 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/url"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
@@ -21,31 +27,35 @@ import (
 //	21:50-58:00
 //	3:17:55-4:17:59
 //	41:40-1:23:00
+//	1:05.5-1:06.25
 // I chose this pattern because at the time I wrote this code, in the following link:
 // https://support.google.com/youtube/answer/71673
 // YouTube indicated that the max video length was 12 hours. I've seen YouTube videos
 // that last more than 99 hours, so if you want to match those you could try expanding
-// my regex.
-var VideoStartEndPattern = regexp.MustCompile(`([\d]{1,2}:)?[\d]{1,2}:[\d]{1,2}-([\d]{1,2}:)?[\d]{1,2}:[\d]{1,2}`)
+// my regex. The seconds can have a fraction (up to milliseconds) for frame accurate
+// clips.
+var VideoStartEndPattern = regexp.MustCompile(`^([\d]{1,2}:)?[\d]{1,2}:[\d]{1,2}(\.[\d]{1,3})?-([\d]{1,2}:)?[\d]{1,2}:[\d]{1,2}(\.[\d]{1,3})?$`)
 
 const InvalidVideoSecond = -1
 
-func Spot2Second(spot string) (int, error) {
+// Spot2Second turns spots like 1:05, 1:05.5 or 1:02:03 into seconds.
+func Spot2Second(spot string) (float64, error) {
 	parts := strings.Split(spot, ":")
 	partsLen := len(parts)
-	if partsLen < 2 {
+	if partsLen < 2 || partsLen > 3 {
 		return 0, fmt.Errorf("unable to parse spot %s", spot)
 	}
-	// parse seconds and validate they are less than 60
-	seconds, err := strconv.Atoi(parts[1])
+	// parse seconds (the last part, it may have a fraction) and validate they are less
+	// than 60
+	seconds, err := strconv.ParseFloat(parts[partsLen-1], 64)
 	if err != nil {
 		return 0, fmt.Errorf("unable to parse spot %s", spot)
 	}
-	if seconds > 59 {
+	if seconds >= 60 {
 		return 0, fmt.Errorf("unable to parse spot %s", spot)
 	}
 	// parse minutes and validate they are less than 60
-	minutes, err := strconv.Atoi(parts[0])
+	minutes, err := strconv.Atoi(parts[partsLen-2])
 	if err != nil {
 		return 0, fmt.Errorf("unable to parse spot %s", spot)
 	}
@@ -53,10 +63,10 @@ func Spot2Second(spot string) (int, error) {
 		return 0, fmt.Errorf("unable to parse spot %s", spot)
 	}
 	// turn the spot into a second by adding seconds and minutes
-	second := seconds + minutes*60
-	// if spot contains hours, parse hours and validate they are less than 24
+	second := seconds + float64(minutes*60)
+	// if spot contains hours, parse hours and validate they are less than 12
 	if partsLen == 3 {
-		hours, err := strconv.Atoi(parts[2])
+		hours, err := strconv.Atoi(parts[0])
 		if err != nil {
 			return 0, fmt.Errorf("unable to parse spot %s", spot)
 		}
@@ -64,12 +74,12 @@ func Spot2Second(spot string) (int, error) {
 			return 0, fmt.Errorf("unable to parse spot %s", spot)
 		}
 		// add the hours to the second representing the spot
-		second += hours * 60 * 60
+		second += float64(hours * 60 * 60)
 	}
 	return second, nil
 }
 
-func ParseStartEndSeconds(span string) (int, int, error) {
+func ParseStartEndSeconds(span string) (float64, float64, error) {
 	if !VideoStartEndPattern.MatchString(span) {
 		return 0, 0, fmt.Errorf("unable to parse video span %s", span)
 	}
@@ -91,119 +101,963 @@ func ParseStartEndSeconds(span string) (int, int, error) {
 	return startSecond, endSecond, nil
 }
 
-func LoadDownloadConfigFromMsg(msg string) (*url.URL, int, int, bool, error) {
-	args := strings.Split(msg, " ")
+// ParseUrlStartSecond parses the t param of videoUrl (the start time of the YouTube
+// share links), like 65, 65s or 1m5s, into seconds.
+func ParseUrlStartSecond(videoUrl *url.URL) (float64, error) {
+	t := strings.TrimSpace(videoUrl.Query().Get("t"))
+	if t == "" {
+		return 0, fmt.Errorf("the URL has no t param")
+	}
+	if _, err := strconv.ParseFloat(t, 64); err == nil {
+		t += "s"
+	}
+	start, err := time.ParseDuration(t)
+	if err != nil || start < 0 {
+		return 0, fmt.Errorf("unable to parse the t param %s of the URL", t)
+	}
+	return start.Seconds(), nil
+}
+
+// Second2Spot turns seconds into spots like 1:05, 1:05.5 or 1:02:03, the reverse of
+// Spot2Second.
+func Second2Spot(second float64) string {
+	second = math.Round(second*1000) / 1000
+	hours := int(second) / 3600
+	minutes := int(second) / 60 % 60
+	seconds := math.Round((second-float64(hours*3600+minutes*60))*1000) / 1000
+	secondsText := strconv.FormatFloat(seconds, 'f', -1, 64)
+	if seconds < 10 {
+		secondsText = "0" + secondsText
+	}
+	if hours > 0 {
+		return fmt.Sprintf("%d:%02d:%s", hours, minutes, secondsText)
+	}
+	return fmt.Sprintf("%d:%s", minutes, secondsText)
+}
+
+// FormatSeconds formats seconds for the ffmpeg -ss and -t options, rounded to
+// milliseconds (10 stays 10, 65.5 stays 65.5).
+func FormatSeconds(seconds float64) string {
+	return strconv.FormatFloat(math.Round(seconds*1000)/1000, 'f', -1, 64)
+}
+
+// NewJobId returns a short random id for a request.
+func NewJobId() string {
+	b := make([]byte, 3)
+	if _, err := rand.Read(b); err != nil {
+		// the id is only used in the logs, a clash is not a big deal
+		return fmt.Sprintf("%06x", time.Now().UnixNano()&0xffffff)
+	}
+	return hex.EncodeToString(b)
+}
+
+// ErrInvalidVideoUrl is returned when the 1st argument of a message is not an http(s)
+// URL, which usually means the user does not know how to use the bot.
+var ErrInvalidVideoUrl = errors.New("the 1st argument is not a valid video URL")
+
+// UsageMessage explains the user how to use the bot.
+const UsageMessage = `Send me the URL of a video and I will send you the video back, for example:
+
+https://youtu.be/dQw4w9WgXcQ
+
+You can also cut the video and ask for only the audio:
+
+https://youtu.be/dQw4w9WgXcQ 0:10-0:51 audio
+
+Other words you can add after the URL: mute, fit, highlight, withdesc, pct:10-20, bookends:10, thumbnails:12, scale:480, quality:1080, fps:15, record:10m, both, chapters, album, alang:es, target:20M, bumper, gif:fps=12,width=480, audio:mp3+m4a, audio:mono+16k, preview, speed:1.5, name:myclip, loop:30, crop:square, multi:360,720, scene, source, sample:15, timestamp.`
+
+// DownloadConfig holds everything a user asked for in a single message.
+type DownloadConfig struct {
+	// JobId is a short random id included in every log line about the request, so its
+	// whole life can be followed even when it interleaves with others.
+	JobId       string
+	VideoUrl    *url.URL
+	StartSecond float64
+	EndSecond   float64
+	AudioOnly   bool
+	Mute        bool
+	// Chapters asks to split the audio in one track per chapter.
+	Chapters bool
+	// Both asks to send the full video besides the cut one.
+	Both bool
+	// Album asks to send the files of the request grouped in albums.
+	Album bool
+	// Video asks for the video even when the user made audio their default.
+	Video bool
+	// Highlight asks to cut the most replayed moment of the video.
+	Highlight bool
+	// Bookends is the length (in seconds) of the start and the end of the video that are
+	// stitched together in a preview, 0 means no preview.
+	Bookends int
+	// Thumbnails is how many frames are tiled in a contact sheet sent instead of the
+	// video, 0 means the video is sent.
+	Thumbnails int
+	// AudioFormats are the formats (like mp3 and m4a) the best audio is transcoded to,
+	// each of them is sent. When empty the audio is sent as mp3.
+	AudioFormats []string
+	// AudioChannels and AudioSampleRate (in Hz) are the layout the audio is converted to
+	// (like mono at 16 kHz for speech), 0 keeps the ones of the video.
+	AudioChannels   int
+	AudioSampleRate int
+	// Qualities are the heights (in pixels) the video is downloaded at, each of them is
+	// sent. When empty the video is downloaded once.
+	Qualities []int
+	// DubAudioFileId is the Telegram file id of the audio that replaces the audio of the
+	// video (the dubwith requests), empty means the audio is kept.
+	DubAudioFileId string
+	// DubAudioFilename is the downloaded DubAudioFileId.
+	DubAudioFilename string
+	// GifFps and GifWidth are the framerate and the width (in pixels) of the GIF sent
+	// instead of the video, GifFps is 0 when the user did not use the gif option.
+	GifFps   int
+	GifWidth int
+	// StartPercent and EndPercent are the span (in percentage of the duration) to cut,
+	// EndPercent is 0 when the user did not use the pct option.
+	StartPercent float64
+	EndPercent   float64
+	// Scale is the height (in pixels) the video is scaled to, 0 means no scaling.
+	Scale int
+	// Fps is the framerate the video is converted to, 0 means the original framerate.
+	Fps int
+	// SampleSeconds is how many seconds from the start of the video are downloaded (and
+	// sent) as a sample, 0 means the whole video is downloaded.
+	SampleSeconds int
+	// LoopSeconds is the duration (in seconds) the video is looped to, 0 means it is not
+	// looped.
+	LoopSeconds int
+	// Timestamp is the timeline of the running time burned into the video, TimestampClip
+	// or TimestampSource, empty means no time is burned.
+	Timestamp string
+	// Crop is the aspect ratio (of CropAspects) the video is center-cropped to, empty
+	// means it is not cropped.
+	Crop string
+	// Speed is the factor the video (and its audio) is sped up by, a factor under 1
+	// slows it down and 0 means the original speed.
+	Speed float64
+	// RecordDuration is how long a live stream is recorded, 0 means the video is not a
+	// live stream.
+	RecordDuration time.Duration
+	// WithDescription asks to send the description of the video as a text file.
+	WithDescription bool
+	// Fit asks to lower the quality of the video until it fits the upload limit.
+	Fit bool
+	// MaxHeight limits the height (in pixels) of the downloaded video, 0 means the
+	// default format is used. It is asked for with the quality option, or taken from
+	// PRIVATE_MAX_HEIGHT and GROUP_MAX_HEIGHT.
+	MaxHeight int
+	// AudioLanguage is the language code of the audio track to download (for videos
+	// with dubs), empty means the default track.
+	AudioLanguage string
+	// TargetBytes is the size the video is compressed to, 0 means it is not compressed.
+	TargetBytes int64
+	// Bumper asks to add the intro and the outro of the operator around the video.
+	Bumper bool
+	// Name is the name (without extension) the files are sent with as documents, empty
+	// means they are sent as videos (or audios, photos...).
+	Name string
+	// Preview asks to send a short, small and muted clip of the video right away, before
+	// the full video is downloaded.
+	Preview bool
+	// Scene asks to move the ends of the cut to the nearest scene changes (within
+	// SceneSnapWindow seconds), so the cut does not start or end mid-scene.
+	Scene bool
+	// Source asks to attach a button to the original URL below the files.
+	Source bool
+	// Priority is the priority (like PriorityShort) of the request when waiting for the
+	// workers of the stages.
+	Priority int
+	// OnProgress is called with the percentage downloaded while yt-dlp downloads the
+	// video, nil means the progress is not reported.
+	OnProgress func(percent float64)
+	// OnQueued is called with the position of the request in the queue of the downloads
+	// and the estimated wait (0 when unknown) every time they change while it waits for a
+	// worker, and with 0 when its download starts. nil means they are not reported.
+	OnQueued func(position int, eta time.Duration)
+	// OnStderr is called with the stderr of every successful run of yt-dlp (to look for
+	// warnings), nil means it is discarded.
+	OnStderr func(stderr string)
+	// AnyFormat asks yt-dlp for the best format whatever it is, it is set when the
+	// requested format is not available.
+	AnyFormat bool
+	// OnFormatFallback is called when the requested format was not available and the
+	// best one was downloaded instead, nil means nobody is told.
+	OnFormatFallback func()
+	// Duration is the duration (in seconds) of the video, it is only resolved when the
+	// requested operations need it.
+	Duration float64
+	// Info is the metadata of the video, it is fetched by the first step of the request
+	// that needs it (see FetchInfo) and reused by the next ones.
+	Info *VideoInfo
+}
+
+// FetchInfo returns the metadata of the video, yt-dlp is asked only the first time.
+func (c *DownloadConfig) FetchInfo(ctx context.Context, config *Config) (*VideoInfo, error) {
+	if c.Info == nil {
+		info, err := FetchVideoInfo(ctx, config, c.VideoUrl.String())
+		if err != nil {
+			return nil, err
+		}
+		c.Info = info
+	}
+	return c.Info, nil
+}
+
+// SpanDuration returns the length of the span to cut, it must have one.
+func (c *DownloadConfig) SpanDuration() time.Duration {
+	return time.Duration((c.EndSecond - c.StartSecond) * float64(time.Second))
+}
+
+// CheckClipDuration returns an error when the span to cut is longer than
+// MaxClipDuration, spans still unknown pass (they must be checked once resolved).
+func CheckClipDuration(config *Config, downloadConfig *DownloadConfig) error {
+	if config.MaxClipDuration == 0 || !downloadConfig.HasSpan() {
+		return nil
+	}
+	if downloadConfig.SpanDuration() > config.MaxClipDuration {
+		return fmt.Errorf("the cut lasts %s, but the longest cut allowed lasts %s", downloadConfig.SpanDuration().Round(time.Second), config.MaxClipDuration)
+	}
+	return nil
+}
+
+// HasSpan reports whether the user asked to cut the video.
+func (c *DownloadConfig) HasSpan() bool {
+	return c.StartSecond != InvalidVideoSecond && c.EndSecond != InvalidVideoSecond
+}
+
+// AudioLayoutArgs returns the ffmpeg arguments converting the audio to the AudioChannels
+// and the AudioSampleRate the user asked for, empty when they did not ask for any.
+func (c *DownloadConfig) AudioLayoutArgs() []string {
+	args := []string{}
+	if c.AudioChannels != 0 {
+		args = append(args, "-ac", strconv.Itoa(c.AudioChannels))
+	}
+	if c.AudioSampleRate != 0 {
+		args = append(args, "-ar", strconv.Itoa(c.AudioSampleRate))
+	}
+	return args
+}
+
+// VideoFilters returns the ffmpeg video filters the user asked for, using any of them
+// forces a re-encode of the video.
+func (c *DownloadConfig) VideoFilters() []string {
+	filters := []string{}
+	if c.Scale != 0 {
+		filters = append(filters, fmt.Sprintf("scale=-2:%d", c.Scale))
+	}
+	if c.Fps != 0 {
+		filters = append(filters, fmt.Sprintf("fps=%d", c.Fps))
+	}
+	return filters
+}
+
+// ExpensiveOperations describes the CPU heavy operations (re-encodings) the user asked
+// for.
+func (c *DownloadConfig) ExpensiveOperations() []string {
+	operations := []string{}
+	if c.Scale != 0 {
+		operations = append(operations, fmt.Sprintf("scale the video to %dp", c.Scale))
+	}
+	if c.Fps != 0 {
+		operations = append(operations, fmt.Sprintf("convert the video to %d fps", c.Fps))
+	}
+	if c.TargetBytes != 0 {
+		operations = append(operations, fmt.Sprintf("compress the video to %.1f MB", float64(c.TargetBytes)/1024/1024))
+	}
+	if c.Bumper {
+		operations = append(operations, "add the intro and the outro")
+	}
+	if c.GifFps != 0 {
+		operations = append(operations, "convert the video to GIF")
+	}
+	if c.Speed != 0 {
+		operations = append(operations, fmt.Sprintf("change the speed to %gx", c.Speed))
+	}
+	if c.LoopSeconds != 0 {
+		operations = append(operations, fmt.Sprintf("loop the video to %d seconds", c.LoopSeconds))
+	}
+	if c.Crop != "" {
+		operations = append(operations, fmt.Sprintf("crop the video to %s", c.Crop))
+	}
+	if c.Timestamp != "" {
+		operations = append(operations, "burn the timestamp")
+	}
+	return operations
+}
+
+// PlayedSeconds returns how long seconds of the original video last once the speed is
+// changed.
+func (c *DownloadConfig) PlayedSeconds(seconds float64) float64 {
+	if c.Speed == 0 {
+		return seconds
+	}
+	return seconds / c.Speed
+}
+
+// IsExpensive reports whether the download needs CPU heavy operations, those must be
+// confirmed by the user before starting.
+func (c *DownloadConfig) IsExpensive() bool {
+	return len(c.ExpensiveOperations()) != 0
+}
+
+// LoadDownloadConfigFromMsg parses messages like:
+//	https://youtu.be/dQw4w9WgXcQ
+//	https://youtu.be/dQw4w9WgXcQ 0:10-0:51
+//	https://youtu.be/dQw4w9WgXcQ 0:10-0:51 audio
+//	https://youtu.be/dQw4w9WgXcQ?t=10 -0:51
+//	https://youtu.be/dQw4w9WgXcQ mute
+//	https://youtu.be/dQw4w9WgXcQ fit
+//	https://youtu.be/dQw4w9WgXcQ highlight audio
+//	https://youtu.be/dQw4w9WgXcQ audio:mp3+m4a
+//	https://youtu.be/dQw4w9WgXcQ audio:mono+16k
+//	https://youtu.be/dQw4w9WgXcQ withdesc
+//	https://youtu.be/dQw4w9WgXcQ pct:10-20
+//	https://youtu.be/dQw4w9WgXcQ bookends:10
+//	https://youtu.be/dQw4w9WgXcQ thumbnails:12
+//	https://youtu.be/dQw4w9WgXcQ 0:10-0:51 both
+//	https://youtu.be/dQw4w9WgXcQ chapters
+//	https://youtu.be/dQw4w9WgXcQ chapters album
+//	https://youtu.be/dQw4w9WgXcQ 0:10-0:51 scale:480 fps:15
+//	https://youtu.be/dQw4w9WgXcQ quality:1080
+//	https://youtube.com/live/jfKfPfyJRdk record:10m
+//	https://youtu.be/dQw4w9WgXcQ 0:10-0:51 target:20M
+//	https://youtu.be/dQw4w9WgXcQ 0:10-0:51 bumper
+//	https://youtu.be/dQw4w9WgXcQ 0:10-0:15 gif:fps=12,width=480
+//	https://youtu.be/dQw4w9WgXcQ preview
+//	https://youtu.be/dQw4w9WgXcQ 0:10-0:51 speed:1.5
+//	https://youtu.be/dQw4w9WgXcQ 0:10-0:51 name:my_clip
+//	https://youtu.be/dQw4w9WgXcQ 0:10-0:15 loop:30
+//	https://youtu.be/dQw4w9WgXcQ 0:10-0:51 crop:vertical
+//	https://youtu.be/dQw4w9WgXcQ 0:10-0:51 multi:360,720
+//	https://youtu.be/dQw4w9WgXcQ 0:10-0:51 scene
+//	https://youtu.be/dQw4w9WgXcQ source
+//	https://youtu.be/dQw4w9WgXcQ sample:15
+//	https://youtu.be/dQw4w9WgXcQ 0:10-0:51 timestamp
+//	https://youtu.be/dQw4w9WgXcQ 0:10-0:51 timestamp:source
+// The first argument is always the video URL, the rest of the arguments (the video
+// spots to make the cut and the option words) can be used in any order.
+func LoadDownloadConfigFromMsg(msg string) (*DownloadConfig, error) {
+	args := strings.Fields(msg)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("the message is empty: %w", ErrInvalidVideoUrl)
+	}
 	videoUrl, err := url.Parse(args[0])
-	if err != nil {
-		return &url.URL{}, InvalidVideoSecond, InvalidVideoSecond, false, fmt.Errorf("unable to parse the 1st argument (video URL)")
-	}
-	argsLen := len(args)
-	if argsLen == 1 {
-		return videoUrl, InvalidVideoSecond, InvalidVideoSecond, false, nil
-	}
-	// at this point, argsLen is greather than 1
-	var (
-		startSecond = InvalidVideoSecond
-		endSecond   = InvalidVideoSecond
-		audioOnly   = false
-		secondArg   = strings.ToLower(args[1])
-	)
-	if secondArg == "audio" {
-		return videoUrl, startSecond, endSecond, true, nil
-	}
-	startSecond, endSecond, err = ParseStartEndSeconds(secondArg)
-	if err != nil {
-		return &url.URL{}, InvalidVideoSecond, InvalidVideoSecond, false, fmt.Errorf("unable to parse the 2nd argument (video spots to make the cut or audio word)")
+	if err != nil || (videoUrl.Scheme != "http" && videoUrl.Scheme != "https") || videoUrl.Host == "" {
+		return nil, fmt.Errorf("unable to parse the 1st argument (%s): %w", args[0], ErrInvalidVideoUrl)
+	}
+	config := &DownloadConfig{
+		JobId:       NewJobId(),
+		VideoUrl:    videoUrl,
+		StartSecond: InvalidVideoSecond,
+		EndSecond:   InvalidVideoSecond,
+	}
+	for i, arg := range args[1:] {
+		arg = strings.ToLower(arg)
+		switch {
+		case arg == "audio":
+			config.AudioOnly = true
+		case strings.HasPrefix(arg, "audio:"):
+			config.AudioOnly = true
+			config.AudioFormats, config.AudioChannels, config.AudioSampleRate, err = ParseAudioOption(strings.TrimPrefix(arg, "audio:"))
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse argument %d (%s): %s", i+2, arg, err)
+			}
+		case arg == "mute":
+			config.Mute = true
+		case arg == "video":
+			config.Video = true
+		case arg == "both":
+			config.Both = true
+		case arg == "chapters":
+			config.Chapters = true
+		case arg == "album":
+			config.Album = true
+		case arg == "fit":
+			config.Fit = true
+		case arg == "highlight":
+			config.Highlight = true
+		case arg == "withdesc":
+			config.WithDescription = true
+		case arg == "bumper":
+			config.Bumper = true
+		case arg == "preview":
+			config.Preview = true
+		case arg == "scene":
+			config.Scene = true
+		case arg == "source":
+			config.Source = true
+		case arg == "timestamp":
+			config.Timestamp = TimestampClip
+		case strings.HasPrefix(arg, "timestamp:"):
+			config.Timestamp = strings.TrimPrefix(arg, "timestamp:")
+			if config.Timestamp != TimestampClip && config.Timestamp != TimestampSource {
+				return nil, fmt.Errorf("unable to parse argument %d (%s): unknown timeline %q, use %s or %s", i+2, arg, config.Timestamp, TimestampClip, TimestampSource)
+			}
+		case strings.HasPrefix(arg, "pct:"):
+			config.StartPercent, config.EndPercent, err = ParsePercentSpan(strings.TrimPrefix(arg, "pct:"))
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse argument %d (%s): %s", i+2, arg, err)
+			}
+		case strings.HasPrefix(arg, "record:"):
+			config.RecordDuration, err = ParseRecordDuration(strings.TrimPrefix(arg, "record:"))
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse argument %d (%s): %s", i+2, arg, err)
+			}
+		case strings.HasPrefix(arg, "alang:"):
+			config.AudioLanguage = strings.TrimPrefix(arg, "alang:")
+			if !AudioLanguagePattern.MatchString(config.AudioLanguage) {
+				return nil, fmt.Errorf("unable to parse argument %d (%s): the language must be a 2 or 3 letters code like es", i+2, arg)
+			}
+		case strings.HasPrefix(arg, "target:"):
+			config.TargetBytes, err = ParseTargetSize(strings.TrimPrefix(arg, "target:"))
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse argument %d (%s): %s", i+2, arg, err)
+			}
+		case strings.HasPrefix(arg, "bookends:"):
+			config.Bookends, err = ParseBoundedInt(strings.TrimPrefix(arg, "bookends:"), MinBookends, MaxBookends)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse argument %d (%s): %s", i+2, arg, err)
+			}
+		case strings.HasPrefix(arg, "thumbnails:"):
+			config.Thumbnails, err = ParseBoundedInt(strings.TrimPrefix(arg, "thumbnails:"), MinThumbnails, MaxThumbnails)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse argument %d (%s): %s", i+2, arg, err)
+			}
+		case arg == "gif" || strings.HasPrefix(arg, "gif:"):
+			config.GifFps, config.GifWidth, err = ParseGifOptions(strings.TrimPrefix(strings.TrimPrefix(arg, "gif"), ":"))
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse argument %d (%s): %s", i+2, arg, err)
+			}
+		case strings.HasPrefix(arg, "scale:"):
+			config.Scale, err = ParseBoundedInt(strings.TrimPrefix(arg, "scale:"), MinScale, MaxScale)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse argument %d (%s): %s", i+2, arg, err)
+			}
+		case strings.HasPrefix(arg, "quality:"):
+			config.MaxHeight, err = ParseBoundedInt(strings.TrimSuffix(strings.TrimPrefix(arg, "quality:"), "p"), MinScale, MaxScale)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse argument %d (%s): %s", i+2, arg, err)
+			}
+		case strings.HasPrefix(arg, "name:"):
+			// the name keeps the case the user wrote it in
+			config.Name, err = ParseOutputName(args[i+1][len("name:"):])
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse argument %d (%s): %s", i+2, arg, err)
+			}
+		case strings.HasPrefix(arg, "sample:"):
+			config.SampleSeconds, err = ParseBoundedInt(strings.TrimPrefix(arg, "sample:"), MinSampleSeconds, MaxSampleSeconds)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse argument %d (%s): %s", i+2, arg, err)
+			}
+		case strings.HasPrefix(arg, "loop:"):
+			config.LoopSeconds, err = ParseBoundedInt(strings.TrimPrefix(arg, "loop:"), MinLoopSeconds, MaxLoopSeconds)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse argument %d (%s): %s", i+2, arg, err)
+			}
+		case strings.HasPrefix(arg, "multi:"):
+			config.Qualities, err = ParseQualities(strings.TrimPrefix(arg, "multi:"))
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse argument %d (%s): %s", i+2, arg, err)
+			}
+		case strings.HasPrefix(arg, "crop:"):
+			config.Crop, err = ParseCrop(strings.TrimPrefix(arg, "crop:"))
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse argument %d (%s): %s", i+2, arg, err)
+			}
+		case strings.HasPrefix(arg, "speed:"):
+			config.Speed, err = ParseSpeed(strings.TrimPrefix(arg, "speed:"))
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse argument %d (%s): %s", i+2, arg, err)
+			}
+		case strings.HasPrefix(arg, "-"):
+			// the end of a cut starting at the t param of the URL, like -0:51
+			if config.HasSpan() {
+				return nil, fmt.Errorf("unable to parse argument %d (%s): the video spots to make the cut were already given", i+2, arg)
+			}
+			startSecond, err := ParseUrlStartSecond(videoUrl)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse argument %d (%s): %s", i+2, arg, err)
+			}
+			endSecond, err := Spot2Second(strings.TrimPrefix(arg, "-"))
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse argument %d (%s): %s", i+2, arg, err)
+			}
+			if startSecond >= endSecond {
+				return nil, fmt.Errorf("unable to parse argument %d (%s): the t param of the URL (%s) is after or at the same that the end spot", i+2, arg, Second2Spot(startSecond))
+			}
+			config.StartSecond, config.EndSecond = startSecond, endSecond
+		case strings.HasPrefix(arg, "fps:"):
+			config.Fps, err = ParseBoundedInt(strings.TrimPrefix(arg, "fps:"), MinFps, MaxFps)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse argument %d (%s): %s", i+2, arg, err)
+			}
+		default:
+			if config.HasSpan() {
+				return nil, fmt.Errorf("unable to parse argument %d (%s): the video spots to make the cut were already given", i+2, arg)
+			}
+			config.StartSecond, config.EndSecond, err = ParseStartEndSeconds(arg)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse argument %d (%s): it is neither an option word nor the video spots to make the cut", i+2, arg)
+			}
+		}
 	}
-	if argsLen == 2 {
-		return videoUrl, startSecond, endSecond, audioOnly, nil
+	if config.AudioOnly && config.Mute {
+		return nil, fmt.Errorf("the audio and mute words can not be used together")
 	}
-	// at this point, argsLen is greather than 2
-	if argsLen > 3 {
-		return &url.URL{}, InvalidVideoSecond, InvalidVideoSecond, false, fmt.Errorf("more than 3 arguments were used")
+	if config.AudioOnly && config.Video {
+		return nil, fmt.Errorf("the audio and video words can not be used together")
 	}
-	thirdArg := args[2]
-	if thirdArg != "audio" {
-		return &url.URL{}, InvalidVideoSecond, InvalidVideoSecond, false, fmt.Errorf("unable to parse the 3rd argument: this argument can only be the audio word")
+	if config.AudioOnly && len(config.VideoFilters()) != 0 {
+		return nil, fmt.Errorf("the audio word can not be used with the scale or fps options")
 	}
-	return videoUrl, startSecond, endSecond, true, nil
+	spans := 0
+	for _, hasSpan := range []bool{config.HasSpan(), config.Highlight, config.EndPercent != 0, config.Bookends != 0} {
+		if hasSpan {
+			spans++
+		}
+	}
+	if spans > 1 {
+		return nil, fmt.Errorf("only one of the video spots to make the cut, the highlight word, the pct option or the bookends option can be used")
+	}
+	if config.SampleSeconds != 0 {
+		if spans != 0 || config.Both || config.Chapters || config.RecordDuration > 0 || len(config.Qualities) != 0 {
+			return nil, fmt.Errorf("the sample option can not be used to cut the video nor with the both or chapters words nor the record or multi options")
+		}
+		// the sample is a cut of the start, it is cut again in case the site ignores the
+		// range (a fast cut of a short file)
+		config.StartSecond, config.EndSecond = 0, float64(config.SampleSeconds)
+		spans = 1
+	}
+	if len(config.AudioFormats) != 0 && (config.Chapters || config.Both || config.Bookends != 0) {
+		return nil, fmt.Errorf("the audio option with formats can not be used with the chapters or both words nor the bookends option")
+	}
+	if config.Chapters {
+		if config.Mute || config.Video || spans > 0 || config.Both || config.RecordDuration > 0 {
+			return nil, fmt.Errorf("the chapters word can not be used with the mute, video or both words, nor to cut or record the video")
+		}
+		// only the audio is split in chapters
+		config.AudioOnly = true
+	}
+	if config.Both && (spans == 0 || config.Fit) {
+		return nil, fmt.Errorf("the both word needs a cut and can not be used with the fit word")
+	}
+	if config.RecordDuration > 0 && (spans > 0 || config.Fit) {
+		return nil, fmt.Errorf("the record option can not be used to cut the video nor with the fit word")
+	}
+	if config.Thumbnails != 0 && (config.AudioOnly || config.Chapters || config.Both || config.RecordDuration > 0 || config.TargetBytes != 0) {
+		return nil, fmt.Errorf("the thumbnails option can not be used with the audio, chapters or both words nor the record or target options")
+	}
+	if config.TargetBytes != 0 && (config.AudioOnly || config.Fit || config.RecordDuration > 0) {
+		return nil, fmt.Errorf("the target option can not be used with the audio or fit words nor the record option")
+	}
+	if config.GifFps != 0 {
+		if spans == 0 {
+			return nil, fmt.Errorf("the gif option needs a cut")
+		}
+		if config.AudioOnly || config.Chapters || config.Both || config.Fit || config.Thumbnails != 0 || config.TargetBytes != 0 || config.Bumper || len(config.VideoFilters()) != 0 {
+			return nil, fmt.Errorf("the gif option can not be used with the audio, chapters, both, fit or bumper words nor the thumbnails, target, scale or fps options")
+		}
+	}
+	if config.Bumper && (config.AudioOnly || config.Chapters || config.Thumbnails != 0 || config.TargetBytes != 0) {
+		return nil, fmt.Errorf("the bumper word can not be used with the audio or chapters words nor the thumbnails or target options")
+	}
+	if config.Preview && (config.AudioOnly || config.Chapters || config.Thumbnails != 0 || config.GifFps != 0 || config.RecordDuration > 0) {
+		return nil, fmt.Errorf("the preview word can not be used with the audio or chapters words nor the thumbnails, gif or record options")
+	}
+	if config.Name != "" && config.Album {
+		return nil, fmt.Errorf("the name option can not be used with the album word")
+	}
+	if config.LoopSeconds != 0 && (config.Chapters || config.Thumbnails != 0 || config.GifFps != 0 || config.RecordDuration > 0) {
+		return nil, fmt.Errorf("the loop option can not be used with the chapters word nor the thumbnails, gif or record options")
+	}
+	if config.Scene && (spans == 0 || config.Bookends != 0 || config.AudioOnly) {
+		return nil, fmt.Errorf("the scene word needs a cut (not the bookends option) and can not be used with the audio word")
+	}
+	if config.MaxHeight != 0 && (config.AudioOnly || config.Chapters || len(config.Qualities) != 0) {
+		return nil, fmt.Errorf("the quality option can not be used with the audio or chapters words nor the multi option")
+	}
+	if len(config.Qualities) != 0 && (config.AudioOnly || config.Chapters || config.Both || config.Fit || config.Thumbnails != 0 || config.GifFps != 0 || config.RecordDuration > 0) {
+		return nil, fmt.Errorf("the multi option can not be used with the audio, chapters, both or fit words nor the thumbnails, gif or record options")
+	}
+	if config.Timestamp != "" && (config.AudioOnly || config.Chapters || config.Thumbnails != 0) {
+		return nil, fmt.Errorf("the timestamp option can not be used with the audio or chapters words nor the thumbnails option")
+	}
+	if config.Crop != "" && (config.AudioOnly || config.Chapters || config.Thumbnails != 0) {
+		return nil, fmt.Errorf("the crop option can not be used with the audio or chapters words nor the thumbnails option")
+	}
+	if config.Speed != 0 && (config.Chapters || config.Thumbnails != 0) {
+		return nil, fmt.Errorf("the speed option can not be used with the chapters word nor the thumbnails option")
+	}
+	if config.AudioLanguage != "" && (config.Mute || config.RecordDuration > 0) {
+		return nil, fmt.Errorf("the alang option can not be used with the mute word nor the record option")
+	}
+	return config, nil
 }
 
-func CutVideo(videoFilename string, startSecond, endSecond int, audioOnly bool) (string, error) {
-	ffmpegPath, err := exec.LookPath("ffmpeg")
-	if err != nil {
-		return "", fmt.Errorf("unable to cut video: %s", err)
-	}
-	videoFilenameExt := filepath.Ext(videoFilename)
-	finalVideoFilename := videoFilename[:len(videoFilename)-len(videoFilenameExt)] + "-cut"
-	if audioOnly {
-		finalVideoFilename = finalVideoFilename + ".mp3"
-	} else {
-		finalVideoFilename = finalVideoFilename + videoFilenameExt
-	}
-	cutCmd := exec.Command(
-		ffmpegPath, "-ss",
-		fmt.Sprint(startSecond),
-		"-i",
-		videoFilename,
-		"-t",
-		fmt.Sprint(endSecond-startSecond),
-		finalVideoFilename,
-	)
-	videoFilename = finalVideoFilename
-	if err := cutCmd.Run(); err != nil {
-		return "", fmt.Errorf("unable to cut video: %s", err)
-	}
-	return finalVideoFilename, nil
-}
-
-func BuildYtdlpCmd(videoUrl string, audioOnly bool) (string, string, []string, error) {
-	ytdlpPath, err := exec.LookPath("yt-dlp")
-	if err != nil {
-		return "", "", nil, fmt.Errorf("yt-dlp is not installed: %s", err)
+// Limits (in seconds) of the sample option.
+const (
+	MinSampleSeconds = 1
+	MaxSampleSeconds = 300
+)
+
+// MaxQualities is how many qualities the multi option can ask for.
+const MaxQualities = 4
+
+// ParseQualities parses the heights of the multi option, like 360,720, each between
+// MinScale and MaxScale. Repeated heights are ignored.
+func ParseQualities(value string) ([]int, error) {
+	qualities := []int{}
+	seen := map[int]bool{}
+	for _, height := range strings.Split(value, ",") {
+		quality, err := ParseBoundedInt(strings.TrimSuffix(height, "p"), MinScale, MaxScale)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[quality] {
+			seen[quality] = true
+			qualities = append(qualities, quality)
+		}
 	}
-	ytdlpArgs := []string{}
-	if audioOnly {
-		ytdlpArgs = append(ytdlpArgs, "-x", "--audio-format", "mp3")
+	if len(qualities) > MaxQualities {
+		return nil, fmt.Errorf("at most %d qualities can be asked for", MaxQualities)
 	}
-	ytdlpArgs = append(ytdlpArgs, "-f", "18", videoUrl)
-	f, err := os.CreateTemp("", "gatonaranja.*.mp4")
-	if err != nil {
-		return "", "", nil, fmt.Errorf("unable to create temp file to save the downloaded video: %s", err)
+	return qualities, nil
+}
+
+// AudioCodecs are the ffmpeg arguments to encode each of the formats of the audio
+// option.
+var AudioCodecs = map[string][]string{
+	"mp3":  {"-c:a", "libmp3lame", "-q:a", "2"},
+	"m4a":  {"-c:a", "aac", "-b:a", "192k"},
+	"opus": {"-c:a", "libopus", "-b:a", "128k"},
+	"flac": {"-c:a", "flac"},
+	"wav":  {"-c:a", "pcm_s16le"},
+}
+
+// AudioSampleRates are the sample rates (in Hz) of the audio option, by their word.
+var AudioSampleRates = map[string]int{
+	"8k":  8000,
+	"16k": 16000,
+	"22k": 22050,
+	"24k": 24000,
+	"44k": 44100,
+	"48k": 48000,
+}
+
+// OpusSampleRates are the sample rates (in Hz) the opus encoder supports.
+var OpusSampleRates = map[int]bool{8000: true, 16000: true, 24000: true, 48000: true}
+
+// ParseAudioOption parses the value of the audio option, like mp3+m4a or opus+mono+16k:
+// the formats (see ParseAudioFormats), the channels (mono is 1, 0 when not given) and
+// the sample rate (0 when not given).
+func ParseAudioOption(value string) ([]string, int, int, error) {
+	formatWords := []string{}
+	channels, sampleRate := 0, 0
+	for _, word := range strings.Split(value, "+") {
+		if word == "mono" {
+			channels = 1
+			continue
+		}
+		if rate, ok := AudioSampleRates[word]; ok {
+			if sampleRate != 0 && sampleRate != rate {
+				return nil, 0, 0, fmt.Errorf("the audio can only have one sample rate")
+			}
+			sampleRate = rate
+			continue
+		}
+		formatWords = append(formatWords, word)
+	}
+	formats := []string{}
+	if len(formatWords) != 0 {
+		var err error
+		formats, err = ParseAudioFormats(strings.Join(formatWords, "+"))
+		if err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	for _, format := range formats {
+		if format == "opus" && sampleRate != 0 && !OpusSampleRates[sampleRate] {
+			return nil, 0, 0, fmt.Errorf("opus does not support %d Hz, use 8k, 16k, 24k or 48k", sampleRate)
+		}
+	}
+	return formats, channels, sampleRate, nil
+}
+
+// ParseAudioFormats parses the formats of the audio option, like mp3+m4a, repeated
+// formats are ignored.
+func ParseAudioFormats(value string) ([]string, error) {
+	formats := []string{}
+	seen := map[string]bool{}
+	for _, format := range strings.Split(value, "+") {
+		if _, ok := AudioCodecs[format]; !ok {
+			return nil, fmt.Errorf("unknown audio format %q, use mp3, m4a, opus, flac or wav (or mono and a sample rate: 8k, 16k, 22k, 24k, 44k or 48k)", format)
+		}
+		if !seen[format] {
+			seen[format] = true
+			formats = append(formats, format)
+		}
+	}
+	return formats, nil
+}
+
+// MaxOutputNameLength is how many characters the name of the name option can have.
+const MaxOutputNameLength = 64
+
+// OutputNamePattern matches the names of the name option, like my_clip or clip-2.1. They
+// can not start with a dot (hidden files) nor contain path separators.
+var OutputNamePattern = regexp.MustCompile(`^[\p{L}\p{N}_-][\p{L}\p{N}._-]*$`)
+
+// ParseOutputName parses the name of the name option.
+func ParseOutputName(value string) (string, error) {
+	if utf8.RuneCountInString(value) > MaxOutputNameLength {
+		return "", fmt.Errorf("the name can have at most %d characters", MaxOutputNameLength)
 	}
-	outputFilename := f.Name()
-	f.Close()
-	err = os.Remove(outputFilename)
+	if !OutputNamePattern.MatchString(value) || strings.Contains(value, "..") {
+		return "", fmt.Errorf("the name can only have letters, numbers, dots, dashes and underscores")
+	}
+	return value, nil
+}
+
+// AudioLanguagePattern matches the language codes of the alang option, like es or spa.
+var AudioLanguagePattern = regexp.MustCompile(`^[a-z]{2,3}$`)
+
+// Limits of the scale and fps options.
+const (
+	MinScale = 144
+	MaxScale = 2160
+	MinFps   = 1
+	MaxFps   = 60
+)
+
+// ParseBoundedInt parses value as an int between min and max (both included).
+func ParseBoundedInt(value string, min, max int) (int, error) {
+	n, err := strconv.Atoi(value)
 	if err != nil {
-		return "", "", nil, fmt.Errorf("unable to remove temp file to save the downloaded video: %s", err)
+		return 0, fmt.Errorf("unable to parse %s into an int", value)
 	}
-	if audioOnly {
-		outputFilename = outputFilename[:len(outputFilename)-1] + "3"
+	if n < min || n > max {
+		return 0, fmt.Errorf("%d must be between %d and %d", n, min, max)
 	}
-	ytdlpArgs = append(ytdlpArgs, "-o", outputFilename)
-	return ytdlpPath, outputFilename, ytdlpArgs, nil
+	return n, nil
 }
 
-func DownloadVideo(videoUrl string, startSecond, endSecond int, audioOnly bool) (string, error) {
-	ytdlpPath, videoFilename, ytdlpArgs, err := BuildYtdlpCmd(videoUrl, audioOnly)
+// Limits of the bookends option (in seconds).
+const (
+	MinBookends = 1
+	MaxBookends = 60
+)
+
+// Limits of the thumbnails option.
+const (
+	MinThumbnails = 2
+	MaxThumbnails = 36
+)
+
+// Defaults and limits of the gif option, the width is capped to keep the GIFs light
+// (a GIF weighs much more than the same video).
+const (
+	DefaultGifFps   = 10
+	DefaultGifWidth = 320
+	MinGifFps       = 1
+	MaxGifFps       = 30
+	MinGifWidth     = 64
+	MaxGifWidth     = 640
+	// MaxGifSeconds is the longest cut that can be turned into a GIF.
+	MaxGifSeconds = 60
+)
+
+// ParseGifOptions parses the sub-options of the gif option, like fps=12,width=480 (both
+// are optional, an empty value takes the defaults), into the framerate and the width.
+func ParseGifOptions(value string) (int, int, error) {
+	fps, width := DefaultGifFps, DefaultGifWidth
+	if value == "" {
+		return fps, width, nil
+	}
+	for _, option := range strings.Split(value, ",") {
+		name, number, found := strings.Cut(option, "=")
+		if !found {
+			return 0, 0, fmt.Errorf("unable to parse %s, the gif options look like fps=12,width=480", option)
+		}
+		var err error
+		switch name {
+		case "fps":
+			fps, err = ParseBoundedInt(number, MinGifFps, MaxGifFps)
+		case "width":
+			width, err = ParseBoundedInt(number, MinGifWidth, MaxGifWidth)
+		default:
+			return 0, 0, fmt.Errorf("unknown gif option %s, use fps or width", name)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return fps, width, nil
+}
+
+// ContactSheetFrameWidth is the width (in pixels) of each frame of a contact sheet.
+const ContactSheetFrameWidth = 320
+
+// Limits of the target option.
+const (
+	MinTargetBytes = 1024 * 1024
+	MaxTargetBytes = 2 * 1024 * 1024 * 1024
+)
+
+const (
+	MinLoopSeconds = 2
+	MaxLoopSeconds = 600
+)
+
+const (
+	MinSpeed = 0.25
+	MaxSpeed = 4.0
+)
+
+// ParseSpeed parses the factor of the speed option, like 1.5 or 0.75, it must be between
+// MinSpeed and MaxSpeed.
+func ParseSpeed(value string) (float64, error) {
+	speed, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(speed) {
+		return 0, fmt.Errorf("unable to parse speed %s", value)
+	}
+	if speed < MinSpeed || speed > MaxSpeed {
+		return 0, fmt.Errorf("speed %s must be between %g and %g", value, MinSpeed, MaxSpeed)
+	}
+	return speed, nil
+}
+
+// ParseTargetSize parses sizes like 20M, 512K or 1G (the suffixes are powers of 1024)
+// into bytes, they must be between MinTargetBytes and MaxTargetBytes.
+func ParseTargetSize(value string) (int64, error) {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(value, "k"):
+		multiplier = 1024
+	case strings.HasSuffix(value, "m"):
+		multiplier = 1024 * 1024
+	case strings.HasSuffix(value, "g"):
+		multiplier = 1024 * 1024 * 1024
+	}
+	number := value
+	if multiplier != 1 {
+		number = value[:len(value)-1]
+	}
+	size, err := strconv.ParseFloat(number, 64)
+	if err != nil || math.IsNaN(size) || math.IsInf(size, 0) || size <= 0 {
+		return 0, fmt.Errorf("unable to parse size %s", value)
+	}
+	bytes := int64(size * float64(multiplier))
+	if bytes < MinTargetBytes || bytes > MaxTargetBytes {
+		return 0, fmt.Errorf("size %s must be between 1M and 2G", value)
+	}
+	return bytes, nil
+}
+
+// Limits of the record option.
+const (
+	MaxRecordDuration = time.Hour
+	// RecordGracePeriod is how much longer than the requested duration a recording can
+	// take before it is killed.
+	RecordGracePeriod = 2 * time.Minute
+)
+
+// ParseRecordDuration parses durations like 10m, 90s or 1h30m, they must be positive
+// and not longer than MaxRecordDuration.
+func ParseRecordDuration(value string) (time.Duration, error) {
+	duration, err := time.ParseDuration(value)
 	if err != nil {
-		return "", fmt.Errorf("unable to download video %s: %s", videoUrl, err)
+		return 0, fmt.Errorf("unable to parse duration %s", value)
+	}
+	if duration < time.Second || duration > MaxRecordDuration {
+		return 0, fmt.Errorf("duration %s must be between 1s and %s", value, MaxRecordDuration)
+	}
+	return duration, nil
+}
+
+// ParsePercentSpan parses spans like 10-20 (from 10% to 20% of the video), the
+// percentages must satisfy 0 <= start < end <= 100.
+func ParsePercentSpan(span string) (float64, float64, error) {
+	parts := strings.Split(span, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("unable to parse percentage span %s", span)
+	}
+	startPercent, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || math.IsNaN(startPercent) || math.IsInf(startPercent, 0) {
+		return 0, 0, fmt.Errorf("unable to parse percentage span %s", span)
+	}
+	endPercent, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || math.IsNaN(endPercent) || math.IsInf(endPercent, 0) {
+		return 0, 0, fmt.Errorf("unable to parse percentage span %s", span)
 	}
-	downloadCmd := exec.Command(ytdlpPath, ytdlpArgs...)
-	if err := downloadCmd.Run(); err != nil {
-		return "", fmt.Errorf("unable to download video %s: %s", videoUrl, err)
+	if startPercent < 0 || endPercent > 100 || startPercent >= endPercent {
+		return 0, 0, fmt.Errorf("percentage span %s must satisfy 0 <= start < end <= 100", span)
 	}
-	if startSecond != InvalidVideoSecond && endSecond != InvalidVideoSecond {
-		videoFilename, err = CutVideo(videoFilename, startSecond, endSecond, audioOnly)
+	return startPercent, endPercent, nil
+}
+
+// CutsBookends reports whether the start and the end of the video must be stitched
+// together, videos too short for that are sent whole.
+func (c *DownloadConfig) CutsBookends() bool {
+	return c.Bookends != 0 && c.Duration > float64(2*c.Bookends)
+}
+
+// NeedsDuration reports whether the requested operations need the duration of the
+// video and it is still unknown.
+func (c *DownloadConfig) NeedsDuration() bool {
+	if c.Duration > 0 {
+		return false
+	}
+	return (c.EndPercent != 0 || c.TargetBytes != 0 || c.Bookends != 0 || c.Thumbnails != 0) && !c.HasSpan()
+}
+
+// ResolveDownloadConfig fills in the parts of downloadConfig that depend on the
+// metadata of the video (like the span of the highlight word or the pct option).
+func ResolveDownloadConfig(ctx context.Context, config *Config, downloadConfig *DownloadConfig) error {
+	needsDuration := downloadConfig.NeedsDuration()
+	if !downloadConfig.Highlight && downloadConfig.EndPercent == 0 && !needsDuration {
+		return nil
+	}
+	info, err := downloadConfig.FetchInfo(ctx, config)
+	if err != nil {
+		return err
+	}
+	downloadConfig.Duration = info.Duration
+	if downloadConfig.Highlight {
+		startSecond, endSecond, err := HighlightSpan(info, HighlightSeconds)
 		if err != nil {
-			return "", fmt.Errorf("unable to download video %s: %s", videoUrl, err)
+			return fmt.Errorf("unable to find the highlight of %s: %s", downloadConfig.VideoUrl, err)
+		}
+		downloadConfig.StartSecond, downloadConfig.EndSecond = float64(startSecond), float64(endSecond)
+	}
+	// when the site does not report the duration it is probed from the downloaded file
+	// (see ProcessVideo)
+	if downloadConfig.EndPercent != 0 && info.Duration > 0 {
+		if err := downloadConfig.ApplyPercentSpan(); err != nil {
+			return err
 		}
 	}
-	return videoFilename, nil
+	return nil
+}
+
+// ApplyPercentSpan turns the span of the pct option into seconds, Duration must be
+// known.
+func (c *DownloadConfig) ApplyPercentSpan() error {
+	if c.Duration <= 0 {
+		return fmt.Errorf("unable to cut %s by percentage: its duration is unknown", c.VideoUrl)
+	}
+	c.StartSecond = math.Floor(c.Duration * c.StartPercent / 100)
+	c.EndSecond = math.Ceil(c.Duration * c.EndPercent / 100)
+	if c.StartSecond >= c.EndSecond {
+		return fmt.Errorf("unable to cut %s by percentage: the span is shorter than a second", c.VideoUrl)
+	}
+	return nil
 }
 
-func UserIsAuthorized(userId int64, authorizedUserIds []int64) bool {
-	if len(authorizedUserIds) == 0 {
+// UserIsAuthorized reports whether the user userId can use the bot in the chat chatId.
+// Both allowlists grant access: a user in authorizedUserIds can use the bot in any chat
+// and anyone can use the bot in a chat in authorizedChatIds. When both allowlists are
+// empty everyone can use the bot.
+func UserIsAuthorized(userId, chatId int64, authorizedUserIds, authorizedChatIds []int64) bool {
+	if len(authorizedUserIds) == 0 && len(authorizedChatIds) == 0 {
 		return true
 	}
 	for _, allowedUserId := range authorizedUserIds {
@@ -211,26 +1065,97 @@ func UserIsAuthorized(userId int64, authorizedUserIds []int64) bool {
 			return true
 		}
 	}
+	for _, allowedChatId := range authorizedChatIds {
+		if chatId == allowedChatId {
+			return true
+		}
+	}
 	return false
 }
 
-func LoadAuthorizedUserIds(authorizedUsersEnv string) ([]int64, error) {
-	authorizedUsersEnvContent := strings.TrimSpace(os.Getenv(authorizedUsersEnv))
-	if authorizedUsersEnvContent == "" {
+// LoadAuthorizedChatIds loads the chat ids listed (comma separated) in the environment
+// variable authorizedChatsEnv.
+func LoadAuthorizedChatIds(authorizedChatsEnv string) ([]int64, error) {
+	authorizedChatsEnvContent := strings.TrimSpace(os.Getenv(authorizedChatsEnv))
+	if authorizedChatsEnvContent == "" {
 		return []int64{}, nil
 	}
-	authorizedUserIds := strings.Split(authorizedUsersEnvContent, ",")
 	ids := []int64{}
-	for _, authorizedUserId := range authorizedUserIds {
-		id, err := strconv.ParseInt(authorizedUserId, 10, 0)
+	for _, authorizedChatId := range strings.Split(authorizedChatsEnvContent, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(authorizedChatId), 10, 0)
 		if err != nil {
-			return []int64{}, fmt.Errorf("unable to parse %s into an int64: %s", authorizedUserId, err)
+			return []int64{}, fmt.Errorf("unable to parse %s into an int64: %s", authorizedChatId, err)
 		}
 		ids = append(ids, id)
 	}
 	return ids, nil
 }
 
+// LoadAuthorizedUserIds merges the user ids listed (comma separated) in the environment
+// variable authorizedUsersEnv and the ids listed (one per line) in the file pointed by the
+// environment variable authorizedUsersFileEnv. Repeated ids are returned only once.
+func LoadAuthorizedUserIds(authorizedUsersEnv, authorizedUsersFileEnv string) ([]int64, error) {
+	ids := []int64{}
+	seen := map[int64]bool{}
+	addId := func(authorizedUserId, source string) error {
+		id, err := strconv.ParseInt(strings.TrimSpace(authorizedUserId), 10, 0)
+		if err != nil {
+			return fmt.Errorf("%s: unable to parse %s into an int64: %s", source, authorizedUserId, err)
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+		return nil
+	}
+	authorizedUsersEnvContent := strings.TrimSpace(os.Getenv(authorizedUsersEnv))
+	if authorizedUsersEnvContent != "" {
+		for _, authorizedUserId := range strings.Split(authorizedUsersEnvContent, ",") {
+			if err := addId(authorizedUserId, authorizedUsersEnv+" (environment variable)"); err != nil {
+				return []int64{}, err
+			}
+		}
+	}
+	authorizedUsersFile := strings.TrimSpace(os.Getenv(authorizedUsersFileEnv))
+	if authorizedUsersFile != "" {
+		content, err := os.ReadFile(authorizedUsersFile)
+		if err != nil {
+			return []int64{}, fmt.Errorf("%s (environment variable): unable to read %s: %s", authorizedUsersFileEnv, authorizedUsersFile, err)
+		}
+		for i, line := range strings.Split(string(content), "\n") {
+			// empty lines and comments are allowed in the file
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			source := fmt.Sprintf("%s (file pointed by %s) line %d", authorizedUsersFile, authorizedUsersFileEnv, i+1)
+			if err := addId(line, source); err != nil {
+				return []int64{}, err
+			}
+		}
+	}
+	return ids, nil
+}
+
+// OptionalDependencies are programs the bot works without, but some features are less
+// robust when they are missing.
+var OptionalDependencies = []string{
+	// ffprobe tells the duration of the downloaded files when the site does not
+	"ffprobe",
+}
+
+// CheckSystemHasOptionalDependencies returns the optional dependencies that are not
+// installed in the system.
+func CheckSystemHasOptionalDependencies() []string {
+	missing := []string{}
+	for _, dep := range OptionalDependencies {
+		if _, err := exec.LookPath(dep); err != nil {
+			missing = append(missing, dep)
+		}
+	}
+	return missing
+}
+
 func CheckSystemHasRequiredDependencies() error {
 	dependencies := []string{
 		"ffmpeg",
@@ -261,13 +1186,33 @@ func main() {
 	if err != nil {
 		log.Fatalf("Unable to start since system has missing dependencies: %s", err)
 	}
+	for _, dep := range CheckSystemHasOptionalDependencies() {
+		log.Printf("Optional dependency %s is not installed in the system, some features may not work with every site", dep)
+	}
+	// Load settings
+	config, err := LoadConfig()
+	if err != nil {
+		log.Fatalf("Unable to start since can not load settings: %s", err)
+	}
+	// Check the whole download pipeline works before taking requests
+	if config.SelfTest {
+		elapsed, err := SelfTest(config)
+		if err != nil {
+			log.Fatalf("Unable to start since the self-test failed: %s", err)
+		}
+		log.Printf("Self-test passed in %s", elapsed.Round(time.Millisecond))
+	}
 	// Load authorized users
-	authorizedUserIds, err := LoadAuthorizedUserIds("AUTHORIZED_USERS")
+	authorizedUserIds, err := LoadAuthorizedUserIds("AUTHORIZED_USERS", "AUTHORIZED_USERS_FILE")
 	if err != nil {
-		log.Fatalf("Unable to start since can not load user ids from AUTHORIZED_USERS (environment variable): %s", err)
+		log.Fatalf("Unable to start since can not load user ids: %s", err)
 	}
-	if len(authorizedUserIds) == 0 {
-		log.Print("You did not specified AUTHORIZED_USERS so everyone is able to use this bot")
+	authorizedChatIds, err := LoadAuthorizedChatIds("AUTHORIZED_CHATS")
+	if err != nil {
+		log.Fatalf("Unable to start since can not load chat ids from AUTHORIZED_CHATS (environment variable): %s", err)
+	}
+	if len(authorizedUserIds) == 0 && len(authorizedChatIds) == 0 {
+		log.Print("You did not specified AUTHORIZED_USERS, AUTHORIZED_USERS_FILE nor AUTHORIZED_CHATS so everyone is able to use this bot")
 	}
 	// Bootstrap the bot
 	token := os.Getenv("TOKEN")
@@ -277,53 +1222,78 @@ func main() {
 	}
 	log.Printf("Authorized on account %s", bot.Self.UserName)
 	// Start the infinite loop to receive messages
-	u := tgbotapi.NewUpdate(0)
+	offsetFile := config.StateFile("offset")
+	offset, err := LoadOffset(offsetFile)
+	if err != nil {
+		log.Fatalf("Unable to start since can not load the offset of the updates: %s", err)
+	}
+	updateTracker := NewUpdateTracker(SeenUpdatesCapacity, offsetFile)
+	userPreferences, err := LoadUserPreferences(config.StateFile("preferences.json"))
+	if err != nil {
+		log.Fatalf("Unable to start since can not load the preferences of the users: %s", err)
+	}
+	accessList, err := LoadAccessList(config.StateFile("users.json"), config.MaxUsers)
+	if err != nil {
+		log.Fatalf("Unable to start since can not load the approved users: %s", err)
+	}
+	quotas, err := LoadQuotas(config.StateFile("quotas.json"), config.DailyQuota)
+	if err != nil {
+		log.Fatalf("Unable to start since can not load the quotas: %s", err)
+	}
+	go quotas.ResetDaily()
+	stats, err := LoadStats(config.StateFile("stats.json"))
+	if err != nil {
+		log.Fatalf("Unable to start since can not load the stats: %s", err)
+	}
+	go stats.SavePeriodically()
+	maintenance, err := LoadMaintenance(config.StateFile("maintenance.json"))
+	if err != nil {
+		log.Fatalf("Unable to start since can not load the maintenance mode: %s", err)
+	}
+	if config.PublicDir != "" {
+		go KeepPublicDirClean(config)
+	}
+	messages, err := LoadMessages(config.MessagesFile, config.MessagesDir)
+	if err != nil {
+		log.Fatalf("Unable to start since can not load the messages: %s", err)
+	}
+	app := &App{
+		Bot:               bot,
+		Config:            config,
+		AuthorizedUserIds: authorizedUserIds,
+		AuthorizedChatIds: authorizedChatIds,
+		PendingDownloads:  NewPendingDownloads(),
+		UserPreferences:   userPreferences,
+		ChatModes:         NewChatModes(),
+		Messages:          messages,
+		AccessList:        accessList,
+		InFlightDownloads: NewInFlightDownloads(),
+		Quotas:            quotas,
+		Stats:             stats,
+		Maintenance:       maintenance,
+		UserLimiter:       NewRateLimiter(config.RateLimitPerUser),
+		ChatLimiter:       NewRateLimiter(config.RateLimitPerChat),
+	}
+	if config.ApiAddr != "" {
+		go func() {
+			log.Fatalf("Unable to serve the API: %s", app.ServeApi())
+		}()
+	}
+	StartStages(config)
+	dispatcher := NewUpdateDispatcher(app.HandleUpdate)
+	u := tgbotapi.NewUpdate(offset)
 	u.Timeout = 60
 	updates := bot.GetUpdatesChan(u)
 	for update := range updates {
-		if update.Message != nil {
-			// Check if user is authorized
-			if !UserIsAuthorized(update.Message.From.ID, authorizedUserIds) {
-				log.Printf("[%s %d] Non-Authorized user sent: %s", update.Message.From.UserName, update.Message.From.ID, update.Message.Text)
-				msg := tgbotapi.NewMessage(update.Message.Chat.ID, "You are NOT AUTHORIZED to use me! 😠")
-				bot.Send(msg)
-				continue
-			} else {
-				log.Printf("[%s %d] Authorized user sent: %s", update.Message.From.UserName, update.Message.From.ID, update.Message.Text)
-			}
-			// Let the user know you are working on the download
-			msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Ok, just wait a second...")
-			msg.ReplyToMessageID = update.Message.MessageID
-			bot.Send(msg)
-			videoUrl, startSecond, endSecond, audioOnly, err := LoadDownloadConfigFromMsg(update.Message.Text)
-			if err != nil {
-				log.Printf("[%s %d] Unable to complete request %s: %s", update.Message.From.UserName, update.Message.From.ID, update.Message.Text, err)
-				msg := tgbotapi.NewMessage(update.Message.Chat.ID, "I'm sorry I was not able to download your video ☹")
-				msg.ReplyToMessageID = update.Message.MessageID
-				bot.Send(msg)
-				continue
-			}
-			videoFilename, err := DownloadVideo(videoUrl.String(), startSecond, endSecond, audioOnly)
-			if err != nil {
-				log.Printf("[%s %d] Unable to complete request %s: %s", update.Message.From.UserName, update.Message.From.ID, update.Message.Text, err)
-				msg := tgbotapi.NewMessage(update.Message.Chat.ID, "I'm sorry I was not able to download your video ☹")
-				msg.ReplyToMessageID = update.Message.MessageID
-				bot.Send(msg)
-				continue
-			}
-			if audioOnly {
-				audioMsg := tgbotapi.NewAudio(update.Message.Chat.ID, tgbotapi.FilePath(videoFilename))
-				msg.ReplyToMessageID = update.Message.MessageID
-				bot.Send(audioMsg)
-			} else {
-				videoMsg := tgbotapi.NewVideo(update.Message.Chat.ID, tgbotapi.FilePath(videoFilename))
-				msg.ReplyToMessageID = update.Message.MessageID
-				bot.Send(videoMsg)
-			}
-			log.Printf("[%s %d] Request %s completed", update.Message.From.UserName, update.Message.From.ID, update.Message.Text)
-			if err := os.Remove(videoFilename); err != nil {
-				log.Printf("[%s %d] Unable to erase file %s", update.Message.From.UserName, update.Message.From.ID, videoFilename)
-			}
+		if updateTracker.Seen(update.UpdateID) {
+			log.Printf("Skipping update %d since it was already processed", update.UpdateID)
+			continue
+		}
+		// the offset is persisted before handling the update, a restart in the middle of
+		// a download must not get the update (and run the download) again
+		if err := updateTracker.Done(update.UpdateID); err != nil {
+			log.Printf("Unable to persist the offset after update %d: %s", update.UpdateID, err)
 		}
+		dispatcher.Dispatch(update)
 	}
 }
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadDownloadConfigFromMsgOptionConflicts(t *testing.T) {
+	const videoUrl = "https://youtu.be/dQw4w9WgXcQ"
+	tests := []struct {
+		options string
+		// wantErr is a part of the expected error, empty when the options are valid
+		wantErr string
+	}{
+		{"", ""},
+		{"0:10-0:51 audio", ""},
+		{"audio mute", "the audio and mute words"},
+		{"audio video", "the audio and video words"},
+		{"audio scale:480", "the audio word can not be used with the scale or fps options"},
+		{"audio fps:15", "the audio word can not be used with the scale or fps options"},
+		{"0:10-0:51 highlight", "only one of the video spots"},
+		{"0:10-0:51 pct:10-20", "only one of the video spots"},
+		{"pct:10-20 bookends:10", "only one of the video spots"},
+		{"highlight bookends:10", "only one of the video spots"},
+		{"sample:15", ""},
+		{"sample:15 0:10-0:51", "the sample option"},
+		{"sample:15 both", "the sample option"},
+		{"sample:15 chapters", "the sample option"},
+		{"sample:15 record:10m", "the sample option"},
+		{"sample:15 multi:360,720", "the sample option"},
+		{"audio:mp3+m4a chapters", "the audio option with formats"},
+		{"0:10-0:51 audio:mp3+m4a both", "the audio option with formats"},
+		{"audio:mp3 bookends:10", "the audio option with formats"},
+		{"chapters album", ""},
+		{"chapters mute", "the chapters word"},
+		{"chapters video", "the chapters word"},
+		{"chapters 0:10-0:51", "the chapters word"},
+		{"chapters record:10m", "the chapters word"},
+		{"0:10-0:51 both", ""},
+		{"both", "the both word needs a cut"},
+		{"0:10-0:51 both fit", "the both word needs a cut"},
+		{"record:10m", ""},
+		{"record:10m 0:10-0:51", "the record option"},
+		{"record:10m fit", "the record option"},
+		{"thumbnails:12", ""},
+		{"thumbnails:12 audio", "the thumbnails option"},
+		{"thumbnails:12 record:10m", "the thumbnails option"},
+		{"thumbnails:12 target:20M", "the thumbnails option"},
+		{"target:20M audio", "the target option"},
+		{"target:20M fit", "the target option"},
+		{"target:20M record:10m", "the target option"},
+		{"0:10-0:15 gif", ""},
+		{"gif", "the gif option needs a cut"},
+		{"0:10-0:15 gif audio", "the gif option can not be used"},
+		{"0:10-0:15 gif fit", "the gif option can not be used"},
+		{"0:10-0:15 gif bumper", "the gif option can not be used"},
+		{"0:10-0:15 gif scale:480", "the gif option can not be used"},
+		{"0:10-0:51 bumper audio", "the bumper word"},
+		{"bumper chapters", "the bumper word"},
+		{"bumper target:20M", "the bumper word"},
+		{"preview audio", "the preview word"},
+		{"preview thumbnails:12", "the preview word"},
+		{"0:10-0:15 preview gif", "the preview word"},
+		{"preview record:10m", "the preview word"},
+		{"name:my_clip album", "the name option"},
+		{"0:10-0:15 loop:30", ""},
+		{"loop:30 thumbnails:12", "the loop option"},
+		{"0:10-0:15 loop:30 gif", "the loop option"},
+		{"loop:30 record:10m", "the loop option"},
+		{"0:10-0:51 scene", ""},
+		{"scene", "the scene word needs a cut"},
+		{"bookends:10 scene", "the scene word needs a cut"},
+		{"0:10-0:51 scene audio", "the scene word needs a cut"},
+		{"quality:1080", ""},
+		{"quality:1080 audio", "the quality option"},
+		{"quality:1080 chapters", "the quality option"},
+		{"quality:1080 multi:360,720", "the quality option"},
+		{"0:10-0:51 multi:360,720", ""},
+		{"multi:360,720 audio", "the multi option"},
+		{"multi:360,720 fit", "the multi option"},
+		{"multi:360,720 thumbnails:12", "the multi option"},
+		{"multi:360,720 record:10m", "the multi option"},
+		{"0:10-0:51 timestamp", ""},
+		{"timestamp audio", "the timestamp option"},
+		{"timestamp chapters", "the timestamp option"},
+		{"timestamp thumbnails:12", "the timestamp option"},
+		{"crop:square audio", "the crop option"},
+		{"crop:square thumbnails:12", "the crop option"},
+		{"speed:1.5 audio", ""},
+		{"speed:1.5 chapters", "the speed option"},
+		{"speed:1.5 thumbnails:12", "the speed option"},
+		{"alang:es", ""},
+		{"alang:es mute", "the alang option"},
+		{"alang:es record:10m", "the alang option"},
+	}
+	for _, test := range tests {
+		msg := strings.TrimSpace(videoUrl + " " + test.options)
+		_, err := LoadDownloadConfigFromMsg(msg)
+		if test.wantErr == "" {
+			if err != nil {
+				t.Errorf("LoadDownloadConfigFromMsg(%q) returned error: %s", msg, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("LoadDownloadConfigFromMsg(%q) returned no error, want one containing %q", msg, test.wantErr)
+		} else if !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("LoadDownloadConfigFromMsg(%q) returned error %q, want one containing %q", msg, err, test.wantErr)
+		}
+	}
+}
+
+func TestParsePercentSpan(t *testing.T) {
+	tests := []struct {
+		span      string
+		wantStart float64
+		wantEnd   float64
+		wantErr   bool
+	}{
+		{"10-20", 10, 20, false},
+		{"0-100", 0, 100, false},
+		{"12.5-50", 12.5, 50, false},
+		{"20-10", 0, 0, true},
+		{"10-10", 0, 0, true},
+		{"-1-10", 0, 0, true},
+		{"10-101", 0, 0, true},
+		{"10", 0, 0, true},
+		{"nan-50", 0, 0, true},
+		{"10-nan", 0, 0, true},
+		{"NaN-NaN", 0, 0, true},
+		{"inf-50", 0, 0, true},
+		{"10-inf", 0, 0, true},
+		{"10-infinity", 0, 0, true},
+	}
+	for _, test := range tests {
+		start, end, err := ParsePercentSpan(test.span)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ParsePercentSpan(%q) returned error %v, want error %t", test.span, err, test.wantErr)
+			continue
+		}
+		if start != test.wantStart || end != test.wantEnd {
+			t.Errorf("ParsePercentSpan(%q) = %g, %g, want %g, %g", test.span, start, end, test.wantStart, test.wantEnd)
+		}
+	}
+}
+
+func TestParseTargetSize(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{"20m", 20 * 1024 * 1024, false},
+		{"1.5m", 1536 * 1024, false},
+		{"2048k", 2 * 1024 * 1024, false},
+		{"1g", 1024 * 1024 * 1024, false},
+		{"512k", 0, true},
+		{"3g", 0, true},
+		{"0m", 0, true},
+		{"-5m", 0, true},
+		{"m", 0, true},
+		{"nanm", 0, true},
+		{"nan", 0, true},
+		{"infm", 0, true},
+		{"inf", 0, true},
+		{"+infinityg", 0, true},
+	}
+	for _, test := range tests {
+		size, err := ParseTargetSize(test.value)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ParseTargetSize(%q) returned error %v, want error %t", test.value, err, test.wantErr)
+			continue
+		}
+		if size != test.want {
+			t.Errorf("ParseTargetSize(%q) = %d, want %d", test.value, size, test.want)
+		}
+	}
+}
+
+func TestParseSpeed(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    float64
+		wantErr bool
+	}{
+		{"1.5", 1.5, false},
+		{"0.75", 0.75, false},
+		{"0.25", 0.25, false},
+		{"4", 4, false},
+		{"0.2", 0, true},
+		{"4.5", 0, true},
+		{"fast", 0, true},
+		{"nan", 0, true},
+		{"inf", 0, true},
+	}
+	for _, test := range tests {
+		speed, err := ParseSpeed(test.value)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ParseSpeed(%q) returned error %v, want error %t", test.value, err, test.wantErr)
+			continue
+		}
+		if speed != test.want {
+			t.Errorf("ParseSpeed(%q) = %g, want %g", test.value, speed, test.want)
+		}
+	}
+}
+
+func TestParseAudioFormats(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"mp3", "mp3", false},
+		{"mp3+m4a", "mp3+m4a", false},
+		{"flac+wav+opus", "flac+wav+opus", false},
+		{"mp3+m4a+mp3", "mp3+m4a", false},
+		{"mp3+ogg", "", true},
+		{"mp3+", "", true},
+		{"", "", true},
+	}
+	for _, test := range tests {
+		formats, err := ParseAudioFormats(test.value)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ParseAudioFormats(%q) returned error %v, want error %t", test.value, err, test.wantErr)
+			continue
+		}
+		if got := strings.Join(formats, "+"); got != test.want {
+			t.Errorf("ParseAudioFormats(%q) = %s, want %s", test.value, got, test.want)
+		}
+	}
+}
+
+func TestParseAudioOption(t *testing.T) {
+	tests := []struct {
+		value          string
+		wantFormats    string
+		wantChannels   int
+		wantSampleRate int
+		wantErr        bool
+	}{
+		{"mp3+m4a", "mp3+m4a", 0, 0, false},
+		{"mono", "", 1, 0, false},
+		{"16k", "", 0, 16000, false},
+		{"mono+16k", "", 1, 16000, false},
+		{"opus+mono+16k", "opus", 1, 16000, false},
+		{"mp3+44k+m4a", "mp3+m4a", 0, 44100, false},
+		{"16k+16k", "", 0, 16000, false},
+		{"16k+48k", "", 0, 0, true},
+		{"opus+44k", "", 0, 0, true},
+		{"mono+ogg", "", 0, 0, true},
+	}
+	for _, test := range tests {
+		formats, channels, sampleRate, err := ParseAudioOption(test.value)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ParseAudioOption(%q) returned error %v, want error %t", test.value, err, test.wantErr)
+			continue
+		}
+		if got := strings.Join(formats, "+"); got != test.wantFormats || channels != test.wantChannels || sampleRate != test.wantSampleRate {
+			t.Errorf("ParseAudioOption(%q) = %s, %d, %d, want %s, %d, %d", test.value, got, channels, sampleRate, test.wantFormats, test.wantChannels, test.wantSampleRate)
+		}
+	}
+}
+
+func TestParseUrlStartSecond(t *testing.T) {
+	tests := []struct {
+		t       string
+		want    float64
+		wantErr bool
+	}{
+		{"65", 65, false},
+		{"65s", 65, false},
+		{"1m5s", 65, false},
+		{"1h2m3s", 3723, false},
+		{"1.5", 1.5, false},
+		{"", 0, true},
+		{"-5", 0, true},
+		{"soon", 0, true},
+	}
+	for _, test := range tests {
+		videoUrl, err := url.Parse("https://www.youtube.com/watch?v=dQw4w9WgXcQ&t=" + url.QueryEscape(test.t))
+		if err != nil {
+			t.Fatalf("unable to parse the URL: %s", err)
+		}
+		start, err := ParseUrlStartSecond(videoUrl)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ParseUrlStartSecond(t=%q) returned error %v, want error %t", test.t, err, test.wantErr)
+			continue
+		}
+		if start != test.want {
+			t.Errorf("ParseUrlStartSecond(t=%q) = %g, want %g", test.t, start, test.want)
+		}
+	}
+}
+
+func TestLoadDownloadConfigFromMsgEndOnlySpot(t *testing.T) {
+	tests := []struct {
+		msg       string
+		wantStart float64
+		wantEnd   float64
+		wantErr   bool
+	}{
+		{"https://youtu.be/dQw4w9WgXcQ?t=65 -1:30", 65, 90, false},
+		{"https://youtu.be/dQw4w9WgXcQ?t=65s -1:30", 65, 90, false},
+		{"https://youtu.be/dQw4w9WgXcQ?t=1m5s -1:30.5", 65, 90.5, false},
+		{"https://youtu.be/dQw4w9WgXcQ?t=90 -1:30", 0, 0, true},
+		{"https://youtu.be/dQw4w9WgXcQ?t=100 -1:30", 0, 0, true},
+		{"https://youtu.be/dQw4w9WgXcQ -1:30", 0, 0, true},
+		{"https://youtu.be/dQw4w9WgXcQ?t=65 0:10-0:20 -1:30", 0, 0, true},
+	}
+	for _, test := range tests {
+		downloadConfig, err := LoadDownloadConfigFromMsg(test.msg)
+		if (err != nil) != test.wantErr {
+			t.Errorf("LoadDownloadConfigFromMsg(%q) returned error %v, want error %t", test.msg, err, test.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if downloadConfig.StartSecond != test.wantStart || downloadConfig.EndSecond != test.wantEnd {
+			t.Errorf("LoadDownloadConfigFromMsg(%q) cuts %g-%g, want %g-%g", test.msg, downloadConfig.StartSecond, downloadConfig.EndSecond, test.wantStart, test.wantEnd)
+		}
+	}
+}
+
+func TestSpot2Second(t *testing.T) {
+	tests := []struct {
+		spot    string
+		want    float64
+		wantErr bool
+	}{
+		{"1:05", 65, false},
+		{"1:05.5", 65.5, false},
+		{"0:00.125", 0.125, false},
+		{"1:02:03", 3723, false},
+		{"1:02:03.25", 3723.25, false},
+		{"1:60", 0, true},
+		{"1:59.9999", 119.9999, false},
+		{"60:00", 0, true},
+		{"12:00:00", 0, true},
+		{"5", 0, true},
+		{"1:2:3:4", 0, true},
+		{"a:05", 0, true},
+	}
+	for _, test := range tests {
+		second, err := Spot2Second(test.spot)
+		if (err != nil) != test.wantErr {
+			t.Errorf("Spot2Second(%q) returned error %v, want error %t", test.spot, err, test.wantErr)
+			continue
+		}
+		if second != test.want {
+			t.Errorf("Spot2Second(%q) = %g, want %g", test.spot, second, test.want)
+		}
+	}
+}
+
+func TestParseStartEndSeconds(t *testing.T) {
+	tests := []struct {
+		span      string
+		wantStart float64
+		wantEnd   float64
+		wantErr   bool
+	}{
+		{"0:10-0:51", 10, 51, false},
+		{"0:10.25-0:10.5", 10.25, 10.5, false},
+		{"1:00:00-1:00:01.001", 3600, 3601.001, false},
+		{"0:10.5-0:10.5", 0, 0, true},
+		{"0:51-0:10", 0, 0, true},
+		{"0:10.1234-0:51", 0, 0, true},
+		{"0:10-", 0, 0, true},
+	}
+	for _, test := range tests {
+		start, end, err := ParseStartEndSeconds(test.span)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ParseStartEndSeconds(%q) returned error %v, want error %t", test.span, err, test.wantErr)
+			continue
+		}
+		if start != test.wantStart || end != test.wantEnd {
+			t.Errorf("ParseStartEndSeconds(%q) = %g, %g, want %g, %g", test.span, start, end, test.wantStart, test.wantEnd)
+		}
+	}
+}
+
+func TestSecond2Spot(t *testing.T) {
+	tests := []struct {
+		second float64
+		want   string
+	}{
+		{0, "0:00"},
+		{65, "1:05"},
+		{65.5, "1:05.5"},
+		{3723, "1:02:03"},
+		{3723.25, "1:02:03.25"},
+		{59.9999, "1:00"},
+	}
+	for _, test := range tests {
+		spot := Second2Spot(test.second)
+		if spot != test.want {
+			t.Errorf("Second2Spot(%g) = %s, want %s", test.second, spot, test.want)
+			continue
+		}
+		// the spots go back to the same seconds (rounded to milliseconds)
+		second, err := Spot2Second(spot)
+		if err != nil {
+			t.Errorf("Spot2Second(%q) returned error: %s", spot, err)
+		} else if math.Abs(second-test.second) > 0.0005 {
+			t.Errorf("Spot2Second(Second2Spot(%g)) = %g", test.second, second)
+		}
+	}
+}
+
+func TestLoadAuthorizedUserIds(t *testing.T) {
+	usersFile := filepath.Join(t.TempDir(), "users")
+	content := "# the team\n3\n\n  2  \n4\n"
+	if err := os.WriteFile(usersFile, []byte(content), 0o644); err != nil {
+		t.Fatalf("unable to write the users file: %s", err)
+	}
+	t.Setenv("TEST_AUTHORIZED_USERS", "1, 2,3")
+	t.Setenv("TEST_AUTHORIZED_USERS_FILE", usersFile)
+	ids, err := LoadAuthorizedUserIds("TEST_AUTHORIZED_USERS", "TEST_AUTHORIZED_USERS_FILE")
+	if err != nil {
+		t.Fatalf("LoadAuthorizedUserIds returned error: %s", err)
+	}
+	if got := fmt.Sprint(ids); got != "[1 2 3 4]" {
+		t.Errorf("LoadAuthorizedUserIds = %s, want [1 2 3 4]", got)
+	}
+
+	t.Setenv("TEST_AUTHORIZED_USERS", "")
+	ids, err = LoadAuthorizedUserIds("TEST_AUTHORIZED_USERS", "TEST_AUTHORIZED_USERS_FILE")
+	if err != nil || fmt.Sprint(ids) != "[3 2 4]" {
+		t.Errorf("LoadAuthorizedUserIds = %v, %v with only the file, want [3 2 4], nil", ids, err)
+	}
+
+	if err := os.WriteFile(usersFile, []byte("1\ngato\n"), 0o644); err != nil {
+		t.Fatalf("unable to write the users file: %s", err)
+	}
+	if _, err := LoadAuthorizedUserIds("TEST_AUTHORIZED_USERS", "TEST_AUTHORIZED_USERS_FILE"); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("LoadAuthorizedUserIds returned error %v, want one about the line 2", err)
+	}
+
+	t.Setenv("TEST_AUTHORIZED_USERS_FILE", filepath.Join(t.TempDir(), "missing"))
+	if _, err := LoadAuthorizedUserIds("TEST_AUTHORIZED_USERS", "TEST_AUTHORIZED_USERS_FILE"); err == nil {
+		t.Error("LoadAuthorizedUserIds returned no error for a missing file")
+	}
+}
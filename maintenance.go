@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Maintenance is the maintenance mode of the bot (persisted in a JSON file, so it
+// survives restarts), while it is enabled the requests are rejected. It is safe for
+// concurrent use.
+type Maintenance struct {
+	mu       sync.Mutex
+	filename string
+	// On reports whether the maintenance mode is enabled.
+	On bool `json:"on"`
+}
+
+// LoadMaintenance loads the maintenance mode persisted in filename, when filename is
+// empty it is kept only in memory.
+func LoadMaintenance(filename string) (*Maintenance, error) {
+	maintenance := &Maintenance{filename: filename}
+	if err := LoadJSON(filename, maintenance); err != nil {
+		return nil, err
+	}
+	return maintenance, nil
+}
+
+// Enabled reports whether the maintenance mode is enabled.
+func (m *Maintenance) Enabled() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.On
+}
+
+// Set enables or disables the maintenance mode and persists it.
+func (m *Maintenance) Set(on bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.On = on
+	return SaveJSON(m.filename, m)
+}
+
+// RejectForMaintenance tells the user of msg the bot is under maintenance and reports
+// true when the maintenance mode is enabled, the requests in progress are not affected.
+func (app *App) RejectForMaintenance(msg *tgbotapi.Message) bool {
+	if !app.Maintenance.Enabled() {
+		return false
+	}
+	log.Printf("[%s %d] Rejected request %s: the bot is under maintenance", msg.From.UserName, msg.From.ID, msg.Text)
+	ReplyText(app.Bot, msg, app.Message(msg, EventMaintenance, MessageData{}, "I'm under maintenance, back soon 🛠️"))
+	return true
+}
+
+// SwitchMaintenance enables or disables the maintenance mode as asked in the arguments
+// of the /maintenance command msg.
+func (app *App) SwitchMaintenance(msg *tgbotapi.Message) {
+	var on bool
+	switch strings.ToLower(strings.TrimSpace(msg.CommandArguments())) {
+	case "on":
+		on = true
+	case "off":
+		on = false
+	default:
+		state := "off"
+		if app.Maintenance.Enabled() {
+			state = "on"
+		}
+		app.ReplyUsage(msg, fmt.Sprintf("/maintenance on|off (it is %s now)", state))
+		return
+	}
+	err := app.Maintenance.Set(on)
+	if err != nil {
+		log.Printf("[%s %d] Unable to persist the maintenance mode: %s", msg.From.UserName, msg.From.ID, err)
+	}
+	log.Printf("[%s %d] Maintenance mode switched on=%t", msg.From.UserName, msg.From.ID, on)
+	switch {
+	case err != nil:
+		ReplyText(app.Bot, msg, app.Message(msg, EventMaintenanceUnsaved, MessageData{Error: err.Error()}, fmt.Sprintf("⚠️ Switched, but it will not survive a restart: %s", err)))
+	case on:
+		ReplyText(app.Bot, msg, app.Message(msg, EventMaintenanceOn, MessageData{}, "🛠️ Maintenance mode on, new requests are rejected (the ones in progress finish)"))
+	default:
+		ReplyText(app.Bot, msg, app.Message(msg, EventMaintenanceOff, MessageData{}, "✅ Maintenance mode off, back to work"))
+	}
+}
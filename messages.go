@@ -0,0 +1,327 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// The events with a reply the operator can customize in MESSAGES_FILE, the file defines
+// a template (text/template) for each event to customize, like:
+//
+//	{{define "failed"}}Oops, {{.UserName}}, I could not download {{.Url}} 🙀{{end}}
+//
+// The events not defined in the file use the built-in replies.
+const (
+	EventNotAuthorized     = "not_authorized"
+	EventUsage             = "usage"
+	EventVideoMode         = "video_mode"
+	EventAudioMode         = "audio_mode"
+	EventAck               = "ack"
+	EventFailed            = "failed"
+	EventBlocked           = "blocked"
+	EventClipTooLong       = "clip_too_long"
+	EventNoAudioLang       = "no_audio_language"
+	EventTooManyFiles      = "too_many_files"
+	EventTimeout           = "timeout"
+	EventTooLarge          = "too_large"
+	EventDryRun            = "dry_run"
+	EventSearchFailed      = "search_failed"
+	EventSearchNotFound    = "search_not_found"
+	EventNoBumpers         = "no_bumpers"
+	EventNoChapters        = "no_chapters"
+	EventQuotaExceeded     = "quota_exceeded"
+	EventPublicLink        = "public_link"
+	EventMaintenance       = "maintenance"
+	EventWarnings          = "warnings"
+	EventRateLimited       = "rate_limited"
+	EventNoFont            = "no_font"
+	EventQueued            = "queued"
+	EventStaleYtdlp        = "stale_ytdlp"
+	EventRecording         = "recording"
+	EventRecorded          = "recorded"
+	EventConfirm           = "confirm"
+	EventConfirmed         = "confirmed"
+	EventCancelled         = "cancelled"
+	EventOfferAudio        = "offer_default_audio"
+	EventDefaultAudio      = "default_audio"
+	EventDefaultVideo      = "default_video"
+	EventTooManyUrls       = "too_many_urls"
+	EventPickUrl           = "pick_url"
+	EventPremiere          = "premiere"
+	EventScheduled         = "scheduled"
+	EventChapters          = "chapters"
+	EventMoreChapters      = "more_chapters"
+	EventQuota             = "quota"
+	EventCommandUsage      = "command_usage"
+	EventInvalidRequest    = "invalid_request"
+	EventListUsage         = "list_usage"
+	EventListTooBig        = "list_too_big"
+	EventListEmpty         = "list_empty"
+	EventListTooLong       = "list_too_long"
+	EventListAccepted      = "list_accepted"
+	EventListSkipped       = "list_skipped"
+	EventLanguage          = "language"
+	EventNoLanguage        = "no_language"
+	EventLanguageSet       = "language_set"
+	EventAlreadyAuthorized = "already_authorized"
+	EventNoApprover        = "no_approver"
+	EventAccessPending     = "access_pending"
+	EventAccessAsked       = "access_requested"
+	EventAccessGranted     = "access_granted"
+	EventAdminOnly         = "admin_only"
+
+	// the events of the captions of the files and of the labels of the buttons
+	EventPreviewCaption = "preview_caption"
+	EventFullCaption    = "full_video_caption"
+	EventCutCaption     = "cut_caption"
+	EventQualityCaption = "quality_caption"
+	EventFitCaption     = "fit_caption"
+	EventContinueButton = "continue_button"
+	EventCancelButton   = "cancel_button"
+	EventYesButton      = "yes_button"
+	EventNoButton       = "no_button"
+	EventSourceButton   = "source_button"
+	EventAllButton      = "all_button"
+	EventScheduleButton = "schedule_button"
+	EventVideoButton    = "video_button"
+	EventChannelButton  = "channel_button"
+
+	// the events of the messages to the admins
+	EventAccessRequest      = "access_request"
+	EventUserApproved       = "user_approved"
+	EventUserEvicted        = "user_evicted"
+	EventUserDenied         = "user_denied"
+	EventApprovalFailed     = "approval_failed"
+	EventDeniedReport       = "denied_report"
+	EventBroadcastNobody    = "broadcast_nobody"
+	EventBroadcastDone      = "broadcast_done"
+	EventTestStarted        = "test_started"
+	EventTestFailed         = "test_failed"
+	EventTestDone           = "test_done"
+	EventMaintenanceOn      = "maintenance_on"
+	EventMaintenanceOff     = "maintenance_off"
+	EventMaintenanceUnsaved = "maintenance_unsaved"
+	EventStats              = "stats"
+	EventApproveButton      = "approve_button"
+	EventDenyButton         = "deny_button"
+)
+
+// MessageData holds the fields the templates of MESSAGES_FILE can use, not every event
+// fills every field.
+type MessageData struct {
+	// UserName is the username of the user the bot replies to.
+	UserName string
+	// Url is the URL of the requested video.
+	Url string
+	// Title is the title of the video.
+	Title string
+	// Duration is a time limit, the duration of a video or the estimated wait of a
+	// request, like 10m0s. Elapsed is how long something took (so far).
+	Duration string
+	Elapsed  string
+	// Time is when something happens, like Jan 2 15:04 UTC.
+	Time string
+	// Error is what went wrong.
+	Error string
+	// Size and Limit are the size of a file and the upload limit, like 12.3 MB.
+	Size  string
+	Limit string
+	// Site is the yt-dlp extractor of the video.
+	Site string
+	// Language is the requested audio language and Languages the available ones.
+	Language  string
+	Languages string
+	// Link is the URL a published file can be downloaded from.
+	Link string
+	// Warnings are what went wrong without failing the download, like subtitles were
+	// unavailable.
+	Warnings string
+	// Count and Max are the files left out and the most files of a request, Count is
+	// also the position of a request in the queue or how many of something there are
+	// (like the requests made today, with Max the limit). Failed is how many went wrong,
+	// like the users a broadcast did not reach (Count being the ones it reached).
+	Count  int
+	Max    int
+	Failed int
+	// Videos and Audios are the requests for videos and for audio of the stats (Count
+	// being all of them, Succeeded the ones that worked and Failed the rest), Domains
+	// lists the top domains of the requests, one per line.
+	Videos    int
+	Audios    int
+	Succeeded int
+	Domains   string
+	// Height is the height of a video in pixels, like 720.
+	Height int
+	// Usage is the syntax of a command, like /search <terms>.
+	Usage string
+	// Text is a text the reply quotes, like the message of a denied user, the lines of
+	// a list that were skipped or what a request will do.
+	Text string
+	// User and Chat are the user and the chat a reply to the admins is about, like
+	// gato (@gato, 123).
+	User string
+	Chat string
+}
+
+// DefaultLanguage is the language of the built-in replies (and of MESSAGES_FILE), the
+// users whose language has no catalog get it.
+const DefaultLanguage = "en"
+
+// CatalogPattern matches the names of the catalogs of MESSAGES_DIR, like es.tmpl, the
+// name is the language code.
+var CatalogPattern = regexp.MustCompile(`^([a-z]{2,3})\.tmpl$`)
+
+// Messages renders the replies customized in MESSAGES_FILE and translated in the
+// catalogs of MESSAGES_DIR.
+type Messages struct {
+	templates *template.Template
+	// catalogs holds the templates of every language of MESSAGES_DIR, by language code.
+	catalogs map[string]*template.Template
+}
+
+// LoadMessages parses the templates of the file filename and the catalogs (one file per
+// language, like es.tmpl) of the directory dir. An empty filename means no reply is
+// customized and an empty dir that no reply is translated.
+func LoadMessages(filename, dir string) (*Messages, error) {
+	messages := &Messages{catalogs: map[string]*template.Template{}}
+	if filename != "" {
+		templates, err := template.ParseFiles(filename)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse the messages file %s: %s", filename, err)
+		}
+		messages.templates = templates
+	}
+	if dir == "" {
+		return messages, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the messages directory %s: %s", dir, err)
+	}
+	for _, entry := range entries {
+		match := CatalogPattern.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		catalog, err := template.ParseFiles(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse the messages catalog %s: %s", entry.Name(), err)
+		}
+		messages.catalogs[match[1]] = catalog
+	}
+	return messages, nil
+}
+
+// Languages returns the languages with a catalog, and DefaultLanguage, sorted.
+func (m *Messages) Languages() []string {
+	languages := []string{DefaultLanguage}
+	for language := range m.catalogs {
+		if language != DefaultLanguage {
+			languages = append(languages, language)
+		}
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+// Supports reports whether the replies can be sent in language.
+func (m *Messages) Supports(language string) bool {
+	_, ok := m.catalogs[language]
+	return ok || language == DefaultLanguage
+}
+
+// Render returns the reply to event in language rendered with data. The events the
+// catalog of language does not translate use the templates of MESSAGES_FILE, and the
+// events not customized there (or whose template fails) use fallback.
+func (m *Messages) Render(language, event string, data MessageData, fallback string) string {
+	templates := m.templates
+	if catalog, ok := m.catalogs[language]; ok && catalog.Lookup(event) != nil {
+		templates = catalog
+	}
+	if templates == nil || templates.Lookup(event) == nil {
+		return fallback
+	}
+	var text strings.Builder
+	if err := templates.ExecuteTemplate(&text, event, data); err != nil {
+		log.Printf("Unable to render the message %s: %s", event, err)
+		return fallback
+	}
+	if strings.TrimSpace(text.String()) == "" {
+		return fallback
+	}
+	return text.String()
+}
+
+// Message returns the reply to event for the user who sent msg in their language, see
+// Messages.Render.
+func (app *App) Message(msg *tgbotapi.Message, event string, data MessageData, fallback string) string {
+	return app.UserMessage(msg.From, event, data, fallback)
+}
+
+// UserMessage returns the message about event for user in their language, like the
+// answers to the inline buttons they press, see Messages.Render.
+func (app *App) UserMessage(user *tgbotapi.User, event string, data MessageData, fallback string) string {
+	if user != nil {
+		data.UserName = user.UserName
+	}
+	return app.Messages.Render(app.UserLanguage(user), event, data, fallback)
+}
+
+// Language returns the language the user who sent msg gets the replies in, see
+// UserLanguage.
+func (app *App) Language(msg *tgbotapi.Message) string {
+	return app.UserLanguage(msg.From)
+}
+
+// UserLanguage returns the language user gets the messages in: the one they picked
+// with /lang, or else the one of their Telegram app (es for es-MX), or else
+// DefaultLanguage.
+func (app *App) UserLanguage(user *tgbotapi.User) string {
+	if user == nil {
+		return DefaultLanguage
+	}
+	if language := app.UserPreferences.Language(user.ID); language != "" && app.Messages.Supports(language) {
+		return language
+	}
+	language, _, _ := strings.Cut(strings.ToLower(user.LanguageCode), "-")
+	if app.Messages.Supports(language) {
+		return language
+	}
+	return DefaultLanguage
+}
+
+// SwitchLanguage replies to the /lang command msg: /lang es makes the user get the
+// replies in Spanish, /lang auto goes back to the language of their Telegram app and
+// /lang alone tells the current one.
+func (app *App) SwitchLanguage(msg *tgbotapi.Message) {
+	languages := strings.Join(app.Messages.Languages(), ", ")
+	language := strings.ToLower(strings.TrimSpace(msg.CommandArguments()))
+	switch {
+	case language == "":
+		data := MessageData{Language: app.Language(msg), Languages: languages}
+		text := fmt.Sprintf("I talk to you in %s, change it with /lang <code> (%s) or /lang auto", data.Language, languages)
+		ReplyText(app.Bot, msg, app.Message(msg, EventLanguage, data, text))
+		return
+	case language == "auto":
+		language = ""
+	case !app.Messages.Supports(language):
+		data := MessageData{Language: language, Languages: languages}
+		text := fmt.Sprintf("I can not talk in %s yet, I can talk in %s", language, languages)
+		ReplyText(app.Bot, msg, app.Message(msg, EventNoLanguage, data, text))
+		return
+	}
+	if err := app.UserPreferences.SetLanguage(msg.From.ID, language); err != nil {
+		log.Printf("[%s %d] Unable to persist the preferences: %s", msg.From.UserName, msg.From.ID, err)
+	}
+	log.Printf("[%s %d] Language set to %q", msg.From.UserName, msg.From.ID, language)
+	data := MessageData{Language: app.Language(msg), Languages: languages}
+	ReplyText(app.Bot, msg, app.Message(msg, EventLanguageSet, data, fmt.Sprintf("Ok, I will talk to you in %s", data.Language)))
+}
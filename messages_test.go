@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// newMessagesApp returns an App whose replies are customized by the templates file
+// content and translated by the catalogs (file name to content).
+func newMessagesApp(t *testing.T, content string, catalogs map[string]string) *App {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "messages.tmpl")
+	if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+		t.Fatalf("unable to write the messages file: %s", err)
+	}
+	catalogsDir := filepath.Join(dir, "catalogs")
+	if err := os.Mkdir(catalogsDir, 0o755); err != nil {
+		t.Fatalf("unable to create the catalogs directory: %s", err)
+	}
+	for name, catalog := range catalogs {
+		if err := os.WriteFile(filepath.Join(catalogsDir, name), []byte(catalog), 0o644); err != nil {
+			t.Fatalf("unable to write the catalog %s: %s", name, err)
+		}
+	}
+	messages, err := LoadMessages(filename, catalogsDir)
+	if err != nil {
+		t.Fatalf("LoadMessages returned error: %s", err)
+	}
+	preferences, err := LoadUserPreferences(filepath.Join(dir, "preferences.json"))
+	if err != nil {
+		t.Fatalf("LoadUserPreferences returned error: %s", err)
+	}
+	return &App{Messages: messages, UserPreferences: preferences}
+}
+
+func TestMessage(t *testing.T) {
+	app := newMessagesApp(t,
+		`{{define "too_large"}}{{.UserName}}, {{.Size}} is over {{.Limit}}{{end}}`+
+			`{{define "command_usage"}}Try {{.Usage}}{{end}}`+
+			`{{define "broken"}}{{.Missing}}{{end}}`+
+			`{{define "blank"}}  {{end}}`,
+		map[string]string{"es.tmpl": `{{define "command_usage"}}Prueba {{.Usage}}{{end}}`},
+	)
+	english := &tgbotapi.Message{From: &tgbotapi.User{ID: 1, UserName: "gato", LanguageCode: "en-US"}}
+	spanish := &tgbotapi.Message{From: &tgbotapi.User{ID: 2, UserName: "michi", LanguageCode: "es-MX"}}
+	tests := []struct {
+		name  string
+		msg   *tgbotapi.Message
+		event string
+		data  MessageData
+		want  string
+	}{
+		{"customized", english, EventTooLarge, MessageData{Size: "60.0 MB", Limit: "50.0 MB"}, "gato, 60.0 MB is over 50.0 MB"},
+		{"translated", spanish, EventCommandUsage, MessageData{Usage: "/meta <url>"}, "Prueba /meta <url>"},
+		{"not translated", spanish, EventTooLarge, MessageData{Size: "60.0 MB", Limit: "50.0 MB"}, "michi, 60.0 MB is over 50.0 MB"},
+		{"not customized", english, EventDryRun, MessageData{}, "fallback"},
+		{"failing template", english, "broken", MessageData{}, "fallback"},
+		{"blank template", english, "blank", MessageData{}, "fallback"},
+		{"no sender", &tgbotapi.Message{}, EventCommandUsage, MessageData{Usage: "/meta <url>"}, "Try /meta <url>"},
+	}
+	for _, test := range tests {
+		if got := app.Message(test.msg, test.event, test.data, "fallback"); got != test.want {
+			t.Errorf("%s: Message(%s) = %q, want %q", test.name, test.event, got, test.want)
+		}
+	}
+}
+
+func TestUserLanguage(t *testing.T) {
+	app := newMessagesApp(t, "", map[string]string{"es.tmpl": "", "pt.tmpl": ""})
+	if err := app.UserPreferences.SetLanguage(3, "pt"); err != nil {
+		t.Fatalf("SetLanguage returned error: %s", err)
+	}
+	tests := []struct {
+		user *tgbotapi.User
+		want string
+	}{
+		{nil, DefaultLanguage},
+		{&tgbotapi.User{ID: 1, LanguageCode: "es-MX"}, "es"},
+		{&tgbotapi.User{ID: 2, LanguageCode: "fr"}, DefaultLanguage},
+		{&tgbotapi.User{ID: 3, LanguageCode: "es"}, "pt"},
+		// the admins and the approved users are messaged knowing only their id
+		{&tgbotapi.User{ID: 3}, "pt"},
+	}
+	for _, test := range tests {
+		if got := app.UserLanguage(test.user); got != test.want {
+			t.Errorf("UserLanguage(%+v) = %q, want %q", test.user, got, test.want)
+		}
+	}
+}
+
+func TestCaptionOutputs(t *testing.T) {
+	app := newMessagesApp(t, "", map[string]string{"es.tmpl": `{{define "quality_caption"}}Hasta {{.Height}}p{{end}}`})
+	outputs := []Output{
+		{Filename: "720.mp4", Caption: "Up to 720p", CaptionEvent: EventQualityCaption, CaptionData: MessageData{Height: 720}},
+		{Filename: "track.m4a", Caption: "Gato - Miau"},
+	}
+	spanish := &tgbotapi.Message{From: &tgbotapi.User{ID: 2, LanguageCode: "es"}}
+	captioned := app.CaptionOutputs(spanish, outputs)
+	if captioned[0].Caption != "Hasta 720p" || captioned[1].Caption != "Gato - Miau" {
+		t.Errorf("CaptionOutputs = %q, %q, want %q, %q", captioned[0].Caption, captioned[1].Caption, "Hasta 720p", "Gato - Miau")
+	}
+	// the outputs are shared with the identical requests
+	if outputs[0].Caption != "Up to 720p" {
+		t.Errorf("CaptionOutputs changed the shared caption to %q", outputs[0].Caption)
+	}
+	english := &tgbotapi.Message{From: &tgbotapi.User{ID: 1, LanguageCode: "en"}}
+	if caption := app.CaptionOutputs(english, outputs)[0].Caption; caption != "Up to 720p" {
+		t.Errorf("CaptionOutputs = %q for an untranslated language, want the built-in caption", caption)
+	}
+}
+
+func TestStatsReport(t *testing.T) {
+	stats, err := LoadStats("")
+	if err != nil {
+		t.Fatalf("LoadStats returned error: %s", err)
+	}
+	stats.VideoRequests, stats.AudioRequests = 2, 1
+	stats.Successes, stats.Failures = 2, 1
+	stats.Bytes = 2048
+	stats.Domains = map[string]int{"youtube.com": 2, "vimeo.com": 1}
+	want := "Requests: 3 (2 video, 1 audio)\nSucceeded: 2, failed: 1\nProduced: " + FormatBytes(2048) + "\nTop domains:\n  youtube.com: 2\n  vimeo.com: 1"
+	if report := StatsReport(stats.Report()); report != want {
+		t.Errorf("StatsReport = %q, want %q", report, want)
+	}
+	app := newMessagesApp(t, `{{define "stats"}}{{.Succeeded}}/{{.Count}} ok{{end}}`, nil)
+	if report := app.Message(&tgbotapi.Message{}, EventStats, stats.Report(), ""); report != "2/3 ok" {
+		t.Errorf("the customized stats = %q, want %q", report, "2/3 ok")
+	}
+}
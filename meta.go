@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// MaxMetaTitleLength is how many characters of the title the card of /meta shows, the
+// card must fit in the 1024 characters of a caption.
+const MaxMetaTitleLength = 300
+
+// BestHeight returns the height (in pixels) of the best video format of the video, 0
+// when it reports none.
+func (info *VideoInfo) BestHeight() int {
+	height := 0
+	for _, format := range info.Formats {
+		if format.Vcodec != "none" && format.Height > height {
+			height = format.Height
+		}
+	}
+	return height
+}
+
+// ChannelName returns the name of the channel of the video (or of its uploader) and
+// the URL of the channel, both empty when unknown.
+func (info *VideoInfo) ChannelName() (string, string) {
+	if info.Channel != "" {
+		return info.Channel, info.ChannelUrl
+	}
+	return info.Uploader, info.UploaderUrl
+}
+
+// FormatCount returns count in a short form, like 950, 12.3K or 1.2M.
+func FormatCount(count int64) string {
+	switch {
+	case count < 1000:
+		return strconv.FormatInt(count, 10)
+	case count < 1000*1000:
+		return strconv.FormatFloat(float64(count)/1000, 'f', 1, 64) + "K"
+	case count < 1000*1000*1000:
+		return strconv.FormatFloat(float64(count)/1000/1000, 'f', 1, 64) + "M"
+	default:
+		return strconv.FormatFloat(float64(count)/1000/1000/1000, 'f', 1, 64) + "B"
+	}
+}
+
+// MetaCard returns the card of the video for /meta: its title, channel, duration, best
+// resolution, upload date and counts. The fields the site does not report are left out.
+func MetaCard(info *VideoInfo) string {
+	title := strings.TrimSpace(info.Title)
+	if title == "" {
+		title = "Untitled"
+	}
+	if utf8.RuneCountInString(title) > MaxMetaTitleLength {
+		title = string([]rune(title)[:MaxMetaTitleLength]) + "…"
+	}
+	lines := []string{"🎬 " + title}
+	if channel, _ := info.ChannelName(); channel != "" {
+		lines = append(lines, "👤 "+channel)
+	}
+	details := []string{}
+	if info.Duration > 0 {
+		details = append(details, "⏱ "+Second2Spot(float64(int(info.Duration))))
+	}
+	if height := info.BestHeight(); height > 0 {
+		details = append(details, fmt.Sprintf("📺 %dp", height))
+	}
+	if uploaded, err := time.Parse("20060102", info.UploadDate); err == nil {
+		details = append(details, "📅 "+uploaded.Format("2006-01-02"))
+	}
+	if len(details) != 0 {
+		lines = append(lines, strings.Join(details, " · "))
+	}
+	counts := []string{}
+	if info.ViewCount != nil {
+		counts = append(counts, fmt.Sprintf("👁 %s views", FormatCount(*info.ViewCount)))
+	}
+	if info.LikeCount != nil {
+		counts = append(counts, fmt.Sprintf("👍 %s likes", FormatCount(*info.LikeCount)))
+	}
+	if len(counts) != 0 {
+		lines = append(lines, strings.Join(counts, " · "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// MetaMarkup returns the buttons of the card of /meta (the reply to msg) linking the
+// video and its channel (when known).
+func (app *App) MetaMarkup(msg *tgbotapi.Message, info *VideoInfo, videoUrl string) interface{} {
+	if info.WebpageUrl != "" {
+		videoUrl = info.WebpageUrl
+	}
+	data := MessageData{Url: videoUrl, Title: info.Title}
+	buttons := []tgbotapi.InlineKeyboardButton{tgbotapi.NewInlineKeyboardButtonURL(app.Message(msg, EventVideoButton, data, "Video 🔗"), videoUrl)}
+	if _, channelUrl := info.ChannelName(); channelUrl != "" {
+		buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonURL(app.Message(msg, EventChannelButton, data, "Channel 🔗"), channelUrl))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(buttons...))
+}
+
+// SendMeta replies to the /meta command msg with the card of the video of its URL, as
+// the caption of its thumbnail (or as text when it has none or Telegram does not take
+// it).
+func (app *App) SendMeta(msg *tgbotapi.Message) {
+	request := strings.TrimSpace(msg.CommandArguments())
+	if request == "" {
+		app.ReplyUsage(msg, "/meta <url>")
+		return
+	}
+	downloadConfig, err := LoadDownloadConfigFromMsg(request)
+	if err != nil {
+		app.ReplyInvalidRequest(msg, err)
+		return
+	}
+	videoUrl, err := NormalizeUrl(app.Config, downloadConfig.VideoUrl)
+	if err != nil {
+		log.Printf("[%s %d] Keeping the short URL: %s", msg.From.UserName, msg.From.ID, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), app.Config.MaxRequestDuration)
+	defer cancel()
+	info, err := FetchVideoInfo(ctx, app.Config, videoUrl.String())
+	if err != nil {
+		log.Printf("[%s %d] Unable to get the metadata of %s: %s", msg.From.UserName, msg.From.ID, videoUrl, err)
+		ReplyText(app.Bot, msg, app.Message(msg, EventFailed, MessageData{Url: videoUrl.String(), Error: err.Error()}, "I'm sorry I was not able to get the metadata of your video ☹"))
+		return
+	}
+	card := MetaCard(info)
+	markup := app.MetaMarkup(msg, info, videoUrl.String())
+	if info.Thumbnail != "" {
+		photo := tgbotapi.NewPhoto(msg.Chat.ID, tgbotapi.FileURL(info.Thumbnail))
+		photo.Caption = card
+		photo.ReplyToMessageID = msg.MessageID
+		photo.ReplyMarkup = markup
+		_, err := SendWithRetry(app.Bot, photo)
+		if err == nil {
+			return
+		}
+		log.Printf("[%s %d] Unable to send the thumbnail of %s, sending the card alone: %s", msg.From.UserName, msg.From.ID, videoUrl, err)
+	}
+	reply := tgbotapi.NewMessage(msg.Chat.ID, card)
+	reply.ReplyToMessageID = msg.MessageID
+	reply.DisableWebPagePreview = true
+	reply.ReplyMarkup = markup
+	if _, err := SendWithRetry(app.Bot, reply); err != nil {
+		log.Printf("[%s %d] Unable to send message: %s", msg.From.UserName, msg.From.ID, err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// The texts of the buttons of the greeting keyboard, pressing one of them sends its text
+// as a message and sets the mode of the chat.
+const (
+	KeyboardVideo = "🎬 Video"
+	KeyboardAudio = "🎵 Audio only"
+)
+
+// ChatModeTTL is how long a chat mode affects the URLs sent to the chat.
+const ChatModeTTL = 5 * time.Minute
+
+// The modes a chat can be in after pressing a button of the greeting keyboard.
+const (
+	ModeNone = iota
+	ModeVideo
+	ModeAudio
+)
+
+type chatMode struct {
+	mode      int
+	expiresAt time.Time
+}
+
+// ChatModes remembers the short-lived mode of every chat, the mode affects only the next
+// URL sent to the chat. It is safe for concurrent use.
+type ChatModes struct {
+	mu    sync.Mutex
+	modes map[int64]chatMode
+}
+
+// NewChatModes creates an empty ChatModes.
+func NewChatModes() *ChatModes {
+	return &ChatModes{modes: map[int64]chatMode{}}
+}
+
+// Set puts the chat chatId in mode for the next ChatModeTTL.
+func (c *ChatModes) Set(chatId int64, mode int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.modes[chatId] = chatMode{mode: mode, expiresAt: time.Now().Add(ChatModeTTL)}
+}
+
+// Take returns the mode of the chat chatId (ModeNone when it expired) and clears it.
+func (c *ChatModes) Take(chatId int64) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	mode, ok := c.modes[chatId]
+	if !ok {
+		return ModeNone
+	}
+	delete(c.modes, chatId)
+	if time.Now().After(mode.expiresAt) {
+		return ModeNone
+	}
+	return mode.mode
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// TempDir is the directory where the bot creates every file it downloads or produces.
+func TempDir() string {
+	return os.TempDir()
+}
+
+// SafeTempPath joins name to TempDir. Every output path must be built with this
+// function (or DerivedTempPath) since name may be influenced by the users (titles,
+// containers, extensions), so names that could escape TempDir (.., absolute paths,
+// path separators) are rejected.
+func SafeTempPath(name string) (string, error) {
+	if name == "" || name == "." || strings.Contains(name, "..") || filepath.IsAbs(name) || strings.ContainsAny(name, "/\\\x00") {
+		return "", fmt.Errorf("unsafe file name %q", name)
+	}
+	return filepath.Join(TempDir(), name), nil
+}
+
+// DerivedTempPath returns the path of a file derived from filename (a file in TempDir),
+// adding suffix to its name and replacing its extension by ext (an empty ext keeps the
+// extension of filename).
+func DerivedTempPath(filename, suffix, ext string) (string, error) {
+	if filepath.Clean(filepath.Dir(filename)) != filepath.Clean(TempDir()) {
+		return "", fmt.Errorf("file %s is not in the temp dir %s", filename, TempDir())
+	}
+	filenameExt := filepath.Ext(filename)
+	if ext == "" {
+		ext = filenameExt
+	}
+	return SafeTempPath(strings.TrimSuffix(filepath.Base(filename), filenameExt) + suffix + ext)
+}
+
+// PathLocks are locks by file path, for the files several requests may write at once.
+type PathLocks struct {
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+// pathLock is the lock of a path, it is dropped when nobody holds nor waits for it.
+type pathLock struct {
+	held  chan struct{}
+	users int
+}
+
+// NewPathLocks returns PathLocks with no path locked.
+func NewPathLocks() *PathLocks {
+	return &PathLocks{locks: map[string]*pathLock{}}
+}
+
+// Lock waits until path is not locked (or ctx is done) and locks it, the returned
+// function unlocks it.
+func (l *PathLocks) Lock(ctx context.Context, path string) (func(), error) {
+	l.mu.Lock()
+	lock, ok := l.locks[path]
+	if !ok {
+		lock = &pathLock{held: make(chan struct{}, 1)}
+		l.locks[path] = lock
+	}
+	lock.users++
+	l.mu.Unlock()
+	select {
+	case lock.held <- struct{}{}:
+		return func() {
+			<-lock.held
+			l.release(path, lock)
+		}, nil
+	case <-ctx.Done():
+		l.release(path, lock)
+		return nil, ctx.Err()
+	}
+}
+
+// release drops the interest of a caller of Lock in lock.
+func (l *PathLocks) release(path string, lock *pathLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lock.users--
+	if lock.users == 0 {
+		delete(l.locks, path)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSafeTempPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{"video.mp4", false},
+		{"my_clip-cut.mp4", false},
+		{"../x", true},
+		{"..", true},
+		{".", true},
+		{"", true},
+		{"/abs", true},
+		{"a/b", true},
+		{"a\\b", true},
+		{"a\x00b", true},
+	}
+	for _, test := range tests {
+		path, err := SafeTempPath(test.name)
+		if (err != nil) != test.wantErr {
+			t.Errorf("SafeTempPath(%q) returned error %v, want error %t", test.name, err, test.wantErr)
+			continue
+		}
+		if err == nil && path != filepath.Join(TempDir(), test.name) {
+			t.Errorf("SafeTempPath(%q) = %s, want it in %s", test.name, path, TempDir())
+		}
+	}
+}
+
+func TestDerivedTempPath(t *testing.T) {
+	videoFilename := filepath.Join(TempDir(), "video.mp4")
+	tests := []struct {
+		filename string
+		suffix   string
+		ext      string
+		want     string
+		wantErr  bool
+	}{
+		{videoFilename, "-cut", "", filepath.Join(TempDir(), "video-cut.mp4"), false},
+		{videoFilename, "-audio", ".m4a", filepath.Join(TempDir(), "video-audio.m4a"), false},
+		{videoFilename, "", ".gif", filepath.Join(TempDir(), "video.gif"), false},
+		{videoFilename, "-cut", "/../x", "", true},
+		{videoFilename, "-cut", ".a/b", "", true},
+		{videoFilename, "/..", "", "", true},
+		{videoFilename, "-cut", "..", "", true},
+		{"/abs/video.mp4", "-cut", "", "", true},
+		{"video.mp4", "-cut", "", "", true},
+		{filepath.Join(TempDir(), "a", "video.mp4"), "-cut", "", "", true},
+		{filepath.Join(TempDir(), "..", "video.mp4"), "-cut", "", "", true},
+	}
+	for _, test := range tests {
+		path, err := DerivedTempPath(test.filename, test.suffix, test.ext)
+		if (err != nil) != test.wantErr {
+			t.Errorf("DerivedTempPath(%q, %q, %q) returned error %v, want error %t", test.filename, test.suffix, test.ext, err, test.wantErr)
+			continue
+		}
+		if path != test.want {
+			t.Errorf("DerivedTempPath(%q, %q, %q) = %s, want %s", test.filename, test.suffix, test.ext, path, test.want)
+		}
+	}
+}
+
+func TestPathLocksSerializeTheSamePath(t *testing.T) {
+	locks := NewPathLocks()
+	unlock, err := locks.Lock(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("Lock(a) returned error: %s", err)
+	}
+	// another path is not blocked
+	unlockOther, err := locks.Lock(context.Background(), "b")
+	if err != nil {
+		t.Fatalf("Lock(b) returned error: %s", err)
+	}
+	unlockOther()
+	locked := make(chan func())
+	go func() {
+		unlock, err := locks.Lock(context.Background(), "a")
+		if err != nil {
+			t.Errorf("second Lock(a) returned error: %s", err)
+		}
+		locked <- unlock
+	}()
+	select {
+	case <-locked:
+		t.Fatal("second Lock(a) did not wait for the first one")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case unlock := <-locked:
+		unlock()
+	case <-time.After(time.Second):
+		t.Fatal("second Lock(a) did not get the lock after the unlock")
+	}
+	if len(locks.locks) != 0 {
+		t.Errorf("the locks of %d paths are kept after every unlock", len(locks.locks))
+	}
+}
+
+func TestPathLocksStopWaitingWhenTheContextIsDone(t *testing.T) {
+	locks := NewPathLocks()
+	unlock, err := locks.Lock(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("Lock(a) returned error: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := locks.Lock(ctx, "a"); err == nil {
+		t.Error("Lock(a) of a locked path returned no error when its context was done")
+	}
+	unlock()
+	if len(locks.locks) != 0 {
+		t.Errorf("the locks of %d paths are kept after every unlock", len(locks.locks))
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// CallbackPickAll picks every URL of a message with several URLs, it is followed by the
+// ids of their pending downloads separated by commas.
+const CallbackPickAll = "pickall:"
+
+// MaxPickedUrls is how many URLs of a message can be picked, the ids of all of them must
+// fit in the 64 bytes of the callback data of the "all" button.
+const MaxPickedUrls = 8
+
+// MessageUrls returns the http(s) URLs of the text of msg (the words that are URLs and
+// the URLs hidden behind text links), each of them once, and the rest of the words
+// (the option words and the video spots).
+func MessageUrls(msg *tgbotapi.Message) ([]string, []string) {
+	urls := []string{}
+	args := []string{}
+	seen := map[string]bool{}
+	add := func(u string) {
+		if !seen[u] {
+			seen[u] = true
+			urls = append(urls, u)
+		}
+	}
+	for _, word := range strings.Fields(msg.Text) {
+		if u, err := url.Parse(word); err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+			add(word)
+		} else {
+			args = append(args, word)
+		}
+	}
+	for _, entity := range msg.Entities {
+		if entity.Type != "text_link" {
+			continue
+		}
+		if u, err := url.Parse(entity.URL); err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+			add(entity.URL)
+		}
+	}
+	return urls, args
+}
+
+// AskWhichUrl replies to msg (which has several URLs) with an inline keyboard to pick
+// which of the URLs to download, or all of them. The rest of the words of msg apply to
+// each URL.
+func (app *App) AskWhichUrl(msg *tgbotapi.Message, urls, args []string) {
+	if len(urls) > MaxPickedUrls {
+		data := MessageData{Count: len(urls), Max: MaxPickedUrls}
+		ReplyText(app.Bot, msg, app.Message(msg, EventTooManyUrls, data, fmt.Sprintf("I can only pick among %d URLs, send me fewer of them 🙀", MaxPickedUrls)))
+		return
+	}
+	lines := []string{}
+	rows := [][]tgbotapi.InlineKeyboardButton{}
+	buttons := []tgbotapi.InlineKeyboardButton{}
+	ids := []string{}
+	for i, u := range urls {
+		downloadConfig, err := LoadDownloadConfigFromMsg(strings.Join(append([]string{u}, args...), " "))
+		if err != nil {
+			log.Printf("[%s %d] Unable to complete request %s: %s", msg.From.UserName, msg.From.ID, msg.Text, err)
+			ReplyText(app.Bot, msg, app.Message(msg, EventFailed, MessageData{Url: u, Error: err.Error()}, "I'm sorry I was not able to download your video ☹"))
+			return
+		}
+		id := app.PendingDownloads.Add(msg, downloadConfig)
+		ids = append(ids, id)
+		lines = append(lines, fmt.Sprintf("%d. %s", i+1, u))
+		buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("⬇️ %d", i+1), CallbackSearch+id))
+	}
+	for start := 0; start < len(buttons); start += 4 {
+		end := start + 4
+		if end > len(buttons) {
+			end = len(buttons)
+		}
+		rows = append(rows, buttons[start:end])
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData(app.Message(msg, EventAllButton, MessageData{Count: len(urls)}, "⬇️ All"), CallbackPickAll+strings.Join(ids, ",")),
+	))
+	log.Printf("[%s %d] Asking which of %d URLs to download", msg.From.UserName, msg.From.ID, len(urls))
+	header := app.Message(msg, EventPickUrl, MessageData{Count: len(urls)}, fmt.Sprintf("Your message has %d URLs, which one do you want?", len(urls)))
+	text := header + "\n\n" + strings.Join(lines, "\n")
+	reply := tgbotapi.NewMessage(msg.Chat.ID, text)
+	reply.ReplyToMessageID = msg.MessageID
+	reply.DisableWebPagePreview = true
+	reply.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	if _, err := SendWithRetry(app.Bot, reply); err != nil {
+		log.Printf("[%s %d] Unable to send message: %s", msg.From.UserName, msg.From.ID, err)
+	}
+}
+
+// HandlePickAll downloads (one after the other) every URL of a message with several
+// URLs, the ones already picked on their own are skipped.
+func (app *App) HandlePickAll(query *tgbotapi.CallbackQuery) {
+	pendings := []*PendingDownload{}
+	for _, id := range strings.Split(strings.TrimPrefix(query.Data, CallbackPickAll), ",") {
+		pending, ok := app.PendingDownloads.Take(id, query.From.ID)
+		if !ok {
+			log.Printf("[%s %d] URL pick %s is unknown or expired", query.From.UserName, query.From.ID, id)
+			continue
+		}
+		pendings = append(pendings, pending)
+	}
+	go func() {
+		for _, pending := range pendings {
+			app.ProcessDownload(pending.Msg, pending.DownloadConfig)
+		}
+	}()
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The priorities of the requests waiting for a worker, the higher ones take the free
+// workers first.
+const (
+	PriorityNormal = iota
+	// PriorityShort is the priority of the audios and the short cuts, they are quick to
+	// process, so they do not wait behind the long videos.
+	PriorityShort
+	// PriorityAdmin is the priority of the requests of the admins.
+	PriorityAdmin
+)
+
+// ShortClipSeconds is how long a cut can last to get PriorityShort.
+const ShortClipSeconds = 60
+
+// RequestPriority returns the priority of the request downloadConfig of the user userId.
+func RequestPriority(config *Config, userId int64, downloadConfig *DownloadConfig) int {
+	if config.IsAdmin(userId) {
+		return PriorityAdmin
+	}
+	if downloadConfig.AudioOnly || (downloadConfig.HasSpan() && downloadConfig.EndSecond-downloadConfig.StartSecond <= ShortClipSeconds) {
+		return PriorityShort
+	}
+	return PriorityNormal
+}
+
+// RollingAverageSize is how many of the last durations a RollingAverage averages.
+const RollingAverageSize = 20
+
+// RollingAverage is the average of the last RollingAverageSize durations added to it,
+// its zero value is empty and ready to use. It is not safe for concurrent use.
+type RollingAverage struct {
+	durations []time.Duration
+	// next is where the next duration goes once durations is full.
+	next int
+}
+
+// Add adds duration to the average, replacing the oldest one when it is full.
+func (a *RollingAverage) Add(duration time.Duration) {
+	if len(a.durations) < RollingAverageSize {
+		a.durations = append(a.durations, duration)
+		return
+	}
+	a.durations[a.next] = duration
+	a.next = (a.next + 1) % RollingAverageSize
+}
+
+// Average returns the average of the durations and whether there is any.
+func (a *RollingAverage) Average() (time.Duration, bool) {
+	if len(a.durations) == 0 {
+		return 0, false
+	}
+	var total time.Duration
+	for _, duration := range a.durations {
+		total += duration
+	}
+	return total / time.Duration(len(a.durations)), true
+}
+
+// Stage is a step of the processing of a request (downloading, cutting or uploading
+// its files) with its own workers. A request goes through the stages one after the
+// other: it is queued in a stage, a free worker of the stage takes it, runs the step and
+// tells the request (through a channel) that it is done, and then the request is queued
+// in the next stage. The stages have separate workers so a request cutting its video
+// (CPU-bound) does not hold a worker of the downloads (network-bound). The requests
+// waiting for a worker get it by priority, and in order of arrival within the same
+// priority.
+type Stage struct {
+	// name is the name of the stage in the errors, like download.
+	name string
+	// workers is how many workers the stage has, 0 means any number: the step runs
+	// right away.
+	workers int
+	mu      sync.Mutex
+	// queued is signaled when a job is queued, for the workers waiting for one.
+	queued *sync.Cond
+	// busy is how many workers are running a job.
+	busy    int
+	waiting stageQueue
+	// arrivals counts the jobs queued, to keep their order.
+	arrivals uint64
+	// held is how long the last jobs took, to estimate the waits.
+	held RollingAverage
+}
+
+// stageJob is the step of a request queued in a stage. started is closed when a worker
+// takes it, done when the worker finished running it, and moved is signaled when its
+// position in the queue may have changed.
+type stageJob struct {
+	priority int
+	arrival  uint64
+	run      func()
+	started  chan struct{}
+	done     chan struct{}
+	moved    chan struct{}
+	// index is the position of the job in the queue, -1 once it left the queue.
+	index int
+}
+
+// stageQueue is a heap of the jobs waiting for a worker, the first one is the one with
+// the highest priority that arrived first.
+type stageQueue []*stageJob
+
+func (q stageQueue) Len() int { return len(q) }
+
+func (q stageQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].arrival < q[j].arrival
+}
+
+func (q stageQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *stageQueue) Push(x interface{}) {
+	job := x.(*stageJob)
+	job.index = len(*q)
+	*q = append(*q, job)
+}
+
+func (q *stageQueue) Pop() interface{} {
+	old := *q
+	job := old[len(old)-1]
+	old[len(old)-1] = nil
+	job.index = -1
+	*q = old[:len(old)-1]
+	return job
+}
+
+// The stages of the processing of a request, StartStages starts them with the workers
+// of DOWNLOAD_WORKERS, CUT_WORKERS and UPLOAD_WORKERS.
+var (
+	DownloadStage *Stage
+	CutStage      *Stage
+	UploadStage   *Stage
+)
+
+// StartStages starts the workers of the stages as configured in config, it must be
+// called (once) before processing any request.
+func StartStages(config *Config) {
+	DownloadStage = NewStage("download", config.DownloadWorkers)
+	CutStage = NewStage("cut", config.CutWorkers)
+	UploadStage = NewStage("upload", config.UploadWorkers)
+}
+
+// NewStage starts a stage named name with workers workers, 0 means any number.
+func NewStage(name string, workers int) *Stage {
+	s := &Stage{name: name, workers: workers}
+	s.queued = sync.NewCond(&s.mu)
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+	return s
+}
+
+// work is a worker of the stage, it runs the queued jobs (the first one first) forever.
+func (s *Stage) work() {
+	for {
+		s.mu.Lock()
+		for s.waiting.Len() == 0 {
+			s.queued.Wait()
+		}
+		job := heap.Pop(&s.waiting).(*stageJob)
+		s.busy++
+		s.notifyMoved()
+		s.mu.Unlock()
+		close(job.started)
+		start := time.Now()
+		job.run()
+		s.mu.Lock()
+		s.held.Add(time.Since(start))
+		s.busy--
+		s.mu.Unlock()
+		close(job.done)
+	}
+}
+
+// Run queues run as a job of priority in the stage and waits until a worker of the stage
+// runs it (or until ctx is done while it waits, then it is dropped and the error of ctx
+// is returned). While the job waits, onPosition (when not nil) is called with its
+// position in the queue (1 is the next one) and the estimated wait (0 when unknown)
+// every time they change, and with 0 when a worker takes it.
+func (s *Stage) Run(ctx context.Context, priority int, onPosition func(position int, eta time.Duration), run func()) error {
+	if s.workers == 0 {
+		run()
+		return nil
+	}
+	job := &stageJob{priority: priority, run: run, started: make(chan struct{}), done: make(chan struct{}), moved: make(chan struct{}, 1)}
+	s.mu.Lock()
+	job.arrival = s.arrivals
+	s.arrivals++
+	heap.Push(&s.waiting, job)
+	s.notifyMoved()
+	s.queued.Signal()
+	s.mu.Unlock()
+	started := job.started
+	lastPosition := 0
+	for {
+		select {
+		case <-started:
+			// a nil channel is never ready, the job is not started twice
+			started = nil
+			if onPosition != nil && lastPosition != 0 {
+				onPosition(0, 0)
+			}
+		case <-job.done:
+			// the job may be done before its start is noticed
+			if onPosition != nil && started != nil && lastPosition != 0 {
+				onPosition(0, 0)
+			}
+			return nil
+		case <-job.moved:
+			if onPosition == nil || started == nil {
+				continue
+			}
+			s.mu.Lock()
+			position, eta := s.position(job)
+			s.mu.Unlock()
+			if position != 0 && position != lastPosition {
+				lastPosition = position
+				onPosition(position, eta)
+			}
+		case <-ctx.Done():
+			s.mu.Lock()
+			if job.index >= 0 {
+				heap.Remove(&s.waiting, job.index)
+				s.notifyMoved()
+				s.mu.Unlock()
+				return fmt.Errorf("gave up waiting for a %s worker: %s", s.name, ctx.Err())
+			}
+			s.mu.Unlock()
+			// a worker took the job meanwhile, run sees ctx is done too
+			<-job.done
+			return nil
+		}
+	}
+}
+
+// position returns the position of job in the queue (1 is the next one, 0 when it is
+// not waiting or a free worker is about to take it) and the estimated wait until it gets
+// a worker (0 when unknown), assuming the jobs ahead take as long as the last ones did.
+// The caller must hold the lock.
+func (s *Stage) position(job *stageJob) (int, time.Duration) {
+	if job.index < 0 {
+		return 0, 0
+	}
+	position := 1
+	for i := range s.waiting {
+		if s.waiting.Less(i, job.index) {
+			position++
+		}
+	}
+	// the free workers take the first jobs right away
+	position -= s.workers - s.busy
+	if position <= 0 {
+		return 0, 0
+	}
+	held, ok := s.held.Average()
+	if !ok {
+		return position, 0
+	}
+	// the jobs ahead (and this one) take the workers in rounds
+	rounds := (position + s.workers - 1) / s.workers
+	return position, time.Duration(rounds) * held
+}
+
+// notifyMoved tells every queued job that its position may have changed, the caller
+// must hold the lock.
+func (s *Stage) notifyMoved() {
+	for _, job := range s.waiting {
+		select {
+		case job.moved <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStageQueueLess(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b stageJob
+		want bool
+	}{
+		{"higher priority first", stageJob{priority: PriorityAdmin, arrival: 5}, stageJob{priority: PriorityNormal, arrival: 1}, true},
+		{"lower priority after", stageJob{priority: PriorityNormal, arrival: 1}, stageJob{priority: PriorityShort, arrival: 5}, false},
+		{"same priority, earlier arrival first", stageJob{priority: PriorityShort, arrival: 1}, stageJob{priority: PriorityShort, arrival: 2}, true},
+		{"same priority, later arrival after", stageJob{priority: PriorityShort, arrival: 2}, stageJob{priority: PriorityShort, arrival: 1}, false},
+		{"same job", stageJob{priority: PriorityNormal, arrival: 1}, stageJob{priority: PriorityNormal, arrival: 1}, false},
+	}
+	for _, test := range tests {
+		a, b := test.a, test.b
+		q := stageQueue{&a, &b}
+		if got := q.Less(0, 1); got != test.want {
+			t.Errorf("%s: Less = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestStageQueuePopsInOrder(t *testing.T) {
+	jobs := []*stageJob{
+		{priority: PriorityNormal, arrival: 0},
+		{priority: PriorityShort, arrival: 1},
+		{priority: PriorityNormal, arrival: 2},
+		{priority: PriorityAdmin, arrival: 3},
+		{priority: PriorityShort, arrival: 4},
+		{priority: PriorityNormal, arrival: 5},
+	}
+	q := stageQueue{}
+	for _, job := range jobs {
+		heap.Push(&q, job)
+	}
+	want := []uint64{3, 1, 4, 0, 2, 5}
+	for _, arrival := range want {
+		job := heap.Pop(&q).(*stageJob)
+		if job.arrival != arrival || job.index != -1 {
+			t.Fatalf("popped the job %d (index %d), want the job %d (index -1)", job.arrival, job.index, arrival)
+		}
+	}
+}
+
+// waitQueued waits until count jobs are queued in the stage s.
+func waitQueued(t *testing.T, s *Stage, count int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.mu.Lock()
+		queued := s.waiting.Len()
+		s.mu.Unlock()
+		if queued == count {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d jobs are queued, want %d", queued, count)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// blockStage takes the only worker of s until the returned function is called.
+func blockStage(t *testing.T, s *Stage) func() {
+	t.Helper()
+	release := make(chan struct{})
+	running := make(chan struct{})
+	go s.Run(context.Background(), PriorityNormal, nil, func() {
+		close(running)
+		<-release
+	})
+	<-running
+	return func() { close(release) }
+}
+
+func TestStageRunOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		priorities []int
+		// want are the indexes of priorities in the order they must run
+		want []int
+	}{
+		{"same priority in order of arrival", []int{PriorityNormal, PriorityNormal, PriorityNormal}, []int{0, 1, 2}},
+		{"higher priority first", []int{PriorityNormal, PriorityShort, PriorityAdmin}, []int{2, 1, 0}},
+		{"mixed", []int{PriorityShort, PriorityNormal, PriorityShort, PriorityAdmin, PriorityNormal}, []int{3, 0, 2, 1, 4}},
+	}
+	for _, test := range tests {
+		s := NewStage("test", 1)
+		release := blockStage(t, s)
+		var mu sync.Mutex
+		order := []int{}
+		var wg sync.WaitGroup
+		for i, priority := range test.priorities {
+			wg.Add(1)
+			go func(i, priority int) {
+				defer wg.Done()
+				err := s.Run(context.Background(), priority, nil, func() {
+					mu.Lock()
+					order = append(order, i)
+					mu.Unlock()
+				})
+				if err != nil {
+					t.Errorf("%s: Run returned error: %s", test.name, err)
+				}
+			}(i, priority)
+			// the arrival order is the order they are queued in
+			waitQueued(t, s, i+1)
+		}
+		release()
+		wg.Wait()
+		for i := range test.want {
+			if i >= len(order) || order[i] != test.want[i] {
+				t.Errorf("%s: the jobs ran in the order %v, want %v", test.name, order, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestStageRunCancelledWhileWaiting(t *testing.T) {
+	s := NewStage("test", 1)
+	release := blockStage(t, s)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error)
+	ran := false
+	go func() {
+		cancelled <- s.Run(ctx, PriorityAdmin, nil, func() { ran = true })
+	}()
+	waitQueued(t, s, 1)
+	done := make(chan struct{})
+	go func() {
+		s.Run(context.Background(), PriorityNormal, nil, func() {})
+		close(done)
+	}()
+	waitQueued(t, s, 2)
+	cancel()
+	if err := <-cancelled; err == nil {
+		t.Error("Run of a cancelled job returned no error")
+	}
+	waitQueued(t, s, 1)
+	release()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the job behind the cancelled one never ran")
+	}
+	if ran {
+		t.Error("the cancelled job ran")
+	}
+}
+
+func TestStageRunReportsThePosition(t *testing.T) {
+	s := NewStage("test", 1)
+	release := blockStage(t, s)
+	positions := make(chan int, 10)
+	done := make(chan struct{})
+	go func() {
+		s.Run(context.Background(), PriorityNormal, nil, func() {})
+	}()
+	waitQueued(t, s, 1)
+	go func() {
+		s.Run(context.Background(), PriorityNormal, func(position int, eta time.Duration) {
+			positions <- position
+		}, func() {})
+		close(done)
+	}()
+	waitQueued(t, s, 2)
+	if position := <-positions; position != 2 {
+		t.Errorf("the job behind another one is at the position %d, want 2", position)
+	}
+	release()
+	<-done
+	close(positions)
+	reported := []int{}
+	for position := range positions {
+		reported = append(reported, position)
+	}
+	if len(reported) == 0 || reported[len(reported)-1] != 0 {
+		t.Errorf("the job reported the positions %v after the 2, want them to end with 0", reported)
+	}
+}
+
+func TestStageWithoutWorkersRunsRightAway(t *testing.T) {
+	s := NewStage("test", 0)
+	ran := false
+	if err := s.Run(context.Background(), PriorityNormal, nil, func() { ran = true }); err != nil || !ran {
+		t.Errorf("Run on a stage without a limit returned %v and ran %t, want nil and true", err, ran)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"sync"
+)
+
+// AudioStreakPrompt is how many audio requests in a row a user must make before the bot
+// offers to make audio their default.
+const AudioStreakPrompt = 5
+
+// Prefix of the callback data of the buttons offering to make audio the default, it is
+// followed by yes or no.
+const CallbackDefaultAudio = "defaultaudio:"
+
+// UserPreferences remembers the preferences of the users (persisted in a JSON file)
+// and their recent requests (kept only in memory), it is safe for concurrent use.
+type UserPreferences struct {
+	mu       sync.Mutex
+	filename string
+	// DefaultAudio holds the users who get only the audio unless they ask for the video.
+	DefaultAudio map[int64]bool `json:"default_audio"`
+	// Languages holds the language picked with /lang by the users who picked one.
+	Languages map[int64]string `json:"languages"`
+	// Declined holds the users who do not want audio as their default, they are not
+	// offered it again.
+	Declined map[int64]bool `json:"declined"`
+	// audioStreaks counts the audio requests in a row of every user.
+	audioStreaks map[int64]int
+}
+
+// LoadUserPreferences loads the preferences persisted in filename, when filename is
+// empty the preferences are kept only in memory.
+func LoadUserPreferences(filename string) (*UserPreferences, error) {
+	prefs := &UserPreferences{
+		filename:     filename,
+		DefaultAudio: map[int64]bool{},
+		Languages:    map[int64]string{},
+		Declined:     map[int64]bool{},
+		audioStreaks: map[int64]int{},
+	}
+	if err := LoadJSON(filename, prefs); err != nil {
+		return nil, err
+	}
+	if prefs.DefaultAudio == nil {
+		prefs.DefaultAudio = map[int64]bool{}
+	}
+	if prefs.Languages == nil {
+		prefs.Languages = map[int64]string{}
+	}
+	if prefs.Declined == nil {
+		prefs.Declined = map[int64]bool{}
+	}
+	return prefs, nil
+}
+
+// AudioByDefault returns the download of request (already parsed as downloadConfig)
+// asking only for the audio, for the users who made it their default. The request is
+// parsed again with the audio word, so the options that need the video (like mute or
+// thumbnails) keep downloadConfig as is instead of conflicting with the default, as do
+// the requests that ask for the video.
+func AudioByDefault(request string, downloadConfig *DownloadConfig) *DownloadConfig {
+	if downloadConfig.AudioOnly || downloadConfig.Video {
+		return downloadConfig
+	}
+	audioConfig, err := LoadDownloadConfigFromMsg(request + " audio")
+	if err != nil {
+		return downloadConfig
+	}
+	audioConfig.JobId = downloadConfig.JobId
+	return audioConfig
+}
+
+// WantsAudio reports whether the user userId made audio their default.
+func (p *UserPreferences) WantsAudio(userId int64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.DefaultAudio[userId]
+}
+
+// Record remembers the user userId made an audio (or video) request and reports
+// whether the bot should offer to make audio their default.
+func (p *UserPreferences) Record(userId int64, audioOnly bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !audioOnly {
+		p.audioStreaks[userId] = 0
+		return false
+	}
+	p.audioStreaks[userId]++
+	if p.DefaultAudio[userId] || p.Declined[userId] {
+		return false
+	}
+	return p.audioStreaks[userId] == AudioStreakPrompt
+}
+
+// SetDefaultAudio makes (or stops making) audio the default of the user userId and
+// persists the preferences.
+func (p *UserPreferences) SetDefaultAudio(userId int64, defaultAudio bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if defaultAudio {
+		p.DefaultAudio[userId] = true
+		delete(p.Declined, userId)
+	} else {
+		delete(p.DefaultAudio, userId)
+		p.Declined[userId] = true
+	}
+	return SaveJSON(p.filename, p)
+}
+
+// Language returns the language picked by the user userId, empty when they picked none.
+func (p *UserPreferences) Language(userId int64) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Languages[userId]
+}
+
+// SetLanguage makes language the language of the user userId (an empty language forgets
+// it) and persists the preferences.
+func (p *UserPreferences) SetLanguage(userId int64, language string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if language == "" {
+		delete(p.Languages, userId)
+	} else {
+		p.Languages[userId] = language
+	}
+	return SaveJSON(p.filename, p)
+}
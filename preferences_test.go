@@ -0,0 +1,75 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestAudioByDefault(t *testing.T) {
+	const videoUrl = "https://youtu.be/dQw4w9WgXcQ"
+	tests := []struct {
+		options string
+		want    bool
+	}{
+		{"", true},
+		{"0:10-0:51", true},
+		{"highlight", true},
+		{"video", false},
+		{"mute", false},
+		{"scale:480", false},
+		{"fps:15", false},
+		{"thumbnails:12", false},
+		{"target:20M", false},
+		{"0:10-0:15 gif", false},
+		{"bumper", false},
+		{"preview", false},
+		{"quality:1080", false},
+		{"multi:360,720", false},
+		{"0:10-0:51 scene", false},
+		{"timestamp", false},
+		{"crop:square", false},
+	}
+	for _, test := range tests {
+		request := videoUrl + " " + test.options
+		downloadConfig, err := LoadDownloadConfigFromMsg(request)
+		if err != nil {
+			t.Fatalf("LoadDownloadConfigFromMsg(%q) returned error: %s", request, err)
+		}
+		audioConfig := AudioByDefault(request, downloadConfig)
+		if audioConfig.AudioOnly != test.want {
+			t.Errorf("AudioByDefault(%q) asks for the audio only: %t, want %t", request, audioConfig.AudioOnly, test.want)
+		}
+		if audioConfig.JobId != downloadConfig.JobId {
+			t.Errorf("AudioByDefault(%q) changed the job id from %s to %s", request, downloadConfig.JobId, audioConfig.JobId)
+		}
+		if audioConfig.StartSecond != downloadConfig.StartSecond || audioConfig.EndSecond != downloadConfig.EndSecond {
+			t.Errorf("AudioByDefault(%q) changed the cut", request)
+		}
+	}
+}
+
+func TestUserPreferencesPersistTheDeclines(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "preferences.json")
+	prefs, err := LoadUserPreferences(filename)
+	if err != nil {
+		t.Fatalf("LoadUserPreferences returned error: %s", err)
+	}
+	if err := prefs.SetDefaultAudio(1, false); err != nil {
+		t.Fatalf("SetDefaultAudio returned error: %s", err)
+	}
+	prefs, err = LoadUserPreferences(filename)
+	if err != nil {
+		t.Fatalf("LoadUserPreferences returned error: %s", err)
+	}
+	for i := 0; i < AudioStreakPrompt*2; i++ {
+		if prefs.Record(1, true) {
+			t.Fatal("the user who declined audio as their default was offered it again after a restart")
+		}
+	}
+	if err := prefs.SetDefaultAudio(1, true); err != nil {
+		t.Fatalf("SetDefaultAudio returned error: %s", err)
+	}
+	if prefs.Declined[1] {
+		t.Error("the user who made audio their default is still among the ones who declined it")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// CallbackSchedule schedules the download of a premiere, it is followed by the id of
+// the pending download and the Unix time to download it at, like schedule:7:1718000000.
+const CallbackSchedule = "schedule:"
+
+// PremierePattern matches the errors of yt-dlp for the videos that are not available
+// yet, like the premieres and the scheduled live streams.
+var PremierePattern = regexp.MustCompile(`(?i)premieres? in|live event will begin|scheduled to start`)
+
+// PremiereMargin is how long after the end of a premiere its download is scheduled,
+// the site needs a while to publish the video.
+const PremiereMargin = 5 * time.Minute
+
+// Premiere is when a video that is not available yet starts.
+type Premiere struct {
+	Start time.Time
+	// Duration is how long the premiere lasts, 0 when it is unknown.
+	Duration time.Duration
+}
+
+// Available returns when the video of the premiere should be available to download.
+func (p Premiere) Available() time.Time {
+	return p.Start.Add(p.Duration + PremiereMargin)
+}
+
+// FetchPremiere asks yt-dlp when the premiere (or scheduled live stream) of videoUrl
+// starts.
+func FetchPremiere(ctx context.Context, config *Config, videoUrl string) (Premiere, error) {
+	ytdlpPath, err := exec.LookPath("yt-dlp")
+	if err != nil {
+		return Premiere{}, fmt.Errorf("yt-dlp is not installed: %s", err)
+	}
+	// the info of the videos without formats yet is dumped anyway with this option
+	ytdlpArgs := []string{"--dump-json", "--no-playlist", "--ignore-no-formats-error"}
+	ytdlpArgs = append(ytdlpArgs, config.YtdlpExtraArgs...)
+	ytdlpArgs = append(ytdlpArgs, videoUrl)
+	output, err := SpacedYtdlpOutput(config, exec.CommandContext(ctx, ytdlpPath, ytdlpArgs...))
+	if err != nil {
+		return Premiere{}, fmt.Errorf("unable to get the start of %s: %s", videoUrl, err)
+	}
+	info := struct {
+		ReleaseTimestamp int64   `json:"release_timestamp"`
+		Duration         float64 `json:"duration"`
+	}{}
+	if err := json.Unmarshal(output, &info); err != nil {
+		return Premiere{}, fmt.Errorf("unable to parse the info of %s: %s", videoUrl, err)
+	}
+	if info.ReleaseTimestamp == 0 {
+		return Premiere{}, fmt.Errorf("%s does not tell when it starts", videoUrl)
+	}
+	return Premiere{
+		Start:    time.Unix(info.ReleaseTimestamp, 0),
+		Duration: time.Duration(info.Duration * float64(time.Second)),
+	}, nil
+}
+
+// OfferSchedule tells the user of msg when the premiere they asked for starts and
+// offers (with an inline button) to download it once available. It reports false when
+// the start of the premiere is unknown, the failure must be reported as usual then.
+func (app *App) OfferSchedule(ctx context.Context, msg *tgbotapi.Message, downloadConfig *DownloadConfig) bool {
+	premiere, err := FetchPremiere(ctx, app.Config, downloadConfig.VideoUrl.String())
+	if err != nil {
+		log.Printf("[%s %d job=%s] Unable to get the start of the premiere: %s", msg.From.UserName, msg.From.ID, downloadConfig.JobId, err)
+		return false
+	}
+	log.Printf("[%s %d job=%s] Request %s is a premiere starting at %s", msg.From.UserName, msg.From.ID, downloadConfig.JobId, msg.Text, premiere.Start.UTC())
+	id := app.PendingDownloads.Add(msg, downloadConfig)
+	data := MessageData{Url: downloadConfig.VideoUrl.String(), Time: premiere.Start.UTC().Format("Jan 2 15:04 MST"), Duration: time.Until(premiere.Start).Round(time.Minute).String()}
+	text := app.Message(msg, EventPremiere, data, fmt.Sprintf("That video is not available yet, it starts on %s (in %s) ⏰", data.Time, data.Duration))
+	reply := tgbotapi.NewMessage(msg.Chat.ID, text)
+	reply.ReplyToMessageID = msg.MessageID
+	reply.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(app.Message(msg, EventScheduleButton, data, "⬇️ Download it then"), fmt.Sprintf("%s%s:%d", CallbackSchedule, id, premiere.Available().Unix())),
+		),
+	)
+	if _, err := SendWithRetry(app.Bot, reply); err != nil {
+		log.Printf("[%s %d job=%s] Unable to send message: %s", msg.From.UserName, msg.From.ID, downloadConfig.JobId, err)
+	}
+	return true
+}
+
+// HandleSchedule schedules the download of the premiere the user was offered, it runs
+// once the premiere is available. The scheduled downloads do not survive a restart.
+func (app *App) HandleSchedule(query *tgbotapi.CallbackQuery) {
+	id, at, _ := strings.Cut(strings.TrimPrefix(query.Data, CallbackSchedule), ":")
+	unixTime, err := strconv.ParseInt(at, 10, 64)
+	if err != nil {
+		log.Printf("[%s %d] Invalid schedule %s: %s", query.From.UserName, query.From.ID, query.Data, err)
+		return
+	}
+	pending, ok := app.PendingDownloads.Take(id, query.From.ID)
+	if !ok {
+		log.Printf("[%s %d] Schedule %s is unknown or expired", query.From.UserName, query.From.ID, id)
+		return
+	}
+	downloadAt := time.Unix(unixTime, 0)
+	log.Printf("[%s %d job=%s] Scheduled request %s for %s", query.From.UserName, query.From.ID, pending.DownloadConfig.JobId, pending.Msg.Text, downloadAt.UTC())
+	time.AfterFunc(time.Until(downloadAt), func() {
+		app.ProcessDownload(pending.Msg, pending.DownloadConfig)
+	})
+	data := MessageData{Url: pending.DownloadConfig.VideoUrl.String(), Time: downloadAt.UTC().Format("Jan 2 15:04 MST")}
+	ReplyText(app.Bot, pending.Msg, app.Message(pending.Msg, EventScheduled, data, fmt.Sprintf("Ok, I will download it on %s ⏰", data.Time)))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// ProgressTemplate is the yt-dlp progress template (one line per update with
+// --newline) that ReadProgress parses: the downloaded bytes and the total bytes (or
+// its estimate, NA when unknown).
+const ProgressTemplate = "download:gatonaranja-progress %(progress.downloaded_bytes)s %(progress.total_bytes,progress.total_bytes_estimate)s"
+
+// ProgressPattern matches the lines printed with ProgressTemplate.
+var ProgressPattern = regexp.MustCompile(`^gatonaranja-progress ([0-9.]+) ([0-9.]+)`)
+
+// ReadProgress reads the output of yt-dlp from r until it is closed, calling onProgress
+// with the percentage downloaded every time yt-dlp reports it.
+func ReadProgress(r io.Reader, onProgress func(percent float64)) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		match := ProgressPattern.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+		if match == nil {
+			continue
+		}
+		downloaded, err := strconv.ParseFloat(match[1], 64)
+		if err != nil {
+			continue
+		}
+		total, err := strconv.ParseFloat(match[2], 64)
+		if err != nil || total <= 0 {
+			continue
+		}
+		onProgress(100 * downloaded / total)
+	}
+}
+
+// ProgressBarWidth is how many cells the progress bar has.
+const ProgressBarWidth = 10
+
+// ProgressEditInterval is the least time between two edits of a progress bar, Telegram
+// does not like a message edited too often.
+const ProgressEditInterval = 3 * time.Second
+
+// RenderProgressBar renders percent as a bar like ▰▰▰▰▰▰▱▱▱▱ 60%.
+func RenderProgressBar(percent float64) string {
+	percent = math.Max(0, math.Min(100, percent))
+	filled := int(percent / 100 * ProgressBarWidth)
+	return strings.Repeat("▰", filled) + strings.Repeat("▱", ProgressBarWidth-filled) + " " + strconv.Itoa(int(percent)) + "%"
+}
+
+// ProgressBar shows the progress of a download by editing a message (the text of the
+// message stays, the bar goes below it), it is safe for concurrent use.
+type ProgressBar struct {
+	mu       sync.Mutex
+	bot      *tgbotapi.BotAPI
+	msg      tgbotapi.Message
+	lastText string
+	lastEdit time.Time
+}
+
+// NewProgressBar creates a progress bar for the sent message msg.
+func NewProgressBar(bot *tgbotapi.BotAPI, msg tgbotapi.Message) *ProgressBar {
+	return &ProgressBar{bot: bot, msg: msg, lastText: msg.Text}
+}
+
+// Update shows percent in the bar, unless the bar was edited less than
+// ProgressEditInterval ago.
+func (p *ProgressBar) Update(percent float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Since(p.lastEdit) < ProgressEditInterval {
+		return
+	}
+	p.edit(percent)
+}
+
+// Finish shows the bar complete, whenever it was last edited.
+func (p *ProgressBar) Finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.edit(100)
+}
+
+// edit replaces the bar with percent, the caller must hold the lock.
+func (p *ProgressBar) edit(percent float64) {
+	text := p.msg.Text + "\n" + RenderProgressBar(percent)
+	// Telegram rejects edits that do not change the text
+	if text == p.lastText {
+		return
+	}
+	EditText(p.bot, p.msg, text)
+	p.lastText = text
+	p.lastEdit = time.Now()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// PublicSweepInterval is how often the files older than PUBLIC_RETENTION are removed
+// from PUBLIC_DIR.
+const PublicSweepInterval = time.Hour
+
+// PublishFile puts a copy of the file filename (a hard link when possible, so it is
+// cheap) in config.PublicDir and returns its URL. The name of the copy starts with a
+// random token, so the files can not be guessed from the videos. filename is left in
+// place.
+func PublishFile(config *Config, filename string) (string, error) {
+	token := make([]byte, 8)
+	if _, err := rand.Read(token); err != nil {
+		return "", fmt.Errorf("unable to publish %s: %s", filename, err)
+	}
+	name := hex.EncodeToString(token) + "-" + filepath.Base(filename)
+	publicFilename := filepath.Join(config.PublicDir, name)
+	if err := os.Link(filename, publicFilename); err != nil {
+		// PUBLIC_DIR may be in another filesystem
+		if err := CopyFile(filename, publicFilename); err != nil {
+			return "", fmt.Errorf("unable to publish %s: %s", filename, err)
+		}
+	}
+	// the retention counts from now, not from when the file was downloaded
+	now := time.Now()
+	if err := os.Chtimes(publicFilename, now, now); err != nil {
+		log.Printf("Unable to set the time of %s: %s", publicFilename, err)
+	}
+	return strings.TrimSuffix(config.PublicUrl, "/") + "/" + url.PathEscape(name), nil
+}
+
+// CopyFile copies the file src to dst.
+func CopyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// SweepPublicDir removes the files of dir modified longer than retention ago.
+func SweepPublicDir(dir string, retention time.Duration) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Unable to sweep %s: %s", dir, err)
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < retention {
+			continue
+		}
+		filename := filepath.Join(dir, entry.Name())
+		if err := os.Remove(filename); err != nil {
+			log.Printf("Unable to remove expired file %s: %s", filename, err)
+			continue
+		}
+		log.Printf("Removed expired file %s", filename)
+	}
+}
+
+// KeepPublicDirClean sweeps config.PublicDir every PublicSweepInterval. It never
+// returns.
+func KeepPublicDirClean(config *Config) {
+	for {
+		SweepPublicDir(config.PublicDir, config.PublicRetention)
+		time.Sleep(PublicSweepInterval)
+	}
+}
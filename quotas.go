@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// QuotaDayLayout formats the day the quotas are counted for.
+const QuotaDayLayout = "2006-01-02"
+
+// Quotas counts the requests every user made today (persisted in a JSON file, so a
+// restart does not reset them) and limits them to a daily quota, it is safe for
+// concurrent use.
+type Quotas struct {
+	mu       sync.Mutex
+	filename string
+	limit    int
+	// Day is the day the counts are for, like 2024-03-15.
+	Day string `json:"day"`
+	// Counts holds the requests every user made on Day.
+	Counts map[int64]int `json:"counts"`
+}
+
+// LoadQuotas loads the counts persisted in filename, when filename is empty they are
+// kept only in memory. Every user can make limit requests a day (0 means any number).
+func LoadQuotas(filename string, limit int) (*Quotas, error) {
+	quotas := &Quotas{
+		filename: filename,
+		limit:    limit,
+		Counts:   map[int64]int{},
+	}
+	if err := LoadJSON(filename, quotas); err != nil {
+		return nil, err
+	}
+	if quotas.Counts == nil {
+		quotas.Counts = map[int64]int{}
+	}
+	quotas.rollOver(time.Now())
+	return quotas, nil
+}
+
+// Limit returns how many requests a day every user can make, 0 means any number.
+func (q *Quotas) Limit() int {
+	return q.limit
+}
+
+// Take counts a request of the user userId and persists the counts, unless the user
+// already used their quota of today: then it reports false and nothing is counted.
+func (q *Quotas) Take(userId int64) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollOver(time.Now())
+	if q.limit > 0 && q.Counts[userId] >= q.limit {
+		return false, nil
+	}
+	q.Counts[userId]++
+	return true, SaveJSON(q.filename, q)
+}
+
+// Refund gives back a request of the user userId taken today (like when it is
+// rejected before downloading anything) and persists the counts.
+func (q *Quotas) Refund(userId int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// the requests of yesterday were already reset
+	if q.rollOver(time.Now()) || q.Counts[userId] == 0 {
+		return nil
+	}
+	q.Counts[userId]--
+	if q.Counts[userId] == 0 {
+		delete(q.Counts, userId)
+	}
+	return SaveJSON(q.filename, q)
+}
+
+// Used returns how many requests the user userId made today.
+func (q *Quotas) Used(userId int64) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollOver(time.Now())
+	return q.Counts[userId]
+}
+
+// ResetDaily resets the counts every midnight (local time), so the persisted counts do
+// not wait for the next request to be reset. It never returns.
+func (q *Quotas) ResetDaily() {
+	for {
+		now := time.Now()
+		midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+		time.Sleep(time.Until(midnight))
+		q.mu.Lock()
+		if q.rollOver(time.Now()) {
+			if err := SaveJSON(q.filename, q); err != nil {
+				log.Printf("Unable to save the quotas: %s", err)
+			}
+		}
+		q.mu.Unlock()
+	}
+}
+
+// rollOver resets the counts when now is not Day anymore and reports whether it did,
+// the caller must hold the lock.
+func (q *Quotas) rollOver(now time.Time) bool {
+	day := now.Format(QuotaDayLayout)
+	if q.Day == day {
+		return false
+	}
+	q.Day = day
+	q.Counts = map[int64]int{}
+	return true
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimitWindow is the window the rate limits are counted in.
+const RateLimitWindow = time.Minute
+
+// RateLimiter allows at most limit requests per RateLimitWindow for each key (like a
+// user or a chat id), it is safe for concurrent use.
+type RateLimiter struct {
+	mu       sync.Mutex
+	limit    int
+	requests map[int64][]time.Time
+}
+
+// NewRateLimiter creates a RateLimiter of limit requests per RateLimitWindow, 0 means
+// any number.
+func NewRateLimiter(limit int) *RateLimiter {
+	return &RateLimiter{limit: limit, requests: map[int64][]time.Time{}}
+}
+
+// Limit returns how many requests per RateLimitWindow each key can make, 0 means any
+// number.
+func (l *RateLimiter) Limit() int {
+	return l.limit
+}
+
+// Allow counts a request of key and returns 0 when key can make it now, otherwise it
+// returns how long key must wait and nothing is counted. Checking and counting is a
+// single step, so concurrent requests never go past the limit.
+func (l *RateLimiter) Allow(key int64) time.Duration {
+	if l.limit == 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	requests := l.prune(key, now)
+	if len(requests) >= l.limit {
+		return requests[0].Add(RateLimitWindow).Sub(now)
+	}
+	l.requests[key] = append(requests, now)
+	return 0
+}
+
+// Forget stops counting the last request of key allowed by Allow, like when another
+// limiter rejected it.
+func (l *RateLimiter) Forget(key int64) {
+	if l.limit == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	requests := l.prune(key, time.Now())
+	if len(requests) == 0 {
+		return
+	}
+	if len(requests) == 1 {
+		delete(l.requests, key)
+		return
+	}
+	l.requests[key] = requests[:len(requests)-1]
+}
+
+// prune forgets the requests of key out of the window and returns the rest, oldest
+// first. l.mu must be held.
+func (l *RateLimiter) prune(key int64, now time.Time) []time.Time {
+	requests := l.requests[key]
+	for len(requests) > 0 && now.Sub(requests[0]) >= RateLimitWindow {
+		requests = requests[1:]
+	}
+	if len(requests) == 0 {
+		delete(l.requests, key)
+		return nil
+	}
+	l.requests[key] = requests
+	return requests
+}
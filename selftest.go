@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	// DefaultSelfTestUrl is a tiny video (the first one of YouTube, 19 seconds long) that
+	// should always be available.
+	DefaultSelfTestUrl = "https://www.youtube.com/watch?v=jNQXAC9IVRw"
+	// SelfTestTimeout is how long the self-test can take before it fails.
+	SelfTestTimeout = 2 * time.Minute
+)
+
+// SelfTest downloads and cuts the video of SELFTEST_URL, which exercises yt-dlp, ffmpeg
+// and the temp dir, and removes the result. It returns how long it took.
+func SelfTest(config *Config) (time.Duration, error) {
+	downloadConfig, err := LoadDownloadConfigFromMsg(config.SelfTestUrl + " 0:00-0:05")
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse SELFTEST_URL: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), SelfTestTimeout)
+	defer cancel()
+	start := time.Now()
+	videoFilename, err := DownloadVideo(ctx, config, downloadConfig)
+	if err != nil {
+		return 0, err
+	}
+	elapsed := time.Since(start)
+	info, err := os.Stat(videoFilename)
+	os.Remove(videoFilename)
+	if err != nil {
+		return 0, fmt.Errorf("unable to find the downloaded video: %s", err)
+	}
+	if info.Size() == 0 {
+		return 0, fmt.Errorf("the downloaded video %s is empty", videoFilename)
+	}
+	return elapsed, nil
+}
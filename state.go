@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SeenUpdatesCapacity is how many update ids the UpdateTracker remembers.
+const SeenUpdatesCapacity = 1000
+
+// WriteFileAtomic writes data to filename through a temp file that is renamed at the
+// end, so a crash never leaves filename half written.
+func WriteFileAtomic(filename string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("unable to write %s: %s", filename, err)
+	}
+	tmpFilename := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmpFilename)
+		return fmt.Errorf("unable to write %s: %s", filename, err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpFilename)
+		return fmt.Errorf("unable to write %s: %s", filename, err)
+	}
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		os.Remove(tmpFilename)
+		return fmt.Errorf("unable to write %s: %s", filename, err)
+	}
+	return nil
+}
+
+// UpdateTracker remembers the ids of the last processed updates, so an update Telegram
+// delivers twice is processed only once, and persists the offset of the next update to
+// receive, so the bot resumes where it left after a restart. The ids are only remembered
+// while the bot runs, after a restart the persisted offset keeps Telegram from
+// delivering the processed updates again.
+type UpdateTracker struct {
+	mu         sync.Mutex
+	seen       map[int]bool
+	order      []int
+	capacity   int
+	offsetFile string
+}
+
+// NewUpdateTracker creates an UpdateTracker remembering up to capacity update ids. The
+// offset is persisted in offsetFile, when offsetFile is empty it is not persisted.
+func NewUpdateTracker(capacity int, offsetFile string) *UpdateTracker {
+	return &UpdateTracker{
+		seen:       map[int]bool{},
+		order:      []int{},
+		capacity:   capacity,
+		offsetFile: offsetFile,
+	}
+}
+
+// Seen marks updateId as seen and reports whether it was already seen.
+func (t *UpdateTracker) Seen(updateId int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.seen[updateId] {
+		return true
+	}
+	t.seen[updateId] = true
+	t.order = append(t.order, updateId)
+	if len(t.order) > t.capacity {
+		delete(t.seen, t.order[0])
+		t.order = t.order[1:]
+	}
+	return false
+}
+
+// Done persists the offset after the update updateId. It must be called before
+// processing the update, so a restart while it is processed (like in the middle of a
+// long download) never processes it again: the updates are processed at most once.
+func (t *UpdateTracker) Done(updateId int) error {
+	if t.offsetFile == "" {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return WriteFileAtomic(t.offsetFile, []byte(strconv.Itoa(updateId+1)))
+}
+
+// LoadOffset reads the offset persisted in offsetFile, it returns 0 (the first pending
+// update) when offsetFile is empty or does not exist yet.
+func LoadOffset(offsetFile string) (int, error) {
+	if offsetFile == "" {
+		return 0, nil
+	}
+	content, err := os.ReadFile(offsetFile)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("unable to read offset from %s: %s", offsetFile, err)
+	}
+	offset, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse offset from %s: %s", offsetFile, err)
+	}
+	return offset, nil
+}
+
+// LoadJSON decodes the JSON file filename into v, a missing file (or an empty filename)
+// leaves v untouched.
+func LoadJSON(filename string, v interface{}) error {
+	if filename == "" {
+		return nil
+	}
+	content, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %s", filename, err)
+	}
+	if err := json.Unmarshal(content, v); err != nil {
+		return fmt.Errorf("unable to parse %s: %s", filename, err)
+	}
+	return nil
+}
+
+// SaveJSON encodes v as JSON into the file filename, an empty filename saves nothing.
+func SaveJSON(filename string, v interface{}) error {
+	if filename == "" {
+		return nil
+	}
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode %s: %s", filename, err)
+	}
+	return WriteFileAtomic(filename, content)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestUpdateTrackerSeen(t *testing.T) {
+	tracker := NewUpdateTracker(2, "")
+	if tracker.Seen(1) {
+		t.Error("the first update was seen")
+	}
+	if !tracker.Seen(1) {
+		t.Error("an update delivered twice was not seen")
+	}
+	tracker.Seen(2)
+	tracker.Seen(3)
+	if tracker.Seen(1) {
+		t.Error("the oldest update is still remembered past the capacity")
+	}
+}
+
+func TestUpdateTrackerPersistsTheOffset(t *testing.T) {
+	offsetFile := filepath.Join(t.TempDir(), "offset")
+	tracker := NewUpdateTracker(SeenUpdatesCapacity, offsetFile)
+	if err := tracker.Done(41); err != nil {
+		t.Fatalf("Done returned error: %s", err)
+	}
+	offset, err := LoadOffset(offsetFile)
+	if err != nil {
+		t.Fatalf("LoadOffset returned error: %s", err)
+	}
+	if offset != 42 {
+		t.Errorf("LoadOffset = %d after the update 41, want 42", offset)
+	}
+}
+
+func TestQuotasTake(t *testing.T) {
+	quotasFile := filepath.Join(t.TempDir(), "quotas.json")
+	quotas, err := LoadQuotas(quotasFile, 2)
+	if err != nil {
+		t.Fatalf("LoadQuotas returned error: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		if allowed, err := quotas.Take(1); !allowed || err != nil {
+			t.Fatalf("Take #%d = %t, %v, want true, nil", i+1, allowed, err)
+		}
+	}
+	if allowed, _ := quotas.Take(1); allowed {
+		t.Error("Take allowed a request past the quota")
+	}
+	if allowed, _ := quotas.Take(2); !allowed {
+		t.Error("the quota of a user limited another user")
+	}
+	// a restart keeps the counts of today
+	quotas, err = LoadQuotas(quotasFile, 2)
+	if err != nil {
+		t.Fatalf("LoadQuotas returned error: %s", err)
+	}
+	if used := quotas.Used(1); used != 2 {
+		t.Errorf("Used = %d after reloading, want 2", used)
+	}
+}
+
+func TestQuotasRefund(t *testing.T) {
+	quotas, err := LoadQuotas("", 1)
+	if err != nil {
+		t.Fatalf("LoadQuotas returned error: %s", err)
+	}
+	quotas.Take(1)
+	if err := quotas.Refund(1); err != nil {
+		t.Fatalf("Refund returned error: %s", err)
+	}
+	if allowed, _ := quotas.Take(1); !allowed {
+		t.Error("a refunded request still uses the quota")
+	}
+	quotas.Refund(2)
+	if used := quotas.Used(2); used != 0 {
+		t.Errorf("Used = %d after refunding a request never taken, want 0", used)
+	}
+}
+
+func TestQuotasRollOver(t *testing.T) {
+	quotas, err := LoadQuotas("", 1)
+	if err != nil {
+		t.Fatalf("LoadQuotas returned error: %s", err)
+	}
+	today := time.Date(2024, 3, 15, 10, 0, 0, 0, time.Local)
+	quotas.rollOver(today)
+	quotas.Counts[1] = 1
+	if quotas.rollOver(today.Add(time.Hour)) {
+		t.Error("rollOver reset the counts within the same day")
+	}
+	if !quotas.rollOver(today.AddDate(0, 0, 1)) {
+		t.Error("rollOver did not reset the counts of yesterday")
+	}
+	if len(quotas.Counts) != 0 {
+		t.Errorf("Counts = %v on a new day, want none", quotas.Counts)
+	}
+}
+
+func TestRateLimiterAllowIsAtomic(t *testing.T) {
+	limiter := NewRateLimiter(5)
+	var wg sync.WaitGroup
+	var allowed int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if limiter.Allow(1) == 0 {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 5 {
+		t.Errorf("Allow let %d concurrent requests in, want 5", allowed)
+	}
+	if wait := limiter.Allow(1); wait <= 0 || wait > RateLimitWindow {
+		t.Errorf("Allow = %s past the limit, want a wait within %s", wait, RateLimitWindow)
+	}
+	if limiter.Allow(2) != 0 {
+		t.Error("the requests of a key limited another key")
+	}
+}
+
+func TestRateLimiterForget(t *testing.T) {
+	limiter := NewRateLimiter(1)
+	limiter.Allow(1)
+	limiter.Forget(1)
+	if limiter.Allow(1) != 0 {
+		t.Error("a forgotten request is still counted")
+	}
+	limiter.Forget(2)
+	if len(limiter.requests) != 1 {
+		t.Errorf("requests = %v after forgetting a key never allowed, want only the key 1", limiter.requests)
+	}
+}
+
+func TestRateLimiterPrunesTheWindow(t *testing.T) {
+	limiter := NewRateLimiter(2)
+	now := time.Now()
+	limiter.requests[1] = []time.Time{now.Add(-2 * RateLimitWindow), now.Add(-RateLimitWindow / 2)}
+	limiter.requests[2] = []time.Time{now.Add(-RateLimitWindow)}
+	if limiter.Allow(1) != 0 {
+		t.Error("a request out of the window is still counted")
+	}
+	if got := len(limiter.requests[1]); got != 2 {
+		t.Errorf("the key 1 has %d requests in the window, want 2", got)
+	}
+	if wait := limiter.Allow(1); wait <= 0 || wait > RateLimitWindow/2 {
+		t.Errorf("Allow = %s, want the wait until the oldest request leaves the window", wait)
+	}
+	limiter.Forget(2)
+	if _, ok := limiter.requests[2]; ok {
+		t.Error("a key with no requests in the window is still kept")
+	}
+}
+
+func TestFloodWait(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		wantWait      time.Duration
+		wantFloodWait bool
+	}{
+		{"retry after", &tgbotapi.Error{Code: 429, ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 7}}, 7 * time.Second, true},
+		{"wrapped", fmt.Errorf("unable to send: %w", &tgbotapi.Error{Code: 429, ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 3}}), 3 * time.Second, true},
+		{"no retry after", &tgbotapi.Error{Code: 429}, time.Second, true},
+		{"retry after without 429", &tgbotapi.Error{Code: 400, ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 2}}, 2 * time.Second, true},
+		{"other telegram error", &tgbotapi.Error{Code: 400, Message: "Bad Request"}, 0, false},
+		{"not a telegram error", errors.New("connection reset"), 0, false},
+		{"nil", nil, 0, false},
+	}
+	for _, test := range tests {
+		wait, isFloodWait := FloodWait(test.err)
+		if wait != test.wantWait || isFloodWait != test.wantFloodWait {
+			t.Errorf("%s: FloodWait = %s, %t, want %s, %t", test.name, wait, isFloodWait, test.wantWait, test.wantFloodWait)
+		}
+	}
+}
+
+func TestRetryOnFloodWaitStopsOnOtherErrors(t *testing.T) {
+	attempts := 0
+	err := RetryOnFloodWait(0, 1, func() error {
+		attempts++
+		return errors.New("connection reset")
+	})
+	if err == nil || attempts != 1 {
+		t.Errorf("RetryOnFloodWait = %v after %d attempts, want the error after 1 attempt", err, attempts)
+	}
+}
+
+func TestSendThrottleBurst(t *testing.T) {
+	throttle := &SendThrottle{buckets: map[int64]*chatBucket{}}
+	start := time.Now()
+	throttle.Wait(1, ChatSendBurst)
+	if elapsed := time.Since(start); elapsed > PrivateChatSendInterval/2 {
+		t.Errorf("a burst of %d messages waited %s, want no wait", ChatSendBurst, elapsed)
+	}
+	if tokens := throttle.buckets[1].tokens; tokens > 0.5 {
+		t.Errorf("the chat has %g tokens after the burst, want none", tokens)
+	}
+	// the buckets of the chats that are full again are forgotten
+	throttle.buckets[1].lastRefill = time.Now().Add(-ChatSendBurst * PrivateChatSendInterval)
+	throttle.Wait(-2, 1)
+	if _, ok := throttle.buckets[1]; ok {
+		t.Error("the bucket of an idle chat is still kept")
+	}
+	if _, ok := throttle.buckets[-2]; !ok {
+		t.Error("the bucket of a group that just sent a message was forgotten")
+	}
+}
+
+func TestSendThrottlePause(t *testing.T) {
+	throttle := &SendThrottle{buckets: map[int64]*chatBucket{}}
+	const retryAfter = 200 * time.Millisecond
+	throttle.Pause(1, retryAfter)
+	// the pause is not a token of the chat, even a full bucket waits for it
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			throttle.Wait(1, 1)
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < retryAfter {
+		t.Errorf("the messages of a paused chat waited %s, want at least %s", elapsed, retryAfter)
+	}
+	start = time.Now()
+	throttle.Pause(0, time.Hour)
+	throttle.Wait(0, 1)
+	if elapsed := time.Since(start); elapsed > retryAfter {
+		t.Errorf("a request to no chat waited %s, want no wait", elapsed)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatsSaveInterval is how often the stats are persisted, the requests completed since
+// the last save are lost if the bot crashes.
+const StatsSaveInterval = time.Minute
+
+// StatsTopDomains is how many of the most requested domains /stats shows.
+const StatsTopDomains = 5
+
+// Stats holds the lifetime totals of the requests (persisted in a JSON file), it is safe
+// for concurrent use.
+type Stats struct {
+	mu       sync.Mutex
+	filename string
+	dirty    bool
+	// VideoRequests and AudioRequests count the requests by type.
+	VideoRequests int `json:"video_requests"`
+	AudioRequests int `json:"audio_requests"`
+	// Successes and Failures count the requests by result.
+	Successes int `json:"successes"`
+	Failures  int `json:"failures"`
+	// Bytes is the size of the files produced by the successful requests.
+	Bytes int64 `json:"bytes"`
+	// Domains counts the requests by domain of the video, like youtube.com.
+	Domains map[string]int `json:"domains"`
+}
+
+// LoadStats loads the stats persisted in filename, when filename is empty they are
+// kept only in memory.
+func LoadStats(filename string) (*Stats, error) {
+	stats := &Stats{filename: filename, Domains: map[string]int{}}
+	if err := LoadJSON(filename, stats); err != nil {
+		return nil, err
+	}
+	if stats.Domains == nil {
+		stats.Domains = map[string]int{}
+	}
+	return stats, nil
+}
+
+// Record counts a request for downloadConfig that produced bytes bytes, or failed when
+// succeeded is false.
+func (s *Stats) Record(downloadConfig *DownloadConfig, succeeded bool, bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if downloadConfig.AudioOnly {
+		s.AudioRequests++
+	} else {
+		s.VideoRequests++
+	}
+	if succeeded {
+		s.Successes++
+		s.Bytes += bytes
+	} else {
+		s.Failures++
+	}
+	s.Domains[strings.TrimPrefix(strings.ToLower(downloadConfig.VideoUrl.Hostname()), "www.")]++
+	s.dirty = true
+}
+
+// Report returns the stats for the reply of /stats (see StatsReport).
+func (s *Stats) Report() MessageData {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	domains := make([]string, 0, len(s.Domains))
+	for domain := range s.Domains {
+		domains = append(domains, domain)
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		if s.Domains[domains[i]] != s.Domains[domains[j]] {
+			return s.Domains[domains[i]] > s.Domains[domains[j]]
+		}
+		return domains[i] < domains[j]
+	})
+	if len(domains) > StatsTopDomains {
+		domains = domains[:StatsTopDomains]
+	}
+	lines := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		lines = append(lines, fmt.Sprintf("  %s: %d", domain, s.Domains[domain]))
+	}
+	return MessageData{
+		Count:     s.VideoRequests + s.AudioRequests,
+		Videos:    s.VideoRequests,
+		Audios:    s.AudioRequests,
+		Succeeded: s.Successes,
+		Failed:    s.Failures,
+		Size:      FormatBytes(s.Bytes),
+		Domains:   strings.Join(lines, "\n"),
+	}
+}
+
+// StatsReport renders the built-in reply of /stats from the stats of Report.
+func StatsReport(data MessageData) string {
+	lines := []string{
+		fmt.Sprintf("Requests: %d (%d video, %d audio)", data.Count, data.Videos, data.Audios),
+		fmt.Sprintf("Succeeded: %d, failed: %d", data.Succeeded, data.Failed),
+		fmt.Sprintf("Produced: %s", data.Size),
+	}
+	if data.Domains != "" {
+		lines = append(lines, "Top domains:", data.Domains)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Save persists the stats when they changed since the last save.
+func (s *Stats) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	if err := SaveJSON(s.filename, s); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// SavePeriodically saves the stats every StatsSaveInterval. It never returns.
+func (s *Stats) SavePeriodically() {
+	for {
+		time.Sleep(StatsSaveInterval)
+		if err := s.Save(); err != nil {
+			log.Printf("Unable to save the stats: %s", err)
+		}
+	}
+}
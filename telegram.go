@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// MaxSendAttempts is how many times SendWithRetry tries to deliver a message before
+// giving up when Telegram keeps answering with flood-wait errors.
+const MaxSendAttempts = 5
+
+// FloodWait reports whether err is a Telegram flood-wait error (HTTP 429 Too Many
+// Requests) and, if it is, how long Telegram asked us to wait before retrying.
+func FloodWait(err error) (time.Duration, bool) {
+	var tgErr *tgbotapi.Error
+	if !errors.As(err, &tgErr) {
+		return 0, false
+	}
+	if tgErr.Code != 429 && tgErr.RetryAfter == 0 {
+		return 0, false
+	}
+	retryAfter := time.Duration(tgErr.RetryAfter) * time.Second
+	if retryAfter <= 0 {
+		retryAfter = time.Second
+	}
+	return retryAfter, true
+}
+
+// SendWithRetry sends c through bot, spaced by ChatSendThrottle from the previous
+// messages to its chat. When Telegram answers with a flood-wait error it sleeps the
+// indicated retry-after and tries again, up to MaxSendAttempts times. Every message the
+// bot sends must go through this function.
+func SendWithRetry(bot *tgbotapi.BotAPI, c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	var sentMsg tgbotapi.Message
+	err := RetryOnFloodWait(ChattableChatId(c), 1, func() error {
+		var err error
+		sentMsg, err = bot.Send(c)
+		return err
+	})
+	return sentMsg, err
+}
+
+// RequestWithRetry is like SendWithRetry but for the requests that do not send a
+// message (like answering a callback query).
+func RequestWithRetry(bot *tgbotapi.BotAPI, c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	var resp *tgbotapi.APIResponse
+	err := RetryOnFloodWait(ChattableChatId(c), 1, func() error {
+		var err error
+		resp, err = bot.Request(c)
+		return err
+	})
+	return resp, err
+}
+
+// SendMediaGroupWithRetry is like SendWithRetry but for albums, Telegram answers them
+// with several messages.
+func SendMediaGroupWithRetry(bot *tgbotapi.BotAPI, c tgbotapi.MediaGroupConfig) ([]tgbotapi.Message, error) {
+	var sentMsgs []tgbotapi.Message
+	err := RetryOnFloodWait(ChattableChatId(c), len(c.Media), func() error {
+		var err error
+		sentMsgs, err = bot.SendMediaGroup(c)
+		return err
+	})
+	return sentMsgs, err
+}
+
+// ChattableChatId returns the id of the chat c is sent to, 0 when it is not sent to a
+// chat (like answering a callback query). tgbotapi keeps the params of its configs
+// unexported, but every config sent to a chat has a ChatID field (of its own or of the
+// BaseChat or BaseEdit it embeds).
+func ChattableChatId(c tgbotapi.Chattable) int64 {
+	value := reflect.Indirect(reflect.ValueOf(c))
+	if value.Kind() != reflect.Struct {
+		return 0
+	}
+	chatId := value.FieldByName("ChatID")
+	if !chatId.IsValid() || chatId.Kind() != reflect.Int64 {
+		return 0
+	}
+	return chatId.Int()
+}
+
+// RetryOnFloodWait calls request (which sends that many messages to the chat chatId)
+// until it succeeds, fails with an error that is not a flood-wait error, or
+// MaxSendAttempts attempts are made. Every attempt waits its turn in ChatSendThrottle.
+func RetryOnFloodWait(chatId int64, messages int, request func() error) error {
+	var err error
+	for attempt := 1; attempt <= MaxSendAttempts; attempt++ {
+		ChatSendThrottle.Wait(chatId, messages)
+		err = request()
+		if err == nil {
+			return nil
+		}
+		retryAfter, isFloodWait := FloodWait(err)
+		if !isFloodWait {
+			return err
+		}
+		log.Printf("Telegram asked to wait %s before sending again (attempt %d of %d)", retryAfter, attempt, MaxSendAttempts)
+		// the other messages to the chat wait too
+		ChatSendThrottle.Pause(chatId, retryAfter)
+	}
+	return fmt.Errorf("unable to send message after %d attempts: %s", MaxSendAttempts, err)
+}
+
+// ReplyText sends text as a reply to msg and returns the sent message, errors are only
+// logged since there is nothing else we can do about them.
+//
+// Every message the bot sends in response to a user must be a reply to the user's
+// message: the version of tgbotapi we use does not know about message_thread_id, but
+// Telegram posts replies in the forum topic of the replied message, so replying keeps
+// the bot inside the topic it was invoked in (or the general topic).
+func ReplyText(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, text string) tgbotapi.Message {
+	reply := tgbotapi.NewMessage(msg.Chat.ID, text)
+	reply.ReplyToMessageID = msg.MessageID
+	sentMsg, err := SendWithRetry(bot, reply)
+	if err != nil {
+		log.Printf("[%s %d] Unable to send message: %s", msg.From.UserName, msg.From.ID, err)
+	}
+	return sentMsg
+}
+
+// NamedFile is the file Filename uploaded as Name. Unlike tgbotapi.FileReader it is
+// opened on every attempt, so the retries of SendWithRetry upload it whole.
+type NamedFile struct {
+	Filename string
+	Name     string
+}
+
+func (f NamedFile) NeedsUpload() bool {
+	return true
+}
+
+func (f NamedFile) UploadData() (string, io.Reader, error) {
+	// tgbotapi closes the file once uploaded
+	fileHandle, err := os.Open(f.Filename)
+	if err != nil {
+		return "", nil, err
+	}
+	return f.Name, fileHandle, nil
+}
+
+func (f NamedFile) SendData() string {
+	panic("NamedFile must be uploaded")
+}
+
+// SendDescription sends the description of the video videoUrl (from its metadata info)
+// as a .txt document replying to msg. Videos without description are skipped.
+func SendDescription(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, videoUrl string, info *VideoInfo) error {
+	if strings.TrimSpace(info.Description) == "" {
+		log.Printf("[%s %d] Video %s has no description, skipping it", msg.From.UserName, msg.From.ID, videoUrl)
+		return nil
+	}
+	document := tgbotapi.NewDocument(msg.Chat.ID, tgbotapi.FileBytes{
+		Name:  "description.txt",
+		Bytes: []byte(info.Description),
+	})
+	document.ReplyToMessageID = msg.MessageID
+	_, err := SendWithRetry(bot, document)
+	return err
+}
+
+// EditText replaces the text of the message sentMsg sent by the bot, errors are only
+// logged. Messages that were not sent (because of an error) are skipped.
+func EditText(bot *tgbotapi.BotAPI, sentMsg tgbotapi.Message, text string) {
+	if sentMsg.MessageID == 0 {
+		return
+	}
+	edit := tgbotapi.NewEditMessageText(sentMsg.Chat.ID, sentMsg.MessageID, text)
+	if _, err := SendWithRetry(bot, edit); err != nil {
+		log.Printf("Unable to edit message %d: %s", sentMsg.MessageID, err)
+	}
+}
+
+// DownloadTelegramFile downloads the file fileId sent to the bot (at most 20 MB, the
+// limit of the Bot API) into TempDir and returns the name of the downloaded file.
+func DownloadTelegramFile(bot *tgbotapi.BotAPI, fileId string) (string, error) {
+	file, err := bot.GetFile(tgbotapi.FileConfig{FileID: fileId})
+	if err != nil {
+		return "", fmt.Errorf("unable to get file %s: %s", fileId, err)
+	}
+	resp, err := http.Get(file.Link(bot.Token))
+	if err != nil {
+		// the error includes the link, which includes the token
+		return "", fmt.Errorf("unable to download file %s", fileId)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to download file %s: %s", fileId, resp.Status)
+	}
+	f, err := os.CreateTemp(TempDir(), "gatonaranja.*"+filepath.Ext(file.FilePath))
+	if err != nil {
+		return "", fmt.Errorf("unable to download file %s: %s", fileId, err)
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", fmt.Errorf("unable to download file %s: %s", fileId, err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("unable to download file %s: %s", fileId, err)
+	}
+	return f.Name(), nil
+}
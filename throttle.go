@@ -0,0 +1,106 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// The per-chat send rates Telegram tolerates before answering with flood-wait errors:
+// about a message per second in private chats and 20 messages per minute in groups. A
+// few messages can be sent in a burst before the rate applies.
+const (
+	PrivateChatSendInterval = time.Second
+	GroupChatSendInterval   = 3 * time.Second
+	ChatSendBurst           = 3
+)
+
+// chatBucket holds the tokens (messages that can be sent right away) of a chat.
+type chatBucket struct {
+	tokens     float64
+	lastRefill time.Time
+	// pausedUntil is when the last flood-wait error of the chat ends.
+	pausedUntil time.Time
+}
+
+// SendThrottle spaces the messages sent to each chat with a token bucket per chat, so
+// bursts of files (like albums or posts with several videos) do not trip the rate limits
+// of Telegram. It is safe for concurrent use.
+type SendThrottle struct {
+	mu      sync.Mutex
+	buckets map[int64]*chatBucket
+}
+
+// ChatSendThrottle spaces every message the bot sends, see SendWithRetry.
+var ChatSendThrottle = &SendThrottle{buckets: map[int64]*chatBucket{}}
+
+// SendInterval returns the time it takes to earn a token in the chat chatId, the ids of
+// the groups and the channels are negative.
+func SendInterval(chatId int64) time.Duration {
+	if chatId < 0 {
+		return GroupChatSendInterval
+	}
+	return PrivateChatSendInterval
+}
+
+// Wait blocks until messages (an album counts its files) can be sent to the chat chatId
+// and takes their tokens. The callers queue one after the other, each one takes its
+// tokens before sleeping. A chatId of 0 (like answering a callback query) never waits.
+func (t *SendThrottle) Wait(chatId int64, messages int) {
+	if chatId == 0 {
+		return
+	}
+	t.mu.Lock()
+	now := time.Now()
+	interval := SendInterval(chatId)
+	bucket := t.bucket(chatId, now)
+	bucket.tokens += float64(now.Sub(bucket.lastRefill)) / float64(interval)
+	if bucket.tokens > ChatSendBurst {
+		bucket.tokens = ChatSendBurst
+	}
+	bucket.lastRefill = now
+	bucket.tokens -= float64(messages)
+	wait := time.Duration(0)
+	if bucket.tokens < 0 {
+		wait = time.Duration(-bucket.tokens * float64(interval))
+	}
+	if paused := bucket.pausedUntil.Sub(now); paused > wait {
+		wait = paused
+	}
+	t.forgetIdle(now)
+	t.mu.Unlock()
+	time.Sleep(wait)
+}
+
+// Pause keeps every message to the chat chatId waiting for retryAfter, as Telegram asks
+// with its flood-wait errors.
+func (t *SendThrottle) Pause(chatId int64, retryAfter time.Duration) {
+	if chatId == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.bucket(chatId, now).pausedUntil = now.Add(retryAfter)
+}
+
+// bucket returns the bucket of the chat chatId, a new chat starts with a full bucket.
+// t.mu must be held.
+func (t *SendThrottle) bucket(chatId int64, now time.Time) *chatBucket {
+	bucket, ok := t.buckets[chatId]
+	if !ok {
+		bucket = &chatBucket{tokens: ChatSendBurst, lastRefill: now}
+		t.buckets[chatId] = bucket
+	}
+	return bucket
+}
+
+// forgetIdle forgets the buckets already full and not paused, they would start full
+// anyway. t.mu must be held.
+func (t *SendThrottle) forgetIdle(now time.Time) {
+	for chatId, bucket := range t.buckets {
+		full := bucket.tokens+float64(now.Sub(bucket.lastRefill))/float64(SendInterval(chatId)) >= ChatSendBurst
+		if full && now.After(bucket.pausedUntil) {
+			delete(t.buckets, chatId)
+		}
+	}
+}
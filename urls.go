@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultShortenerHosts are the hosts of the URL shorteners expanded when
+// SHORTENER_HOSTS is not set.
+var DefaultShortenerHosts = []string{"bit.ly", "t.co", "tinyurl.com", "goo.gl", "ow.ly", "buff.ly", "is.gd"}
+
+// DefaultTrackingParams are the query params stripped from the URLs when
+// TRACKING_PARAMS is not set.
+var DefaultTrackingParams = []string{"si", "feature", "fbclid", "gclid", "igshid", "utm_source", "utm_medium", "utm_campaign", "utm_term", "utm_content"}
+
+// TwitterHosts are the hosts of Twitter/X (and of the sites that fix its embeds),
+// their URLs are rewritten as x.com ones.
+var TwitterHosts = []string{"x.com", "twitter.com", "mobile.twitter.com", "mobile.x.com", "fxtwitter.com", "vxtwitter.com", "fixupx.com", "fixvx.com"}
+
+// ShortUrlTimeout is how long expanding a short URL can take.
+const ShortUrlTimeout = 10 * time.Second
+
+// MaxShortUrlRedirects is how many redirects expanding a short URL can follow.
+const MaxShortUrlRedirects = 10
+
+// NormalizeUrl expands the short URLs (of config.ShortenerHosts), rewrites youtu.be
+// URLs as youtube.com/watch ones and Twitter/X URLs as x.com ones and strips the
+// tracking params (of config.TrackingParams), so the same video always gets the same
+// URL. When a short URL can not be expanded it is kept as is, yt-dlp may still
+// understand it.
+func NormalizeUrl(config *Config, videoUrl *url.URL) (*url.URL, error) {
+	normalizedUrl := *videoUrl
+	var err error
+	if hostIn(normalizedUrl.Host, config.ShortenerHosts) {
+		var expandedUrl *url.URL
+		expandedUrl, err = ExpandShortUrl(&normalizedUrl, config.ShortenerHosts)
+		if err == nil {
+			normalizedUrl = *expandedUrl
+		}
+	}
+	if hostIn(normalizedUrl.Host, []string{"youtu.be"}) {
+		query := normalizedUrl.Query()
+		query.Set("v", strings.Trim(normalizedUrl.Path, "/"))
+		normalizedUrl.Host = "www.youtube.com"
+		normalizedUrl.Path = "/watch"
+		normalizedUrl.RawQuery = query.Encode()
+	}
+	if hostIn(normalizedUrl.Host, TwitterHosts) {
+		normalizedUrl.Host = "x.com"
+	}
+	query := normalizedUrl.Query()
+	for _, param := range config.TrackingParams {
+		query.Del(param)
+	}
+	normalizedUrl.RawQuery = query.Encode()
+	return &normalizedUrl, err
+}
+
+// ExpandShortUrl follows (with HEAD requests) the redirects of the short URL shortUrl
+// and returns the first URL they lead to out of shortenerHosts. That URL is never
+// requested, the video site may be slow or block the bot and only its URL is needed.
+func ExpandShortUrl(shortUrl *url.URL, shortenerHosts []string) (*url.URL, error) {
+	expandedUrl := shortUrl
+	client := &http.Client{
+		Timeout: ShortUrlTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= MaxShortUrlRedirects {
+				return fmt.Errorf("stopped after %d redirects", MaxShortUrlRedirects)
+			}
+			expandedUrl = req.URL
+			if !hostIn(req.URL.Host, shortenerHosts) {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	resp, err := client.Head(shortUrl.String())
+	if err != nil {
+		return nil, fmt.Errorf("unable to expand short URL %s: %s", shortUrl, err)
+	}
+	resp.Body.Close()
+	if expandedUrl.Scheme != "http" && expandedUrl.Scheme != "https" {
+		return nil, fmt.Errorf("unable to expand short URL %s: it leads to %s", shortUrl, expandedUrl)
+	}
+	return expandedUrl, nil
+}
+
+// ParseMirrorHosts parses the items of MIRROR_HOSTS, like x.com=fxtwitter.com, into the
+// alternative hosts of each host (in the order of the items).
+func ParseMirrorHosts(items []string) (map[string][]string, error) {
+	mirrorHosts := map[string][]string{}
+	for _, item := range items {
+		host, mirror, found := strings.Cut(item, "=")
+		host = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(host)), "www.")
+		mirror = strings.ToLower(strings.TrimSpace(mirror))
+		if !found || host == "" || mirror == "" || strings.ContainsAny(host+mirror, "/:") {
+			return nil, fmt.Errorf("MIRROR_HOSTS item %q is not like host=mirror", item)
+		}
+		mirrorHosts[host] = append(mirrorHosts[host], mirror)
+	}
+	return mirrorHosts, nil
+}
+
+// MirrorUrls returns videoUrl rewritten with each alternative host of its host (of
+// config.MirrorHosts), in order.
+func MirrorUrls(config *Config, videoUrl *url.URL) []*url.URL {
+	mirrorUrls := []*url.URL{}
+	host := strings.TrimPrefix(strings.ToLower(videoUrl.Host), "www.")
+	for _, mirror := range config.MirrorHosts[host] {
+		mirrorUrl := *videoUrl
+		mirrorUrl.Host = mirror
+		mirrorUrls = append(mirrorUrls, &mirrorUrl)
+	}
+	return mirrorUrls
+}
+
+// IsMultiVideoUrl reports whether the post of videoUrl may hold several videos (like
+// the Twitter/X posts), each of them is sent.
+func IsMultiVideoUrl(videoUrl *url.URL) bool {
+	return hostIn(videoUrl.Host, TwitterHosts)
+}
+
+// hostIn reports whether host (or host without the www. prefix) is one of hosts.
+func hostIn(host string, hosts []string) bool {
+	host = strings.TrimPrefix(strings.ToLower(host), "www.")
+	for _, h := range hosts {
+		if host == strings.ToLower(h) {
+			return true
+		}
+	}
+	return false
+}
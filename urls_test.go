@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestNormalizeUrl(t *testing.T) {
+	config := &Config{TrackingParams: DefaultTrackingParams}
+	tests := []struct {
+		videoUrl string
+		want     string
+	}{
+		{"https://youtu.be/dQw4w9WgXcQ", "https://www.youtube.com/watch?v=dQw4w9WgXcQ"},
+		{"https://youtu.be/dQw4w9WgXcQ?t=10", "https://www.youtube.com/watch?t=10&v=dQw4w9WgXcQ"},
+		{"https://youtu.be/dQw4w9WgXcQ?si=AbCdEf", "https://www.youtube.com/watch?v=dQw4w9WgXcQ"},
+		{"https://youtu.be/dQw4w9WgXcQ?si=AbCdEf&t=10", "https://www.youtube.com/watch?t=10&v=dQw4w9WgXcQ"},
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ", "https://www.youtube.com/watch?v=dQw4w9WgXcQ"},
+		{"https://youtube.com/watch?v=dQw4w9WgXcQ&feature=share", "https://youtube.com/watch?v=dQw4w9WgXcQ"},
+		{"https://twitter.com/user/status/1", "https://x.com/user/status/1"},
+		{"https://vxtwitter.com/user/status/1?utm_source=a", "https://x.com/user/status/1"},
+	}
+	for _, test := range tests {
+		videoUrl, err := url.Parse(test.videoUrl)
+		if err != nil {
+			t.Fatalf("unable to parse %s: %s", test.videoUrl, err)
+		}
+		normalizedUrl, err := NormalizeUrl(config, videoUrl)
+		if err != nil {
+			t.Errorf("NormalizeUrl(%s) returned error: %s", test.videoUrl, err)
+			continue
+		}
+		if normalizedUrl.String() != test.want {
+			t.Errorf("NormalizeUrl(%s) = %s, want %s", test.videoUrl, normalizedUrl, test.want)
+		}
+	}
+}
+
+func TestExpandShortUrlStopsAtTheFirstOtherHost(t *testing.T) {
+	methods := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusMovedPermanently)
+		case "/b":
+			// the video site is never requested, the test would fail reaching it
+			http.Redirect(w, r, "https://video.invalid/watch?v=1", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	shortUrl, err := url.Parse(server.URL + "/a")
+	if err != nil {
+		t.Fatalf("unable to parse %s: %s", server.URL, err)
+	}
+	expandedUrl, err := ExpandShortUrl(shortUrl, []string{shortUrl.Host})
+	if err != nil {
+		t.Fatalf("ExpandShortUrl(%s) returned error: %s", shortUrl, err)
+	}
+	if want := "https://video.invalid/watch?v=1"; expandedUrl.String() != want {
+		t.Errorf("ExpandShortUrl(%s) = %s, want %s", shortUrl, expandedUrl, want)
+	}
+	if len(methods) != 2 || methods[0] != http.MethodHead || methods[1] != http.MethodHead {
+		t.Errorf("ExpandShortUrl(%s) made the requests %v, want 2 HEAD requests", shortUrl, methods)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// WarningRule tells the users what a warning of yt-dlp means for their download, the
+// warnings that match no rule are only logged.
+type WarningRule struct {
+	// Pattern is a regular expression matched against each warning line of the stderr.
+	Pattern string `json:"pattern"`
+	// Message completes "Downloaded, but ...", like "subtitles were unavailable".
+	Message string `json:"message"`
+	pattern *regexp.Regexp
+}
+
+// FormatFallbackWarning is told when the requested format was not available and the best
+// one was downloaded instead, see FetchVideo. It is told even without SURFACE_WARNINGS.
+const FormatFallbackWarning = "the requested quality was not available, so I sent the best one"
+
+// DefaultWarningRules are the rules used when WARNING_RULES_FILE is not set.
+var DefaultWarningRules = []WarningRule{
+	{Pattern: `(?i)there are no subtitles`, Message: "subtitles were unavailable"},
+	{Pattern: `(?i)(some|requested) formats? (are|is) (missing|not available|unavailable)`, Message: "some formats were unavailable, so the quality may be lower"},
+	{Pattern: `(?i)possibly damaged`, Message: "the video may be damaged"},
+	{Pattern: `(?i)unable to embed`, Message: "some metadata could not be embedded"},
+	{Pattern: `(?i)(thumbnail|cover).*(not available|unable|failed)`, Message: "the thumbnail was unavailable"},
+}
+
+// CompileWarningRules compiles the patterns of rules.
+func CompileWarningRules(rules []WarningRule) ([]WarningRule, error) {
+	compiled := []WarningRule{}
+	for _, rule := range rules {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("unable to compile the warning pattern %s: %s", rule.Pattern, err)
+		}
+		if strings.TrimSpace(rule.Message) == "" {
+			return nil, fmt.Errorf("the warning pattern %s has no message", rule.Pattern)
+		}
+		rule.pattern = pattern
+		compiled = append(compiled, rule)
+	}
+	return compiled, nil
+}
+
+// LoadWarningRules loads the rules of the JSON file filename (a list of objects with a
+// pattern and a message), an empty filename loads DefaultWarningRules.
+func LoadWarningRules(filename string) ([]WarningRule, error) {
+	if filename == "" {
+		return CompileWarningRules(DefaultWarningRules)
+	}
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %s", filename, err)
+	}
+	rules := []WarningRule{}
+	if err := json.Unmarshal(content, &rules); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %s", filename, err)
+	}
+	return CompileWarningRules(rules)
+}
+
+// ClassifyWarnings returns the messages of the rules matching the warnings (the lines
+// starting with WARNING:) of the stderr of yt-dlp, each message only once.
+func ClassifyWarnings(stderr string, rules []WarningRule) []string {
+	messages := []string{}
+	seen := map[string]bool{}
+	for _, line := range strings.Split(stderr, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "WARNING:") {
+			continue
+		}
+		for _, rule := range rules {
+			if rule.pattern.MatchString(line) && !seen[rule.Message] {
+				seen[rule.Message] = true
+				messages = append(messages, rule.Message)
+			}
+		}
+	}
+	return messages
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// WebhookTimeout is how long posting an event to WEBHOOK_URL can take.
+const WebhookTimeout = 5 * time.Second
+
+const (
+	WebhookCompleted = "completed"
+	WebhookFailed    = "failed"
+)
+
+// WebhookEvent is the JSON posted to WEBHOOK_URL when a download completes or fails.
+type WebhookEvent struct {
+	JobId    string `json:"job_id"`
+	UserId   int64  `json:"user_id"`
+	UserName string `json:"user_name"`
+	Url      string `json:"url"`
+	// Status is WebhookCompleted or WebhookFailed.
+	Status string `json:"status"`
+	// Seconds is how long the download took.
+	Seconds float64 `json:"seconds"`
+	// Bytes is the size of the files produced, 0 when the download failed.
+	Bytes int64 `json:"bytes"`
+	// Error is what went wrong, empty when the download completed.
+	Error string `json:"error,omitempty"`
+}
+
+// NewWebhookEvent returns the event of the download of the request msg, err is nil when
+// it completed.
+func NewWebhookEvent(msg *tgbotapi.Message, downloadConfig *DownloadConfig, elapsed time.Duration, size int64, err error) WebhookEvent {
+	event := WebhookEvent{
+		JobId:    downloadConfig.JobId,
+		UserId:   msg.From.ID,
+		UserName: msg.From.UserName,
+		Url:      downloadConfig.VideoUrl.String(),
+		Status:   WebhookCompleted,
+		Seconds:  elapsed.Seconds(),
+		Bytes:    size,
+	}
+	if err != nil {
+		event.Status = WebhookFailed
+		event.Error = err.Error()
+	}
+	return event
+}
+
+// NotifyWebhook posts event to WEBHOOK_URL (when set) in the background, it is best
+// effort: the failures are only logged and never retried.
+func (app *App) NotifyWebhook(event WebhookEvent) {
+	if app.Config.WebhookUrl == "" {
+		return
+	}
+	go func() {
+		if err := PostWebhook(app.Config.WebhookUrl, event); err != nil {
+			log.Printf("[job=%s] Unable to notify the webhook: %s", event.JobId, err)
+		}
+	}()
+}
+
+// PostWebhook posts event as JSON to webhookUrl.
+func PostWebhook(webhookUrl string, event WebhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("unable to encode the event: %s", err)
+	}
+	client := &http.Client{Timeout: WebhookTimeout}
+	resp, err := client.Post(webhookUrl, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to post the event: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("the webhook answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Spacer keeps a minimum time between the start of consecutive operations.
+type Spacer struct {
+	mu      sync.Mutex
+	lastRun time.Time
+}
+
+// DownloadSpacer spaces the yt-dlp runs of the whole bot as asked in DOWNLOAD_SPACING.
+var DownloadSpacer = &Spacer{}
+
+// Wait blocks until spacing has passed since the previous call returned. The callers
+// queue one after the other, so with many downloads waiting the throughput drops to one
+// download per spacing.
+func (s *Spacer) Wait(spacing time.Duration) {
+	if spacing <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if wait := spacing - time.Since(s.lastRun); wait > 0 {
+		time.Sleep(wait)
+	}
+	s.lastRun = time.Now()
+}
+
+// StartSpacedYtdlp starts the yt-dlp command cmd once DOWNLOAD_SPACING has passed since
+// the previous yt-dlp run started. Every yt-dlp run that reaches a site (the downloads,
+// but also the metadata, extractor, search and thumbnail lookups) must start through
+// it, the sites count them all.
+func StartSpacedYtdlp(config *Config, cmd *exec.Cmd) error {
+	DownloadSpacer.Wait(config.DownloadSpacing)
+	return cmd.Start()
+}
+
+// RunSpacedYtdlp is like StartSpacedYtdlp but it also waits for cmd to finish.
+func RunSpacedYtdlp(config *Config, cmd *exec.Cmd) error {
+	if err := StartSpacedYtdlp(config, cmd); err != nil {
+		return err
+	}
+	return cmd.Wait()
+}
+
+// SpacedYtdlpOutput is like RunSpacedYtdlp but it returns the standard output of cmd.
+func SpacedYtdlpOutput(config *Config, cmd *exec.Cmd) ([]byte, error) {
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	err := RunSpacedYtdlp(config, cmd)
+	return stdout.Bytes(), err
+}
+
+// YtdlpVersionDate returns the release date of the installed yt-dlp, its versions are
+// dates like 2024.08.06 (nightly builds add a build number, like 2024.08.06.232604).
+func YtdlpVersionDate(ctx context.Context) (time.Time, error) {
+	ytdlpPath, err := exec.LookPath("yt-dlp")
+	if err != nil {
+		return time.Time{}, fmt.Errorf("yt-dlp is not installed: %s", err)
+	}
+	// the version is local, it does not need spacing
+	output, err := exec.CommandContext(ctx, ytdlpPath, "--version").Output()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to get the version of yt-dlp: %s", err)
+	}
+	version := strings.TrimSpace(string(output))
+	parts := strings.Split(version, ".")
+	if len(parts) < 3 {
+		return time.Time{}, fmt.Errorf("unable to parse the version of yt-dlp %s", version)
+	}
+	date, err := time.Parse("2006.01.02", strings.Join(parts[:3], "."))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to parse the version of yt-dlp %s", version)
+	}
+	return date, nil
+}
+
+// YtdlpStaleness returns how old the installed yt-dlp is and whether it is older than
+// staleAfter. Sites change often and break the extractors of old releases.
+func YtdlpStaleness(ctx context.Context, staleAfter time.Duration) (time.Duration, bool) {
+	date, err := YtdlpVersionDate(ctx)
+	if err != nil {
+		log.Printf("Unable to check whether yt-dlp is outdated: %s", err)
+		return 0, false
+	}
+	age := time.Since(date)
+	return age, staleAfter > 0 && age > staleAfter
+}
+
+// HighlightSeconds is the length of the clip cut around the most replayed moment of a
+// video when the user uses the highlight word.
+const HighlightSeconds = 30
+
+// HeatmapSegment is a piece of the "most replayed" graph YouTube shows over the
+// progress bar of some videos.
+type HeatmapSegment struct {
+	StartTime float64 `json:"start_time"`
+	EndTime   float64 `json:"end_time"`
+	Value     float64 `json:"value"`
+}
+
+// Chapter is a chapter of a video.
+type Chapter struct {
+	StartTime float64 `json:"start_time"`
+	EndTime   float64 `json:"end_time"`
+	Title     string  `json:"title"`
+}
+
+// Format is one of the formats a video is offered in.
+type Format struct {
+	FormatId string `json:"format_id"`
+	Acodec   string `json:"acodec"`
+	Vcodec   string `json:"vcodec"`
+	Height   int    `json:"height"`
+	Language string `json:"language"`
+}
+
+// VideoInfo holds the metadata yt-dlp reports about a video (only the fields the bot
+// uses are decoded).
+type VideoInfo struct {
+	Title       string           `json:"title"`
+	Description string           `json:"description"`
+	Track       string           `json:"track"`
+	Artist      string           `json:"artist"`
+	Creator     string           `json:"creator"`
+	Uploader    string           `json:"uploader"`
+	UploaderUrl string           `json:"uploader_url"`
+	Channel     string           `json:"channel"`
+	ChannelUrl  string           `json:"channel_url"`
+	Album       string           `json:"album"`
+	Thumbnail   string           `json:"thumbnail"`
+	WebpageUrl  string           `json:"webpage_url"`
+	Duration    float64          `json:"duration"`
+	Heatmap     []HeatmapSegment `json:"heatmap"`
+	Chapters    []Chapter        `json:"chapters"`
+	Formats     []Format         `json:"formats"`
+	// UploadDate is the day the video was uploaded, like 20091025.
+	UploadDate string `json:"upload_date"`
+	// ViewCount and LikeCount are nil when the site does not report them.
+	ViewCount *int64 `json:"view_count"`
+	LikeCount *int64 `json:"like_count"`
+}
+
+// TrackTitle returns the title of the song of the video (as reported by music sites),
+// or the title of the video when it is not a song.
+func (info *VideoInfo) TrackTitle() string {
+	if info.Track != "" {
+		return info.Track
+	}
+	return info.Title
+}
+
+// Performer returns the artist of the song of the video, or its creator or uploader
+// when it is not a song, empty when none is known.
+func (info *VideoInfo) Performer() string {
+	for _, performer := range []string{info.Artist, info.Creator, info.Uploader} {
+		if performer != "" {
+			return performer
+		}
+	}
+	return ""
+}
+
+// AudioCaption returns the caption of an audio of performer and title from album, like
+// 🎵 Artist — Title (Album), the missing fields are left out.
+func AudioCaption(performer, title, album string) string {
+	caption := title
+	if performer != "" && title != "" {
+		caption = performer + " — " + title
+	} else if performer != "" {
+		caption = performer
+	}
+	if caption == "" {
+		return ""
+	}
+	if album != "" && album != title {
+		caption += " (" + album + ")"
+	}
+	return "🎵 " + caption
+}
+
+// AudioLanguages returns the languages of the audio tracks of the video, without
+// repetitions.
+func (info *VideoInfo) AudioLanguages() []string {
+	languages := []string{}
+	seen := map[string]bool{}
+	for _, format := range info.Formats {
+		if format.Acodec == "none" || format.Language == "" || seen[format.Language] {
+			continue
+		}
+		seen[format.Language] = true
+		languages = append(languages, format.Language)
+	}
+	return languages
+}
+
+// HasAudioLanguage reports whether the video has an audio track in language (es matches
+// es-US too, like the format selector of the alang option does).
+func (info *VideoInfo) HasAudioLanguage(language string) bool {
+	for _, audioLanguage := range info.AudioLanguages() {
+		if strings.HasPrefix(audioLanguage, language) {
+			return true
+		}
+	}
+	return false
+}
+
+// FetchVideoInfo asks yt-dlp for the metadata of videoUrl without downloading it.
+func FetchVideoInfo(ctx context.Context, config *Config, videoUrl string) (*VideoInfo, error) {
+	ytdlpPath, err := exec.LookPath("yt-dlp")
+	if err != nil {
+		return nil, fmt.Errorf("yt-dlp is not installed: %s", err)
+	}
+	ytdlpArgs := []string{"--dump-json", "--no-playlist"}
+	ytdlpArgs = append(ytdlpArgs, config.YtdlpExtraArgs...)
+	ytdlpArgs = append(ytdlpArgs, videoUrl)
+	output, err := SpacedYtdlpOutput(config, exec.CommandContext(ctx, ytdlpPath, ytdlpArgs...))
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the info of %s: %s", videoUrl, err)
+	}
+	info := &VideoInfo{}
+	if err := json.Unmarshal(output, info); err != nil {
+		return nil, fmt.Errorf("unable to parse the info of %s: %s", videoUrl, err)
+	}
+	return info, nil
+}
+
+// HighlightSpan returns the start and end seconds of a clip of length seconds centered
+// on the most replayed moment of the video.
+func HighlightSpan(info *VideoInfo, length int) (int, int, error) {
+	if len(info.Heatmap) == 0 {
+		return 0, 0, fmt.Errorf("the video has no most replayed data")
+	}
+	peak := info.Heatmap[0]
+	for _, segment := range info.Heatmap[1:] {
+		if segment.Value > peak.Value {
+			peak = segment
+		}
+	}
+	duration := info.Duration
+	if duration <= 0 {
+		duration = info.Heatmap[len(info.Heatmap)-1].EndTime
+	}
+	end := int(math.Ceil(duration))
+	if end <= length {
+		return 0, end, nil
+	}
+	// center the clip on the peak, moving it back inside the video when it overflows
+	startSecond := int((peak.StartTime+peak.EndTime)/2) - length/2
+	if startSecond < 0 {
+		startSecond = 0
+	}
+	if startSecond+length > end {
+		startSecond = end - length
+	}
+	return startSecond, startSecond + length, nil
+}
+
+// GetExtractor asks yt-dlp which extractor would be used to download videoUrl, without
+// downloading anything.
+func GetExtractor(ctx context.Context, config *Config, videoUrl string) (string, error) {
+	ytdlpPath, err := exec.LookPath("yt-dlp")
+	if err != nil {
+		return "", fmt.Errorf("yt-dlp is not installed: %s", err)
+	}
+	// the extra arguments (like the cookies or the proxy) may change what the site
+	// answers, the probe must see what the download will
+	ytdlpArgs := []string{"--print", "extractor", "--simulate"}
+	ytdlpArgs = append(ytdlpArgs, config.YtdlpExtraArgs...)
+	ytdlpArgs = append(ytdlpArgs, videoUrl)
+	output, err := SpacedYtdlpOutput(config, exec.CommandContext(ctx, ytdlpPath, ytdlpArgs...))
+	if err != nil {
+		return "", fmt.Errorf("unable to get the extractor of %s: %s", videoUrl, err)
+	}
+	// playlists print one line per video, all of them share the extractor
+	extractor := strings.TrimSpace(strings.SplitN(string(output), "\n", 2)[0])
+	if extractor == "" {
+		return "", fmt.Errorf("unable to get the extractor of %s: yt-dlp printed nothing", videoUrl)
+	}
+	return extractor, nil
+}
+
+// ExtractorIsAllowed reports whether videos can be downloaded with extractor. Names are
+// compared ignoring case and the extractor family (e.g. youtube:tab counts as youtube).
+// An extractor in denied is never allowed, when allowed is empty every other extractor
+// is allowed.
+func ExtractorIsAllowed(extractor string, allowed, denied []string) bool {
+	family := strings.SplitN(extractor, ":", 2)[0]
+	matches := func(names []string) bool {
+		for _, name := range names {
+			if strings.EqualFold(name, extractor) || strings.EqualFold(name, family) {
+				return true
+			}
+		}
+		return false
+	}
+	if matches(denied) {
+		return false
+	}
+	return len(allowed) == 0 || matches(allowed)
+}
+
+// SearchResultsCount is how many results /search returns.
+const SearchResultsCount = 5
+
+// SearchResult is a video found by SearchVideos.
+type SearchResult struct {
+	Id       string  `json:"id"`
+	Title    string  `json:"title"`
+	Url      string  `json:"url"`
+	Duration float64 `json:"duration"`
+}
+
+// SearchVideos searches terms on YouTube and returns the first count results.
+func SearchVideos(ctx context.Context, config *Config, terms string, count int) ([]SearchResult, error) {
+	ytdlpPath, err := exec.LookPath("yt-dlp")
+	if err != nil {
+		return nil, fmt.Errorf("yt-dlp is not installed: %s", err)
+	}
+	ytdlpArgs := []string{"--dump-json", "--flat-playlist"}
+	ytdlpArgs = append(ytdlpArgs, config.YtdlpExtraArgs...)
+	ytdlpArgs = append(ytdlpArgs, fmt.Sprintf("ytsearch%d:%s", count, terms))
+	output, err := SpacedYtdlpOutput(config, exec.CommandContext(ctx, ytdlpPath, ytdlpArgs...))
+	if err != nil {
+		return nil, fmt.Errorf("unable to search %s: %s", terms, err)
+	}
+	results := []SearchResult{}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if line == "" {
+			continue
+		}
+		result := SearchResult{}
+		if err := json.Unmarshal([]byte(line), &result); err != nil {
+			return nil, fmt.Errorf("unable to parse the results of %s: %s", terms, err)
+		}
+		if result.Url == "" {
+			result.Url = "https://www.youtube.com/watch?v=" + result.Id
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetExtractorPassesTheExtraArgs(t *testing.T) {
+	// the fake yt-dlp prints its arguments as the extractor
+	fakeTools(t, map[string]string{"yt-dlp": `echo "$*"`})
+	t.Setenv("YTDLP_EXTRA_ARGS", "--proxy socks5://127.0.0.1:1080")
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig returned error: %s", err)
+	}
+	extractor, err := GetExtractor(context.Background(), config, "https://youtu.be/dQw4w9WgXcQ")
+	if err != nil {
+		t.Fatalf("GetExtractor returned error: %s", err)
+	}
+	if !strings.Contains(extractor, "--proxy socks5://127.0.0.1:1080 https://youtu.be/dQw4w9WgXcQ") {
+		t.Errorf("GetExtractor ran yt-dlp with %q, want the extra args before the URL", extractor)
+	}
+}
+
+func TestLookupsAreSpaced(t *testing.T) {
+	fakeTools(t, map[string]string{"yt-dlp": `case "$*" in *ytsearch*) echo '{"id": "dQw4w9WgXcQ"}' ;; *) echo youtube ;; esac`})
+	const spacing = 200 * time.Millisecond
+	t.Setenv("DOWNLOAD_SPACING", spacing.String())
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig returned error: %s", err)
+	}
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if _, err := GetExtractor(context.Background(), config, "https://youtu.be/dQw4w9WgXcQ"); err != nil {
+			t.Fatalf("GetExtractor returned error: %s", err)
+		}
+		if _, err := SearchVideos(context.Background(), config, "gato", 1); err != nil {
+			t.Fatalf("SearchVideos returned error: %s", err)
+		}
+	}
+	// the first run may start right away, the other three wait
+	if elapsed := time.Since(start); elapsed < 3*spacing {
+		t.Errorf("4 lookups took %s, want at least %s with a spacing of %s", elapsed, 3*spacing, spacing)
+	}
+}
+
+func TestLookupsGiveUpWithTheRequest(t *testing.T) {
+	// the fake yt-dlp hangs like a site that never answers
+	fakeTools(t, map[string]string{"yt-dlp": "while :; do :; done"})
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig returned error: %s", err)
+	}
+	const videoUrl = "https://youtu.be/dQw4w9WgXcQ"
+	lookups := map[string]func(ctx context.Context) error{
+		"FetchVideoInfo": func(ctx context.Context) error {
+			_, err := FetchVideoInfo(ctx, config, videoUrl)
+			return err
+		},
+		"GetExtractor": func(ctx context.Context) error {
+			_, err := GetExtractor(ctx, config, videoUrl)
+			return err
+		},
+		"FetchPremiere": func(ctx context.Context) error {
+			_, err := FetchPremiere(ctx, config, videoUrl)
+			return err
+		},
+		"SearchVideos": func(ctx context.Context) error {
+			_, err := SearchVideos(ctx, config, "gato", 1)
+			return err
+		},
+	}
+	for name, lookup := range lookups {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		start := time.Now()
+		err := lookup(ctx)
+		cancel()
+		if err == nil {
+			t.Errorf("%s returned no error once the request ran out of time", name)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%s took %s to give up, the request ran out of time after 100ms", name, elapsed)
+		}
+	}
+}
+
+func TestFetchInfoAsksYtdlpOnce(t *testing.T) {
+	runs := filepath.Join(t.TempDir(), "runs")
+	fakeTools(t, map[string]string{"yt-dlp": `echo run >> ` + runs + `; echo '{"duration": 200, "description": "gato"}'`})
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig returned error: %s", err)
+	}
+	downloadConfig := mustLoadDownloadConfig(t, "https://youtu.be/dQw4w9WgXcQ pct:10-20")
+	if err := ResolveDownloadConfig(context.Background(), config, downloadConfig); err != nil {
+		t.Fatalf("ResolveDownloadConfig returned error: %s", err)
+	}
+	if downloadConfig.StartSecond != 20 || downloadConfig.EndSecond != 40 {
+		t.Errorf("the span is %g-%g, want 20-40", downloadConfig.StartSecond, downloadConfig.EndSecond)
+	}
+	info, err := downloadConfig.FetchInfo(context.Background(), config)
+	if err != nil {
+		t.Fatalf("FetchInfo returned error: %s", err)
+	}
+	if info.Description != "gato" {
+		t.Errorf("FetchInfo returned the description %q, want %q", info.Description, "gato")
+	}
+	output, err := os.ReadFile(runs)
+	if err != nil {
+		t.Fatalf("unable to read the runs of yt-dlp: %s", err)
+	}
+	if count := strings.Count(string(output), "run"); count != 1 {
+		t.Errorf("yt-dlp ran %d times, want once per request", count)
+	}
+}
+
+func TestExtractorIsAllowed(t *testing.T) {
+	tests := []struct {
+		name      string
+		extractor string
+		allowed   []string
+		denied    []string
+		want      bool
+	}{
+		{"no lists", "youtube", nil, nil, true},
+		{"allowed", "youtube", []string{"vimeo", "youtube"}, nil, true},
+		{"not allowed", "tiktok", []string{"youtube"}, nil, false},
+		{"denied", "tiktok", nil, []string{"tiktok"}, false},
+		{"not denied", "youtube", nil, []string{"tiktok"}, true},
+		{"denied wins over allowed", "youtube", []string{"youtube"}, []string{"youtube"}, false},
+		{"family allowed", "youtube:tab", []string{"youtube"}, nil, true},
+		{"family denied", "youtube:tab", []string{"youtube:tab"}, []string{"youtube"}, false},
+		{"only the family member denied", "youtube", []string{"youtube"}, []string{"youtube:tab"}, true},
+		{"case ignored", "YouTube", []string{"youtube"}, []string{"TIKTOK"}, true},
+	}
+	for _, test := range tests {
+		if got := ExtractorIsAllowed(test.extractor, test.allowed, test.denied); got != test.want {
+			t.Errorf("%s: ExtractorIsAllowed(%q, %v, %v) = %t, want %t", test.name, test.extractor, test.allowed, test.denied, got, test.want)
+		}
+	}
+}